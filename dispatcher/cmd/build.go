@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Runs the build subcommand, which uploads a function's source to the dispatcher to be built into a new version:
+//
+//	dispatcher build --fn=delta --source=delta.tar.gz --file=runtime_delta.py --class_name=RuntimeDelta
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "The address of the dispatcher")
+	user := fs.String("user", "admin", "The admin user calling the dispatcher")
+	fn := fs.String("fn", "", "The function to build, created if it does not exist")
+	source := fs.String("source", "", "The source, a tar archive, optionally gzipped, or a single .py file")
+	file := fs.String("file", "", "The Python file of the source defining the class; the .py source if empty")
+	className := fs.String("class_name", "", "The class of the function")
+	requirements := fs.String("requirements", "", "The requirements.txt installed on top of the runtime's, if any")
+	memoryMB := fs.Int64("memory_mb", 0, "The memory limit of instances in MB; not limited, and billed at 512 MB, if 0")
+	description := fs.String("description", "", "The description of the version")
+	users := fs.String("users", "", "Comma-separated users allowed to call the function")
+	fs.Parse(args)
+
+	if *fn == "" || *source == "" || *className == "" {
+		return fmt.Errorf("--fn, --source and --class_name must be provided")
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := writeFormFile(w, "source", *source); err != nil {
+		return err
+	}
+	if *requirements != "" {
+		if err := writeFormFile(w, "requirements", *requirements); err != nil {
+			return err
+		}
+	}
+	fields := map[string]string{
+		"file":        *file,
+		"class_name":  *className,
+		"description": *description,
+		"users":       *users,
+	}
+	if *memoryMB > 0 {
+		fields["memory_mb"] = strconv.FormatInt(*memoryMB, 10)
+	}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := w.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/admin/functions/%s/build", strings.TrimRight(*addr, "/"), *fn)
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("User", *user)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not call the dispatcher, error: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("build failed with status %d: %s", resp.StatusCode, respBody)
+	}
+	os.Stdout.Write(respBody)
+	return nil
+}
+
+// Writes the content of file path as the form file name.
+func writeFormFile(w *multipart.Writer, name, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read --%s, error: %v", name, err)
+	}
+	fw, err := w.CreateFormFile(name, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(content)
+	return err
+}
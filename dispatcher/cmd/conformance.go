@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"serverless/dispatcher/pkg/conformance"
+)
+
+// Runs the conformance subcommand, which checks that the runtime at --url implements the runtime protocol, and fails
+// if it does not:
+//
+//	dispatcher conformance --url=http://localhost:5000 --args='{"prompt": "hi"}'
+func runConformance(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:5000", "The base URL of the runtime, whose function must be loaded")
+	invokeArgs := fs.String("args", "{}", "The JSON args of the invocations, which the function must serve")
+	timeout := fs.Duration("timeout", 10*time.Second, "The timeout of each check")
+	fs.Parse(args)
+
+	if !json.Valid([]byte(*invokeArgs)) {
+		return fmt.Errorf("--args must be JSON")
+	}
+	report := conformance.Run(context.Background(), *url, conformance.Options{
+		Args:    json.RawMessage(*invokeArgs),
+		Timeout: *timeout,
+	})
+	for _, res := range report.Results {
+		if res.Passed {
+			fmt.Printf("PASS %s\n", res.Name)
+		} else {
+			fmt.Printf("FAIL %s: %s\n", res.Name, res.Error)
+		}
+	}
+	if !report.Passed {
+		return fmt.Errorf("%d of %d checks failed", len(report.Failed()), len(report.Results))
+	}
+	os.Stdout.WriteString("All checks passed\n")
+	return nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,58 +16,185 @@ import (
 	"serverless/dispatcher/pkg/core"
 )
 
+// Logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	log.SetOutput(os.Stderr)
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		if err := runBuild(os.Args[2:]); err != nil {
+			fatal("Could not build function", "error", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		if err := runConformance(os.Args[2:]); err != nil {
+			fatal("Runtime does not conform to the protocol", "error", err)
+		}
+		return
+	}
 
 	var concurLimit int64
 	var runtimeImage string
+	var adminUser string
+	var overheadPolicy string
+	var ledgerRetention time.Duration
+	var invokeTimeout time.Duration
+	asyncCfg := core.AsyncConfig{Webhook: core.DefaultWebhookConfig()}
+	var callbackAllowlist string
+	var callbackSecretFile string
+	var schedulesFile string
+	var routeAliasesFlag string
+	var warmPoolSize int
+	var snapshotMode string
+	var checkpointDir string
+	var checkImages bool
+	var imageRegistry string
+	var tracingCfg core.TracingConfig
+	var logLevel string
+	var logFormat string
 
 	flag.Int64Var(&concurLimit, "concur_limit", 3, "Set the concurrency limit")
 	flag.StringVar(&runtimeImage, "runtime_image", "runtime", "The runtime's docker image")
+	flag.StringVar(&adminUser, "admin_user", "admin", "The user allowed to call the admin APIs")
+	flag.StringVar(&overheadPolicy, "overhead_policy", "trigger",
+		"Who pays for instances' startup and idle time: trigger, proportional or platform")
+	flag.DurationVar(&ledgerRetention, "ledger_retention", 90*24*time.Hour,
+		"How long invocations are kept in the billing ledger to be invoiced; kept forever if 0")
+	flag.DurationVar(&invokeTimeout, "invoke_timeout", time.Minute,
+		"The default timeout of invocations, from proxying the request to the end of the response")
+	flag.IntVar(&warmPoolSize, "warm_pool_size", 0,
+		"The number of generic runtime containers kept warm to be specialized on cold starts; 0 disables the pool")
+	flag.StringVar(&snapshotMode, "snapshot_mode", "none",
+		"How the first ready instance of each function version is snapshotted to launch later ones from: "+
+			"none, checkpoint or commit")
+	flag.StringVar(&checkpointDir, "checkpoint_dir", "checkpoints",
+		"The directory storing checkpoints with --snapshot_mode=checkpoint, which restored containers read them from")
+	flag.BoolVar(&checkImages, "check_images", true,
+		"Check that the images of functions are present locally, rejecting invocations of those that are not")
+	flag.StringVar(&imageRegistry, "image_registry", "",
+		"The registry missing images are pulled from in the background, e.g., localhost:5000; not pulled if empty")
+	flag.StringVar(&routeAliasesFlag, "route_aliases", "alpha=alpha,beta=beta,gamma=gamma",
+		"Comma-separated <route>=<fn> pairs, serving /<route> by function fn in addition to /functions/<fn>/invoke")
+
+	flag.StringVar(&asyncCfg.Dir, "async_dir", "async_invocations",
+		"The directory persisting asynchronous invocations; kept in memory only if empty")
+	flag.IntVar(&asyncCfg.Workers, "async_workers", 4, "The number of asynchronous invocations dispatched concurrently")
+	flag.DurationVar(&asyncCfg.Retention, "async_retention", 24*time.Hour,
+		"How long the results of asynchronous invocations are kept")
+	flag.StringVar(&callbackAllowlist, "callback_allowlist", "",
+		"Comma-separated URLs that callback URLs of asynchronous invocations must be under; callbacks are refused if empty")
+	flag.StringVar(&callbackSecretFile, "callback_secret_file", "",
+		"The file containing the key signing callbacks with HMAC-SHA256; callbacks are not signed if empty")
+	flag.IntVar(&asyncCfg.Webhook.MaxAttempts, "callback_max_attempts", asyncCfg.Webhook.MaxAttempts,
+		"The most attempts of delivering a callback before it's recorded as a dead letter")
+	flag.StringVar(&schedulesFile, "schedules_file", "schedules.json",
+		"The file persisting scheduled invocations; kept in memory only if empty")
+
+	flag.StringVar(&tracingCfg.OTLPEndpoint, "otlp_endpoint", "", "The OTLP/HTTP endpoint to export spans to")
+	flag.BoolVar(&tracingCfg.OTLPInsecure, "otlp_insecure", false, "Export spans to --otlp_endpoint over plain HTTP")
+	flag.StringVar(&tracingCfg.File, "trace_file", "", "The file to write spans to, if --otlp_endpoint is not set")
+
+	flag.StringVar(&logLevel, "log_level", "info", "The minimal level of logs: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log_format", "text", "The format of logs: text or json")
 
 	flag.Parse()
 
+	if err := core.InitLogging(os.Stderr, logLevel, logFormat); err != nil {
+		fatal("Could not initialize logging", "error", err)
+	}
+
+	shutdownTracing, err := core.InitTracing(tracingCfg)
+	if err != nil {
+		fatal("Could not initialize tracing", "error", err)
+	}
+
+	policy, err := core.ParseOverheadPolicy(overheadPolicy)
+	if err != nil {
+		fatal("Invalid --overhead_policy", "error", err)
+	}
+
+	snapshots, err := core.ParseSnapshotMode(snapshotMode)
+	if err != nil {
+		fatal("Invalid --snapshot_mode", "error", err)
+	}
+
+	routeAliases, err := core.ParseRouteAliases(routeAliasesFlag)
+	if err != nil {
+		fatal("Invalid --route_aliases", "error", err)
+	}
+
 	dispatcher := core.NewDispatcher(runtimeImage)
+	dispatcher.GetAPIUsageTracker().SetOverheadPolicy(policy)
+	dispatcher.GetBillingMgr().SetRetention(ledgerRetention)
 
 	dispatcher.SetAPIConcurLimit(concurLimit)
-	log.Println("API limit is set to", concurLimit)
+	slog.Info("API limit is set", "limit", concurLimit)
 
-	r := mux.NewRouter()
-	r.HandleFunc("/alpha", func(w http.ResponseWriter, r *http.Request) {
-		ctx := core.CallContext{
-			Fn:             "alpha",
-			InstRdyTimeout: 12 * time.Second,
-		}
-		dispatcher.Dispatch(ctx, w, r)
-	})
-	r.HandleFunc("/beta", func(w http.ResponseWriter, r *http.Request) {
-		ctx := core.CallContext{
-			Fn:             "beta",
-			InstRdyTimeout: 12 * time.Second,
+	dispatcher.SetInvokeTimeout(invokeTimeout)
+
+	dispatcher.SetWarmPoolSize(warmPoolSize)
+
+	if err := dispatcher.SetSnapshotMode(snapshots, checkpointDir); err != nil {
+		fatal("Invalid --checkpoint_dir", "error", err)
+	}
+
+	if checkImages {
+		dispatcher.CheckImages(imageRegistry)
+	}
+
+	dispatcher.AllowAdmin(adminUser)
+
+	if callbackAllowlist != "" {
+		asyncCfg.Webhook.Allowlist = strings.Split(callbackAllowlist, ",")
+	}
+	if callbackSecretFile != "" {
+		secret, err := os.ReadFile(callbackSecretFile)
+		if err != nil {
+			fatal("Could not read --callback_secret_file", "error", err)
 		}
-		dispatcher.Dispatch(ctx, w, r)
-	})
+		asyncCfg.Webhook.Secret = strings.TrimSpace(string(secret))
+	}
+	if err := dispatcher.StartAsync(asyncCfg); err != nil {
+		fatal("Could not start asynchronous invocations", "error", err)
+	}
+	if err := dispatcher.StartScheduler(schedulesFile); err != nil {
+		fatal("Could not start schedules", "error", err)
+	}
+
+	r := mux.NewRouter()
+	dispatcher.RegisterAdminRoutes(r.PathPrefix("/admin").Subrouter())
+	dispatcher.RegisterUsageRoutes(r)
+	dispatcher.RegisterMetricsRoutes(r)
+	dispatcher.RegisterAsyncRoutes(r)
+	dispatcher.RegisterInvokeRoutes(r, routeAliases)
 
 	// Channel to listen for interrupt signals
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		log.Println("Starting server on :8080")
+		slog.Info("Starting server", "addr", ":8080")
 		if err := http.ListenAndServe(":8080", r); err != nil {
-			log.Fatalf("Could not start server: %s\n", err.Error())
+			fatal("Could not start server", "error", err)
 		}
 	}()
 
 	// Block until an interrupt signal is received
 	<-stopChan
-	log.Println("Interrupt signal received. Shutting down...")
+	slog.Info("Interrupt signal received. Shutting down...")
 
 	dispatcher.StopLaunchMonitor()
 
 	// Perform cleanup tasks
 	dispatcher.Shutdown()
 
-	log.Println("Server gracefully stopped.")
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush spans", "error", err)
+	}
+
+	slog.Info("Server gracefully stopped.")
 	os.Exit(0)
 }
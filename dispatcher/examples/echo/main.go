@@ -0,0 +1,62 @@
+// Echo is a Go function served with the runtime SDK, responding with a greeting for its "prompt" arg, and streaming
+// it word by word to clients accepting streams. Build its image from the dispatcher's directory:
+//
+//	docker build -f examples/echo/Dockerfile -t echo .
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"serverless/dispatcher/pkg/protocol"
+	"serverless/dispatcher/pkg/sdk"
+)
+
+type echo struct{}
+
+type echoArgs struct {
+	Prompt string `json:"prompt"`
+}
+
+func (echo) Load(ctx context.Context) error {
+	return nil
+}
+
+func (echo) answer(args json.RawMessage) (string, error) {
+	var a echoArgs
+	if err := json.Unmarshal(args, &a); err != nil || a.Prompt == "" {
+		return "", sdk.Errorf(protocol.ErrorInvalidRequest, "args must be {\"prompt\": <non-empty string>}")
+	}
+	return fmt.Sprintf("Given your question: %s. I think the best answer is to buy ice cream.", a.Prompt), nil
+}
+
+func (e echo) Invoke(ctx context.Context, args json.RawMessage) (any, error) {
+	return e.answer(args)
+}
+
+func (e echo) InvokeStream(ctx context.Context, args json.RawMessage, send func(any) error) error {
+	answer, err := e.answer(args)
+	if err != nil {
+		return err
+	}
+	for _, word := range strings.SplitAfter(answer, " ") {
+		if err := send(word); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	port := flag.Int("port", 5000, "The port to serve at")
+	flag.Parse()
+	if err := sdk.Serve(fmt.Sprintf(":%d", *port), echo{}); err != nil {
+		slog.Error("Could not serve", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,301 @@
+// Package conformance checks that a runtime serving a function implements the runtime protocol, so that the dispatcher
+// can run it regardless of the language it's written in.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// The timeout of each check, if Options.Timeout is not set.
+const defaultTimeout = 10 * time.Second
+
+// The request ID of the invocations of the suite.
+const testRequestID = "conformance-test"
+
+// Options configures the suite.
+type Options struct {
+	// The args of the invocations, which the function must serve successfully. {} if empty.
+	Args json.RawMessage
+	// The timeout of each check. defaultTimeout if 0.
+	Timeout time.Duration
+	// The client calling the runtime. http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Result is the result of a check.
+type Result struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Why the check failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the result of the suite.
+type Report struct {
+	URL string `json:"url"`
+	// Whether all checks passed.
+	Passed  bool     `json:"passed"`
+	Results []Result `json:"results"`
+}
+
+// Failed returns the results of the failed checks.
+func (r Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if !res.Passed {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context, s *suite) error
+}
+
+// The checks, in the order they run. The runtime must be ready before invocations are checked.
+var checks = []check{
+	{"alive", checkAlive},
+	{"ready", checkReady},
+	{"invoke", checkInvoke},
+	{"request_id", checkRequestID},
+	{"invalid_request", checkInvalidRequest},
+	{"unsupported_version", checkUnsupportedVersion},
+	{"deadline_exceeded", checkDeadlineExceeded},
+	{"stream", checkStream},
+}
+
+type suite struct {
+	baseURL string
+	opts    Options
+}
+
+// Run runs the suite against the runtime at baseURL, e.g., http://localhost:5000, whose function must be loaded.
+func Run(ctx context.Context, baseURL string, opts Options) Report {
+	if len(opts.Args) == 0 {
+		opts.Args = json.RawMessage("{}")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	s := &suite{baseURL: strings.TrimRight(baseURL, "/"), opts: opts}
+
+	report := Report{URL: s.baseURL, Passed: true}
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		err := c.run(checkCtx, s)
+		cancel()
+		res := Result{Name: c.name, Passed: err == nil}
+		if err != nil {
+			res.Error = err.Error()
+			report.Passed = false
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// Calls the runtime at path, returning the response with its body read.
+func (s *suite) do(ctx context.Context, method, path string, header http.Header, body []byte) (
+	*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read the response, error: %v", err)
+	}
+	return resp, respBody, nil
+}
+
+// Returns the headers of an invocation per the protocol.
+func invokeHeader() http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
+	h.Set(protocol.RequestIDHeader, testRequestID)
+	return h
+}
+
+// Returns the body of an invocation with the suite's args.
+func (s *suite) invokeBody() []byte {
+	body, _ := json.Marshal(protocol.InvokeRequest{Args: s.opts.Args})
+	return body
+}
+
+func expectStatus(resp *http.Response, body []byte, status int) error {
+	if resp.StatusCode != status {
+		return fmt.Errorf("got status %d, want %d, body: %.200s", resp.StatusCode, status, body)
+	}
+	return nil
+}
+
+func expectJSON(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return fmt.Errorf("got Content-Type %q, want application/json", resp.Header.Get("Content-Type"))
+	}
+	return nil
+}
+
+// Checks that the response is the error envelope of type t, with the status of t.
+func expectError(resp *http.Response, body []byte, t protocol.ErrorType) error {
+	if err := expectStatus(resp, body, t.Status()); err != nil {
+		return err
+	}
+	if err := expectJSON(resp); err != nil {
+		return err
+	}
+	var errResp protocol.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return fmt.Errorf("invalid error response %.200s, error: %v", body, err)
+	}
+	if errResp.Error.Type != t {
+		return fmt.Errorf("got error type %q, want %q", errResp.Error.Type, t)
+	}
+	return nil
+}
+
+func checkAlive(ctx context.Context, s *suite) error {
+	resp, body, err := s.do(ctx, http.MethodGet, protocol.AlivePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, body, http.StatusOK)
+}
+
+func checkReady(ctx context.Context, s *suite) error {
+	resp, body, err := s.do(ctx, http.MethodGet, protocol.ReadyPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, body, http.StatusOK); err != nil {
+		return err
+	}
+	var ready protocol.ReadyResponse
+	if err := json.Unmarshal(body, &ready); err != nil {
+		return fmt.Errorf("invalid ready response %.200s, error: %v", body, err)
+	}
+	if ready.ProtocolVersion != protocol.Version {
+		return fmt.Errorf("got protocol_version %d, want %d", ready.ProtocolVersion, protocol.Version)
+	}
+	return nil
+}
+
+func checkInvoke(ctx context.Context, s *suite) error {
+	resp, body, err := s.do(ctx, http.MethodPost, protocol.InvokePath, invokeHeader(), s.invokeBody())
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, body, http.StatusOK); err != nil {
+		return err
+	}
+	if err := expectJSON(resp); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("invalid response %.200s, error: %v", body, err)
+	}
+	if _, ok := fields["response"]; !ok {
+		return fmt.Errorf("response %.200s has no \"response\" field", body)
+	}
+	return nil
+}
+
+func checkRequestID(ctx context.Context, s *suite) error {
+	resp, _, err := s.do(ctx, http.MethodPost, protocol.InvokePath, invokeHeader(), s.invokeBody())
+	if err != nil {
+		return err
+	}
+	if got := resp.Header.Get(protocol.RequestIDHeader); got != testRequestID {
+		return fmt.Errorf("got %s %q, want %q", protocol.RequestIDHeader, got, testRequestID)
+	}
+	return nil
+}
+
+func checkInvalidRequest(ctx context.Context, s *suite) error {
+	resp, body, err := s.do(ctx, http.MethodPost, protocol.InvokePath, invokeHeader(), []byte("not json"))
+	if err != nil {
+		return err
+	}
+	return expectError(resp, body, protocol.ErrorInvalidRequest)
+}
+
+func checkUnsupportedVersion(ctx context.Context, s *suite) error {
+	h := invokeHeader()
+	h.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version+1))
+	resp, body, err := s.do(ctx, http.MethodPost, protocol.InvokePath, h, s.invokeBody())
+	if err != nil {
+		return err
+	}
+	return expectError(resp, body, protocol.ErrorUnsupportedVersion)
+}
+
+func checkDeadlineExceeded(ctx context.Context, s *suite) error {
+	h := invokeHeader()
+	protocol.SetDeadline(h, time.Now().Add(-time.Second))
+	resp, body, err := s.do(ctx, http.MethodPost, protocol.InvokePath, h, s.invokeBody())
+	if err != nil {
+		return err
+	}
+	return expectError(resp, body, protocol.ErrorDeadlineExceeded)
+}
+
+// Checks that invocations accepting NDJSON are either streamed as lines of chunks, or responded to as usual by
+// functions not streaming.
+func checkStream(ctx context.Context, s *suite) error {
+	h := invokeHeader()
+	h.Set("Accept", protocol.NDJSONMediaType+", application/json;q=0.5")
+	resp, body, err := s.do(ctx, http.MethodPost, protocol.InvokePath, h, s.invokeBody())
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, body, http.StatusOK); err != nil {
+		return err
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		return nil
+	case protocol.NDJSONMediaType:
+	default:
+		return fmt.Errorf("got Content-Type %q, want %s or application/json", mediaType, protocol.NDJSONMediaType)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return fmt.Errorf("invalid line %.200s, error: %v", scanner.Bytes(), err)
+		}
+		if _, ok := fields["chunk"]; !ok {
+			return fmt.Errorf("line %.200s has no \"chunk\" field", scanner.Bytes())
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,67 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/sdk"
+)
+
+type echo struct{}
+
+func (echo) Load(ctx context.Context) error {
+	return nil
+}
+
+func (echo) Invoke(ctx context.Context, args json.RawMessage) (any, error) {
+	return args, nil
+}
+
+// TestRun tests that runtimes built with the SDK pass the suite
+func TestRun(t *testing.T) {
+	rt := sdk.New(echo{})
+	assert.NoError(t, rt.Load(context.Background()))
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	report := Run(context.Background(), server.URL+"/", Options{Args: json.RawMessage(`{"x": 1}`)})
+	assert.True(t, report.Passed, report.Failed())
+	assert.Equal(t, server.URL, report.URL)
+	assert.Len(t, report.Results, len(checks))
+}
+
+// TestRun_Failures tests reporting the checks failed by a runtime predating the protocol, which responds with plain
+// text errors, and does not echo request IDs
+func TestRun_Failures(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/invoke", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"response": "ok"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	report := Run(context.Background(), server.URL, Options{})
+	assert.False(t, report.Passed)
+	var failed []string
+	for _, res := range report.Failed() {
+		assert.NotEmpty(t, res.Error)
+		failed = append(failed, res.Name)
+	}
+	assert.Equal(t, []string{"ready", "request_id", "invalid_request", "unsupported_version", "deadline_exceeded"},
+		failed)
+}
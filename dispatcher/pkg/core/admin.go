@@ -0,0 +1,807 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Registers the admin APIs onto r. All of them require the User header to name an admin, see PermMgr.AllowAdmin.
+//
+//	GET    /functions/{fn}/versions          Returns the versions of function fn, the oldest first.
+//	POST   /functions/{fn}/versions          Publishes a new version of function fn, body: FunctionVersion, of which
+//	                                         image, cmd, memory_mb and description are used. The image and cmd
+//	                                         default to those of the latest version.
+//	POST   /functions/{fn}/build             Builds a source into an image on top of the runtime image, and publishes
+//	                                         it as a new version of function fn, creating fn if it does not exist.
+//	                                         Body: multipart form of source, a tar archive, optionally gzipped, or a
+//	                                         single .py file, file, the Python file of the source defining the class,
+//	                                         class_name, and optionally requirements, memory_mb, description and
+//	                                         users, comma-separated users allowed to call fn. Returns BuildResult,
+//	                                         or 422 with the build output if a build step fails.
+//	POST   /functions/{fn}/conformance       Checks that a version of function fn implements the runtime protocol,
+//	                                         body: ConformanceRequest, optional. Launches an instance if none is
+//	                                         ready. Returns conformance.Report, whether the checks passed or not.
+//	GET    /functions/{fn}/aliases           Returns the aliases of function fn by name.
+//	PUT    /functions/{fn}/aliases/{alias}   Adds or replaces an alias of function fn, body:
+//	                                         {"weights": {"<version>": <weight>, ...}}.
+//	DELETE /functions/{fn}/aliases/{alias}   Removes the alias. The default alias can not be removed.
+//
+//	GET    /images        Returns the image of each version of each function, with its availability and digest, see
+//	                      FunctionImage.
+//	POST   /images/check  Checks the images again, pulling missing ones, and returns them the same as GET /images.
+//
+//	GET    /rollouts                Returns the last rollout of each function.
+//	GET    /functions/{fn}/rollout  Returns the last rollout of function fn, with the stats of its versions.
+//	POST   /functions/{fn}/rollout  Starts shifting an alias of function fn to a new version, body: RolloutSpec.
+//	                                Fields not provided take the values of DefaultRolloutSpec. Returns 409 if a
+//	                                rollout of fn is running.
+//	DELETE /functions/{fn}/rollout  Rolls back the running rollout of function fn.
+//
+//	GET    /cold_starts       Returns the summaries of the recent cold starts by function, see ColdStartSummary.
+//	GET    /cold_starts/{fn}  Returns the summary of the recent cold starts of function fn, with the time each of
+//	                          them spent in each phase.
+//
+//	GET    /limits       Returns the default and per-function concurrency limits, and the in-flight call counts.
+//	PUT    /limits       Sets the default concurrency limit, body: {"limit": <n>}.
+//	PUT    /limits/{fn}  Sets the concurrency limit of function fn, body: {"limit": <n>}.
+//	DELETE /limits/{fn}  Removes the concurrency limit of function fn, so the default limit applies.
+//
+//	GET    /timeouts       Returns the default and per-function invocation timeouts.
+//	PUT    /timeouts       Sets the default invocation timeout, body: {"timeout": <duration, e.g. "30s">}.
+//	PUT    /timeouts/{fn}  Sets the invocation timeout of function fn, body: {"timeout": <duration>}.
+//	DELETE /timeouts/{fn}  Removes the invocation timeout of function fn, so the default timeout applies.
+//
+//	GET    /retries        Returns the retry policies of all functions.
+//	PUT    /retries/{fn}   Sets the retry policy of function fn, body: RetryPolicy. Fields not provided take the
+//	                       values of DefaultRetryPolicy.
+//	DELETE /retries/{fn}   Removes the retry policy of function fn, so its invocations are never retried.
+//
+//	GET    /health               Returns the circuit breaker state, outlier policy and instances' health by function.
+//	PUT    /health/{fn}/policy   Sets the outlier policy of function fn, body: OutlierPolicy. Fields not provided take
+//	                             the values of DefaultOutlierPolicy.
+//	DELETE /health/{fn}/policy   Removes the outlier policy of function fn, so the default policy applies.
+//
+//	GET    /async/policies       Returns the retry policies of asynchronous invocations set by function.
+//	PUT    /async/policies/{fn}  Sets the retry policy of function fn's asynchronous invocations, body:
+//	                             AsyncRetryPolicy. Fields not provided take the values of DefaultAsyncRetryPolicy.
+//	DELETE /async/policies/{fn}  Removes the retry policy of function fn, so DefaultAsyncRetryPolicy applies.
+//
+//	GET    /async/dead_letters                Returns the dead letters, of function fn if the fn query parameter is
+//	                                          given.
+//	GET    /async/dead_letters/{id}           Returns the dead letter, including its payload and last result.
+//	POST   /async/dead_letters/{id}/replay    Queues the dead letter again.
+//	DELETE /async/dead_letters/{id}           Removes the dead letter.
+//	DELETE /async/dead_letters                Removes all dead letters, of function fn if the fn query parameter is
+//	                                          given. Returns {"purged": <n>}.
+//
+//	GET    /schedules         Returns all schedules with their next fire times, the earliest first.
+//	GET    /schedules/{name}  Returns the schedule.
+//	PUT    /schedules/{name}  Adds or replaces a schedule, body: Schedule. The user must be allowed to call the
+//	                          function.
+//	DELETE /schedules/{name}  Removes the schedule.
+//
+//	GET    /webhooks/dead_letters  Returns the callbacks of asynchronous invocations that could not be delivered.
+//	DELETE /webhooks/dead_letters  Removes all dead letters of callbacks.
+//
+//	GET    /plans              Returns all pricing plans.
+//	PUT    /plans/{plan}       Adds or replaces a pricing plan, body: PricingPlan.
+//	PUT    /users/{user}/plan  Sets the pricing plan of a user, body: {"plan": <name>}.
+//	GET    /invoices/{user}    Returns the invoice of a user, for the period given by the from and to query parameters
+//	                           in RFC 3339, which default to the beginning of the ledger and now.
+func (d *Dispatcher) RegisterAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/functions/{fn}/versions", d.requireAdmin(d.handleGetVersions)).Methods(http.MethodGet)
+	r.HandleFunc("/functions/{fn}/versions", d.requireAdmin(d.handlePublishVersion)).Methods(http.MethodPost)
+	r.HandleFunc("/functions/{fn}/build", d.requireAdmin(d.handleBuild)).Methods(http.MethodPost)
+	r.HandleFunc("/functions/{fn}/conformance", d.requireAdmin(d.handleConformance)).Methods(http.MethodPost)
+	r.HandleFunc("/functions/{fn}/aliases", d.requireAdmin(d.handleGetAliases)).Methods(http.MethodGet)
+	r.HandleFunc("/functions/{fn}/aliases/{alias}", d.requireAdmin(d.handleSetAlias)).Methods(http.MethodPut)
+	r.HandleFunc("/functions/{fn}/aliases/{alias}", d.requireAdmin(d.handleDeleteAlias)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/images", d.requireAdmin(d.handleGetImages)).Methods(http.MethodGet)
+	r.HandleFunc("/images/check", d.requireAdmin(d.handleCheckImages)).Methods(http.MethodPost)
+
+	r.HandleFunc("/rollouts", d.requireAdmin(d.handleGetRollouts)).Methods(http.MethodGet)
+	r.HandleFunc("/functions/{fn}/rollout", d.requireAdmin(d.handleGetRollout)).Methods(http.MethodGet)
+	r.HandleFunc("/functions/{fn}/rollout", d.requireAdmin(d.handleStartRollout)).Methods(http.MethodPost)
+	r.HandleFunc("/functions/{fn}/rollout", d.requireAdmin(d.handleRollback)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/cold_starts", d.requireAdmin(d.handleGetColdStarts)).Methods(http.MethodGet)
+	r.HandleFunc("/cold_starts/{fn}", d.requireAdmin(d.handleGetFnColdStarts)).Methods(http.MethodGet)
+
+	r.HandleFunc("/limits", d.requireAdmin(d.handleGetLimits)).Methods(http.MethodGet)
+	r.HandleFunc("/limits", d.requireAdmin(d.handleSetDefaultLimit)).Methods(http.MethodPut)
+	r.HandleFunc("/limits/{fn}", d.requireAdmin(d.handleSetFnLimit)).Methods(http.MethodPut)
+	r.HandleFunc("/limits/{fn}", d.requireAdmin(d.handleResetFnLimit)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/timeouts", d.requireAdmin(d.handleGetTimeouts)).Methods(http.MethodGet)
+	r.HandleFunc("/timeouts", d.requireAdmin(d.handleSetDefaultTimeout)).Methods(http.MethodPut)
+	r.HandleFunc("/timeouts/{fn}", d.requireAdmin(d.handleSetFnTimeout)).Methods(http.MethodPut)
+	r.HandleFunc("/timeouts/{fn}", d.requireAdmin(d.handleResetFnTimeout)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/retries", d.requireAdmin(d.handleGetRetryPolicies)).Methods(http.MethodGet)
+	r.HandleFunc("/retries/{fn}", d.requireAdmin(d.handleSetRetryPolicy)).Methods(http.MethodPut)
+	r.HandleFunc("/retries/{fn}", d.requireAdmin(d.handleResetRetryPolicy)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/health", d.requireAdmin(d.handleGetHealth)).Methods(http.MethodGet)
+	r.HandleFunc("/health/{fn}/policy", d.requireAdmin(d.handleSetOutlierPolicy)).Methods(http.MethodPut)
+	r.HandleFunc("/health/{fn}/policy", d.requireAdmin(d.handleResetOutlierPolicy)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/async/policies", d.requireAdmin(d.handleGetAsyncRetryPolicies)).Methods(http.MethodGet)
+	r.HandleFunc("/async/policies/{fn}", d.requireAdmin(d.handleSetAsyncRetryPolicy)).Methods(http.MethodPut)
+	r.HandleFunc("/async/policies/{fn}", d.requireAdmin(d.handleResetAsyncRetryPolicy)).Methods(http.MethodDelete)
+	r.HandleFunc("/async/dead_letters", d.requireAdmin(d.handleGetDeadLetters)).Methods(http.MethodGet)
+	r.HandleFunc("/async/dead_letters", d.requireAdmin(d.handlePurgeDeadLetters)).Methods(http.MethodDelete)
+	r.HandleFunc("/async/dead_letters/{id}", d.requireAdmin(d.handleGetDeadLetter)).Methods(http.MethodGet)
+	r.HandleFunc("/async/dead_letters/{id}", d.requireAdmin(d.handlePurgeDeadLetter)).Methods(http.MethodDelete)
+	r.HandleFunc("/async/dead_letters/{id}/replay", d.requireAdmin(d.handleReplayDeadLetter)).Methods(http.MethodPost)
+
+	r.HandleFunc("/schedules", d.requireAdmin(d.handleGetSchedules)).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{name}", d.requireAdmin(d.handleGetSchedule)).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{name}", d.requireAdmin(d.handleSetSchedule)).Methods(http.MethodPut)
+	r.HandleFunc("/schedules/{name}", d.requireAdmin(d.handleDeleteSchedule)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/webhooks/dead_letters", d.requireAdmin(d.handleGetWebhookDeadLetters)).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/dead_letters", d.requireAdmin(d.handlePurgeWebhookDeadLetters)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/plans", d.requireAdmin(d.handleGetPlans)).Methods(http.MethodGet)
+	r.HandleFunc("/plans/{plan}", d.requireAdmin(d.handleSetPlan)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{user}/plan", d.requireAdmin(d.handleSetUserPlan)).Methods(http.MethodPut)
+	r.HandleFunc("/invoices/{user}", d.requireAdmin(d.handleGetInvoice)).Methods(http.MethodGet)
+}
+
+// Wraps h to reject requests not sent by an admin.
+func (d *Dispatcher) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("User")
+		if user == "" {
+			http.Error(w, "User header not provided", http.StatusBadRequest)
+			return
+		}
+		if !d.permMgr.IsAdmin(user) {
+			http.Error(w, fmt.Sprintf("User %s is not an admin", user), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Returns true if function fn is registered, or writes the error response.
+func (d *Dispatcher) fnFound(w http.ResponseWriter, fn string) bool {
+	if !d.launcher.HasFn(fn) {
+		http.Error(w, fmt.Sprintf("Function %s not found", fn), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (d *Dispatcher) handleGetVersions(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if d.fnFound(w, fn) {
+		versions, _ := d.versionMgr.Versions(fn)
+		writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+func (d *Dispatcher) handlePublishVersion(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if !d.fnFound(w, fn) {
+		return
+	}
+	var v FunctionVersion
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	v, err := d.publishVersion(fn, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, v)
+}
+
+func (d *Dispatcher) handleBuild(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	r.Body = http.MaxBytesReader(w, r.Body, maxSourceBytes)
+	spec, users, err := parseBuildForm(r)
+	if err == nil {
+		err = validateBuild(fn, spec)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid build request, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	res, err := d.BuildFunction(r.Context(), fn, spec, users)
+	if errors.Is(err, ErrBuildFailed) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not build function %s, error: %v", fn, err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (d *Dispatcher) handleConformance(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if !d.fnFound(w, fn) {
+		return
+	}
+	var req ConformanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	report, err := d.CheckConformance(r.Context(), fn, req)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, fmt.Sprintf("Version %s of function %s not found", req.Version, fn), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not check function %s, error: %v", fn, err), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// Parses the multipart form of a build request, see RegisterAdminRoutes.
+func parseBuildForm(r *http.Request) (BuildSpec, []string, error) {
+	if err := r.ParseMultipartForm(maxSourceBytes); err != nil {
+		return BuildSpec{}, nil, err
+	}
+	spec := BuildSpec{
+		File:        r.FormValue("file"),
+		ClassName:   r.FormValue("class_name"),
+		Description: r.FormValue("description"),
+	}
+	if s := r.FormValue("memory_mb"); s != "" {
+		var err error
+		if spec.MemoryMB, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return BuildSpec{}, nil, fmt.Errorf("invalid memory_mb %q", s)
+		}
+	}
+
+	source, hdr, err := r.FormFile("source")
+	if err != nil {
+		return BuildSpec{}, nil, fmt.Errorf("source must be provided, error: %v", err)
+	}
+	defer source.Close()
+	if strings.HasSuffix(hdr.Filename, ".py") {
+		content, err := io.ReadAll(source)
+		if err != nil {
+			return BuildSpec{}, nil, err
+		}
+		spec.Files = map[string][]byte{path.Base(hdr.Filename): content}
+		if spec.File == "" {
+			spec.File = path.Base(hdr.Filename)
+		}
+	} else if spec.Files, err = ReadSourceArchive(source); err != nil {
+		return BuildSpec{}, nil, err
+	}
+
+	// Requirements are either uploaded as a file, or given as a value.
+	if reqs, _, err := r.FormFile("requirements"); err == nil {
+		defer reqs.Close()
+		if spec.Requirements, err = io.ReadAll(reqs); err != nil {
+			return BuildSpec{}, nil, err
+		}
+	} else {
+		spec.Requirements = []byte(r.FormValue("requirements"))
+	}
+
+	var users []string
+	for _, user := range strings.Split(r.FormValue("users"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	return spec, users, nil
+}
+
+func (d *Dispatcher) handleGetAliases(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if d.fnFound(w, fn) {
+		aliases, _ := d.versionMgr.Aliases(fn)
+		writeJSON(w, http.StatusOK, aliases)
+	}
+}
+
+func (d *Dispatcher) handleSetAlias(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if !d.fnFound(w, fn) {
+		return
+	}
+	var a Alias
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["alias"]
+	if err := d.versionMgr.SetAlias(fn, name, a.Weights); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aliases, _ := d.versionMgr.Aliases(fn)
+	writeJSON(w, http.StatusOK, aliases[name])
+}
+
+func (d *Dispatcher) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := d.versionMgr.DeleteAlias(vars["fn"], vars["alias"])
+	switch {
+	case errors.Is(err, ErrAliasNotFound):
+		http.Error(w, fmt.Sprintf("Alias %s of function %s not found", vars["alias"], vars["fn"]), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (d *Dispatcher) handleGetColdStarts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.coldStartTracker.Summaries())
+}
+
+func (d *Dispatcher) handleGetFnColdStarts(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if !d.fnFound(w, fn) {
+		return
+	}
+	summary, ok := d.coldStartTracker.Summary(fn)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No cold start of function %s", fn), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// Returns true if image checks are enabled, or writes the error response.
+func (d *Dispatcher) imagesChecked(w http.ResponseWriter) bool {
+	if d.imageMgr == nil {
+		http.Error(w, "Image checks are not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (d *Dispatcher) handleGetImages(w http.ResponseWriter, r *http.Request) {
+	if d.imagesChecked(w) {
+		writeJSON(w, http.StatusOK, d.functionImages())
+	}
+}
+
+func (d *Dispatcher) handleCheckImages(w http.ResponseWriter, r *http.Request) {
+	if d.imagesChecked(w) {
+		writeJSON(w, http.StatusOK, d.checkAllImages())
+	}
+}
+
+func (d *Dispatcher) handleGetRollouts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.rolloutMgr.List())
+}
+
+func (d *Dispatcher) handleGetRollout(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	status, err := d.rolloutMgr.Get(fn)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("No rollout of function %s", fn), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Dispatcher) handleStartRollout(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	if !d.fnFound(w, fn) {
+		return
+	}
+	spec := DefaultRolloutSpec()
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	status, err := d.rolloutMgr.Start(fn, spec)
+	switch {
+	case errors.Is(err, ErrRolloutInProgress):
+		http.Error(w, fmt.Sprintf("A rollout of function %s is running", fn), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(w, http.StatusCreated, status)
+	}
+}
+
+func (d *Dispatcher) handleRollback(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	status, err := d.rolloutMgr.Rollback(fn, "rolled back by admin")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("No running rollout of function %s", fn), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// The request body of setting a concurrency limit.
+type limitRequest struct {
+	Limit *int64 `json:"limit"`
+}
+
+func decodeLimitRequest(r *http.Request) (int64, error) {
+	var req limitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, fmt.Errorf("invalid request body, error: %v", err)
+	}
+	if req.Limit == nil || *req.Limit < 0 {
+		return 0, fmt.Errorf("limit must be provided and non-negative")
+	}
+	return *req.Limit, nil
+}
+
+func (d *Dispatcher) handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.apiLimitMgr.Snapshot())
+}
+
+func (d *Dispatcher) handleSetDefaultLimit(w http.ResponseWriter, r *http.Request) {
+	limit, err := decodeLimitRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.SetAPIConcurLimit(limit)
+	writeJSON(w, http.StatusOK, d.apiLimitMgr.Snapshot())
+}
+
+func (d *Dispatcher) handleSetFnLimit(w http.ResponseWriter, r *http.Request) {
+	limit, err := decodeLimitRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.SetFnAPIConcurLimit(mux.Vars(r)["fn"], limit)
+	writeJSON(w, http.StatusOK, d.apiLimitMgr.Snapshot())
+}
+
+func (d *Dispatcher) handleResetFnLimit(w http.ResponseWriter, r *http.Request) {
+	d.apiLimitMgr.ResetAPILimit(mux.Vars(r)["fn"])
+	writeJSON(w, http.StatusOK, d.apiLimitMgr.Snapshot())
+}
+
+func decodeTimeoutRequest(r *http.Request) (time.Duration, error) {
+	var req struct {
+		Timeout string `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, fmt.Errorf("invalid request body, error: %v", err)
+	}
+	timeout, err := time.ParseDuration(req.Timeout)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("timeout must be a non-negative duration, got '%s'", req.Timeout)
+	}
+	return timeout, nil
+}
+
+func (d *Dispatcher) handleGetTimeouts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.proxy.Snapshot())
+}
+
+func (d *Dispatcher) handleSetDefaultTimeout(w http.ResponseWriter, r *http.Request) {
+	timeout, err := decodeTimeoutRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.SetInvokeTimeout(timeout)
+	writeJSON(w, http.StatusOK, d.proxy.Snapshot())
+}
+
+func (d *Dispatcher) handleSetFnTimeout(w http.ResponseWriter, r *http.Request) {
+	timeout, err := decodeTimeoutRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.SetFnInvokeTimeout(mux.Vars(r)["fn"], timeout)
+	writeJSON(w, http.StatusOK, d.proxy.Snapshot())
+}
+
+func (d *Dispatcher) handleResetFnTimeout(w http.ResponseWriter, r *http.Request) {
+	d.proxy.ResetFnTimeout(mux.Vars(r)["fn"])
+	writeJSON(w, http.StatusOK, d.proxy.Snapshot())
+}
+
+func (d *Dispatcher) handleGetRetryPolicies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.retryMgr.Policies())
+}
+
+func (d *Dispatcher) handleSetRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := DefaultRetryPolicy()
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := d.retryMgr.SetPolicy(mux.Vars(r)["fn"], policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func (d *Dispatcher) handleResetRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	d.retryMgr.ResetPolicy(mux.Vars(r)["fn"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Dispatcher) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.healthMgr.Snapshot())
+}
+
+func (d *Dispatcher) handleSetOutlierPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := DefaultOutlierPolicy()
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := d.healthMgr.SetPolicy(mux.Vars(r)["fn"], policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func (d *Dispatcher) handleResetOutlierPolicy(w http.ResponseWriter, r *http.Request) {
+	d.healthMgr.ResetPolicy(mux.Vars(r)["fn"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns true if asynchronous invocations are started, or writes the error response.
+func (d *Dispatcher) asyncStarted(w http.ResponseWriter) bool {
+	if d.asyncMgr == nil {
+		http.Error(w, "Asynchronous invocations are not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (d *Dispatcher) handleGetAsyncRetryPolicies(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		writeJSON(w, http.StatusOK, d.asyncMgr.RetryPolicies())
+	}
+}
+
+func (d *Dispatcher) handleSetAsyncRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	if !d.asyncStarted(w) {
+		return
+	}
+	policy := DefaultAsyncRetryPolicy()
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := d.asyncMgr.SetRetryPolicy(mux.Vars(r)["fn"], policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func (d *Dispatcher) handleResetAsyncRetryPolicy(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		d.asyncMgr.ResetRetryPolicy(mux.Vars(r)["fn"])
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Writes the error response of a failed operation on a dead letter.
+func writeDeadLetterError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, ErrAsyncNotFound):
+		http.Error(w, fmt.Sprintf("Invocation %s not found", id), http.StatusNotFound)
+	case errors.Is(err, ErrAsyncNotDeadLetter):
+		http.Error(w, fmt.Sprintf("Invocation %s is not a dead letter", id), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (d *Dispatcher) handleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		writeJSON(w, http.StatusOK, d.asyncMgr.DeadLetters(r.URL.Query().Get("fn")))
+	}
+}
+
+func (d *Dispatcher) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !d.asyncStarted(w) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	rec, err := d.asyncMgr.DeadLetter(id)
+	if err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+func (d *Dispatcher) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !d.asyncStarted(w) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	inv, err := d.asyncMgr.Replay(id)
+	if err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, inv)
+}
+
+func (d *Dispatcher) handlePurgeDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !d.asyncStarted(w) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := d.asyncMgr.PurgeDeadLetter(id); err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Dispatcher) handlePurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		n := d.asyncMgr.PurgeDeadLetters(r.URL.Query().Get("fn"))
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	}
+}
+
+// Returns true if schedules are started, or writes the error response.
+func (d *Dispatcher) schedulerStarted(w http.ResponseWriter) bool {
+	if d.scheduleMgr == nil {
+		http.Error(w, "Schedules are not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (d *Dispatcher) handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	if d.schedulerStarted(w) {
+		writeJSON(w, http.StatusOK, d.scheduleMgr.List())
+	}
+}
+
+func (d *Dispatcher) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	if !d.schedulerStarted(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	status, err := d.scheduleMgr.Get(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Schedule %s not found", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Dispatcher) handleSetSchedule(w http.ResponseWriter, r *http.Request) {
+	if !d.schedulerStarted(w) {
+		return
+	}
+	var s Schedule
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !d.launcher.HasFn(s.Fn) {
+		http.Error(w, fmt.Sprintf("Function %s not found", s.Fn), http.StatusBadRequest)
+		return
+	}
+	if !d.permMgr.IsUserAllowed(s.User, s.Fn) {
+		http.Error(w, fmt.Sprintf("User %s is not allowed to call function %s", s.User, s.Fn), http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := d.scheduleMgr.Set(name, s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, _ := d.scheduleMgr.Get(name)
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Dispatcher) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if !d.schedulerStarted(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := d.scheduleMgr.Delete(name); err != nil {
+		http.Error(w, fmt.Sprintf("Schedule %s not found", name), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Dispatcher) handleGetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		writeJSON(w, http.StatusOK, d.webhookMgr.DeadLetters())
+	}
+}
+
+func (d *Dispatcher) handlePurgeWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if d.asyncStarted(w) {
+		d.webhookMgr.PurgeDeadLetters()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (d *Dispatcher) handleGetPlans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.billingMgr.Plans())
+}
+
+func (d *Dispatcher) handleSetPlan(w http.ResponseWriter, r *http.Request) {
+	var plan PricingPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	plan.Name = mux.Vars(r)["plan"]
+	if err := d.billingMgr.SetPlan(plan); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (d *Dispatcher) handleSetUserPlan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := d.billingMgr.SetUserPlan(mux.Vars(r)["user"], req.Plan); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Dispatcher) handleGetInvoice(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.billingMgr.Invoice(mux.Vars(r)["user"], from, to))
+}
+
+// Parses the from and to query parameters in RFC 3339. They default to the zero time and now respectively.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	var from time.Time
+	to := time.Now()
+	var err error
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, fmt.Errorf("invalid from time %s, error: %v", s, err)
+		}
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, fmt.Errorf("invalid to time %s, error: %v", s, err)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from time %v must be before to time %v", from, to)
+	}
+	return from, to, nil
+}
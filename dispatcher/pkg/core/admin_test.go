@@ -0,0 +1,392 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdminRouter(d *Dispatcher) *mux.Router {
+	r := mux.NewRouter()
+	d.RegisterAdminRoutes(r.PathPrefix("/admin").Subrouter())
+	return r
+}
+
+func doAdminRequest(r http.Handler, method, path, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("User", user)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestAdmin_RequireAdmin tests that admin APIs reject non-admin users
+func TestAdmin_RequireAdmin(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodGet, "/admin/limits", "test", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestAdmin_Limits tests changing the concurrency limits through the admin APIs
+func TestAdmin_Limits(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/limits", "admin", `{"limit": 5}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(5), d.GetAPILimitMgr().GetLimit("alpha"))
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/limits/alpha", "admin", `{"limit": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), d.GetAPILimitMgr().GetLimit("alpha"))
+	assert.Equal(t, int64(5), d.GetAPILimitMgr().GetLimit("beta"))
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/limits", "admin", "")
+	var snapshot APILimitSnapshot
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.Equal(t, int64(5), snapshot.DefaultLimit)
+	assert.Equal(t, int64(1), snapshot.Limits["alpha"])
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/limits/alpha", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(5), d.GetAPILimitMgr().GetLimit("alpha"))
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/limits/alpha", "admin", `{"limit": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_Timeouts tests setting invocation timeouts through the admin APIs
+func TestAdmin_Timeouts(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/timeouts/alpha", "admin", `{"timeout": "30s"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 30*time.Second, d.proxy.Timeout("alpha"))
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/timeouts", "admin", `{"timeout": "2m"}`)
+	var snapshot ProxyTimeoutSnapshot
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.Equal(t, "2m0s", snapshot.DefaultTimeout)
+	assert.Equal(t, map[string]string{"alpha": "30s"}, snapshot.Timeouts)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/timeouts/alpha", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2*time.Minute, d.proxy.Timeout("alpha"))
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/timeouts/alpha", "admin", `{"timeout": "soon"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_Retries tests setting retry policies through the admin APIs
+func TestAdmin_Retries(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/retries/alpha", "admin",
+		`{"max_attempts": 2, "idempotent": true, "initial_backoff": "10ms"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	policy, ok := d.GetRetryMgr().Policy("alpha")
+	assert.True(t, ok)
+	assert.Equal(t, 2, policy.MaxAttempts)
+	assert.True(t, policy.Idempotent)
+	assert.Equal(t, Duration(10*time.Millisecond), policy.InitialBackoff)
+	assert.Equal(t, DefaultRetryPolicy().RetryableStatuses, policy.RetryableStatuses)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/retries", "admin", "")
+	var policies map[string]RetryPolicy
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &policies))
+	assert.Equal(t, policy, policies["alpha"])
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/retries/alpha", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	_, ok = d.GetRetryMgr().Policy("alpha")
+	assert.False(t, ok)
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/retries/alpha", "admin", `{"max_attempts": 0}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_Health tests getting instances' health and setting outlier policies through the admin APIs
+func TestAdmin_Health(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/health/alpha/policy", "admin", `{"consecutive_5xx": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rc := &RunningContainer{name: "alpha-0", fn: "alpha"}
+	d.GetHealthMgr().observe(rc, http.StatusInternalServerError, time.Millisecond)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/health", "admin", "")
+	var health map[string]FnHealth
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, BreakerOpen, health["alpha"].Breaker)
+	assert.Equal(t, 1, health["alpha"].Policy.Consecutive5xx)
+	assert.Len(t, health["alpha"].Instances, 1)
+	assert.True(t, health["alpha"].Instances[0].Ejected)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/health/alpha/policy", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/health/alpha/policy", "admin", `{"latency_factor": 0.5}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_WebhookDeadLetters tests inspecting and purging the dead letters of callbacks through the admin APIs
+func TestAdmin_WebhookDeadLetters(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodGet, "/admin/webhooks/dead_letters", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code, "asynchronous invocations are not started")
+
+	assert.NoError(t, d.StartAsync(AsyncConfig{Workers: 1, Webhook: DefaultWebhookConfig()}))
+	defer d.Shutdown()
+	d.webhookMgr.deadLetters = []WebhookDeadLetter{{InvocationID: "id", Fn: "alpha", Attempts: 5}}
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/webhooks/dead_letters", "admin", "")
+	var deadLetters []WebhookDeadLetter
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &deadLetters))
+	assert.Equal(t, d.webhookMgr.DeadLetters(), deadLetters)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/webhooks/dead_letters", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, d.webhookMgr.DeadLetters())
+}
+
+// TestAdmin_AsyncDeadLetters tests managing retry policies and dead letters of async invocations through the admin
+// APIs
+func TestAdmin_AsyncDeadLetters(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+	assert.NoError(t, d.StartAsync(AsyncConfig{Workers: 1, Webhook: DefaultWebhookConfig()}))
+	defer d.Shutdown()
+	addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/async/policies/alpha", "admin", `{"max_retries": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doAdminRequest(r, http.MethodPut, "/admin/async/policies/alpha", "admin", `{"max_retries": 0}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doAdminRequest(r, http.MethodGet, "/admin/async/policies", "admin", "")
+	var policies map[string]AsyncRetryPolicy
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &policies))
+	assert.Equal(t, 0, policies["alpha"].MaxRetries)
+	assert.Equal(t, DefaultAsyncRetryPolicy().MaxBackoff, policies["alpha"].MaxBackoff)
+
+	inv, err := d.asyncMgr.Submit(AsyncRequest{Fn: "alpha", User: "test", Payload: []byte("payload")})
+	assert.NoError(t, err)
+	waitForAsyncStatus(t, d.asyncMgr, inv.ID, AsyncDeadLetter)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/async/dead_letters?fn=alpha", "admin", "")
+	var deadLetters []AsyncInvocation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &deadLetters))
+	assert.Len(t, deadLetters, 1)
+	w = doAdminRequest(r, http.MethodGet, "/admin/async/dead_letters/"+inv.ID, "admin", "")
+	var rec AsyncRecord
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rec))
+	assert.Equal(t, "payload", string(rec.Payload))
+
+	w = doAdminRequest(r, http.MethodPost, "/admin/async/dead_letters/"+inv.ID+"/replay", "admin", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	waitForAsyncStatus(t, d.asyncMgr, inv.ID, AsyncDeadLetter)
+	w = doAdminRequest(r, http.MethodDelete, "/admin/async/dead_letters/"+inv.ID, "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doAdminRequest(r, http.MethodGet, "/admin/async/dead_letters/"+inv.ID, "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/async/policies/alpha", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+// TestAdmin_Schedules tests managing schedules through the admin APIs
+func TestAdmin_Schedules(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+	assert.Error(t, d.StartScheduler(""), "asynchronous invocations are not started")
+	assert.NoError(t, d.StartAsync(AsyncConfig{Workers: 1, Webhook: DefaultWebhookConfig()}))
+	assert.NoError(t, d.StartScheduler(""))
+	defer d.Shutdown()
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/schedules/nightly", "admin",
+		`{"fn": "alpha", "cron": "0 2 * * *", "user": "other"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the user is not allowed to call alpha")
+	w = doAdminRequest(r, http.MethodPut, "/admin/schedules/nightly", "admin",
+		`{"fn": "alpha", "cron": "0 2 * * *", "user": "test", "payload": {"args": {}}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doAdminRequest(r, http.MethodPut, "/admin/schedules/hourly", "admin",
+		`{"fn": "beta", "cron": "@hourly", "user": "test", "missed_runs": "run_once"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/schedules", "admin", "")
+	var schedules []ScheduleStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &schedules))
+	assert.Len(t, schedules, 2)
+	assert.Equal(t, "hourly", schedules[0].Name)
+	assert.Equal(t, MissedRunOnce, schedules[0].MissedRuns)
+	assert.True(t, schedules[0].NextFireTime.After(time.Now()))
+	assert.Equal(t, "nightly", schedules[1].Name)
+	assert.JSONEq(t, `{"args": {}}`, string(schedules[1].Payload))
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/schedules/nightly", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doAdminRequest(r, http.MethodGet, "/admin/schedules/nightly", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestAdmin_Billing tests managing pricing plans and getting invoices through the admin APIs
+func TestAdmin_Billing(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPut, "/admin/plans/free", "admin", `{"per_request": 0}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doAdminRequest(r, http.MethodPut, "/admin/users/test/plan", "admin", `{"plan": "free"}`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doAdminRequest(r, http.MethodPut, "/admin/users/test/plan", "admin", `{"plan": "unknown"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	d.GetBillingMgr().Record(LedgerEntry{User: "test", Fn: "alpha", ReceivedTime: time.Now(), ExecTime: time.Second})
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/invoices/test", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var invoice Invoice
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &invoice))
+	assert.Len(t, invoice.Lines, 1)
+	assert.Equal(t, "free", invoice.Lines[0].Plan)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/invoices/test?from=yesterday", "admin", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestAdmin_Versions tests publishing versions and setting aliases through the admin APIs
+func TestAdmin_Versions(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/versions", "admin", `{"image": "runtime:v2"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var v FunctionVersion
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.Equal(t, 2, v.Version)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/functions/alpha/versions", "admin", "")
+	var versions []FunctionVersion
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &versions))
+	assert.Len(t, versions, 2)
+
+	w = doAdminRequest(r, http.MethodPut, "/admin/functions/alpha/aliases/canary", "admin", `{"weights": {"2": 1}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doAdminRequest(r, http.MethodPut, "/admin/functions/alpha/aliases/canary", "admin", `{"weights": {"3": 1}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/functions/alpha/aliases", "admin", "")
+	var aliases map[string]Alias
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aliases))
+	assert.Equal(t, map[int]int{2: 1}, aliases["canary"].Weights)
+	assert.Equal(t, map[int]int{1: 1}, aliases[defaultAlias].Weights)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/functions/alpha/aliases/default", "admin", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doAdminRequest(r, http.MethodDelete, "/admin/functions/alpha/aliases/canary", "admin", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doAdminRequest(r, http.MethodDelete, "/admin/functions/alpha/aliases/canary", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/functions/delta/versions", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestAdmin_Rollouts tests starting and rolling back rollouts through the admin APIs
+func TestAdmin_Rollouts(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	defer d.rolloutMgr.Stop()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+	_, err := d.versionMgr.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+
+	w := doAdminRequest(r, http.MethodGet, "/admin/functions/alpha/rollout", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	body := `{"to_version": 2, "steps": [10, 100], "step_duration": "1h"}`
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/rollout", "admin", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/rollout", "admin", body)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/functions/alpha/rollout", "admin", "")
+	var status RolloutStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, RolloutRunning, status.State)
+	assert.Equal(t, 10, status.Percent)
+
+	w = doAdminRequest(r, http.MethodDelete, "/admin/functions/alpha/rollout", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doAdminRequest(r, http.MethodDelete, "/admin/functions/alpha/rollout", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/rollouts", "admin", "")
+	var rollouts []RolloutStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rollouts))
+	assert.Len(t, rollouts, 1)
+	assert.Equal(t, RolloutRolledBack, rollouts[0].State)
+	aliases, _ := d.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{1: 1}, aliases[defaultAlias].Weights)
+}
+
+// TestAdmin_ColdStarts tests getting the breakdowns of recent cold starts
+func TestAdmin_ColdStarts(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodGet, "/admin/cold_starts/alpha", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doAdminRequest(r, http.MethodGet, "/admin/cold_starts/delta", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	d.coldStartTracker.record("alpha", ColdStartBreakdown{Instance: "alpha-0", Load: Duration(time.Second)})
+	w = doAdminRequest(r, http.MethodGet, "/admin/cold_starts/alpha", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var summary ColdStartSummary
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, 1, summary.Count)
+	assert.Equal(t, Duration(time.Second), summary.Mean[phaseLoad])
+	assert.Equal(t, "alpha-0", summary.Recent[0].Instance)
+
+	w = doAdminRequest(r, http.MethodGet, "/admin/cold_starts", "admin", "")
+	var summaries map[string]ColdStartSummary
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summaries))
+	assert.Contains(t, summaries, "alpha")
+}
@@ -1,8 +1,9 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -16,66 +17,191 @@ import (
 //   FinishAPICall(ctx APIContext) error
 // }
 
+var (
+	// Returned by StartAPICall when no slot became available within the wait timeout.
+	ErrAPILimitReached = errors.New("API concurrency limit reached")
+
+	// Returned by StartAPICall when the API's limit is 0, i.e., the API is not accepting calls at all.
+	ErrAPIDisabled = errors.New("API is not accepting calls")
+)
+
+// The concurrency state of one API.
+type apiLimiter struct {
+	// The number of calls currently holding a slot.
+	inflight int64
+
+	// Closed and replaced whenever a slot is released or the limit changes, so that waiting callers wake up and
+	// re-check. This allows the limit to be resized while callers are waiting, which a buffered channel semaphore
+	// cannot do.
+	changed chan struct{}
+}
+
+// APILimitMgr limits the number of concurrent calls of each API.
+// The limit can be changed at any time, and applies to calls already waiting for a slot.
 type APILimitMgr struct {
-	limit      int64
-	callCount  map[string]*int64
-	semaphores map[string]chan struct{}
-	mu         sync.Mutex
+	mu sync.Mutex
+
+	// Applies to APIs without a per-API limit.
+	// Protected by mu.
+	defaultLimit int64
+
+	// Per-API limits that override defaultLimit.
+	// Protected by mu.
+	apiLimits map[string]int64
+
+	// Protected by mu.
+	limiters map[string]*apiLimiter
 }
 
 func NewAPILimitMgr(limit int64) APILimitMgr {
 	return APILimitMgr{
-		limit:      limit,
-		callCount:  make(map[string]*int64),
-		semaphores: make(map[string]chan struct{}),
+		defaultLimit: limit,
+		apiLimits:    make(map[string]int64),
+		limiters:     make(map[string]*apiLimiter),
 	}
 }
 
-func (m *APILimitMgr) StartAPICall(api string, timeout time.Duration) bool {
-	var semaphore chan struct{}
+// Must be called with mu held.
+func (m *APILimitMgr) limiterLocked(api string) *apiLimiter {
+	l, ok := m.limiters[api]
+	if !ok {
+		l = &apiLimiter{changed: make(chan struct{})}
+		m.limiters[api] = l
+	}
+	return l
+}
 
-	m.mu.Lock()
-	if _, exists := m.semaphores[api]; !exists {
-		m.semaphores[api] = make(chan struct{}, m.limit)
-		var count int64
-		m.callCount[api] = &count
+// Must be called with mu held.
+func (m *APILimitMgr) limitLocked(api string) int64 {
+	if limit, ok := m.apiLimits[api]; ok {
+		return limit
 	}
-	semaphore = m.semaphores[api]
-	m.mu.Unlock()
-
-	select {
-	case semaphore <- struct{}{}:
-		atomic.AddInt64(m.callCount[api], 1)
-		return true
-	case <-time.After(timeout):
-		return false
+	return m.defaultLimit
+}
+
+// Wakes up all callers waiting on l. Must be called with mu held.
+func (l *apiLimiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// StartAPICall acquires a concurrency slot for api, waiting up to timeout for one to become available.
+// A non-positive timeout waits until ctx is done.
+//
+// Returns nil on success, and the caller must call FinishAPICall afterwards. Returns ErrAPIDisabled if the limit of api
+// is 0, ErrAPILimitReached if timed out, or ctx.Err() if ctx is done before acquiring a slot.
+func (m *APILimitMgr) StartAPICall(ctx context.Context, api string, timeout time.Duration) error {
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	for {
+		m.mu.Lock()
+		limit := m.limitLocked(api)
+		if limit <= 0 {
+			m.mu.Unlock()
+			return ErrAPIDisabled
+		}
+		l := m.limiterLocked(api)
+		if l.inflight < limit {
+			l.inflight++
+			m.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeoutChan:
+			return ErrAPILimitReached
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
+// FinishAPICall releases the slot acquired by a successful StartAPICall.
+// Calling it without a matching StartAPICall is a no-op.
 func (m *APILimitMgr) FinishAPICall(api string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, exists := m.semaphores[api]; exists {
-		select {
-		case <-m.semaphores[api]:
-			atomic.AddInt64(m.callCount[api], -1)
-		default:
-			panic("This should never happen if calls are correctly paired")
-		}
+
+	l, ok := m.limiters[api]
+	if !ok || l.inflight == 0 {
+		return
 	}
+	l.inflight--
+	l.notifyLocked()
 }
 
 func (m *APILimitMgr) GetConcurrentCallCount(api string) int64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if count, exists := m.callCount[api]; exists {
-		return atomic.LoadInt64(count)
+	if l, ok := m.limiters[api]; ok {
+		return l.inflight
 	}
 	return 0
 }
 
+// SetLimit sets the default limit, which applies to all APIs without a per-API limit.
+// Lowering the limit does not interrupt calls in progress; new calls wait until the in-flight count drops below it.
 func (m *APILimitMgr) SetLimit(limit int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.limit = limit
+	m.defaultLimit = limit
+	for _, l := range m.limiters {
+		l.notifyLocked()
+	}
+}
+
+// SetAPILimit sets the limit of api, overriding the default limit.
+func (m *APILimitMgr) SetAPILimit(api string, limit int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiLimits[api] = limit
+	m.limiterLocked(api).notifyLocked()
+}
+
+// ResetAPILimit removes the per-API limit of api, so that the default limit applies again.
+func (m *APILimitMgr) ResetAPILimit(api string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.apiLimits, api)
+	m.limiterLocked(api).notifyLocked()
+}
+
+// GetLimit returns the limit in effect for api.
+func (m *APILimitMgr) GetLimit(api string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limitLocked(api)
+}
+
+// A point-in-time view of the limits and in-flight calls.
+type APILimitSnapshot struct {
+	DefaultLimit int64            `json:"default_limit"`
+	Limits       map[string]int64 `json:"limits"`
+	Inflight     map[string]int64 `json:"inflight"`
+}
+
+func (m *APILimitMgr) Snapshot() APILimitSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := APILimitSnapshot{
+		DefaultLimit: m.defaultLimit,
+		Limits:       make(map[string]int64),
+		Inflight:     make(map[string]int64),
+	}
+	for api, limit := range m.apiLimits {
+		s.Limits[api] = limit
+	}
+	for api, l := range m.limiters {
+		s.Inflight[api] = l.inflight
+	}
+	return s
 }
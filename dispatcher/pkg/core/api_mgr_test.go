@@ -1,6 +1,8 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -12,17 +14,18 @@ func TestStartAPICall(t *testing.T) {
 	manager := NewAPILimitMgr(limit)
 
 	api := "exampleAPI"
-	if !manager.StartAPICall(api, 1*time.Second) {
-		t.Fatalf("Expected StartAPICall to succeed, got failure")
+	ctx := context.Background()
+	if err := manager.StartAPICall(ctx, api, 1*time.Second); err != nil {
+		t.Fatalf("Expected StartAPICall to succeed, got %v", err)
 	}
 	if manager.GetConcurrentCallCount(api) != 1 {
 		t.Fatalf("Expected concurrent call count to be 1, got %d", manager.GetConcurrentCallCount(api))
 	}
 
-	manager.StartAPICall(api, 1*time.Second)
-	manager.StartAPICall(api, 1*time.Second)
-	if manager.StartAPICall(api, 1*time.Second) {
-		t.Fatalf("Expected StartAPICall to fail when limit is reached, got success")
+	manager.StartAPICall(ctx, api, 1*time.Second)
+	manager.StartAPICall(ctx, api, 1*time.Second)
+	if err := manager.StartAPICall(ctx, api, 100*time.Millisecond); !errors.Is(err, ErrAPILimitReached) {
+		t.Fatalf("Expected StartAPICall to fail with ErrAPILimitReached when limit is reached, got %v", err)
 	}
 	if manager.GetConcurrentCallCount(api) != 3 {
 		t.Fatalf("Expected concurrent call count to be 3, got %d", manager.GetConcurrentCallCount(api))
@@ -35,8 +38,9 @@ func TestFinishAPICall(t *testing.T) {
 	manager := NewAPILimitMgr(limit)
 
 	api := "exampleAPI"
-	manager.StartAPICall(api, 1*time.Second)
-	manager.StartAPICall(api, 1*time.Second)
+	ctx := context.Background()
+	manager.StartAPICall(ctx, api, 1*time.Second)
+	manager.StartAPICall(ctx, api, 1*time.Second)
 
 	manager.FinishAPICall(api)
 	if manager.GetConcurrentCallCount(api) != 1 {
@@ -47,6 +51,13 @@ func TestFinishAPICall(t *testing.T) {
 	if manager.GetConcurrentCallCount(api) != 0 {
 		t.Fatalf("Expected concurrent call count to be 0 after finishing all calls, got %d", manager.GetConcurrentCallCount(api))
 	}
+
+	// Unpaired calls must not panic or drive the count negative.
+	manager.FinishAPICall(api)
+	manager.FinishAPICall("unknownAPI")
+	if manager.GetConcurrentCallCount(api) != 0 {
+		t.Fatalf("Expected concurrent call count to stay 0 after unpaired finish, got %d", manager.GetConcurrentCallCount(api))
+	}
 }
 
 // TestConcurrentCalls tests concurrent API calls
@@ -60,7 +71,7 @@ func TestConcurrentCalls(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if manager.StartAPICall(api, 1*time.Second) {
+			if manager.StartAPICall(context.Background(), api, 1*time.Second) == nil {
 				time.Sleep(100 * time.Millisecond) // Simulate API call duration
 				manager.FinishAPICall(api)
 			}
@@ -79,16 +90,17 @@ func TestStartAPICallTimeout(t *testing.T) {
 	manager := NewAPILimitMgr(limit)
 
 	api := "exampleAPI"
-	if !manager.StartAPICall(api, 1*time.Second) {
-		t.Fatalf("Expected StartAPICall to succeed, got failure")
+	ctx := context.Background()
+	if err := manager.StartAPICall(ctx, api, 1*time.Second); err != nil {
+		t.Fatalf("Expected StartAPICall to succeed, got %v", err)
 	}
 	if manager.GetConcurrentCallCount(api) != 1 {
 		t.Fatalf("Expected concurrent call count to be 1, got %d", manager.GetConcurrentCallCount(api))
 	}
 
 	// Attempt to start another call with a short timeout
-	if manager.StartAPICall(api, 100*time.Millisecond) {
-		t.Fatalf("Expected StartAPICall to fail due to timeout, got success")
+	if err := manager.StartAPICall(ctx, api, 100*time.Millisecond); !errors.Is(err, ErrAPILimitReached) {
+		t.Fatalf("Expected StartAPICall to fail due to timeout, got %v", err)
 	}
 	if manager.GetConcurrentCallCount(api) != 1 {
 		t.Fatalf("Expected concurrent call count to still be 1, got %d", manager.GetConcurrentCallCount(api))
@@ -99,3 +111,70 @@ func TestStartAPICallTimeout(t *testing.T) {
 		t.Fatalf("Expected concurrent call count to be 0 after finishing the call, got %d", manager.GetConcurrentCallCount(api))
 	}
 }
+
+// TestStartAPICallContextCanceled tests that a waiting call returns when its context is canceled
+func TestStartAPICallContextCanceled(t *testing.T) {
+	manager := NewAPILimitMgr(1)
+
+	api := "exampleAPI"
+	manager.StartAPICall(context.Background(), api, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if err := manager.StartAPICall(ctx, api, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected StartAPICall to fail with context.Canceled, got %v", err)
+	}
+	if manager.GetConcurrentCallCount(api) != 1 {
+		t.Fatalf("Expected concurrent call count to still be 1, got %d", manager.GetConcurrentCallCount(api))
+	}
+}
+
+// TestSetLimitWakesWaiters tests that raising the limit admits calls that are already waiting
+func TestSetLimitWakesWaiters(t *testing.T) {
+	manager := NewAPILimitMgr(1)
+
+	api := "exampleAPI"
+	manager.StartAPICall(context.Background(), api, time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- manager.StartAPICall(context.Background(), api, time.Second)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	manager.SetLimit(2)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Expected waiting call to succeed after raising the limit, got %v", err)
+	}
+	if manager.GetConcurrentCallCount(api) != 2 {
+		t.Fatalf("Expected concurrent call count to be 2, got %d", manager.GetConcurrentCallCount(api))
+	}
+}
+
+// TestSetAPILimit tests per-API limits overriding the default limit
+func TestSetAPILimit(t *testing.T) {
+	manager := NewAPILimitMgr(3)
+	ctx := context.Background()
+
+	manager.SetAPILimit("disabled", 0)
+	if err := manager.StartAPICall(ctx, "disabled", time.Second); !errors.Is(err, ErrAPIDisabled) {
+		t.Fatalf("Expected ErrAPIDisabled, got %v", err)
+	}
+
+	manager.SetAPILimit("small", 1)
+	if manager.GetLimit("small") != 1 || manager.GetLimit("other") != 3 {
+		t.Fatalf("Expected limits 1 and 3, got %d and %d", manager.GetLimit("small"), manager.GetLimit("other"))
+	}
+	manager.StartAPICall(ctx, "small", time.Second)
+	if err := manager.StartAPICall(ctx, "small", 50*time.Millisecond); !errors.Is(err, ErrAPILimitReached) {
+		t.Fatalf("Expected ErrAPILimitReached, got %v", err)
+	}
+
+	manager.ResetAPILimit("small")
+	if err := manager.StartAPICall(ctx, "small", 50*time.Millisecond); err != nil {
+		t.Fatalf("Expected StartAPICall to succeed after resetting the limit, got %v", err)
+	}
+}
@@ -1,16 +1,118 @@
 package core
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
+// OverheadPolicy determines who pays for the time instances spend starting up and idling, i.e., the time not spent
+// on serving any invocation.
+type OverheadPolicy string
+
+const (
+	// Attributes the overhead to the user whose invocation triggered the cold start. Instances launched by the
+	// launcher on its own, e.g., when the utilization ratio is high, are attributed proportionally instead.
+	OverheadPolicyTrigger OverheadPolicy = "trigger"
+
+	// Splits the overhead among users served by the instance, in proportion to their execution time on it.
+	OverheadPolicyProportional OverheadPolicy = "proportional"
+
+	// Attributes the overhead to PlatformUser, i.e., the platform absorbs it.
+	OverheadPolicyPlatform OverheadPolicy = "platform"
+)
+
+// The pseudo user absorbing the overhead that is not attributed to any user.
+const PlatformUser = "@platform"
+
+func ParseOverheadPolicy(s string) (OverheadPolicy, error) {
+	switch p := OverheadPolicy(s); p {
+	case OverheadPolicyTrigger, OverheadPolicyProportional, OverheadPolicyPlatform:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid overhead policy %s, must be trigger, proportional or platform", s)
+}
+
+// InstanceUsage tracks the lifecycle of a RunningContainer.
+type InstanceUsage struct {
+	Fn       string `json:"fn"`
+	Instance string `json:"instance"`
+
+	// The user whose invocation triggered launching the instance, empty if launched by the launcher on its own.
+	TriggerUser string `json:"trigger_user"`
+
+	LaunchTime time.Time `json:"launch_time"`
+	// Zero if the instance never became ready.
+	ReadyTime time.Time `json:"ready_time"`
+	// Zero if the instance is still running.
+	StopTime time.Time `json:"stop_time"`
+
+	// The execution time of invocations served by the instance, by user.
+	UserExecTime map[string]time.Duration `json:"user_exec_time"`
+
+	// Used to get ReadyTime, which is recorded by the RunningContainer itself.
+	rc *RunningContainer
+}
+
+// The time from launch to ready, or to now if the instance is not yet ready.
+func (u *InstanceUsage) StartupTime(now time.Time) time.Duration {
+	if !u.ReadyTime.IsZero() {
+		return u.ReadyTime.Sub(u.LaunchTime)
+	}
+	return u.RunningTime(now)
+}
+
+// The time from launch to stop, or to now if the instance is still running.
+func (u *InstanceUsage) RunningTime(now time.Time) time.Duration {
+	if !u.StopTime.IsZero() {
+		now = u.StopTime
+	}
+	return now.Sub(u.LaunchTime)
+}
+
+func (u *InstanceUsage) BusyTime() time.Duration {
+	var busy time.Duration
+	for _, d := range u.UserExecTime {
+		busy += d
+	}
+	return busy
+}
+
+// The time the instance was ready but not serving any invocation. Concurrent invocations are counted separately in
+// BusyTime, so this is an approximation that never goes below 0.
+func (u *InstanceUsage) IdleTime(now time.Time) time.Duration {
+	idle := u.RunningTime(now) - u.StartupTime(now) - u.BusyTime()
+	if idle < 0 {
+		return 0
+	}
+	return idle
+}
+
+// UserUsage breaks down the time attributed to a user. ExecTime is the time spent serving the user's invocations,
+// which is reported separately from the overhead attributed to the user by the OverheadPolicy.
+type UserUsage struct {
+	Count       int           `json:"count"`
+	ExecTime    time.Duration `json:"exec_time"`
+	StartupTime time.Duration `json:"startup_time"`
+	IdleTime    time.Duration `json:"idle_time"`
+}
+
 // APIUsageTracker tracks the running time of APIs called by different users.
+// It also tracks the lifecycle of instances, and attributes their startup and idle time to users by an
+// OverheadPolicy.
 type APIUsageTracker struct {
 	mu     sync.Mutex
 	timing map[string]time.Duration
 	count  map[string]int
 
+	// Protected by mu.
+	overheadPolicy OverheadPolicy
+
+	// Map from instance name to its usage, retained after the instance stops.
+	// Protected by mu.
+	instUsages map[string]*InstanceUsage
+
 	// TODO/Req: Add tracking of the number of concurrent API calls for each instance.
 	// The goal is to track each RunningContainer's backup calls. Use map[string]*int64, the key is containerID, value is
 	// the busy time (aka. the actual time used for serving function requests), the busy-time/running-time is the
@@ -29,8 +131,10 @@ type APIUsageTracker struct {
 // NewAPIUsageTracker initializes a new APIUsageTracker.
 func NewAPIUsageTracker() APIUsageTracker {
 	return APIUsageTracker{
-		timing: make(map[string]time.Duration),
-		count:  make(map[string]int),
+		timing:         make(map[string]time.Duration),
+		count:          make(map[string]int),
+		overheadPolicy: OverheadPolicyTrigger,
+		instUsages:     make(map[string]*InstanceUsage),
 	}
 }
 
@@ -56,3 +160,164 @@ func (tracker *APIUsageTracker) GetTotalTime(user string) time.Duration {
 
 	return tracker.timing[user]
 }
+
+func (tracker *APIUsageTracker) SetOverheadPolicy(p OverheadPolicy) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.overheadPolicy = p
+}
+
+// Must be called with mu held.
+func (tracker *APIUsageTracker) instUsageLocked(fn, inst string) *InstanceUsage {
+	u, ok := tracker.instUsages[inst]
+	if !ok {
+		u = &InstanceUsage{
+			Fn:           fn,
+			Instance:     inst,
+			UserExecTime: make(map[string]time.Duration),
+		}
+		tracker.instUsages[inst] = u
+	}
+	return u
+}
+
+// EndInstanceAPICall is EndAPICall for an invocation served by rc, which is also attributed to rc.
+func (tracker *APIUsageTracker) EndInstanceAPICall(user string, rc *RunningContainer, startTime time.Time) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	duration := time.Since(startTime)
+	tracker.timing[user] += duration
+	tracker.count[user]++
+	u := tracker.instUsageLocked(rc.fn, rc.name)
+	u.UserExecTime[user] += duration
+}
+
+// InstLaunched implements InstLifecycleListener.
+func (tracker *APIUsageTracker) InstLaunched(rc *RunningContainer) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	u := tracker.instUsageLocked(rc.fn, rc.name)
+	u.TriggerUser = rc.triggerUser
+	u.LaunchTime = rc.launchTime
+	u.rc = rc
+}
+
+// InstStopped implements InstLifecycleListener.
+func (tracker *APIUsageTracker) InstStopped(rc *RunningContainer) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	u := tracker.instUsageLocked(rc.fn, rc.name)
+	u.rc = rc
+	tracker.refreshReadyTimeLocked()
+	u.StopTime = time.Now()
+}
+
+// Fills in the ready time of instances that became ready since last time.
+// Must be called with mu held.
+func (tracker *APIUsageTracker) refreshReadyTimeLocked() {
+	for _, u := range tracker.instUsages {
+		if !u.ReadyTime.IsZero() || u.rc == nil {
+			continue
+		}
+		if rdyTime, ok := u.rc.ReadyTime(); ok {
+			u.ReadyTime = rdyTime
+		}
+	}
+}
+
+// Splits d among users in proportion to weights, and adds the shares to res. Adds d to PlatformUser if weights sum
+// up to 0.
+func splitOverhead(res map[string]*UserUsage, weights map[string]time.Duration, d time.Duration,
+	add func(u *UserUsage, d time.Duration)) {
+	var total time.Duration
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		add(userUsage(res, PlatformUser), d)
+		return
+	}
+	for user, w := range weights {
+		add(userUsage(res, user), time.Duration(float64(d)*float64(w)/float64(total)))
+	}
+}
+
+func userUsage(res map[string]*UserUsage, user string) *UserUsage {
+	u, ok := res[user]
+	if !ok {
+		u = &UserUsage{}
+		res[user] = u
+	}
+	return u
+}
+
+// GetAllUsage returns the usage of all users, including PlatformUser, with the startup and idle time of instances
+// attributed by the OverheadPolicy up to now.
+func (tracker *APIUsageTracker) GetAllUsage() map[string]UserUsage {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.refreshReadyTimeLocked()
+	now := time.Now()
+	res := make(map[string]*UserUsage)
+	for user, d := range tracker.timing {
+		u := userUsage(res, user)
+		u.ExecTime = d
+		u.Count = tracker.count[user]
+	}
+
+	addStartup := func(u *UserUsage, d time.Duration) { u.StartupTime += d }
+	addIdle := func(u *UserUsage, d time.Duration) { u.IdleTime += d }
+	for _, inst := range tracker.instUsages {
+		if inst.LaunchTime.IsZero() {
+			// Never saw the launch, e.g., launched before being tracked.
+			continue
+		}
+		var weights map[string]time.Duration
+		switch {
+		case tracker.overheadPolicy == OverheadPolicyTrigger && inst.TriggerUser != "":
+			weights = map[string]time.Duration{inst.TriggerUser: 1}
+		case tracker.overheadPolicy == OverheadPolicyPlatform:
+			weights = nil
+		default:
+			weights = inst.UserExecTime
+		}
+		splitOverhead(res, weights, inst.StartupTime(now), addStartup)
+		splitOverhead(res, weights, inst.IdleTime(now), addIdle)
+	}
+
+	usage := make(map[string]UserUsage, len(res))
+	for user, u := range res {
+		usage[user] = *u
+	}
+	return usage
+}
+
+// GetUsage returns the usage of user, see GetAllUsage.
+func (tracker *APIUsageTracker) GetUsage(user string) UserUsage {
+	return tracker.GetAllUsage()[user]
+}
+
+// GetInstanceUsages returns the usage of all tracked instances, ordered by launch time.
+func (tracker *APIUsageTracker) GetInstanceUsages() []InstanceUsage {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.refreshReadyTimeLocked()
+	res := make([]InstanceUsage, 0, len(tracker.instUsages))
+	for _, u := range tracker.instUsages {
+		c := *u
+		c.rc = nil
+		c.UserExecTime = make(map[string]time.Duration, len(u.UserExecTime))
+		for user, d := range u.UserExecTime {
+			c.UserExecTime[user] = d
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LaunchTime.Before(res[j].LaunchTime) })
+	return res
+}
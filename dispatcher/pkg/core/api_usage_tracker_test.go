@@ -29,3 +29,89 @@ func TestAPIUsageTracker(t *testing.T) {
 		t.Errorf("Expected call count 2, got %d", count)
 	}
 }
+
+// Returns a RunningContainer launched 10s ago, ready after 4s, with user1 and user2 having used it for 1s and 3s.
+func newTestTrackedInst(tracker *APIUsageTracker, name, triggerUser string) *RunningContainer {
+	now := time.Now()
+	rc := &RunningContainer{
+		name:        name,
+		fn:          "alpha",
+		triggerUser: triggerUser,
+		launchTime:  now.Add(-10 * time.Second),
+		isRdy:       true,
+		rdyTime:     now.Add(-6 * time.Second),
+	}
+	tracker.InstLaunched(rc)
+	tracker.EndInstanceAPICall("user1", rc, now.Add(-time.Second))
+	tracker.EndInstanceAPICall("user2", rc, now.Add(-3*time.Second))
+	tracker.InstStopped(rc)
+	return rc
+}
+
+func assertDurationNear(t *testing.T, expected, actual time.Duration) {
+	t.Helper()
+	if diff := expected - actual; diff > 50*time.Millisecond || diff < -50*time.Millisecond {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestAPIUsageTrackerInstanceUsage(t *testing.T) {
+	tracker := NewAPIUsageTracker()
+	newTestTrackedInst(&tracker, "alpha-0", "user1")
+
+	usages := tracker.GetInstanceUsages()
+	if len(usages) != 1 {
+		t.Fatalf("Expected 1 instance usage, got %d", len(usages))
+	}
+	u := usages[0]
+	now := time.Now()
+	assertDurationNear(t, 4*time.Second, u.StartupTime(now))
+	assertDurationNear(t, 10*time.Second, u.RunningTime(now))
+	assertDurationNear(t, 4*time.Second, u.BusyTime())
+	assertDurationNear(t, 2*time.Second, u.IdleTime(now))
+}
+
+func TestAPIUsageTrackerOverheadPolicy(t *testing.T) {
+	tracker := NewAPIUsageTracker()
+	newTestTrackedInst(&tracker, "alpha-0", "user1")
+
+	// Trigger policy.
+	usage := tracker.GetAllUsage()
+	assertDurationNear(t, time.Second, usage["user1"].ExecTime)
+	assertDurationNear(t, 4*time.Second, usage["user1"].StartupTime)
+	assertDurationNear(t, 2*time.Second, usage["user1"].IdleTime)
+	assertDurationNear(t, 3*time.Second, usage["user2"].ExecTime)
+	assertDurationNear(t, 0, usage["user2"].StartupTime)
+
+	tracker.SetOverheadPolicy(OverheadPolicyProportional)
+	usage = tracker.GetAllUsage()
+	assertDurationNear(t, time.Second, usage["user1"].StartupTime)
+	assertDurationNear(t, 3*time.Second, usage["user2"].StartupTime)
+	assertDurationNear(t, 1500*time.Millisecond, usage["user2"].IdleTime)
+
+	tracker.SetOverheadPolicy(OverheadPolicyPlatform)
+	usage = tracker.GetAllUsage()
+	assertDurationNear(t, 0, usage["user1"].StartupTime)
+	assertDurationNear(t, 4*time.Second, usage[PlatformUser].StartupTime)
+	assertDurationNear(t, 2*time.Second, usage[PlatformUser].IdleTime)
+	assertDurationNear(t, 0, usage[PlatformUser].ExecTime)
+}
+
+func TestAPIUsageTrackerTriggerPolicyWithoutTrigger(t *testing.T) {
+	tracker := NewAPIUsageTracker()
+	// Launched by the launcher on its own, so attributed proportionally.
+	newTestTrackedInst(&tracker, "alpha-0", "")
+
+	usage := tracker.GetAllUsage()
+	assertDurationNear(t, time.Second, usage["user1"].StartupTime)
+	assertDurationNear(t, 3*time.Second, usage["user2"].StartupTime)
+}
+
+func TestParseOverheadPolicy(t *testing.T) {
+	if p, err := ParseOverheadPolicy("platform"); err != nil || p != OverheadPolicyPlatform {
+		t.Errorf("Expected platform policy, got %v, error: %v", p, err)
+	}
+	if _, err := ParseOverheadPolicy("nobody"); err == nil {
+		t.Errorf("Expected error for invalid policy")
+	}
+}
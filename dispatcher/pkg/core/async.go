@@ -0,0 +1,918 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// AsyncStatus is the status of an asynchronous invocation.
+type AsyncStatus string
+
+const (
+	AsyncQueued    AsyncStatus = "queued"
+	AsyncRunning   AsyncStatus = "running"
+	AsyncSucceeded AsyncStatus = "succeeded"
+	AsyncFailed    AsyncStatus = "failed"
+	AsyncCanceled  AsyncStatus = "canceled"
+	// Failed in the runtime or timed out after all retries, see AsyncRetryPolicy. Kept until replayed or purged.
+	AsyncDeadLetter AsyncStatus = "dead_letter"
+)
+
+func (s AsyncStatus) finished() bool {
+	return s == AsyncSucceeded || s == AsyncFailed || s == AsyncCanceled || s == AsyncDeadLetter
+}
+
+const (
+	// The request and response bodies of asynchronous invocations are limited to this size.
+	maxAsyncBodyBytes = 6 << 20
+
+	// Asynchronous invocations wait for their functions' instances and concurrency limits longer than synchronous
+	// ones, as no client is holding a connection.
+	asyncInstRdyTimeout   = time.Minute
+	asyncLimitWaitTimeout = 10 * time.Minute
+
+	// How often finished invocations are checked for expiring.
+	asyncPurgeInterval = time.Minute
+)
+
+var (
+	ErrAsyncNotFound      = errors.New("invocation not found")
+	ErrAsyncFinished      = errors.New("invocation already finished")
+	ErrAsyncNotDeadLetter = errors.New("invocation is not a dead letter")
+)
+
+// AsyncRetryPolicy determines how the asynchronous invocations of a function are retried, when they fail in the
+// runtime or time out. Invocations still failing after all retries become dead letters.
+type AsyncRetryPolicy struct {
+	// Retries at most MaxRetries times, waiting exponentially longer between retries, from InitialBackoff up to
+	// MaxBackoff. 0 disables retrying.
+	MaxRetries     int      `json:"max_retries"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+}
+
+func DefaultAsyncRetryPolicy() AsyncRetryPolicy {
+	return AsyncRetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: Duration(time.Second),
+		MaxBackoff:     Duration(time.Minute),
+	}
+}
+
+func (p AsyncRetryPolicy) Validate() error {
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must be non-negative")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("backoffs must satisfy 0 <= initial_backoff <= max_backoff")
+	}
+	return nil
+}
+
+// AsyncInvocation describes an asynchronous invocation and its outcome.
+type AsyncInvocation struct {
+	ID     string      `json:"id"`
+	Fn     string      `json:"fn"`
+	User   string      `json:"user"`
+	Status AsyncStatus `json:"status"`
+
+	CreatedTime time.Time `json:"created_time"`
+	// Zero until the invocation is dispatched. Updated by each attempt.
+	StartedTime time.Time `json:"started_time"`
+	// The attempts of dispatching the invocation so far.
+	Attempts int `json:"attempts"`
+	// When a queued invocation is retried, zero if it's dispatched as soon as a worker is free.
+	NextAttemptTime time.Time `json:"next_attempt_time"`
+	// Zero until the invocation is finished.
+	FinishedTime time.Time `json:"finished_time"`
+
+	// The HTTP status the function responded with, 0 if not finished.
+	ResultStatus int `json:"result_status,omitempty"`
+
+	// Why the invocation failed or was canceled.
+	Error string `json:"error,omitempty"`
+
+	// The URL the result is POSTed to once finished, see WebhookMgr.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// AsyncRequest is a request of queuing an invocation.
+type AsyncRequest struct {
+	Fn string
+	// The user the invocation runs on behalf of.
+	User        string
+	ContentType string
+	Payload     []byte
+	// Optional.
+	CallbackURL string
+}
+
+// AsyncRecord is the persisted state of an asynchronous invocation, including its payload and result.
+type AsyncRecord struct {
+	AsyncInvocation
+
+	ContentType string `json:"content_type,omitempty"`
+	Payload     []byte `json:"payload,omitempty"`
+
+	ResultContentType string `json:"result_content_type,omitempty"`
+	Result            []byte `json:"result,omitempty"`
+}
+
+// AsyncConfig configures asynchronous invocations.
+type AsyncConfig struct {
+	// The directory persisting invocations, so that they survive restarts. Invocations are kept in memory only if
+	// empty.
+	Dir string
+
+	// The number of invocations dispatched concurrently.
+	Workers int
+
+	// How long the results of finished invocations are kept.
+	Retention time.Duration
+
+	// Configures the callbacks delivering results.
+	Webhook WebhookConfig
+}
+
+// The state of a running invocation.
+type runningAsync struct {
+	cancel context.CancelFunc
+	// True if canceled by the user, rather than interrupted by stopping AsyncMgr.
+	canceled bool
+}
+
+// AsyncMgr queues asynchronous invocations, and dispatches them by a pool of workers.
+type AsyncMgr struct {
+	cfg AsyncConfig
+
+	// Dispatches an invocation, i.e., Dispatcher.Dispatch.
+	dispatch func(ctx CallContext, w http.ResponseWriter, r *http.Request)
+
+	// Called after an invocation is finished, without holding mu.
+	onFinished func(inv AsyncInvocation)
+
+	// Called after a failed invocation is scheduled for retrying, without holding mu.
+	onRetry func(inv AsyncInvocation)
+
+	mu sync.Mutex
+	// Signaled when invocations are queued, or when stopping.
+	cond *sync.Cond
+	// Protected by mu.
+	records map[string]*AsyncRecord
+	// The IDs of queued invocations, in the order of dispatching. Invocations waiting for their NextAttemptTime are
+	// added once it's reached.
+	// Protected by mu.
+	queue []string
+	// Protected by mu.
+	policies map[string]AsyncRetryPolicy
+	// Protected by mu.
+	running map[string]*runningAsync
+	// Protected by mu.
+	stopped bool
+
+	workers     sync.WaitGroup
+	stopJanitor chan struct{}
+}
+
+// NewAsyncMgr creates an AsyncMgr, loading the invocations persisted in cfg.Dir. Invocations not finished before are
+// queued again.
+func NewAsyncMgr(cfg AsyncConfig, dispatch func(CallContext, http.ResponseWriter, *http.Request)) (*AsyncMgr, error) {
+	m := &AsyncMgr{
+		cfg:         cfg,
+		dispatch:    dispatch,
+		onFinished:  func(AsyncInvocation) {},
+		onRetry:     func(AsyncInvocation) {},
+		records:     make(map[string]*AsyncRecord),
+		policies:    make(map[string]AsyncRetryPolicy),
+		running:     make(map[string]*runningAsync),
+		stopJanitor: make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	if cfg.Dir == "" {
+		return m, nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create directory %s, error: %v", cfg.Dir, err)
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var queued []*AsyncRecord
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read invocation %s, error: %v", path, err)
+		}
+		var rec AsyncRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("Could not parse invocation %s, error: %v", path, err)
+		}
+		m.records[rec.ID] = &rec
+		if !rec.Status.finished() {
+			rec.Status = AsyncQueued
+			queued = append(queued, &rec)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].CreatedTime.Before(queued[j].CreatedTime) })
+	for _, rec := range queued {
+		m.enqueueLocked(rec)
+	}
+	slog.Info("Loaded async invocations", "dir", cfg.Dir, "invocations", len(m.records), "queued", len(queued))
+	return m, nil
+}
+
+// Start starts the workers, and purging expired invocations.
+func (m *AsyncMgr) Start() {
+	for i := 0; i < max(m.cfg.Workers, 1); i++ {
+		m.workers.Add(1)
+		go m.work()
+	}
+	go func() {
+		ticker := time.NewTicker(asyncPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.purgeExpired(time.Now())
+			case <-m.stopJanitor:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the workers. Running invocations are interrupted, and queued again when AsyncMgr is created next time.
+func (m *AsyncMgr) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	for _, r := range m.running {
+		r.cancel()
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	m.workers.Wait()
+	close(m.stopJanitor)
+}
+
+// Writes rec to its file. Must be called with mu held.
+func (m *AsyncMgr) persistLocked(rec *AsyncRecord) error {
+	if m.cfg.Dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.cfg.Dir, rec.ID+".json"), b)
+}
+
+// Persists rec, logging failures instead of returning them. Must be called with mu held.
+func (m *AsyncMgr) mustPersistLocked(rec *AsyncRecord) {
+	if err := m.persistLocked(rec); err != nil {
+		slog.Error("Failed to persist async invocation", "id", rec.ID, "error", err)
+	}
+}
+
+// Submit queues an invocation, with req.Payload as the request body.
+func (m *AsyncMgr) Submit(req AsyncRequest) (AsyncInvocation, error) {
+	rec := &AsyncRecord{
+		AsyncInvocation: AsyncInvocation{
+			ID:          newRequestID(),
+			Fn:          req.Fn,
+			User:        req.User,
+			Status:      AsyncQueued,
+			CreatedTime: time.Now(),
+			CallbackURL: req.CallbackURL,
+		},
+		ContentType: req.ContentType,
+		Payload:     req.Payload,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.persistLocked(rec); err != nil {
+		return AsyncInvocation{}, fmt.Errorf("Could not persist invocation, error: %v", err)
+	}
+	m.records[rec.ID] = rec
+	m.enqueueLocked(rec)
+	return rec.AsyncInvocation, nil
+}
+
+// Queues rec for dispatching, once its NextAttemptTime is reached. Must be called with mu held.
+func (m *AsyncMgr) enqueueLocked(rec *AsyncRecord) {
+	delay := time.Until(rec.NextAttemptTime)
+	if delay <= 0 {
+		m.queue = append(m.queue, rec.ID)
+		m.cond.Signal()
+		return
+	}
+	time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// Skips if canceled or purged meanwhile.
+		if m.records[rec.ID] == rec && rec.Status == AsyncQueued && !slices.Contains(m.queue, rec.ID) {
+			m.queue = append(m.queue, rec.ID)
+			m.cond.Signal()
+		}
+	})
+}
+
+func (m *AsyncMgr) Get(id string) (AsyncInvocation, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[id]
+	if !ok {
+		return AsyncInvocation{}, false
+	}
+	return rec.AsyncInvocation, true
+}
+
+// Result returns the invocation, and the content type and body of the function's response.
+func (m *AsyncMgr) Result(id string) (AsyncInvocation, string, []byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[id]
+	if !ok {
+		return AsyncInvocation{}, "", nil, false
+	}
+	return rec.AsyncInvocation, rec.ResultContentType, rec.Result, true
+}
+
+// Cancel cancels a queued or running invocation.
+func (m *AsyncMgr) Cancel(id string) (AsyncInvocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.records[id]
+	if !ok {
+		return AsyncInvocation{}, ErrAsyncNotFound
+	}
+	switch rec.Status {
+	case AsyncQueued:
+		m.queue = slices.DeleteFunc(m.queue, func(queued string) bool { return queued == id })
+		rec.Status = AsyncCanceled
+		rec.Error = "canceled by user"
+		rec.FinishedTime = time.Now()
+		m.mustPersistLocked(rec)
+		inv := rec.AsyncInvocation
+		go m.onFinished(inv)
+		return inv, nil
+	case AsyncRunning:
+		// The worker records the cancellation once the dispatching returns.
+		r := m.running[id]
+		r.canceled = true
+		r.cancel()
+		return rec.AsyncInvocation, nil
+	}
+	return rec.AsyncInvocation, ErrAsyncFinished
+}
+
+// QueueDepths returns the number of queued invocations by function.
+func (m *AsyncMgr) QueueDepths() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]int)
+	for _, id := range m.queue {
+		res[m.records[id].Fn]++
+	}
+	return res
+}
+
+// Removes the invocations finished for longer than the retention, except dead letters.
+func (m *AsyncMgr) purgeExpired(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, rec := range m.records {
+		if rec.Status.finished() && rec.Status != AsyncDeadLetter && now.Sub(rec.FinishedTime) >= m.cfg.Retention {
+			m.removeLocked(id)
+		}
+	}
+}
+
+// Removes invocation id, and its file. Must be called with mu held.
+func (m *AsyncMgr) removeLocked(id string) {
+	delete(m.records, id)
+	if m.cfg.Dir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(m.cfg.Dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove async invocation", "id", id, "error", err)
+	}
+}
+
+// SetRetryPolicy sets the retry policy of function fn, overriding DefaultAsyncRetryPolicy.
+func (m *AsyncMgr) SetRetryPolicy(fn string, p AsyncRetryPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[fn] = p
+	return nil
+}
+
+// ResetRetryPolicy removes the retry policy of function fn, so DefaultAsyncRetryPolicy applies.
+func (m *AsyncMgr) ResetRetryPolicy(fn string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.policies, fn)
+}
+
+// RetryPolicies returns the retry policies set by function.
+func (m *AsyncMgr) RetryPolicies() map[string]AsyncRetryPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]AsyncRetryPolicy, len(m.policies))
+	for fn, p := range m.policies {
+		res[fn] = p
+	}
+	return res
+}
+
+// Must be called with mu held.
+func (m *AsyncMgr) policyLocked(fn string) AsyncRetryPolicy {
+	if p, ok := m.policies[fn]; ok {
+		return p
+	}
+	return DefaultAsyncRetryPolicy()
+}
+
+// DeadLetters returns the dead letters of function fn, or of all functions if fn is empty, the oldest first.
+func (m *AsyncMgr) DeadLetters(fn string) []AsyncInvocation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []AsyncInvocation{}
+	for _, rec := range m.records {
+		if rec.Status == AsyncDeadLetter && (fn == "" || rec.Fn == fn) {
+			res = append(res, rec.AsyncInvocation)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].FinishedTime.Before(res[j].FinishedTime) })
+	return res
+}
+
+// DeadLetter returns the dead letter id, including its payload and the result of its last attempt.
+func (m *AsyncMgr) DeadLetter(id string) (AsyncRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, err := m.deadLetterLocked(id)
+	if err != nil {
+		return AsyncRecord{}, err
+	}
+	return *rec, nil
+}
+
+// Must be called with mu held.
+func (m *AsyncMgr) deadLetterLocked(id string) (*AsyncRecord, error) {
+	rec, ok := m.records[id]
+	if !ok {
+		return nil, ErrAsyncNotFound
+	}
+	if rec.Status != AsyncDeadLetter {
+		return nil, ErrAsyncNotDeadLetter
+	}
+	return rec, nil
+}
+
+// Replay queues the dead letter id again, as a new invocation with the same ID, retried per its function's policy.
+func (m *AsyncMgr) Replay(id string) (AsyncInvocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, err := m.deadLetterLocked(id)
+	if err != nil {
+		return AsyncInvocation{}, err
+	}
+	rec.Status = AsyncQueued
+	rec.Attempts = 0
+	rec.StartedTime = time.Time{}
+	rec.FinishedTime = time.Time{}
+	rec.ResultStatus = 0
+	rec.ResultContentType = ""
+	rec.Result = nil
+	rec.Error = ""
+	if err := m.persistLocked(rec); err != nil {
+		return AsyncInvocation{}, fmt.Errorf("Could not persist invocation, error: %v", err)
+	}
+	m.enqueueLocked(rec)
+	return rec.AsyncInvocation, nil
+}
+
+// PurgeDeadLetter removes the dead letter id.
+func (m *AsyncMgr) PurgeDeadLetter(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.deadLetterLocked(id); err != nil {
+		return err
+	}
+	m.removeLocked(id)
+	return nil
+}
+
+// PurgeDeadLetters removes the dead letters of function fn, or of all functions if fn is empty, and returns how many
+// were removed.
+func (m *AsyncMgr) PurgeDeadLetters(fn string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, rec := range m.records {
+		if rec.Status == AsyncDeadLetter && (fn == "" || rec.Fn == fn) {
+			m.removeLocked(id)
+			n++
+		}
+	}
+	return n
+}
+
+// Takes the next queued invocation and marks it running. Blocks until there is one. Returns false if stopped.
+func (m *AsyncMgr) next() (AsyncRecord, context.Context, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.queue) == 0 && !m.stopped {
+		m.cond.Wait()
+	}
+	if m.stopped {
+		return AsyncRecord{}, nil, false
+	}
+	id := m.queue[0]
+	m.queue = m.queue[1:]
+	rec := m.records[id]
+	rec.Status = AsyncRunning
+	rec.StartedTime = time.Now()
+	rec.Attempts++
+	rec.NextAttemptTime = time.Time{}
+	m.mustPersistLocked(rec)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.running[id] = &runningAsync{cancel: cancel}
+	return *rec, ctx, true
+}
+
+func (m *AsyncMgr) work() {
+	defer m.workers.Done()
+	for {
+		rec, ctx, ok := m.next()
+		if !ok {
+			return
+		}
+		w := m.run(ctx, rec)
+		m.finish(rec.ID, w)
+	}
+}
+
+// Dispatches the invocation rec, and returns its response.
+func (m *AsyncMgr) run(ctx context.Context, rec AsyncRecord) (w *resultRecorder) {
+	w = newResultRecorder()
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			w.aborted = true
+		}
+	}()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/functions/"+rec.Fn+"/async",
+		bytes.NewReader(rec.Payload))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return w
+	}
+	r.Header.Set("User", rec.User)
+	r.Header.Set(requestIDHeader, rec.ID)
+	if rec.ContentType != "" {
+		r.Header.Set("Content-Type", rec.ContentType)
+	}
+	m.dispatch(CallContext{
+		Fn:               rec.Fn,
+		InstRdyTimeout:   asyncInstRdyTimeout,
+		LimitWaitTimeout: asyncLimitWaitTimeout,
+	}, w, r)
+	return w
+}
+
+// Records the response w of the invocation id.
+func (m *AsyncMgr) finish(id string, w *resultRecorder) {
+	m.mu.Lock()
+	running := m.running[id]
+	delete(m.running, id)
+	rec := m.records[id]
+	running.cancel()
+
+	if m.stopped && !running.canceled {
+		// Interrupted, dispatches it again after restarting.
+		rec.Status = AsyncQueued
+		rec.StartedTime = time.Time{}
+		rec.Attempts--
+		m.mustPersistLocked(rec)
+		m.mu.Unlock()
+		return
+	}
+
+	if w.status == 0 {
+		// Like net/http, responds with 200 if nothing is written.
+		w.status = http.StatusOK
+	}
+	rec.FinishedTime = time.Now()
+	rec.ResultStatus = w.status
+	rec.ResultContentType = w.header.Get("Content-Type")
+	rec.Result = w.body.Bytes()
+	switch {
+	case running.canceled:
+		rec.Status = AsyncCanceled
+		rec.Error = "canceled by user"
+	case w.aborted:
+		rec.Status = AsyncFailed
+		rec.Error = "response aborted"
+	case w.status >= 200 && w.status < 300:
+		rec.Status = AsyncSucceeded
+	default:
+		rec.Status = AsyncFailed
+		rec.Error = fmt.Sprintf("function responded with status %d", w.status)
+	}
+	if w.truncated {
+		rec.Error = strings.TrimPrefix(rec.Error+"; response truncated", "; ")
+	}
+	if rec.Status == AsyncFailed && w.failedInRuntime() {
+		p := m.policyLocked(rec.Fn)
+		if w.retryable() && rec.Attempts <= p.MaxRetries {
+			rec.Status = AsyncQueued
+			rec.FinishedTime = time.Time{}
+			rec.NextAttemptTime = time.Now().Add(
+				jitteredBackoff(time.Duration(p.InitialBackoff), time.Duration(p.MaxBackoff), rec.Attempts))
+			m.mustPersistLocked(rec)
+			m.enqueueLocked(rec)
+			inv := rec.AsyncInvocation
+			m.mu.Unlock()
+
+			slog.Warn("Retrying async invocation", "id", id, logKeyFn, inv.Fn, "attempts", inv.Attempts,
+				"next_attempt_time", inv.NextAttemptTime, "error", inv.Error)
+			m.onRetry(inv)
+			return
+		}
+		rec.Status = AsyncDeadLetter
+		slog.Error("Async invocation became a dead letter", "id", id, logKeyFn, rec.Fn, "attempts", rec.Attempts,
+			"error", rec.Error)
+	}
+	m.mustPersistLocked(rec)
+	inv := rec.AsyncInvocation
+	m.mu.Unlock()
+
+	m.onFinished(inv)
+}
+
+// Records the response of an asynchronous invocation.
+type resultRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// True if the body exceeds maxAsyncBodyBytes, and the rest is dropped.
+	truncated bool
+	// True if the response was aborted after being partially written.
+	aborted bool
+}
+
+func newResultRecorder() *resultRecorder {
+	return &resultRecorder{header: make(http.Header)}
+}
+
+// Returns true if the invocation failed in the runtime or timed out, rather than being rejected, so it's retried, and
+// becomes a dead letter once out of retries.
+func (w *resultRecorder) failedInRuntime() bool {
+	return w.aborted || w.status >= http.StatusInternalServerError || w.status == http.StatusTooManyRequests
+}
+
+// Returns true if retrying the failed invocation may succeed, i.e., unless the function's code raised an error it
+// does not flag as retryable.
+func (w *resultRecorder) retryable() bool {
+	if !w.aborted && protocol.ErrorSource(w.header.Get(errorSourceHeader)) == protocol.SourceFunction {
+		var resp protocol.ErrorResponse
+		if err := json.Unmarshal(w.body.Bytes(), &resp); err == nil {
+			return resp.Error.Retryable
+		}
+	}
+	return true
+}
+
+func (w *resultRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *resultRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+func (w *resultRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n := min(len(b), maxAsyncBodyBytes-w.body.Len())
+	if n < len(b) {
+		w.truncated = true
+	}
+	w.body.Write(b[:n])
+	return len(b), nil
+}
+
+// StartAsync starts serving asynchronous invocations as configured by cfg. Must be called before
+// RegisterAsyncRoutes.
+func (d *Dispatcher) StartAsync(cfg AsyncConfig) error {
+	webhookMgr, err := NewWebhookMgr(cfg.Webhook)
+	if err != nil {
+		return err
+	}
+	webhookMgr.onResult = func(fn, result string) {
+		d.metrics.webhookDeliveries.Inc(fn, result)
+	}
+	m, err := NewAsyncMgr(cfg, d.Dispatch)
+	if err != nil {
+		return err
+	}
+	m.onRetry = func(inv AsyncInvocation) {
+		d.metrics.asyncRetries.Inc(inv.Fn)
+	}
+	m.onFinished = func(inv AsyncInvocation) {
+		d.metrics.asyncInvocations.Inc(inv.Fn, string(inv.Status))
+		if inv.CallbackURL == "" {
+			return
+		}
+		inv, contentType, result, ok := m.Result(inv.ID)
+		if ok {
+			webhookMgr.Deliver(inv.CallbackURL, WebhookPayload{
+				Invocation:        inv,
+				ResultContentType: contentType,
+				Result:            result,
+			})
+		}
+	}
+	d.metrics.registry.AddCollector(func() {
+		d.metrics.asyncQueueDepth.Reset()
+		for fn, depth := range m.QueueDepths() {
+			d.metrics.asyncQueueDepth.Set(float64(depth), fn)
+		}
+		d.metrics.asyncDeadLetters.Reset()
+		for _, inv := range m.DeadLetters("") {
+			d.metrics.asyncDeadLetters.Add(1, inv.Fn)
+		}
+	})
+	d.asyncMgr = m
+	d.webhookMgr = webhookMgr
+	m.Start()
+	return nil
+}
+
+// Registers the asynchronous invocation APIs onto r. The User header is required; users can only access their own
+// invocations, except admins.
+//
+//	POST   /functions/{fn}/async     Queues an invocation of function fn with the request body as its payload.
+//	                                 Returns 202 with the AsyncInvocation, whose ID is used by the APIs below. The
+//	                                 result is POSTed to the X-Callback-URL header if provided, see WebhookMgr.
+//	GET    /invocations/{id}         Returns the AsyncInvocation.
+//	GET    /invocations/{id}/result  Returns the function's response of a finished invocation, with its status.
+//	DELETE /invocations/{id}         Cancels a queued or running invocation.
+func (d *Dispatcher) RegisterAsyncRoutes(r *mux.Router) {
+	r.HandleFunc("/functions/{fn}/async", d.handleSubmitAsync).Methods(http.MethodPost)
+	r.HandleFunc("/invocations/{id}", d.handleGetAsync).Methods(http.MethodGet)
+	r.HandleFunc("/invocations/{id}/result", d.handleGetAsyncResult).Methods(http.MethodGet)
+	r.HandleFunc("/invocations/{id}", d.handleCancelAsync).Methods(http.MethodDelete)
+}
+
+func (d *Dispatcher) handleSubmitAsync(w http.ResponseWriter, r *http.Request) {
+	fn := mux.Vars(r)["fn"]
+	user := r.Header.Get("User")
+	if user == "" {
+		http.Error(w, "User header not provided", http.StatusBadRequest)
+		return
+	}
+	if !d.launcher.HasFn(fn) {
+		http.Error(w, fmt.Sprintf("Function %s not found", fn), http.StatusNotFound)
+		return
+	}
+	if !d.permMgr.IsUserAllowed(user, fn) {
+		http.Error(w, fmt.Sprintf("User %s is not allowed to call function %s", user, fn), http.StatusForbidden)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxAsyncBodyBytes+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read request body, error: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(payload) > maxAsyncBodyBytes {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", maxAsyncBodyBytes),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	callbackURL := r.Header.Get(callbackURLHeader)
+	if callbackURL != "" {
+		if err := d.webhookMgr.ValidateURL(callbackURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	inv, err := d.asyncMgr.Submit(AsyncRequest{
+		Fn:          fn,
+		User:        user,
+		ContentType: r.Header.Get("Content-Type"),
+		Payload:     payload,
+		CallbackURL: callbackURL,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Queued async invocation", "id", inv.ID, logKeyFn, fn, logKeyUser, user)
+	w.Header().Set("Location", "/invocations/"+inv.ID)
+	writeJSON(w, http.StatusAccepted, inv)
+}
+
+// Returns the invocation in the request path if the caller may access it, or writes the error response.
+func (d *Dispatcher) accessibleAsync(w http.ResponseWriter, r *http.Request) (AsyncInvocation, bool) {
+	caller := r.Header.Get("User")
+	if caller == "" {
+		http.Error(w, "User header not provided", http.StatusBadRequest)
+		return AsyncInvocation{}, false
+	}
+	id := mux.Vars(r)["id"]
+	inv, ok := d.asyncMgr.Get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invocation %s not found", id), http.StatusNotFound)
+		return inv, false
+	}
+	if inv.User != caller && !d.permMgr.IsAdmin(caller) {
+		http.Error(w, fmt.Sprintf("User %s is not allowed to access invocation %s", caller, id),
+			http.StatusForbidden)
+		return inv, false
+	}
+	return inv, true
+}
+
+func (d *Dispatcher) handleGetAsync(w http.ResponseWriter, r *http.Request) {
+	if inv, ok := d.accessibleAsync(w, r); ok {
+		writeJSON(w, http.StatusOK, inv)
+	}
+}
+
+func (d *Dispatcher) handleGetAsyncResult(w http.ResponseWriter, r *http.Request) {
+	inv, ok := d.accessibleAsync(w, r)
+	if !ok {
+		return
+	}
+	inv, contentType, body, ok := d.asyncMgr.Result(inv.ID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invocation %s not found", inv.ID), http.StatusNotFound)
+		return
+	}
+	if !inv.Status.finished() || inv.ResultStatus == 0 {
+		http.Error(w, fmt.Sprintf("Invocation %s has no result, status: %s", inv.ID, inv.Status),
+			http.StatusConflict)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Invocation-Status", string(inv.Status))
+	w.WriteHeader(inv.ResultStatus)
+	w.Write(body)
+}
+
+func (d *Dispatcher) handleCancelAsync(w http.ResponseWriter, r *http.Request) {
+	inv, ok := d.accessibleAsync(w, r)
+	if !ok {
+		return
+	}
+	inv, err := d.asyncMgr.Cancel(inv.ID)
+	switch {
+	case errors.Is(err, ErrAsyncNotFound):
+		http.Error(w, fmt.Sprintf("Invocation %s not found", inv.ID), http.StatusNotFound)
+	case errors.Is(err, ErrAsyncFinished):
+		http.Error(w, fmt.Sprintf("Invocation %s already finished, status: %s", inv.ID, inv.Status),
+			http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, inv)
+	}
+}
@@ -0,0 +1,309 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// Waits until invocation id of m has status.
+func waitForAsyncStatus(t *testing.T, m *AsyncMgr, id string, status AsyncStatus) AsyncInvocation {
+	var inv AsyncInvocation
+	assert.Eventually(t, func() bool {
+		inv, _ = m.Get(id)
+		return inv.Status == status
+	}, 5*time.Second, 10*time.Millisecond, "invocation %s is %s, not %s", id, inv.Status, status)
+	return inv
+}
+
+// Creates an AsyncMgr with one worker, persisting invocations in dir.
+func newTestAsyncMgr(t *testing.T, dir string, dispatch func(CallContext, http.ResponseWriter, *http.Request)) *AsyncMgr {
+	m, err := NewAsyncMgr(AsyncConfig{Dir: dir, Workers: 1, Retention: time.Hour}, dispatch)
+	assert.NoError(t, err)
+	return m
+}
+
+// TestAsyncMgr_Dispatch tests that queued invocations are dispatched with their payloads, and their results recorded
+func TestAsyncMgr_Dispatch(t *testing.T) {
+	var got *http.Request
+	var body string
+	m := newTestAsyncMgr(t, "", func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "done")
+	})
+	m.Start()
+	defer m.Stop()
+
+	inv, err := m.Submit(AsyncRequest{
+		Fn:          "alpha",
+		User:        "test",
+		ContentType: "application/json",
+		Payload:     []byte(`{"args": {}}`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, AsyncQueued, inv.Status)
+
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncSucceeded)
+	assert.Equal(t, http.StatusOK, inv.ResultStatus)
+	assert.False(t, inv.StartedTime.IsZero())
+	assert.Equal(t, `{"args": {}}`, body)
+	assert.Equal(t, "test", got.Header.Get("User"))
+	assert.Equal(t, inv.ID, got.Header.Get(requestIDHeader))
+	assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+
+	_, contentType, result, ok := m.Result(inv.ID)
+	assert.True(t, ok)
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, "done", string(result))
+}
+
+// TestAsyncMgr_Cancel tests canceling queued and running invocations
+func TestAsyncMgr_Cancel(t *testing.T) {
+	started := make(chan struct{})
+	m := newTestAsyncMgr(t, "", func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	m.Start()
+	defer m.Stop()
+
+	running, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	<-started
+	queued, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	assert.Equal(t, map[string]int{"alpha": 1}, m.QueueDepths())
+
+	inv, err := m.Cancel(queued.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, AsyncCanceled, inv.Status)
+	assert.Empty(t, m.QueueDepths())
+
+	_, err = m.Cancel(running.ID)
+	assert.NoError(t, err)
+	waitForAsyncStatus(t, m, running.ID, AsyncCanceled)
+
+	_, err = m.Cancel(running.ID)
+	assert.ErrorIs(t, err, ErrAsyncFinished)
+	_, err = m.Cancel("unknown")
+	assert.ErrorIs(t, err, ErrAsyncNotFound)
+}
+
+// TestAsyncMgr_Durable tests that invocations survive restarts, and the interrupted ones are dispatched again
+func TestAsyncMgr_Durable(t *testing.T) {
+	dir := t.TempDir()
+	started := make(chan struct{})
+	m := newTestAsyncMgr(t, dir, func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	m.Start()
+	interrupted, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test", Payload: []byte("first")})
+	<-started
+	queued, _ := m.Submit(AsyncRequest{Fn: "beta", User: "test", Payload: []byte("second")})
+	m.Stop()
+
+	var payloads []string
+	m = newTestAsyncMgr(t, dir, func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		payloads = append(payloads, string(b))
+	})
+	assert.Equal(t, map[string]int{"alpha": 1, "beta": 1}, m.QueueDepths())
+	m.Start()
+	defer m.Stop()
+	waitForAsyncStatus(t, m, interrupted.ID, AsyncSucceeded)
+	waitForAsyncStatus(t, m, queued.ID, AsyncSucceeded)
+	assert.Equal(t, []string{"first", "second"}, payloads)
+}
+
+// TestAsyncMgr_PurgeExpired tests that finished invocations are removed after the retention
+func TestAsyncMgr_PurgeExpired(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestAsyncMgr(t, dir, func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	m.Start()
+	defer m.Stop()
+
+	inv, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncFailed)
+	assert.Equal(t, http.StatusBadRequest, inv.ResultStatus)
+	assert.Equal(t, 1, inv.Attempts, "rejected invocations are not retried")
+
+	m.purgeExpired(inv.FinishedTime.Add(time.Minute))
+	_, ok := m.Get(inv.ID)
+	assert.True(t, ok)
+	m.purgeExpired(inv.FinishedTime.Add(time.Hour))
+	_, ok = m.Get(inv.ID)
+	assert.False(t, ok)
+	assert.NoFileExists(t, dir+"/"+inv.ID+".json")
+}
+
+// TestAsyncMgr_DeadLetter tests that invocations failing in the runtime are retried, and become dead letters after
+// all retries
+func TestAsyncMgr_DeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	var fail atomic.Bool
+	fail.Store(true)
+	var calls int32
+	m := newTestAsyncMgr(t, dir, func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	})
+	policy := AsyncRetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: Duration(time.Millisecond),
+		MaxBackoff:     Duration(time.Millisecond),
+	}
+	assert.NoError(t, m.SetRetryPolicy("alpha", policy))
+	var retries int32
+	m.onRetry = func(AsyncInvocation) { atomic.AddInt32(&retries, 1) }
+	m.Start()
+	defer m.Stop()
+
+	inv, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test", Payload: []byte("payload")})
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncDeadLetter)
+	assert.Equal(t, 3, inv.Attempts)
+	assert.Equal(t, int32(3), calls)
+	assert.Equal(t, int32(2), retries)
+	assert.Equal(t, http.StatusGatewayTimeout, inv.ResultStatus)
+
+	m.purgeExpired(inv.FinishedTime.Add(2 * time.Hour))
+	deadLetters := m.DeadLetters("alpha")
+	assert.Len(t, deadLetters, 1, "dead letters do not expire")
+	assert.Empty(t, m.DeadLetters("beta"))
+	rec, err := m.DeadLetter(inv.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(rec.Payload))
+
+	fail.Store(false)
+	inv, err = m.Replay(inv.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, AsyncQueued, inv.Status)
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncSucceeded)
+	assert.Equal(t, 1, inv.Attempts)
+	_, err = m.Replay(inv.ID)
+	assert.ErrorIs(t, err, ErrAsyncNotDeadLetter)
+}
+
+// TestAsyncMgr_FunctionErrors tests that errors of the function's code are retried only if flagged as retryable, and
+// become dead letters either way
+func TestAsyncMgr_FunctionErrors(t *testing.T) {
+	var calls int32
+	var retryable atomic.Bool
+	m := newTestAsyncMgr(t, "", func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeErrorResponse(w, http.StatusInternalServerError, protocol.Error{Type: protocol.ErrorFunction,
+			Message: "bug", Retryable: retryable.Load(), Source: protocol.SourceFunction})
+	})
+	policy := AsyncRetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: Duration(time.Millisecond),
+		MaxBackoff:     Duration(time.Millisecond),
+	}
+	assert.NoError(t, m.SetRetryPolicy("alpha", policy))
+	m.Start()
+	defer m.Stop()
+
+	inv, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncDeadLetter)
+	assert.Equal(t, 1, inv.Attempts)
+	assert.Equal(t, int32(1), calls)
+	assert.Len(t, m.DeadLetters("alpha"), 1)
+
+	retryable.Store(true)
+	inv, _ = m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	inv = waitForAsyncStatus(t, m, inv.ID, AsyncDeadLetter)
+	assert.Equal(t, 3, inv.Attempts)
+	assert.Equal(t, int32(4), calls)
+	assert.Len(t, m.DeadLetters("alpha"), 2)
+}
+
+// TestAsyncMgr_PurgeDeadLetters tests removing dead letters by function
+func TestAsyncMgr_PurgeDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestAsyncMgr(t, dir, func(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	for _, fn := range []string{"alpha", "beta"} {
+		assert.NoError(t, m.SetRetryPolicy(fn, AsyncRetryPolicy{}))
+	}
+	m.Start()
+	defer m.Stop()
+
+	alpha1, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	alpha2, _ := m.Submit(AsyncRequest{Fn: "alpha", User: "test"})
+	beta, _ := m.Submit(AsyncRequest{Fn: "beta", User: "test"})
+	for _, inv := range []AsyncInvocation{alpha1, alpha2, beta} {
+		waitForAsyncStatus(t, m, inv.ID, AsyncDeadLetter)
+	}
+
+	assert.NoError(t, m.PurgeDeadLetter(alpha1.ID))
+	assert.ErrorIs(t, m.PurgeDeadLetter(alpha1.ID), ErrAsyncNotFound)
+	assert.NoFileExists(t, dir+"/"+alpha1.ID+".json")
+	assert.Equal(t, 1, m.PurgeDeadLetters("alpha"))
+	assert.Equal(t, []string{beta.ID}, []string{m.DeadLetters("")[0].ID})
+	assert.Equal(t, 1, m.PurgeDeadLetters(""))
+}
+
+func doAsyncRequest(r http.Handler, method, path, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set("User", user)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestAsyncRoutes tests submitting an invocation and fetching its result through the APIs
+func TestAsyncRoutes(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	assert.NoError(t, d.StartAsync(AsyncConfig{Workers: 1, Retention: time.Hour, Webhook: DefaultWebhookConfig()}))
+	defer d.asyncMgr.Stop()
+	addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	})
+	r := mux.NewRouter()
+	d.RegisterAsyncRoutes(r)
+
+	assert.Equal(t, http.StatusBadRequest, doAsyncRequest(r, http.MethodPost, "/functions/alpha/async", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, doAsyncRequest(r, http.MethodPost, "/functions/delta/async", "test", "").Code)
+	assert.Equal(t, http.StatusForbidden, doAsyncRequest(r, http.MethodPost, "/functions/alpha/async", "other", "").Code)
+
+	w := doAsyncRequest(r, http.MethodPost, "/functions/alpha/async", "test", "payload")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var inv AsyncInvocation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &inv))
+	assert.Equal(t, "/invocations/"+inv.ID, w.Header().Get("Location"))
+	waitForAsyncStatus(t, d.asyncMgr, inv.ID, AsyncSucceeded)
+
+	w = doAsyncRequest(r, http.MethodGet, "/invocations/"+inv.ID+"/result", "test", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "payload", w.Body.String())
+	assert.Equal(t, string(AsyncSucceeded), w.Header().Get("X-Invocation-Status"))
+
+	assert.Equal(t, http.StatusForbidden, doAsyncRequest(r, http.MethodGet, "/invocations/"+inv.ID, "other", "").Code)
+	assert.Equal(t, http.StatusOK, doAsyncRequest(r, http.MethodGet, "/invocations/"+inv.ID, "admin", "").Code)
+	assert.Equal(t, http.StatusConflict, doAsyncRequest(r, http.MethodDelete, "/invocations/"+inv.ID, "test", "").Code)
+	assert.Equal(t, http.StatusNotFound, doAsyncRequest(r, http.MethodGet, "/invocations/unknown", "test", "").Code)
+	assert.Equal(t, float64(1), d.metrics.asyncInvocations.Value("alpha", string(AsyncSucceeded)))
+}
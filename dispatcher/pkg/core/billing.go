@@ -0,0 +1,289 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// LedgerEntry records one function invocation for billing.
+type LedgerEntry struct {
+	User string `json:"user"`
+	Fn   string `json:"fn"`
+
+	// The name of the RunningContainer that served the invocation.
+	Instance string `json:"instance"`
+
+	// The time when the dispatcher received the invocation.
+	ReceivedTime time.Time `json:"received_time"`
+
+	// The time from receiving the invocation to proxying it to the instance, which includes waiting for the concurrency
+	// limit, and for the instance to become ready.
+	QueuedTime time.Duration `json:"queued_time"`
+
+	// True if the invocation had to launch a new instance.
+	ColdStart bool `json:"cold_start"`
+
+	// The time the instance spent serving the invocation.
+	ExecTime time.Duration `json:"exec_time"`
+
+	// The memory tier of the instance.
+	MemoryMB int64 `json:"memory_mb"`
+
+	// Who failed the invocation, empty if it succeeded. Invocations failed by the platform are not charged.
+	ErrorSource protocol.ErrorSource `json:"error_source,omitempty"`
+
+	// The pricing plan applied, and the resulting charges. Filled by BillingMgr.Record.
+	Plan    string  `json:"plan"`
+	Charges Charges `json:"charges"`
+}
+
+// The GB-seconds consumed by the invocation, i.e., the memory tier in GB multiplied by the execution time in seconds.
+func (e LedgerEntry) GBSeconds() float64 {
+	return float64(e.MemoryMB) / 1024 * e.ExecTime.Seconds()
+}
+
+// Charges break down the cost of invocations by pricing component.
+type Charges struct {
+	Request   float64 `json:"request"`
+	Compute   float64 `json:"compute"`
+	ColdStart float64 `json:"cold_start"`
+	Total     float64 `json:"total"`
+}
+
+func (c *Charges) add(o Charges) {
+	c.Request += o.Request
+	c.Compute += o.Compute
+	c.ColdStart += o.ColdStart
+	c.Total += o.Total
+}
+
+// PricingPlan determines how much users are charged for invocations.
+type PricingPlan struct {
+	Name string `json:"name"`
+
+	// Charged for every invocation.
+	PerRequest float64 `json:"per_request"`
+
+	// Charged for every GB-second of execution, see LedgerEntry.GBSeconds.
+	PerGBSecond float64 `json:"per_gb_second"`
+
+	// Charged for every invocation that had to launch a new instance. This is the "bursty charging" of container
+	// startup time described in README.md.
+	ColdStartSurcharge float64 `json:"cold_start_surcharge"`
+}
+
+// Returns the charges of the invocation recorded in e under plan p.
+func (p PricingPlan) Charge(e LedgerEntry) Charges {
+	if e.ErrorSource == protocol.SourcePlatform {
+		return Charges{}
+	}
+	c := Charges{
+		Request: p.PerRequest,
+		Compute: p.PerGBSecond * e.GBSeconds(),
+	}
+	if e.ColdStart {
+		c.ColdStart = p.ColdStartSurcharge
+	}
+	c.Total = c.Request + c.Compute + c.ColdStart
+	return c
+}
+
+// The plan applied to users without an assigned plan.
+const defaultPricingPlanName = "default"
+
+// InvoiceLine sums up a user's invocations of one function under one pricing plan.
+type InvoiceLine struct {
+	Fn          string `json:"fn"`
+	Plan        string `json:"plan"`
+	Invocations int    `json:"invocations"`
+	ColdStarts  int    `json:"cold_starts"`
+	// The invocations failed by the function, charged, and by the platform, not charged.
+	FunctionErrors int     `json:"function_errors"`
+	PlatformErrors int     `json:"platform_errors"`
+	GBSeconds      float64 `json:"gb_seconds"`
+	Charges        Charges `json:"charges"`
+}
+
+// Invoice sums up a user's invocations received within [From, To).
+type Invoice struct {
+	User  string        `json:"user"`
+	From  time.Time     `json:"from"`
+	To    time.Time     `json:"to"`
+	Lines []InvoiceLine `json:"lines"`
+	Total float64       `json:"total"`
+}
+
+// How long ledger entries are kept by default, enough to invoice the previous months.
+const defaultLedgerRetention = 90 * 24 * time.Hour
+
+// BillingMgr keeps the ledger of recent invocations, and charges them according to the users' pricing plans.
+type BillingMgr struct {
+	mu sync.Mutex
+
+	// Ordered by the time of recording.
+	ledger []LedgerEntry
+
+	// How long entries are kept after being received, relative to the latest recorded one. Kept forever if 0.
+	retention time.Duration
+
+	plans map[string]PricingPlan
+
+	// Map from user to the name of the user's pricing plan.
+	userPlans map[string]string
+}
+
+// NewBillingMgr creates a BillingMgr charging all users with defaultPlan, whose name is overridden to "default".
+func NewBillingMgr(defaultPlan PricingPlan) BillingMgr {
+	defaultPlan.Name = defaultPricingPlanName
+	return BillingMgr{
+		retention: defaultLedgerRetention,
+		plans:     map[string]PricingPlan{defaultPricingPlanName: defaultPlan},
+		userPlans: make(map[string]string),
+	}
+}
+
+// SetRetention sets how long ledger entries are kept, 0 keeping them forever. Invocations received earlier can no
+// longer be invoiced.
+func (m *BillingMgr) SetRetention(retention time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retention = retention
+}
+
+// SetPlan adds or replaces a pricing plan. Replacing a plan does not change the charges already recorded.
+func (m *BillingMgr) SetPlan(p PricingPlan) error {
+	if p.Name == "" {
+		return fmt.Errorf("pricing plan must have a name")
+	}
+	if p.PerRequest < 0 || p.PerGBSecond < 0 || p.ColdStartSurcharge < 0 {
+		return fmt.Errorf("pricing plan %s has negative prices", p.Name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.plans[p.Name] = p
+	return nil
+}
+
+func (m *BillingMgr) Plans() []PricingPlan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plans := make([]PricingPlan, 0, len(m.plans))
+	for _, p := range m.plans {
+		plans = append(plans, p)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Name < plans[j].Name })
+	return plans
+}
+
+// SetUserPlan charges the future invocations of user with the named plan.
+func (m *BillingMgr) SetUserPlan(user, plan string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.plans[plan]; !ok {
+		return fmt.Errorf("Could not find pricing plan %s", plan)
+	}
+	m.userPlans[user] = plan
+	return nil
+}
+
+// Must be called with mu held.
+func (m *BillingMgr) userPlanLocked(user string) PricingPlan {
+	if name, ok := m.userPlans[user]; ok {
+		if p, ok := m.plans[name]; ok {
+			return p
+		}
+	}
+	return m.plans[defaultPricingPlanName]
+}
+
+// Record charges e with the user's current pricing plan, and appends it to the ledger. Entries received longer than
+// the retention before e are dropped.
+func (m *BillingMgr) Record(e LedgerEntry) LedgerEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.userPlanLocked(e.User)
+	e.Plan = p.Name
+	e.Charges = p.Charge(e)
+	m.ledger = append(m.ledger, e)
+	if m.retention > 0 {
+		m.dropExpiredLocked(e.ReceivedTime.Add(-m.retention))
+	}
+	return e
+}
+
+// Drops the entries at the head of the ledger received before cutoff. Entries are recorded once their invocations
+// finish, so an expired entry may follow a longer invocation received later, and is dropped with the next records.
+// Must be called with mu held.
+func (m *BillingMgr) dropExpiredLocked(cutoff time.Time) {
+	i := 0
+	for i < len(m.ledger) && m.ledger[i].ReceivedTime.Before(cutoff) {
+		i++
+	}
+	// The array holding the dropped entries is freed once append outgrows it, as it copies only the kept ones.
+	m.ledger = m.ledger[i:]
+}
+
+// Entries returns the ledger entries received within [from, to) that satisfy match. A nil match matches all entries.
+func (m *BillingMgr) Entries(from, to time.Time, match func(e LedgerEntry) bool) []LedgerEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res []LedgerEntry
+	for _, e := range m.ledger {
+		if e.ReceivedTime.Before(from) || !e.ReceivedTime.Before(to) {
+			continue
+		}
+		if match == nil || match(e) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Invoice returns the invoice of user for invocations received within [from, to).
+func (m *BillingMgr) Invoice(user string, from, to time.Time) Invoice {
+	entries := m.Entries(from, to, func(e LedgerEntry) bool { return e.User == user })
+
+	type lineKey struct{ fn, plan string }
+	lines := make(map[lineKey]*InvoiceLine)
+	for _, e := range entries {
+		key := lineKey{e.Fn, e.Plan}
+		line, ok := lines[key]
+		if !ok {
+			line = &InvoiceLine{Fn: e.Fn, Plan: e.Plan}
+			lines[key] = line
+		}
+		line.Invocations++
+		if e.ColdStart {
+			line.ColdStarts++
+		}
+		switch e.ErrorSource {
+		case protocol.SourceFunction:
+			line.FunctionErrors++
+		case protocol.SourcePlatform:
+			line.PlatformErrors++
+		}
+		line.GBSeconds += e.GBSeconds()
+		line.Charges.add(e.Charges)
+	}
+
+	invoice := Invoice{User: user, From: from, To: to, Lines: make([]InvoiceLine, 0, len(lines))}
+	for _, line := range lines {
+		invoice.Lines = append(invoice.Lines, *line)
+		invoice.Total += line.Charges.Total
+	}
+	sort.Slice(invoice.Lines, func(i, j int) bool {
+		if invoice.Lines[i].Fn != invoice.Lines[j].Fn {
+			return invoice.Lines[i].Fn < invoice.Lines[j].Fn
+		}
+		return invoice.Lines[i].Plan < invoice.Lines[j].Plan
+	})
+	return invoice
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+var testPricingPlan = PricingPlan{
+	PerRequest:         1,
+	PerGBSecond:        10,
+	ColdStartSurcharge: 100,
+}
+
+func TestPricingPlanCharge(t *testing.T) {
+	e := LedgerEntry{ExecTime: 2 * time.Second, MemoryMB: 512, ColdStart: true}
+
+	c := testPricingPlan.Charge(e)
+
+	assert.Equal(t, 1.0, c.Request)
+	assert.Equal(t, 10.0, c.Compute)
+	assert.Equal(t, 100.0, c.ColdStart)
+	assert.Equal(t, 111.0, c.Total)
+
+	// Invocations failed by the function are charged, those failed by the platform are not.
+	e.ErrorSource = protocol.SourceFunction
+	assert.Equal(t, 111.0, testPricingPlan.Charge(e).Total)
+	e.ErrorSource = protocol.SourcePlatform
+	assert.Equal(t, Charges{}, testPricingPlan.Charge(e))
+}
+
+func TestBillingMgrRecord(t *testing.T) {
+	m := NewBillingMgr(testPricingPlan)
+	assert.NoError(t, m.SetPlan(PricingPlan{Name: "free"}))
+	assert.Error(t, m.SetPlan(PricingPlan{Name: "bad", PerRequest: -1}))
+	assert.Error(t, m.SetUserPlan("user2", "unknown"))
+	assert.NoError(t, m.SetUserPlan("user2", "free"))
+
+	e := m.Record(LedgerEntry{User: "user1", Fn: "alpha", ExecTime: time.Second, MemoryMB: 1024})
+	assert.Equal(t, "default", e.Plan)
+	assert.Equal(t, 11.0, e.Charges.Total)
+
+	e = m.Record(LedgerEntry{User: "user2", Fn: "alpha", ExecTime: time.Second, MemoryMB: 1024})
+	assert.Equal(t, "free", e.Plan)
+	assert.Equal(t, 0.0, e.Charges.Total)
+}
+
+func TestBillingMgrInvoice(t *testing.T) {
+	m := NewBillingMgr(testPricingPlan)
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start, ExecTime: time.Second, MemoryMB: 1024,
+		ColdStart: true})
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start.Add(time.Hour), ExecTime: time.Second,
+		MemoryMB: 1024})
+	m.Record(LedgerEntry{User: "user1", Fn: "beta", ReceivedTime: start.Add(time.Hour), ExecTime: time.Second,
+		MemoryMB: 512})
+	// Outside of the invoice period.
+	m.Record(LedgerEntry{User: "user1", Fn: "beta", ReceivedTime: start.Add(48 * time.Hour), ExecTime: time.Second,
+		MemoryMB: 512})
+	// Another user.
+	m.Record(LedgerEntry{User: "user2", Fn: "alpha", ReceivedTime: start, ExecTime: time.Second, MemoryMB: 1024})
+
+	invoice := m.Invoice("user1", start, start.Add(24*time.Hour))
+
+	assert.Equal(t, "user1", invoice.User)
+	assert.Len(t, invoice.Lines, 2)
+	alpha := invoice.Lines[0]
+	assert.Equal(t, "alpha", alpha.Fn)
+	assert.Equal(t, 2, alpha.Invocations)
+	assert.Equal(t, 1, alpha.ColdStarts)
+	assert.Equal(t, 2.0, alpha.GBSeconds)
+	assert.Equal(t, 122.0, alpha.Charges.Total)
+	beta := invoice.Lines[1]
+	assert.Equal(t, "beta", beta.Fn)
+	assert.Equal(t, 1, beta.Invocations)
+	assert.Equal(t, 6.0, beta.Charges.Total)
+	assert.Equal(t, 128.0, invoice.Total)
+}
+
+func TestBillingMgrRetention(t *testing.T) {
+	m := NewBillingMgr(testPricingPlan)
+	m.SetRetention(24 * time.Hour)
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start})
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start.Add(time.Hour)})
+	assert.Len(t, m.Entries(start, start.Add(48*time.Hour), nil), 2)
+
+	// Drops the entries received longer than the retention before the latest one.
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start.Add(24*time.Hour + time.Minute)})
+	entries := m.Entries(start, start.Add(48*time.Hour), nil)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, start.Add(time.Hour), entries[0].ReceivedTime)
+
+	// Keeps entries forever with a retention of 0.
+	m.SetRetention(0)
+	m.Record(LedgerEntry{User: "user1", Fn: "alpha", ReceivedTime: start.Add(72 * time.Hour)})
+	assert.Len(t, m.Entries(start, start.Add(96*time.Hour), nil), 3)
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// The repository of the images built from functions' sources, tagged by their content hashes.
+const builtImageRepo = "serverless-fn"
+
+// The most bytes of the files extracted from a source archive.
+const maxSourceBytes = 64 << 20
+
+// Function names start with a letter, so that they are never confused with routes of other APIs.
+var fnNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+var pythonIdentifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ErrBuildFailed is returned when a build step fails, e.g., installing the requirements, as opposed to the build not
+// being able to run.
+var ErrBuildFailed = errors.New("build failed")
+
+// BuildSpec is the source of a function, built into an image on top of the runtime image.
+type BuildSpec struct {
+	// Map from the paths of the source files, relative to the runtime's directory, to their contents.
+	Files map[string][]byte
+	// The path of the Python file defining the function's class, one of Files.
+	File      string
+	ClassName string
+	// The content of a requirements.txt installed with pip, on top of the runtime's requirements. Optional.
+	Requirements []byte
+
+	// The memory limit of instances in MB. Instances are not limited, and billed at defaultMemoryMB, if 0.
+	MemoryMB    int64
+	Description string
+}
+
+func (s BuildSpec) Validate() error {
+	if len(s.Files) == 0 {
+		return fmt.Errorf("source must contain at least one file")
+	}
+	if _, ok := s.Files[s.File]; !ok || !strings.HasSuffix(s.File, ".py") {
+		return fmt.Errorf("file %q must be a Python file of the source", s.File)
+	}
+	if !pythonIdentifierRegexp.MatchString(s.ClassName) {
+		return fmt.Errorf("class_name %q must be a Python identifier", s.ClassName)
+	}
+	if s.MemoryMB < 0 {
+		return fmt.Errorf("memory_mb must be non-negative")
+	}
+	return nil
+}
+
+// ReadSourceArchive returns the files of a tar archive, optionally gzipped, by their cleaned paths. Only regular files
+// and directories are accepted, and paths must stay within the archive.
+func ReadSourceArchive(r io.Reader) (map[string][]byte, error) {
+	br := bufio.NewReader(r)
+	// Gzipped archives start with the magic number 0x1f8b.
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip archive, error: %v", err)
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+
+	files := make(map[string][]byte)
+	total := int64(0)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tar archive, error: %v", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("path %s of the archive is outside of it", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, fmt.Errorf("%s of the archive is not a regular file", hdr.Name)
+		}
+		total += hdr.Size
+		if total > maxSourceBytes {
+			return nil, fmt.Errorf("source exceeds %d bytes", maxSourceBytes)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s of the archive, error: %v", hdr.Name, err)
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+// Builds images.
+type imageBuilder interface {
+	// Builds the image tagged tag from buildContext, a tar archive with the Dockerfile at its root.
+	build(ctx context.Context, buildContext []byte, tag string) error
+}
+
+// Builder builds the sources of functions into images on top of the runtime image.
+type Builder struct {
+	baseImage string
+
+	// imageBuilder is used for testing.
+	backend imageBuilder
+}
+
+func NewBuilder(baseImage string) *Builder {
+	return &Builder{baseImage: baseImage, backend: dockerBuilder{}}
+}
+
+// Build builds spec into an image of function fn, and returns its tag. Images are tagged with the hash of their build
+// context, so that building the same source again results in the same tag. The base image is referred to by name,
+// so rebuilding it does not change the tags.
+func (b *Builder) Build(ctx context.Context, fn string, spec BuildSpec) (string, error) {
+	buildContext := b.buildContext(spec)
+	sum := sha256.Sum256(buildContext)
+	// Image names must be lowercase.
+	tag := fmt.Sprintf("%s/%s:%s", builtImageRepo, strings.ToLower(fn), hex.EncodeToString(sum[:])[:12])
+
+	logger := slog.With(logKeyFn, fn, "image", tag)
+	logger.Info("Building image")
+	start := time.Now()
+	if err := b.backend.build(ctx, buildContext, tag); err != nil {
+		logger.Error("Failed to build image", "error", err)
+		return "", err
+	}
+	logger.Info("Built image", "duration", time.Since(start))
+	return tag, nil
+}
+
+// Returns the build context of spec. Entries are sorted, and timestamps are not set, so that the same spec always
+// results in the same bytes.
+func (b *Builder) buildContext(spec BuildSpec) []byte {
+	dockerfile := fmt.Sprintf("FROM %s\n", b.baseImage)
+	if len(spec.Requirements) > 0 {
+		dockerfile += "COPY requirements.txt /tmp/requirements.txt\n" +
+			"RUN pip install --no-cache-dir -r /tmp/requirements.txt\n"
+	}
+	dockerfile += "COPY src/ .\n"
+
+	entries := map[string][]byte{"Dockerfile": []byte(dockerfile)}
+	if len(spec.Requirements) > 0 {
+		entries["requirements.txt"] = spec.Requirements
+	}
+	for name, content := range spec.Files {
+		entries["src/"+name] = content
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		// Writing to a bytes.Buffer never fails.
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(entries[name])), Format: tar.FormatPAX})
+		tw.Write(entries[name])
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+// Builds images with the docker daemon.
+type dockerBuilder struct{}
+
+func (dockerBuilder) build(ctx context.Context, buildContext []byte, tag string) error {
+	resp, err := dockerClient.ImageBuild(ctx, bytes.NewReader(buildContext), types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  "Dockerfile",
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not build image %s, error: %v", tag, err)
+	}
+	defer resp.Body.Close()
+	// Keeps the last lines of the output, to explain failed steps.
+	var output []string
+	err = readDockerStream(resp.Body, func(s string) {
+		output = append(output, strings.TrimRight(s, "\n"))
+		if len(output) > 20 {
+			output = output[1:]
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v\n%s", ErrBuildFailed, err, strings.Join(output, "\n"))
+	}
+	return nil
+}
+
+func validateBuild(fn string, spec BuildSpec) error {
+	if !fnNameRegexp.MatchString(fn) {
+		return fmt.Errorf("invalid function name %q, must start with a letter, followed by letters, digits, - or _", fn)
+	}
+	return spec.Validate()
+}
+
+// BuildResult is a function version built from source.
+type BuildResult struct {
+	Fn string `json:"fn"`
+	// Whether the function was created by the build, as opposed to getting a new version.
+	Created bool `json:"created"`
+	FunctionVersion
+}
+
+// BuildFunction builds spec into an image, and registers it as a new version of function fn, or as version 1 if fn
+// does not exist. Users are allowed to call fn.
+func (d *Dispatcher) BuildFunction(ctx context.Context, fn string, spec BuildSpec, users []string) (
+	BuildResult, error) {
+	if err := validateBuild(fn, spec); err != nil {
+		return BuildResult{}, err
+	}
+	tag, err := d.builder.Build(ctx, fn, spec)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	if d.imageMgr != nil {
+		// Records the digest.
+		d.imageMgr.Check(tag)
+	}
+
+	cmd := append([]string{}, genericRuntimeCmd...)
+	v := FunctionVersion{
+		Image:       tag,
+		Cmd:         append(cmd, "--file="+spec.File, "--class_name="+spec.ClassName),
+		MemoryMB:    spec.MemoryMB,
+		Description: spec.Description,
+	}
+	res := BuildResult{Fn: fn}
+	if !d.launcher.HasFn(fn) {
+		res.FunctionVersion, err = d.versionMgr.Create(fn, v)
+		res.Created = err == nil
+	}
+	if !res.Created {
+		// fn exists, or was created concurrently.
+		res.FunctionVersion, err = d.versionMgr.Publish(fn, v)
+	}
+	if err != nil {
+		return BuildResult{}, err
+	}
+	for _, user := range users {
+		d.permMgr.AllowUserAPI(user, fn)
+	}
+	return res, nil
+}
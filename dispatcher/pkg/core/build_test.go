@@ -0,0 +1,198 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Records the build contexts of images, failing builds with err.
+type testImageBuilder struct {
+	err    error
+	builds map[string]map[string]string
+}
+
+func (b *testImageBuilder) build(ctx context.Context, buildContext []byte, tag string) error {
+	if b.err != nil {
+		return b.err
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(buildContext))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		content, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(content)
+	}
+	b.builds[tag] = files
+	return nil
+}
+
+func newTestBuilder() (*Builder, *testImageBuilder) {
+	b := NewBuilder("runtime")
+	backend := &testImageBuilder{builds: make(map[string]map[string]string)}
+	b.backend = backend
+	return b, backend
+}
+
+// Returns a tar archive of files, gzipped if compress.
+func newTestArchive(t *testing.T, files map[string]string, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gw *gzip.Writer
+	if compress {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for name, content := range files {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	if gw != nil {
+		assert.NoError(t, gw.Close())
+	}
+	return buf.Bytes()
+}
+
+// TestReadSourceArchive tests reading plain and gzipped tar archives, and rejecting paths outside of them
+func TestReadSourceArchive(t *testing.T) {
+	files := map[string]string{"./runtime_delta.py": "class RuntimeDelta: pass", "lib/util.py": "x = 1"}
+	for _, compress := range []bool{false, true} {
+		res, err := ReadSourceArchive(bytes.NewReader(newTestArchive(t, files, compress)))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{
+			"runtime_delta.py": []byte("class RuntimeDelta: pass"),
+			"lib/util.py":      []byte("x = 1"),
+		}, res)
+	}
+
+	for _, name := range []string{"../evil.py", "/etc/evil.py", "lib/../../evil.py"} {
+		_, err := ReadSourceArchive(bytes.NewReader(newTestArchive(t, map[string]string{name: ""}, false)))
+		assert.Error(t, err, name)
+	}
+	_, err := ReadSourceArchive(bytes.NewReader([]byte("not an archive")))
+	assert.Error(t, err)
+}
+
+// TestBuilder_Build tests that images are built on top of the base image, and tagged by the hash of their content
+func TestBuilder_Build(t *testing.T) {
+	b, backend := newTestBuilder()
+	spec := BuildSpec{
+		Files:        map[string][]byte{"runtime_delta.py": []byte("class RuntimeDelta: pass")},
+		File:         "runtime_delta.py",
+		ClassName:    "RuntimeDelta",
+		Requirements: []byte("numpy"),
+	}
+	tag, err := b.Build(context.Background(), "Delta", spec)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^serverless-fn/delta:[0-9a-f]{12}$`, tag)
+	files := backend.builds[tag]
+	assert.Contains(t, files["Dockerfile"], "FROM runtime\n")
+	assert.Contains(t, files["Dockerfile"], "pip install")
+	assert.Equal(t, "numpy", files["requirements.txt"])
+	assert.Equal(t, "class RuntimeDelta: pass", files["src/runtime_delta.py"])
+
+	same, err := b.Build(context.Background(), "Delta", spec)
+	assert.NoError(t, err)
+	assert.Equal(t, tag, same)
+
+	spec.Requirements = nil
+	other, err := b.Build(context.Background(), "Delta", spec)
+	assert.NoError(t, err)
+	assert.NotEqual(t, tag, other)
+	assert.NotContains(t, backend.builds[other]["Dockerfile"], "pip install")
+}
+
+// Returns a build request of source named filename, with form fields.
+func newTestBuildRequest(t *testing.T, fn, filename string, source []byte, fields map[string]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("source", filename)
+	assert.NoError(t, err)
+	fw.Write(source)
+	for name, value := range fields {
+		assert.NoError(t, mw.WriteField(name, value))
+	}
+	assert.NoError(t, mw.Close())
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/functions/%s/build", fn), &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("User", "admin")
+	return req
+}
+
+// TestAdmin_Build tests building sources into new functions and new versions of existing functions
+func TestAdmin_Build(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+	builder, backend := newTestBuilder()
+	d.builder = builder
+
+	source := newTestArchive(t, map[string]string{"runtime_delta.py": "class RuntimeDelta: pass"}, true)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newTestBuildRequest(t, "delta", "delta.tar.gz", source, map[string]string{
+		"file": "runtime_delta.py", "class_name": "RuntimeDelta", "requirements": "numpy", "users": "test, other",
+	}))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var res BuildResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Created)
+	assert.Equal(t, 1, res.Version)
+	assert.Contains(t, backend.builds, res.Image)
+	assert.Equal(t, []string{"python", "runtime.py", "--file=runtime_delta.py", "--class_name=RuntimeDelta"}, res.Cmd)
+	assert.True(t, d.launcher.HasFn("delta"))
+	assert.True(t, d.permMgr.IsUserAllowed("other", "delta"))
+	version, err := d.versionMgr.Resolve("delta", "", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	// A single Python file is built as is, into a new version of an existing function.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newTestBuildRequest(t, "alpha", "runtime_alpha.py", []byte("class RuntimeAlpha: pass"),
+		map[string]string{"class_name": "RuntimeAlpha", "memory_mb": "1024"}))
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Created)
+	assert.Equal(t, 2, res.Version)
+	assert.Equal(t, int64(1024), res.MemoryMB)
+
+	for _, fields := range []map[string]string{
+		{"class_name": "RuntimeDelta"},
+		{"file": "runtime_delta.py"},
+		{"file": "runtime_delta.py", "class_name": "Runtime Delta"},
+		{"file": "missing.py", "class_name": "RuntimeDelta"},
+	} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, newTestBuildRequest(t, "delta", "delta.tar.gz", source, fields))
+		assert.Equal(t, http.StatusBadRequest, w.Code, fields)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newTestBuildRequest(t, "9delta", "delta.tar.gz", source,
+		map[string]string{"file": "runtime_delta.py", "class_name": "RuntimeDelta"}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	backend.err = fmt.Errorf("%w: pip install failed", ErrBuildFailed)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newTestBuildRequest(t, "delta", "delta.tar.gz", source,
+		map[string]string{"file": "runtime_delta.py", "class_name": "RuntimeDelta"}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "pip install failed")
+	versions, _ := d.versionMgr.Versions("delta")
+	assert.Len(t, versions, 1)
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// The most recent cold starts kept per function by ColdStartTracker.
+const coldStartHistorySize = 100
+
+// The phases of cold starts, in order.
+const (
+	// From launching being requested to the container being created.
+	phaseCreate = "create"
+	// From the container being created to being started.
+	phaseStart = "start"
+	// Importing the function's module, as reported by the runtime.
+	phaseImport = "import"
+	// Running the function's load(), as reported by the runtime.
+	phaseLoad = "load"
+	// The rest of the time from the container being started to the first successful ready probe, i.e., starting the
+	// runtime process, and the delay of probing.
+	phaseInit = "init"
+)
+
+// ColdStartBreakdown is the time an instance spent in each phase of its launch, until it was first ready.
+type ColdStartBreakdown struct {
+	Instance string `json:"instance"`
+	Version  int    `json:"version"`
+	// How the instance was launched, i.e., template, warm_pool or snapshot.
+	From                string    `json:"from"`
+	LaunchRequestedTime time.Time `json:"launch_requested_time"`
+
+	Create Duration `json:"create"`
+	Start  Duration `json:"start"`
+	Import Duration `json:"import"`
+	Load   Duration `json:"load"`
+	Init   Duration `json:"init"`
+	// From launching being requested to the first successful ready probe.
+	Total Duration `json:"total"`
+}
+
+// Returns the durations of the phases by name.
+func (b ColdStartBreakdown) phases() map[string]time.Duration {
+	return map[string]time.Duration{
+		phaseCreate: time.Duration(b.Create),
+		phaseStart:  time.Duration(b.Start),
+		phaseImport: time.Duration(b.Import),
+		phaseLoad:   time.Duration(b.Load),
+		phaseInit:   time.Duration(b.Init),
+	}
+}
+
+// Returns the cold start breakdown of c, and false if c is not ready yet, or its breakdown was taken before. So that
+// each instance's cold start is reported once, by whichever invocation first sees it ready.
+func (c *RunningContainer) takeColdStart() (ColdStartBreakdown, bool) {
+	c.rdyMu.Lock()
+	defer c.rdyMu.Unlock()
+	if !c.isRdy || c.coldStartTaken {
+		return ColdStartBreakdown{}, false
+	}
+	c.coldStartTaken = true
+
+	// Phases missing their times, e.g., of instances not run by Container, take no time.
+	requested := c.launchRequestedTime
+	if requested.IsZero() {
+		requested = c.launchTime
+	}
+	created := latest(requested, c.createdTime)
+	started := latest(created, c.startedTime)
+	ready := latest(started, c.rdyTime)
+
+	b := ColdStartBreakdown{
+		Instance:            c.name,
+		Version:             c.version,
+		From:                c.launchedFrom,
+		LaunchRequestedTime: requested,
+		Create:              Duration(created.Sub(requested)),
+		Start:               Duration(started.Sub(created)),
+		Total:               Duration(ready.Sub(requested)),
+	}
+	// Restored processes report the loading done before the checkpoint.
+	if !c.restored {
+		b.Import = Duration(c.importDuration)
+		b.Load = Duration(c.loadDuration)
+	}
+	b.Init = Duration(max(ready.Sub(started)-time.Duration(b.Import)-time.Duration(b.Load), 0))
+	return b, true
+}
+
+// Returns the later of a and b, a if b is zero.
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// ColdStartTracker keeps the most recent cold start breakdowns of each function.
+type ColdStartTracker struct {
+	mu sync.Mutex
+	// Map from the function to its most recent cold starts, the oldest first.
+	// Protected by mu.
+	history map[string][]ColdStartBreakdown
+}
+
+func NewColdStartTracker() ColdStartTracker {
+	return ColdStartTracker{history: make(map[string][]ColdStartBreakdown)}
+}
+
+func (t *ColdStartTracker) record(fn string, b ColdStartBreakdown) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := append(t.history[fn], b)
+	if len(h) > coldStartHistorySize {
+		h = append([]ColdStartBreakdown{}, h[len(h)-coldStartHistorySize:]...)
+	}
+	t.history[fn] = h
+}
+
+// ColdStartSummary summarizes the recent cold starts of a function.
+type ColdStartSummary struct {
+	Count int `json:"count"`
+	// The mean duration of each phase, and of the total.
+	Mean   map[string]Duration  `json:"mean"`
+	Recent []ColdStartBreakdown `json:"recent"`
+}
+
+// Summary returns the summary of the recent cold starts of function fn, and false if fn had none.
+func (t *ColdStartTracker) Summary(fn string) (ColdStartSummary, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.history[fn]
+	if !ok {
+		return ColdStartSummary{}, false
+	}
+	sums := make(map[string]time.Duration)
+	for _, b := range h {
+		for phase, d := range b.phases() {
+			sums[phase] += d
+		}
+		sums["total"] += time.Duration(b.Total)
+	}
+	mean := make(map[string]Duration, len(sums))
+	for phase, sum := range sums {
+		mean[phase] = Duration(sum / time.Duration(len(h)))
+	}
+	return ColdStartSummary{Count: len(h), Mean: mean, Recent: append([]ColdStartBreakdown{}, h...)}, true
+}
+
+// Summaries returns the summaries of the recent cold starts by function.
+func (t *ColdStartTracker) Summaries() map[string]ColdStartSummary {
+	t.mu.Lock()
+	fns := make([]string, 0, len(t.history))
+	for fn := range t.history {
+		fns = append(fns, fn)
+	}
+	t.mu.Unlock()
+
+	res := make(map[string]ColdStartSummary, len(fns))
+	for _, fn := range fns {
+		res[fn], _ = t.Summary(fn)
+	}
+	return res
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// TestRunningContainer_TakeColdStart tests breaking an instance's launch down into phases, with the durations
+// reported by the runtime, once per instance
+func TestRunningContainer_TakeColdStart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, protocol.ReadyResponse{ImportSeconds: 0.5, LoadSeconds: 2})
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	rc := &RunningContainer{
+		name:                "alpha-0",
+		version:             1,
+		launchedFrom:        launchFromTemplate,
+		readyUrl:            server.URL,
+		launchRequestedTime: now.Add(-5 * time.Second),
+		createdTime:         now.Add(-4 * time.Second),
+		startedTime:         now.Add(-3500 * time.Millisecond),
+	}
+	_, ok := rc.takeColdStart()
+	assert.False(t, ok)
+
+	assert.NoError(t, rc.WaitForReady(time.Second))
+	b, ok := rc.takeColdStart()
+	assert.True(t, ok)
+	assert.Equal(t, "alpha-0", b.Instance)
+	assert.Equal(t, launchFromTemplate, b.From)
+	assert.Equal(t, Duration(time.Second), b.Create)
+	assert.Equal(t, Duration(500*time.Millisecond), b.Start)
+	assert.Equal(t, Duration(500*time.Millisecond), b.Import)
+	assert.Equal(t, Duration(2*time.Second), b.Load)
+	assert.InDelta(t, time.Second, time.Duration(b.Init), float64(100*time.Millisecond))
+	assert.InDelta(t, 5*time.Second, time.Duration(b.Total), float64(100*time.Millisecond))
+
+	_, ok = rc.takeColdStart()
+	assert.False(t, ok)
+
+	// Restored processes report the loading done before the checkpoint, and plain "OK" is reported as no loading.
+	rc = &RunningContainer{readyUrl: server.URL, restored: true, launchRequestedTime: now}
+	assert.NoError(t, rc.WaitForReady(time.Second))
+	b, _ = rc.takeColdStart()
+	assert.Zero(t, b.Import)
+	assert.Zero(t, b.Load)
+	assert.Equal(t, b.Total, b.Init)
+}
+
+// TestColdStartTracker tests summarizing the recent cold starts of functions
+func TestColdStartTracker(t *testing.T) {
+	tracker := NewColdStartTracker()
+	_, ok := tracker.Summary("alpha")
+	assert.False(t, ok)
+
+	for i := 0; i < coldStartHistorySize+10; i++ {
+		load := time.Second
+		if i%2 == 1 {
+			load = 3 * time.Second
+		}
+		tracker.record("alpha", ColdStartBreakdown{Instance: "alpha", Load: Duration(load), Total: Duration(load)})
+	}
+	tracker.record("beta", ColdStartBreakdown{Instance: "beta-0", Create: Duration(time.Second)})
+
+	s, ok := tracker.Summary("alpha")
+	assert.True(t, ok)
+	assert.Equal(t, coldStartHistorySize, s.Count)
+	assert.Len(t, s.Recent, coldStartHistorySize)
+	assert.Equal(t, Duration(2*time.Second), s.Mean[phaseLoad])
+	assert.Equal(t, Duration(2*time.Second), s.Mean["total"])
+	assert.Equal(t, Duration(0), s.Mean[phaseCreate])
+
+	summaries := tracker.Summaries()
+	assert.Len(t, summaries, 2)
+	assert.Equal(t, Duration(time.Second), summaries["beta"].Mean[phaseCreate])
+}
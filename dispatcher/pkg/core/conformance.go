@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"serverless/dispatcher/pkg/conformance"
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// ConformanceRequest is the body of a conformance run of a function version.
+type ConformanceRequest struct {
+	// The version or alias of the function, the default alias if empty.
+	Version string `json:"version"`
+	// The args of the invocations, which the function must serve successfully. {} if empty.
+	Args json.RawMessage `json:"args"`
+}
+
+// CheckConformance runs the conformance suite against a ready instance of version of function fn, launching one if
+// there is none, so that runtimes in any language can be checked to implement the runtime protocol before serving
+// traffic. Invocations of the suite are not metered.
+func (d *Dispatcher) CheckConformance(ctx context.Context, fn string, req ConformanceRequest) (
+	conformance.Report, error) {
+	version, err := d.versionMgr.Resolve(fn, req.Version, "")
+	if err != nil {
+		return conformance.Report{}, err
+	}
+	if err := d.imageUnavailable(fn, version); err != nil {
+		return conformance.Report{}, err
+	}
+	rc, err := d.launcher.pickInst(fn, func(rc *RunningContainer) bool {
+		return rc.version == version && rc.IsReady()
+	})
+	if err != nil {
+		if rc, err = d.launcher.LaunchVersion(fn, version); err != nil {
+			return conformance.Report{}, err
+		}
+		if err = rc.WaitForReady(defaultInstRdyTimeout); err != nil {
+			return conformance.Report{}, fmt.Errorf("Timeout waiting for the instance to become ready, error: %v", err)
+		}
+	}
+	rc.logger().Info("Checking conformance")
+	baseURL := strings.TrimSuffix(rc.Url, protocol.InvokePath)
+	return conformance.Run(ctx, baseURL, conformance.Options{Args: req.Args}), nil
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/conformance"
+	"serverless/dispatcher/pkg/sdk"
+)
+
+type testEchoFunction struct{}
+
+func (testEchoFunction) Load(ctx context.Context) error {
+	return nil
+}
+
+func (testEchoFunction) Invoke(ctx context.Context, args json.RawMessage) (any, error) {
+	return args, nil
+}
+
+// TestAdmin_Conformance tests running the conformance suite against a ready instance of a function version
+func TestAdmin_Conformance(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	rt := sdk.New(testEchoFunction{})
+	assert.NoError(t, rt.Load(context.Background()))
+	addTestInst(t, d, "alpha", rt.Handler().ServeHTTP)
+
+	w := doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/conformance", "admin",
+		`{"version": "1", "args": {"prompt": "hi"}}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var report conformance.Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Passed, report.Failed())
+
+	// The body is optional.
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/conformance", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/conformance", "admin", `{"version": "9"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/delta/conformance", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/conformance", "test", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -2,7 +2,9 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
 	"strconv"
 	"sync"
@@ -12,6 +14,9 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	"go.opentelemetry.io/otel/trace"
+
+	"serverless/dispatcher/pkg/protocol"
 )
 
 var (
@@ -40,6 +45,22 @@ type RunningContainer struct {
 	// Human readable name for easier debugging.
 	name string
 
+	// The function served by this instance.
+	// Fixed parameter, set at launch time.
+	fn string
+
+	// The version of fn served by this instance.
+	// Fixed parameter, set at launch time.
+	version int
+
+	// The user whose invocation triggered launching this instance, empty if launched by the launcher on its own.
+	// Fixed parameter, set at launch time.
+	triggerUser string
+
+	// The span of launching this instance, linked from the span of the invocation that triggered the launch.
+	// Fixed parameter, set at launch time.
+	launchSpanCtx trace.SpanContext
+
 	// Fixed parameter, set at launch time.
 	containerID string
 
@@ -51,12 +72,36 @@ type RunningContainer struct {
 	// Fixed parameter, set at launch time.
 	concurLimit int
 
+	// The memory tier of this instance in MB for billing, its memory limit if the version sets one.
+	// Fixed parameter, set at launch time.
+	memoryMB int64
+
 	// The time when this instance is launched.
 	launchTime time.Time
 
+	// How this instance was launched, one of the launchFrom* constants.
+	// Fixed parameter, set at launch time.
+	launchedFrom string
+
+	// The times when launching this instance was requested, its container was created, and started. Instances
+	// specialized from the warm pool are created and started when specialized.
+	// Fixed parameters, set at launch time.
+	launchRequestedTime time.Time
+	createdTime         time.Time
+	startedTime         time.Time
+
+	// Whether the processes of this instance were restored from a checkpoint, i.e., its function was loaded before
+	// it was launched.
+	// Fixed parameter, set at launch time.
+	restored bool
+
 	// The URL to check the readiness of the service running inside the service.
 	readyUrl string
 
+	// The URLs to check that a generic runtime is up, and to specialize it into a function, see WarmPool.
+	aliveUrl      string
+	specializeUrl string
+
 	// TODO: Add mutex protection to check isRdy. As the running container will be checked for readiness for each
 	// incoming requests (and if the container is not ready, the caller needs to wait). The check is invoked by HTTP
 	// handler functions for each incoming requests, so they would happen concurrently.
@@ -68,14 +113,30 @@ type RunningContainer struct {
 	// The time when this instance is ready and is able to serve requests.
 	// Protected by rdyMu
 	rdyTime time.Time
+	// The durations of importing the function and running its load(), reported by the runtime once ready.
+	// Protected by rdyMu
+	importDuration time.Duration
+	loadDuration   time.Duration
+	// True once the cold start breakdown of this instance is taken, see takeColdStart.
+	// Protected by rdyMu
+	coldStartTaken bool
 
 	// The time duration that this instance is actually serving requests.
 	busyTimeMu sync.RWMutex
 	busyTime   time.Duration
 }
 
+// Returns the log attributes identifying this instance.
+func (c *RunningContainer) logAttrs() []any {
+	return []any{logKeyFn, c.fn, logKeyVersion, c.version, logKeyInstance, c.name, logKeyContainerID, c.containerID}
+}
+
+func (c *RunningContainer) logger() *slog.Logger {
+	return slog.With(c.logAttrs()...)
+}
+
 func (c *RunningContainer) Stop() error {
-	fmt.Println("stopping", c)
+	c.logger().Debug("Stopping container")
 	ctx := context.Background()
 	if err := dockerClient.ContainerStop(ctx, c.containerID, container.StopOptions{}); err != nil {
 		return fmt.Errorf("failed to stop container %s: %v", c.containerID, err)
@@ -84,7 +145,7 @@ func (c *RunningContainer) Stop() error {
 }
 
 func (c *RunningContainer) Remove() error {
-	fmt.Println("removing", c)
+	c.logger().Debug("Removing container")
 	err := dockerClient.ContainerRemove(context.Background(), c.containerID, container.RemoveOptions{})
 	if err != nil {
 		return fmt.Errorf("Failed to remove container %s: %v", c.containerID, err)
@@ -109,14 +170,30 @@ func (c *RunningContainer) WaitForReady(timeout time.Duration) error {
 	if c.IsReady() {
 		return nil
 	}
-	err := WaitForHTTPGetOK(c.readyUrl, 100*time.Millisecond, timeout)
-	if err == nil {
-		c.rdyMu.Lock()
-		defer c.rdyMu.Unlock()
+	body, err := waitForHTTPGetOKBody(c.readyUrl, 100*time.Millisecond, timeout)
+	if err != nil {
+		return err
+	}
+	// Runtimes report how long loading took, older ones respond with a plain "OK".
+	var report protocol.ReadyResponse
+	json.Unmarshal(body, &report)
+
+	c.rdyMu.Lock()
+	defer c.rdyMu.Unlock()
+	if !c.isRdy {
 		c.rdyTime = time.Now()
 		c.isRdy = true
+		c.importDuration = time.Duration(report.ImportSeconds * float64(time.Second))
+		c.loadDuration = time.Duration(report.LoadSeconds * float64(time.Second))
 	}
-	return err
+	return nil
+}
+
+// Returns the time when this instance became ready, and false if it is not ready yet.
+func (c *RunningContainer) ReadyTime() (time.Time, bool) {
+	c.rdyMu.Lock()
+	defer c.rdyMu.Unlock()
+	return c.rdyTime, c.isRdy
 }
 
 func (c *RunningContainer) IsReady() bool {
@@ -134,8 +211,15 @@ type ContainerInterface interface {
 type Container struct {
 	image string
 	cmd   []string
+
+	// The memory limit of the container in MB. The container is not limited if not set, and billed at
+	// defaultMemoryMB.
+	memoryMB int64
 }
 
+// The memory tier of containers that do not set a memory limit, which their invocations are billed at.
+const defaultMemoryMB = 512
+
 func NewContainer(image string, cmd []string) Container {
 	return Container{
 		image: image,
@@ -143,6 +227,14 @@ func NewContainer(image string, cmd []string) Container {
 	}
 }
 
+// Returns the memory tier of the container in MB, which its invocations are billed at.
+func (c Container) memoryTierMB() int64 {
+	if c.memoryMB > 0 {
+		return c.memoryMB
+	}
+	return defaultMemoryMB
+}
+
 func preparePortBindings(portBindings map[string]string) (nat.PortSet, nat.PortMap, error) {
 	exposedPorts := nat.PortSet{}
 	portMap := nat.PortMap{}
@@ -181,8 +273,14 @@ func pickPort() (int, error) {
 const runtimePort = "5000"
 
 // Run the input image, with the input cmd as the entrypoint, and portBindings as port mapping.
-// The input image must be present locally.
+// The input image must be present locally, see ImageMgr.
 func (c Container) Run(name string) (*RunningContainer, error) {
+	return c.run(name, container.StartOptions{})
+}
+
+// Runs the container named name, started with startOpts, e.g., to restore a checkpoint.
+// The created container is removed if it fails to start.
+func (c Container) run(name string, startOpts container.StartOptions) (*RunningContainer, error) {
 	ctx := context.Background()
 
 	hostPort, err := pickPort()
@@ -196,28 +294,39 @@ func (c Container) Run(name string) (*RunningContainer, error) {
 		return nil, fmt.Errorf("Error preparing port binding, error: %v", err)
 	}
 
+	hostConfig := &container.HostConfig{PortBindings: portMap}
+	// Only versions setting memory_mb are limited, others keep the docker daemon's default.
+	if c.memoryMB > 0 {
+		hostConfig.Resources.Memory = c.memoryMB * 1024 * 1024
+	}
 	resp, err := dockerClient.ContainerCreate(ctx, &container.Config{
 		Image:        c.image,
 		Cmd:          c.cmd,
 		ExposedPorts: exposedPorts,
-	}, &container.HostConfig{
-		PortBindings: portMap,
-	}, &network.NetworkingConfig{}, nil /*platform*/, name)
+	}, hostConfig, &network.NetworkingConfig{}, nil /*platform*/, name)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create container: %v", err)
 	}
+	createdTime := time.Now()
 
-	if err := dockerClient.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+	if err := dockerClient.ContainerStart(ctx, resp.ID, startOpts); err != nil {
+		dockerClient.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
 		return nil, fmt.Errorf("failed to start container: %v", err)
 	}
+	startedTime := time.Now()
 
 	return &RunningContainer{
-		name:        name,
-		containerID: resp.ID,
-		Url:         fmt.Sprintf("http://localhost:%d/invoke", hostPort),
-		readyUrl:    fmt.Sprintf("http://localhost:%d/ready", hostPort),
-		concurLimit: 2,
-		launchTime:  time.Now(),
+		name:          name,
+		containerID:   resp.ID,
+		Url:           fmt.Sprintf("http://localhost:%d/invoke", hostPort),
+		readyUrl:      fmt.Sprintf("http://localhost:%d/ready", hostPort),
+		aliveUrl:      fmt.Sprintf("http://localhost:%d/alive", hostPort),
+		specializeUrl: fmt.Sprintf("http://localhost:%d/specialize", hostPort),
+		concurLimit:   2,
+		memoryMB:      c.memoryTierMB(),
+		launchTime:    startedTime,
+		createdTime:   createdTime,
+		startedTime:   startedTime,
 	}, nil
 }
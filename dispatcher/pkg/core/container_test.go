@@ -75,3 +75,9 @@ func TestWaitForReady(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, c.IsReady())
 }
+
+// TestContainerMemoryTier tests that containers without a memory limit are billed at the default memory tier
+func TestContainerMemoryTier(t *testing.T) {
+	assert.Equal(t, int64(defaultMemoryMB), NewContainer("runtime", nil).memoryTierMB())
+	assert.Equal(t, int64(1024), Container{image: "runtime", memoryMB: 1024}.memoryTierMB())
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronExpr is a parsed cron expression, with the 5 standard fields: minute, hour, day of month, month and day of week.
+// Each field is "*", a value, a range "a-b", or a comma-separated list of them, optionally with a step "/n". Months
+// and days of week can also be named by their first 3 letters. Like in cron, a time matches if either the day of
+// month or the day of week matches, when both are restricted.
+//
+// The macros @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly are also accepted.
+type CronExpr struct {
+	// Bit i is set if value i matches.
+	minute, hour, dom, month, dow uint64
+
+	// True if the field is "*" or starts with "*".
+	domStar, dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseCron parses the cron expression spec.
+func ParseCron(spec string) (CronExpr, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return CronExpr{}, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+
+	var e CronExpr
+	var err error
+	if e.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return CronExpr{}, fmt.Errorf("invalid minute field, error: %v", err)
+	}
+	if e.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return CronExpr{}, fmt.Errorf("invalid hour field, error: %v", err)
+	}
+	if e.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return CronExpr{}, fmt.Errorf("invalid day of month field, error: %v", err)
+	}
+	if e.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return CronExpr{}, fmt.Errorf("invalid month field, error: %v", err)
+	}
+	// 7 is also Sunday.
+	if e.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return CronExpr{}, fmt.Errorf("invalid day of week field, error: %v", err)
+	}
+	if e.dow&(1<<7) != 0 {
+		e.dow |= 1
+	}
+	e.domStar = strings.HasPrefix(fields[2], "*")
+	e.dowStar = strings.HasPrefix(fields[4], "*")
+	return e, nil
+}
+
+// Parses a field whose values are in [low, high]. names, if not nil, names the values from low.
+func parseCronField(field string, low, high int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		var start, end int
+		switch {
+		case rangePart == "*":
+			start, end = low, high
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = parseCronValue(bounds[0], low, names); err != nil {
+				return 0, err
+			}
+			if end, err = parseCronValue(bounds[1], low, names); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := parseCronValue(rangePart, low, names)
+			if err != nil {
+				return 0, err
+			}
+			start, end = v, v
+			if step > 1 {
+				// "a/n" means from a to the end.
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return 0, fmt.Errorf("%q is out of range [%d, %d]", part, low, high)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, low int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return low + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+func (e CronExpr) matchesDay(t time.Time) bool {
+	domMatch := e.dom&(1<<t.Day()) != 0
+	dowMatch := e.dow&(1<<t.Weekday()) != 0
+	if e.domStar || e.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time matching e strictly after t, in t's location. Returns the zero time if none matches
+// within 5 years, e.g., for "0 0 30 2 *".
+func (e CronExpr) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case e.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !e.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case e.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case e.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"*/0 * * * *", "5-1 * * * *", "x * * * *", "* * * * 8"} {
+		_, err := ParseCron(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCronExpr_Next(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 30, 15, 0, time.UTC) // Wednesday
+	for spec, want := range map[string]time.Time{
+		"* * * * *":            time.Date(2024, 1, 31, 10, 31, 0, 0, time.UTC),
+		"*/15 * * * *":         time.Date(2024, 1, 31, 10, 45, 0, 0, time.UTC),
+		"30 10 * * *":          time.Date(2024, 2, 1, 10, 30, 0, 0, time.UTC),
+		"0 9-17/4 * * *":       time.Date(2024, 1, 31, 13, 0, 0, 0, time.UTC),
+		"@hourly":              time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC),
+		"@monthly":             time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 29 feb *":         time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 * * sun":          time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":            time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC),
+		"0 8 * * mon-fri":      time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC),
+		"0 0 15 * fri":         time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC),
+		"0,20 10,12 * * *":     time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+		"0 0 1 jan,jul *":      time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 30 2 *":           {},
+		"0 12 31 * *":          time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+		"5 4 31 4,6,9,11,12 *": time.Date(2024, 12, 31, 4, 5, 0, 0, time.UTC),
+	} {
+		e, err := ParseCron(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, want, e.Next(from), spec)
+	}
+}
+
+func TestCronExpr_NextInLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+5:30", 5*3600+1800)
+	e, err := ParseCron("0 9 * * *")
+	assert.NoError(t, err)
+	from := time.Date(2024, 1, 31, 10, 0, 0, 0, loc)
+	assert.Equal(t, time.Date(2024, 2, 1, 9, 0, 0, 0, loc), e.Next(from))
+}
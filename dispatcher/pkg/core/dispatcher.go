@@ -1,10 +1,23 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"serverless/dispatcher/pkg/protocol"
 )
 
 type dispatcherConfig struct {
@@ -23,6 +36,12 @@ type Dispatcher struct {
 	// Launcher launches container instance on incoming requests.
 	launcher Launcher
 
+	// VersionMgr keeps the versions and aliases of functions, and resolves invocations to versions.
+	versionMgr VersionMgr
+
+	// RolloutMgr shifts aliases to new versions step by step, rolling back on regressions.
+	rolloutMgr *RolloutMgr
+
 	// PermMgr checks user's permission to call function.
 	permMgr PermMgr
 
@@ -31,14 +50,60 @@ type Dispatcher struct {
 
 	// APIUsageTracker tracks users' execution time of serving function invocations.
 	apiUsageTracker APIUsageTracker
+
+	// BillingMgr records every invocation in the ledger, and charges users according to their pricing plans.
+	billingMgr BillingMgr
+
+	// Proxy forwards invocations to instances, with per-function timeouts.
+	proxy *Proxy
+
+	// RetryMgr determines which failed invocations are retried on other instances.
+	retryMgr RetryMgr
+
+	// HealthMgr ejects failing and slow instances from routing.
+	healthMgr HealthMgr
+
+	// ColdStartTracker keeps the phase breakdowns of recent cold starts.
+	coldStartTracker ColdStartTracker
+
+	// Builder builds the sources of functions into images on top of the runtime image.
+	builder *Builder
+
+	// ImageMgr checks that the images of function versions are available. Nil until CheckImages is called.
+	imageMgr *ImageMgr
+
+	// AsyncMgr queues and dispatches asynchronous invocations. Nil until StartAsync is called.
+	asyncMgr *AsyncMgr
+
+	// WebhookMgr delivers the results of asynchronous invocations to their callback URLs. Nil until StartAsync is
+	// called.
+	webhookMgr *WebhookMgr
+
+	// ScheduleMgr fires scheduled invocations. Nil until StartScheduler is called.
+	scheduleMgr *ScheduleMgr
+
+	metrics *DispatcherMetrics
+}
+
+// The pricing plan applied to users without an assigned plan.
+var defaultPricingPlan = PricingPlan{
+	PerRequest:         0.0000002,
+	PerGBSecond:        0.0000166667,
+	ColdStartSurcharge: 0.00001,
 }
 
-func NewDispatcher(runtimeImage string) Dispatcher {
-	dispatcher := Dispatcher{
-		launcher:        NewLauncher(time.Second),
-		permMgr:         NewPermMgr(),
-		apiLimitMgr:     NewAPILimitMgr(3 /*default*/),
-		apiUsageTracker: NewAPIUsageTracker(),
+func NewDispatcher(runtimeImage string) *Dispatcher {
+	dispatcher := &Dispatcher{
+		launcher:         NewLauncher(time.Second),
+		permMgr:          NewPermMgr(),
+		apiLimitMgr:      NewAPILimitMgr(3 /*default*/),
+		apiUsageTracker:  NewAPIUsageTracker(),
+		billingMgr:       NewBillingMgr(defaultPricingPlan),
+		proxy:            NewProxy(),
+		retryMgr:         NewRetryMgr(),
+		healthMgr:        NewHealthMgr(DefaultOutlierPolicy()),
+		coldStartTracker: NewColdStartTracker(),
+		builder:          NewBuilder(runtimeImage),
 	}
 
 	alphaContainer := Container{
@@ -51,14 +116,45 @@ func NewDispatcher(runtimeImage string) Dispatcher {
 		cmd:   []string{"python", "runtime.py", "--file=runtime_beta.py", "--class_name=RuntimeBeta"},
 	}
 
+	// Streams its output token by token.
+	gammaContainer := Container{
+		image: runtimeImage,
+		cmd:   []string{"python", "runtime.py", "--file=runtime_gamma.py", "--class_name=RuntimeGamma"},
+	}
+
 	dispatcher.cfg.defaultMaxInstCountPerFn = 3
-	dispatcher.launcher.registerContainer("alpha", alphaContainer)
-	dispatcher.launcher.registerContainer("beta", betaContainer)
+	dispatcher.versionMgr = NewVersionMgr(&dispatcher.launcher)
+	dispatcher.versionMgr.register("alpha", alphaContainer, "RuntimeAlpha")
+	dispatcher.versionMgr.register("beta", betaContainer, "RuntimeBeta")
+	dispatcher.versionMgr.register("gamma", gammaContainer, "RuntimeGamma")
+	dispatcher.launcher.addListener(&dispatcher.apiUsageTracker)
+	dispatcher.launcher.addListener(&dispatcher.healthMgr)
+	dispatcher.launcher.warmPool = NewWarmPool(runtimeImage)
+	dispatcher.metrics = newDispatcherMetrics(&dispatcher.launcher, &dispatcher.healthMgr)
+	dispatcher.launcher.onLaunched = func(fn, from string) {
+		dispatcher.metrics.launches.Inc(fn, from)
+	}
+	dispatcher.launcher.onSnapshot = func(fn, result string) {
+		dispatcher.metrics.snapshots.Inc(fn, result)
+	}
+	dispatcher.rolloutMgr = NewRolloutMgr(&dispatcher.versionMgr)
+	dispatcher.rolloutMgr.onFinished = func(fn string, state RolloutState) {
+		dispatcher.metrics.rollouts.Inc(fn, string(state))
+	}
+	dispatcher.metrics.registry.AddCollector(func() {
+		dispatcher.metrics.rolloutPercent.Reset()
+		for _, r := range dispatcher.rolloutMgr.List() {
+			if r.State == RolloutRunning {
+				dispatcher.metrics.rolloutPercent.Set(float64(r.Percent), r.Fn)
+			}
+		}
+	})
 	// Start the monitoring goroutine to constantly watch utnization ratio and launch/shutdown instance accordingly.
 	go dispatcher.launcher.MonitorForever()
 
 	dispatcher.permMgr.AllowUserAPI("test", "alpha")
 	dispatcher.permMgr.AllowUserAPI("test", "beta")
+	dispatcher.permMgr.AllowUserAPI("test", "gamma")
 
 	return dispatcher
 }
@@ -78,11 +174,82 @@ func (d *Dispatcher) SetAPIConcurLimit(limit int64) {
 	d.apiLimitMgr.SetLimit(limit)
 }
 
+// Sets the concurrency limit of function fn, overriding the limit set by SetAPIConcurLimit.
+// A limit of 0 rejects all calls to fn.
+func (d *Dispatcher) SetFnAPIConcurLimit(fn string, limit int64) {
+	d.apiLimitMgr.SetAPILimit(fn, limit)
+}
+
+// Sets the count of idle generic runtime containers kept warm, to be specialized into instances of any function
+// running the runtime image. 0 disables the warm pool.
+func (d *Dispatcher) SetWarmPoolSize(size int) {
+	d.launcher.warmPool.Resize(size)
+}
+
+// Sets how the first ready instance of each function version is snapshotted, for later instances of the version to
+// be restored from. Checkpoints are stored under checkpointDir, which is required with SnapshotCheckpoint.
+func (d *Dispatcher) SetSnapshotMode(mode SnapshotMode, checkpointDir string) error {
+	s, err := newSnapshotter(mode, checkpointDir)
+	if err != nil {
+		return err
+	}
+	d.launcher.setSnapshotter(s)
+	return nil
+}
+
+// Sets the timeout of invocations of functions without a per-function timeout. A timeout of 0 disables it.
+func (d *Dispatcher) SetInvokeTimeout(timeout time.Duration) {
+	d.proxy.SetDefaultTimeout(timeout)
+}
+
+// Sets the timeout of invocations of function fn, from proxying the request to the end of the response.
+// Invocations timed out fail with 504.
+func (d *Dispatcher) SetFnInvokeTimeout(fn string, timeout time.Duration) {
+	d.proxy.SetFnTimeout(fn, timeout)
+}
+
+// Allows user to call the admin APIs.
+func (d *Dispatcher) AllowAdmin(user string) {
+	d.permMgr.AllowAdmin(user)
+}
+
 func (d *Dispatcher) GetAPILimitMgr() *APILimitMgr {
 	return &d.apiLimitMgr
 }
 
+func (d *Dispatcher) GetVersionMgr() *VersionMgr {
+	return &d.versionMgr
+}
+
+func (d *Dispatcher) GetRolloutMgr() *RolloutMgr {
+	return d.rolloutMgr
+}
+
+func (d *Dispatcher) GetRetryMgr() *RetryMgr {
+	return &d.retryMgr
+}
+
+func (d *Dispatcher) GetHealthMgr() *HealthMgr {
+	return &d.healthMgr
+}
+
+func (d *Dispatcher) GetAPIUsageTracker() *APIUsageTracker {
+	return &d.apiUsageTracker
+}
+
+func (d *Dispatcher) GetBillingMgr() *BillingMgr {
+	return &d.billingMgr
+}
+
 func (d *Dispatcher) Shutdown() {
+	if d.scheduleMgr != nil {
+		d.scheduleMgr.Stop()
+	}
+	d.rolloutMgr.Stop()
+	if d.asyncMgr != nil {
+		d.asyncMgr.Stop()
+		d.webhookMgr.Stop()
+	}
 	d.launcher.ShutdownAll()
 }
 
@@ -91,8 +258,77 @@ type CallContext struct {
 	// The name of the function to invoke.
 	Fn string
 
+	// The version of the function to invoke: a version number, "latest", or an alias. The default alias if empty.
+	Version string
+
 	// The timeout waiting for the function instance to become ready.
 	InstRdyTimeout time.Duration
+
+	// The timeout waiting for a free slot when the function's concurrency limit is reached.
+	// Uses defaultLimitWaitTimeout if not set.
+	LimitWaitTimeout time.Duration
+}
+
+const defaultLimitWaitTimeout = 10 * time.Second
+
+func (ctx CallContext) limitWaitTimeout() time.Duration {
+	if ctx.LimitWaitTimeout > 0 {
+		return ctx.LimitWaitTimeout
+	}
+	return defaultLimitWaitTimeout
+}
+
+// A cold start fails after failing to launch an instance this many times, waiting exponentially longer between
+// attempts, from coldStartBackoff up to maxColdStartBackoff.
+const (
+	maxColdStartAttempts = 3
+	coldStartBackoff     = 100 * time.Millisecond
+	maxColdStartBackoff  = time.Second
+)
+
+// Asks the launcher for an instance of version of function fn for an invocation of user, traced by the span of ctx,
+// retrying failed launches up to maxColdStartAttempts times. Fails once ctx is done, e.g., the client is gone.
+func (d *Dispatcher) coldStart(ctx context.Context, fn string, version int, user string) (*RunningContainer, error) {
+	for attempt := 1; ; attempt++ {
+		// Buffered, so that the launcher never blocks once ctx is done.
+		rcChan := make(chan *RunningContainer, 1)
+		n := launchNotification{fn, version, user, trace.SpanContextFromContext(ctx), rcChan}
+		select {
+		case d.launcher.launchNotifier <- n:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		select {
+		case rc := <-rcChan:
+			if rc != nil {
+				return rc, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if attempt >= maxColdStartAttempts {
+			return nil, fmt.Errorf("failed launching an instance %d times", attempt)
+		}
+		select {
+		case <-time.After(jitteredBackoff(coldStartBackoff, maxColdStartBackoff, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Writes the response for a call rejected by APILimitMgr.
+func writeAPILimitError(w http.ResponseWriter, fn string, err error) {
+	switch {
+	case errors.Is(err, ErrAPILimitReached):
+		w.Header().Set("Retry-After", "1")
+		writeInvokeError(w, protocol.ErrorRateLimited, fmt.Sprintf("Too many concurrent calls to function %s", fn))
+	case errors.Is(err, ErrAPIDisabled):
+		writeInvokeError(w, protocol.ErrorUnavailable, fmt.Sprintf("Function %s is not accepting calls", fn))
+	default:
+		writeInvokeError(w, protocol.ErrorUnavailable,
+			fmt.Sprintf("Gave up waiting for function %s, error: %v", fn, err))
+	}
 }
 
 // Option #1: Queue requests, and let another processor goroutine to fetch request, and send back responses.
@@ -107,43 +343,184 @@ type CallContext struct {
 //
 // Option #2: Handle requests inside Dispatch, and wait for another goroutine to start new instances.
 func (d *Dispatcher) Dispatch(ctx CallContext, w http.ResponseWriter, r *http.Request) {
+	receivedTime := time.Now()
+
+	// Checked before anything else, so that unknown functions never show up in logs, metrics and traces.
+	if !d.launcher.HasFn(ctx.Fn) {
+		writeInvokeError(w, protocol.ErrorNotFound, fmt.Sprintf("Function %s not found", ctx.Fn))
+		return
+	}
+	version, err := d.versionMgr.Resolve(ctx.Fn, ctx.Version, r.Header.Get("User"))
+	if err != nil {
+		writeInvokeError(w, protocol.ErrorNotFound,
+			fmt.Sprintf("Version %s of function %s not found", ctx.Version, ctx.Fn))
+		return
+	}
+	w.Header().Set(versionHeader, strconv.Itoa(version))
+
+	// Each phase is traced as a child span of the invocation's span, which continues the caller's trace if any.
+	spanCtx, span := tracer().Start(
+		otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)),
+		"Dispatch", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(fnAttr(ctx.Fn), versionAttr(version)))
+	defer span.End()
+
+	// The request ID correlates the log lines of the invocation, in both the dispatcher and the runtime.
+	reqID := r.Header.Get(requestIDHeader)
+	if reqID == "" {
+		reqID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, reqID)
+	span.SetAttributes(attribute.String("serverless.request_id", reqID))
+	logger := slog.With(logKeyRequestID, reqID, logKeyFn, ctx.Fn, logKeyVersion, version)
+	r = r.WithContext(withRequestID(spanCtx, reqID))
+
+	sw := newStatusRecorder(w)
+	w = sw
+	defer func() {
+		logger.Info("Served invocation", "status", sw.status, "duration", time.Since(receivedTime))
+		d.metrics.observeInvocation(ctx.Fn, sw.status, time.Since(receivedTime))
+		if sw.status >= http.StatusBadRequest {
+			d.metrics.observeInvocationError(ctx.Fn, sw.Header())
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}()
+
 	user := r.Header.Get("User")
 	if user == "" {
-		http.Error(w, "User header not provided", http.StatusBadRequest)
+		writeInvokeError(w, protocol.ErrorInvalidRequest, "User header not provided")
+		return
+	}
+	span.SetAttributes(userAttr(user))
+	logger = logger.With(logKeyUser, user)
+
+	_, permSpan := tracer().Start(spanCtx, "CheckPermission")
+	allowed := d.permMgr.IsUserAllowed(user, ctx.Fn)
+	permSpan.End()
+	if !allowed {
+		writeInvokeError(w, protocol.ErrorForbidden,
+			fmt.Sprintf("User %s is not allowed to call function %s", user, ctx.Fn))
+		return
+	}
+
+	if state, retryAfter := d.healthMgr.Breaker(ctx.Fn); state == BreakerOpen {
+		logger.Warn("Rejected by open circuit breaker")
+		d.metrics.breakerRejections.Inc(ctx.Fn)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeInvokeError(w, protocol.ErrorUnavailable, fmt.Sprintf("All instances of function %s are failing", ctx.Fn))
 		return
 	}
 
-	if !d.permMgr.IsUserAllowed(user, ctx.Fn) {
-		http.Error(w, fmt.Sprintf("User %s is not allowed to call function %s", user, ctx.Fn), http.StatusForbidden)
+	if err := d.imageUnavailable(ctx.Fn, version); err != nil {
+		logger.Warn("Rejected as the image is unavailable", "error", err)
+		writeInvokeError(w, protocol.ErrorUnavailable,
+			fmt.Sprintf("Version %d of function %s is unavailable, error: %v", version, ctx.Fn, err))
 		return
 	}
 
-	rc, err := d.launcher.PickInst(ctx.Fn)
+	d.metrics.queueDepth.Add(1, ctx.Fn)
+	queued := true
+	dequeue := func() {
+		if queued {
+			d.metrics.queueDepth.Add(-1, ctx.Fn)
+			queued = false
+		}
+	}
+	defer dequeue()
 
+	// Acquire before picking an instance, so that rejected calls never trigger cold starts.
+	_, limitSpan := tracer().Start(spanCtx, "AcquireLimit")
+	err = d.apiLimitMgr.StartAPICall(r.Context(), ctx.Fn, ctx.limitWaitTimeout())
+	endSpan(limitSpan, err)
 	if err != nil {
-		log.Println("Cold start, need to create an instance for function:", ctx.Fn)
-		for {
-			rcChan := make(chan *RunningContainer)
-			d.launcher.launchNotifier <- launchNotification{ctx.Fn, rcChan}
-			rc = <-rcChan
-			if rc != nil {
-				break
-			}
+		logger.Warn("Rejected by concurrency limit", "error", err)
+		d.metrics.limitRejections.Inc(ctx.Fn, limitRejectionReason(err))
+		writeAPILimitError(w, ctx.Fn, err)
+		return
+	}
+	defer d.apiLimitMgr.FinishAPICall(ctx.Fn)
+
+	rc, err := d.launcher.pickInst(ctx.Fn, func(rc *RunningContainer) bool {
+		return rc.version == version && d.healthMgr.isRoutable(rc)
+	})
+
+	coldStart := err != nil
+	coldStartTime := time.Now()
+	if coldStart {
+		logger.Info("Cold start, need to create an instance")
+		coldStartCtx, coldStartSpan := tracer().Start(spanCtx, "ColdStart")
+		rc, err = d.coldStart(coldStartCtx, ctx.Fn, version, user)
+		if err != nil {
+			endSpan(coldStartSpan, err)
+			logger.Error("Failed to launch an instance", "error", err)
+			writeInvokeError(w, protocol.ErrorUnavailable,
+				fmt.Sprintf("No capacity to serve function %s, error: %v", ctx.Fn, err))
+			return
+		}
+		coldStartSpan.SetAttributes(instAttr(rc))
+		coldStartSpan.End()
+		if rc.launchSpanCtx.IsValid() {
+			span.AddLink(trace.Link{SpanContext: rc.launchSpanCtx})
 		}
 	}
+	span.SetAttributes(instAttr(rc))
+	logger = logger.With(logKeyInstance, rc.name, logKeyContainerID, rc.containerID)
+	r = r.WithContext(withLogger(r.Context(), logger))
 
+	_, rdySpan := tracer().Start(spanCtx, "WaitForReady")
 	err = rc.WaitForReady(ctx.InstRdyTimeout)
+	endSpan(rdySpan, err)
+	if errors.Is(err, errServerFailed) {
+		// The runtime failed loading the function, so the instance never becomes ready.
+		logger.Error("Instance failed loading the function", "error", err)
+		go d.launcher.shutdownInst(rc)
+		writeInvokeError(w, protocol.ErrorFunction, fmt.Sprintf("Instance failed loading the function, error: %v", err))
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Timeout waiting for the instance to become ready, error: %v", err),
-			http.StatusInternalServerError)
+		logger.Error("Timeout waiting for the instance to become ready", "error", err)
+		writeInvokeError(w, protocol.ErrorNotReady,
+			fmt.Sprintf("Timeout waiting for the instance to become ready, error: %v", err))
 		return
 	}
+	if coldStart {
+		d.metrics.observeColdStart(ctx.Fn, time.Since(coldStartTime))
+		d.launcher.instReady(rc)
+	}
+	if breakdown, ok := rc.takeColdStart(); ok {
+		d.coldStartTracker.record(ctx.Fn, breakdown)
+		d.metrics.observeColdStartPhases(ctx.Fn, breakdown)
+	}
 
-	d.apiLimitMgr.StartAPICall(ctx.Fn, 10*time.Second)
+	dequeue()
 	apiStartTime := d.apiUsageTracker.StartAPICall(user)
-	ProxyRequest(rc.Url, w, r)
-	d.apiUsageTracker.EndAPICall(user, apiStartTime)
+	rc, err = d.invoke(ctx, rc, w, r)
+	if err != nil {
+		d.metrics.proxyErrors.Inc(ctx.Fn)
+	}
+	d.apiUsageTracker.EndInstanceAPICall(user, rc, apiStartTime)
 	callDuration := time.Now().Sub(apiStartTime)
-	rc.AddBusyTime(callDuration)
-	d.apiLimitMgr.FinishAPICall(ctx.Fn)
+	var errSource protocol.ErrorSource
+	if sw.status >= http.StatusBadRequest {
+		errSource = protocol.ErrorSource(sw.Header().Get(errorSourceHeader))
+	}
+
+	d.billingMgr.Record(LedgerEntry{
+		User:         user,
+		Fn:           ctx.Fn,
+		Instance:     rc.name,
+		ReceivedTime: receivedTime,
+		QueuedTime:   apiStartTime.Sub(receivedTime),
+		ColdStart:    coldStart,
+		ExecTime:     callDuration,
+		MemoryMB:     rc.memoryMB,
+		ErrorSource:  errSource,
+	})
+
+	if errors.Is(err, errResponseAborted) {
+		// Aborts the connection, so that the client sees the response is incomplete.
+		panic(http.ErrAbortHandler)
+	}
 }
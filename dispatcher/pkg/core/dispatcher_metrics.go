@@ -0,0 +1,264 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DispatcherMetrics holds the metrics of Dispatcher, exposed through RegisterMetricsRoutes.
+type DispatcherMetrics struct {
+	registry *MetricsRegistry
+
+	// The invocations served, and their end-to-end latency, by function and HTTP status.
+	invocations        CounterVec
+	invocationDuration HistogramVec
+	// The failed invocations, by function, source and type of the error, see protocol.ErrorSource.
+	invocationErrors CounterVec
+
+	// The invocations that had to launch a new instance, and the time from launching to the instance becoming ready,
+	// by function.
+	coldStarts        CounterVec
+	coldStartDuration HistogramVec
+	// The time instances spent in each phase of their launch, by function and phase, see ColdStartBreakdown.
+	coldStartPhaseDuration HistogramVec
+
+	// The instances launched, by function and how they were launched, the snapshots of instances by function and
+	// result, and the idle containers in the warm pool.
+	launches           CounterVec
+	snapshots          CounterVec
+	warmPoolContainers GaugeVec
+
+	// The invocations received but not yet proxied to an instance, by function.
+	queueDepth GaugeVec
+
+	// The instances by function and state, collected from Launcher.
+	instances GaugeVec
+
+	// The utilization ratios last calculated by Launcher.MonitorForever, by function.
+	utilRatio GaugeVec
+
+	// The invocations failed to be proxied to the instance, by function.
+	proxyErrors CounterVec
+
+	// The invocations rejected by APILimitMgr, by function and reason.
+	limitRejections CounterVec
+
+	// The attempts made in addition to the first one of invocations, by function and kind, i.e., retry or hedge.
+	retries CounterVec
+
+	// The retries and hedged requests not made because the retry budget is exhausted, by function.
+	retryBudgetExhausted CounterVec
+
+	// The instances ejected from routing, by function and reason, and the ones currently ejected, by function.
+	ejections        CounterVec
+	ejectedInstances GaugeVec
+
+	// The state of circuit breakers, 1 for the current state of each function and 0 for the others.
+	breakerState GaugeVec
+
+	// The invocations failed fast by open circuit breakers, by function.
+	breakerRejections CounterVec
+
+	// The asynchronous invocations finished, by function and status, and the queued ones, by function.
+	asyncInvocations CounterVec
+	asyncQueueDepth  GaugeVec
+
+	// The retries of failed asynchronous invocations, and the dead letters kept, by function.
+	asyncRetries     CounterVec
+	asyncDeadLetters GaugeVec
+
+	// The attempts of delivering callbacks of asynchronous invocations, by function and result, i.e., delivered,
+	// retried or dead_letter.
+	webhookDeliveries CounterVec
+
+	// The pulls of missing images, by result, i.e., succeeded or failed.
+	imagePulls CounterVec
+
+	// The due runs of schedules, by schedule and result, i.e., fired, skipped_missed, skipped_overlap or failed.
+	scheduleRuns CounterVec
+
+	// The rollouts finished, by function and state, i.e., completed or rolled_back, and the percentage of traffic sent
+	// to the new version by running rollouts, by function.
+	rollouts       CounterVec
+	rolloutPercent GaugeVec
+}
+
+func newDispatcherMetrics(l *Launcher, h *HealthMgr) *DispatcherMetrics {
+	r := NewMetricsRegistry()
+	m := &DispatcherMetrics{
+		registry: r,
+		invocations: r.NewCounterVec("serverless_invocations_total",
+			"The number of function invocations served.", "fn", "status"),
+		invocationDuration: r.NewHistogramVec("serverless_invocation_duration_seconds",
+			"The end-to-end latency of function invocations.", defaultDurationBuckets, "fn", "status"),
+		invocationErrors: r.NewCounterVec("serverless_invocation_errors_total",
+			"The number of failed function invocations, by whether the client, the function or the platform failed "+
+				"them, and the type of error.", "fn", "source", "type"),
+		coldStarts: r.NewCounterVec("serverless_cold_starts_total",
+			"The number of invocations that launched a new instance.", "fn"),
+		coldStartDuration: r.NewHistogramVec("serverless_cold_start_duration_seconds",
+			"The time from launching an instance for an invocation to the instance becoming ready.",
+			defaultDurationBuckets, "fn"),
+		coldStartPhaseDuration: r.NewHistogramVec("serverless_cold_start_phase_duration_seconds",
+			"The time instances spent in each phase of their launch until first ready, i.e., create, start, init, "+
+				"import or load.", defaultDurationBuckets, "fn", "phase"),
+		launches: r.NewCounterVec("serverless_instance_launches_total",
+			"The number of instances launched, by whether they were run from the template, specialized from the "+
+				"warm pool, or restored from a snapshot.", "fn", "from"),
+		snapshots: r.NewCounterVec("serverless_snapshots_total",
+			"The number of instance snapshots by result, i.e., taken, failed or restore_failed.", "fn", "result"),
+		warmPoolContainers: r.NewGaugeVec("serverless_warm_pool_containers",
+			"The number of generic runtime containers by state, i.e., idle or target.", "state"),
+		queueDepth: r.NewGaugeVec("serverless_queue_depth",
+			"The number of invocations received but not yet proxied to an instance.", "fn"),
+		instances: r.NewGaugeVec("serverless_instances",
+			"The number of instances by state.", "fn", "state"),
+		utilRatio: r.NewGaugeVec("serverless_utilization_ratio",
+			"The utilization ratio used by the launcher to scale instances.", "fn"),
+		proxyErrors: r.NewCounterVec("serverless_proxy_errors_total",
+			"The number of invocations failed to be proxied to the instance.", "fn"),
+		limitRejections: r.NewCounterVec("serverless_limit_rejections_total",
+			"The number of invocations rejected by the concurrency limit.", "fn", "reason"),
+		retries: r.NewCounterVec("serverless_retries_total",
+			"The number of retried and hedged attempts of invocations.", "fn", "kind"),
+		retryBudgetExhausted: r.NewCounterVec("serverless_retry_budget_exhausted_total",
+			"The number of retries and hedged requests not made because the retry budget is exhausted.", "fn"),
+		ejections: r.NewCounterVec("serverless_instance_ejections_total",
+			"The number of times instances were ejected from routing as outliers.", "fn", "reason"),
+		ejectedInstances: r.NewGaugeVec("serverless_ejected_instances",
+			"The number of instances currently ejected from routing.", "fn"),
+		breakerState: r.NewGaugeVec("serverless_circuit_breaker_state",
+			"The state of circuit breakers, 1 for the current state.", "fn", "state"),
+		breakerRejections: r.NewCounterVec("serverless_circuit_breaker_rejections_total",
+			"The number of invocations failed fast by open circuit breakers.", "fn"),
+		asyncInvocations: r.NewCounterVec("serverless_async_invocations_total",
+			"The number of asynchronous invocations finished.", "fn", "status"),
+		asyncQueueDepth: r.NewGaugeVec("serverless_async_queue_depth",
+			"The number of asynchronous invocations queued.", "fn"),
+		asyncRetries: r.NewCounterVec("serverless_async_retries_total",
+			"The number of retries of failed asynchronous invocations.", "fn"),
+		asyncDeadLetters: r.NewGaugeVec("serverless_async_dead_letters",
+			"The number of asynchronous invocations failed after all retries, kept until replayed or purged.", "fn"),
+		webhookDeliveries: r.NewCounterVec("serverless_webhook_deliveries_total",
+			"The number of callbacks of asynchronous invocations delivered, retried and given up.", "fn", "result"),
+		imagePulls: r.NewCounterVec("serverless_image_pulls_total",
+			"The number of pulls of missing images by result, i.e., succeeded or failed.", "result"),
+		scheduleRuns: r.NewCounterVec("serverless_schedule_runs_total",
+			"The number of due runs of schedules, by whether they were fired or skipped.", "schedule", "result"),
+		rollouts: r.NewCounterVec("serverless_rollouts_total",
+			"The number of rollouts finished, by whether they completed or rolled back.", "fn", "state"),
+		rolloutPercent: r.NewGaugeVec("serverless_rollout_traffic_percent",
+			"The percentage of traffic sent to the new version by running rollouts.", "fn"),
+	}
+	r.AddCollector(func() {
+		m.instances.Reset()
+		for fn, states := range l.InstStates() {
+			for state, count := range states {
+				m.instances.Set(float64(count), fn, state)
+			}
+		}
+		m.utilRatio.Reset()
+		for fn, ratio := range l.UtilRatios() {
+			m.utilRatio.Set(ratio, fn)
+		}
+		if l.warmPool != nil {
+			idle, size := l.warmPool.Size()
+			m.warmPoolContainers.Set(float64(idle), "idle")
+			m.warmPoolContainers.Set(float64(size), "target")
+		}
+		m.ejectedInstances.Reset()
+		m.breakerState.Reset()
+		for fn, fh := range h.Snapshot() {
+			ejected := 0
+			for _, ih := range fh.Instances {
+				if ih.Ejected {
+					ejected++
+				}
+			}
+			m.ejectedInstances.Set(float64(ejected), fn)
+			for _, state := range []BreakerState{BreakerClosed, BreakerHalfOpen, BreakerOpen} {
+				value := 0.0
+				if state == fh.Breaker {
+					value = 1
+				}
+				m.breakerState.Set(value, fn, string(state))
+			}
+		}
+	})
+	return m
+}
+
+func (m *DispatcherMetrics) observeInvocation(fn string, status int, d time.Duration) {
+	s := strconv.Itoa(status)
+	m.invocations.Inc(fn, s)
+	m.invocationDuration.Observe(d.Seconds(), fn, s)
+}
+
+// Observes the failed invocation of function fn, whose error response has header.
+func (m *DispatcherMetrics) observeInvocationError(fn string, header http.Header) {
+	source, t := header.Get(errorSourceHeader), header.Get(errorTypeHeader)
+	if source == "" {
+		source, t = "unknown", "unknown"
+	}
+	m.invocationErrors.Inc(fn, source, t)
+}
+
+func (m *DispatcherMetrics) observeColdStart(fn string, d time.Duration) {
+	m.coldStarts.Inc(fn)
+	m.coldStartDuration.Observe(d.Seconds(), fn)
+}
+
+func (m *DispatcherMetrics) observeColdStartPhases(fn string, b ColdStartBreakdown) {
+	for phase, d := range b.phases() {
+		m.coldStartPhaseDuration.Observe(d.Seconds(), fn, phase)
+	}
+}
+
+// Returns the reason label of limit rejection err.
+func limitRejectionReason(err error) string {
+	switch {
+	case errors.Is(err, ErrAPILimitReached):
+		return "limit_reached"
+	case errors.Is(err, ErrAPIDisabled):
+		return "disabled"
+	}
+	return "canceled"
+}
+
+// Registers GET /metrics onto r, serving the metrics in the Prometheus text exposition format.
+func (d *Dispatcher) RegisterMetricsRoutes(r *mux.Router) {
+	r.Handle("/metrics", d.metrics.registry).Methods(http.MethodGet)
+}
+
+// Records the status code written to the wrapped http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// The time when the status is written, zero if written implicitly.
+	headerTime time.Time
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.headerTime = time.Now()
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Allows http.ResponseController to reach the wrapped http.ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+func newTestDispatchRequest(user string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/alpha", nil)
+	req.Header.Set("User", user)
+	return req
+}
+
+// TestDispatch_Permission tests that requests without a permitted user are rejected
+func TestDispatch_Permission(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	ctx := CallContext{Fn: "alpha"}
+
+	w := httptest.NewRecorder()
+	d.Dispatch(ctx, w, newTestDispatchRequest(""))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	d.Dispatch(ctx, w, newTestDispatchRequest("stranger"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestDispatch_APILimit tests that calls rejected by the concurrency limit are mapped to 429 and 503
+func TestDispatch_APILimit(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	ctx := CallContext{Fn: "alpha", LimitWaitTimeout: 50 * time.Millisecond}
+
+	d.SetFnAPIConcurLimit("alpha", 0)
+	w := httptest.NewRecorder()
+	d.Dispatch(ctx, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	d.SetFnAPIConcurLimit("alpha", 1)
+	assert.NoError(t, d.GetAPILimitMgr().StartAPICall(context.Background(), "alpha", time.Second))
+	w = httptest.NewRecorder()
+	d.Dispatch(ctx, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, int64(1), d.GetAPILimitMgr().GetConcurrentCallCount("alpha"))
+
+	assert.Equal(t, 1.0, d.metrics.limitRejections.Value("alpha", "disabled"))
+	assert.Equal(t, 1.0, d.metrics.limitRejections.Value("alpha", "limit_reached"))
+	assert.Equal(t, 1.0, d.metrics.invocations.Value("alpha", "429"))
+	assert.Equal(t, 0.0, d.metrics.queueDepth.Value("alpha"))
+}
+
+// TestDispatch_UnknownFn tests that invocations of unknown functions get 404
+func TestDispatch_UnknownFn(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "delta"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestDispatch_LaunchFails tests that cold starts give up after failing to launch a few times, or once the client is
+// gone, releasing the concurrency slot
+func TestDispatch_LaunchFails(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	c := new(MockContainer)
+	c.On("Run").Return((*RunningContainer)(nil), errors.New("no capacity"))
+	d.launcher.registerContainer("alpha", c)
+
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var resp protocol.ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, protocol.ErrorUnavailable, resp.Error.Type)
+	assert.Equal(t, protocol.SourcePlatform, resp.Error.Source)
+	c.AssertNumberOfCalls(t, "Run", maxColdStartAttempts)
+	assert.Equal(t, int64(0), d.GetAPILimitMgr().GetConcurrentCallCount("alpha"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test").WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(0), d.GetAPILimitMgr().GetConcurrentCallCount("alpha"))
+}
+
+// TestDispatch_LoadFails tests that instances failing to load their function are removed, without waiting for the
+// ready timeout
+func TestDispatch_LoadFails(t *testing.T) {
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusInternalServerError, protocol.ErrorResponse{Error: protocol.Error{
+			Type: protocol.ErrorFunction, Message: "Failed loading RuntimeAlpha of runtime_alpha.py"}})
+	}))
+	defer runtime.Close()
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	c := new(MockContainer)
+	rc := &RunningContainer{name: "alpha-0", Url: runtime.URL + "/invoke", readyUrl: runtime.URL + "/ready"}
+	c.On("Run").Return(rc, nil)
+	d.launcher.registerContainer("alpha", c)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha", InstRdyTimeout: 10 * time.Second}, w, newTestDispatchRequest("test"))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var resp protocol.ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, protocol.ErrorFunction, resp.Error.Type)
+	assert.Eventually(t, func() bool { return d.launcher.InstsCount("alpha") == 0 }, 5*time.Second, 10*time.Millisecond)
+}
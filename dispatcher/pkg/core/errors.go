@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// The headers of the error responses of invocations, naming the type and source of the error, so that it can be told
+// without parsing the body.
+const (
+	errorTypeHeader   = "X-Error-Type"
+	errorSourceHeader = "X-Error-Source"
+)
+
+// The most bytes of the error responses of instances read to interpret them.
+const maxErrorResponseBytes = 64 << 10
+
+// The most bytes of error responses outside of the protocol quoted in the error reported to the client.
+const maxQuotedErrorBytes = 200
+
+// Returns whether errors of type t raised by the platform may go away by calling again.
+func isRetryableErrorType(t protocol.ErrorType) bool {
+	switch t {
+	case protocol.ErrorRateLimited, protocol.ErrorUnavailable, protocol.ErrorNotReady, protocol.ErrorInstanceFailed:
+		return true
+	}
+	return false
+}
+
+// Returns the error of type t raised by the dispatcher.
+func newInvokeError(t protocol.ErrorType, msg string) protocol.Error {
+	return protocol.Error{Type: t, Message: msg, Retryable: isRetryableErrorType(t), Source: t.Source()}
+}
+
+// Writes the error response of an invocation, i.e., the error envelope of e with status, naming the type and source
+// of e in the headers.
+func writeErrorResponse(w http.ResponseWriter, status int, e protocol.Error) {
+	w.Header().Set(errorTypeHeader, string(e.Type))
+	w.Header().Set(errorSourceHeader, string(e.Source))
+	writeJSON(w, status, protocol.ErrorResponse{Error: e})
+}
+
+// Writes the error response of an invocation failed by the dispatcher with an error of type t.
+func writeInvokeError(w http.ResponseWriter, t protocol.ErrorType, msg string) {
+	writeErrorResponse(w, t.Status(), newInvokeError(t, msg))
+}
+
+// Interprets the error response of an instance with status and body, and returns the error reported to the client,
+// attributed to its source, with its status.
+//
+// The errors of functions are reported as is, with the code and retryable flag set by the function. Errors of the
+// runtime are attributed to the platform. Responses outside of the protocol, e.g., of runtimes predating it, keep their
+// status, and quote their body.
+func interpretErrorResponse(status int, body []byte) (protocol.Error, int) {
+	var resp protocol.ErrorResponse
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error.Type == "" {
+		t := protocol.ErrorInstanceFailed
+		if status < http.StatusInternalServerError {
+			t = protocol.ErrorInvalidRequest
+		}
+		quoted := strings.TrimSpace(string(body[:min(len(body), maxQuotedErrorBytes)]))
+		return newInvokeError(t, fmt.Sprintf("Instance responded with status %d: %s", status, quoted)), status
+	}
+
+	e := resp.Error
+	switch e.Type {
+	case protocol.ErrorFunction, protocol.ErrorInvalidRequest:
+		e.Source = e.Type.Source()
+		return e, e.Type.Status()
+	case protocol.ErrorUnsupportedVersion:
+		// The runtime does not speak the protocol of the dispatcher, which is not the client's fault.
+		e.Source, e.Retryable = protocol.SourcePlatform, false
+		return e, http.StatusBadGateway
+	case protocol.ErrorNotReady, protocol.ErrorDeadlineExceeded:
+		return newInvokeError(e.Type, e.Message), e.Type.Status()
+	}
+	// Types unknown to the protocol keep their status.
+	e.Source = protocol.SourcePlatform
+	if status < http.StatusInternalServerError {
+		e.Source = protocol.SourceClient
+	}
+	return e, status
+}
+
+// Replaces the error response of an instance with the error response reported to the client, see
+// interpretErrorResponse.
+func rewriteErrorResponse(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorResponseBytes))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		// Compressed, so neither interpreted nor quoted.
+		body = nil
+	}
+	e, status := interpretErrorResponse(resp.StatusCode, body)
+	b, _ := json.Marshal(protocol.ErrorResponse{Error: e})
+	b = append(b, '\n')
+
+	resp.StatusCode = status
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.TransferEncoding = nil
+	resp.Trailer = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Trailer")
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.Header.Set(errorTypeHeader, string(e.Type))
+	resp.Header.Set(errorSourceHeader, string(e.Source))
+	return nil
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// TestInterpretErrorResponse tests attributing the error responses of instances to their sources, with consistent
+// statuses
+func TestInterpretErrorResponse(t *testing.T) {
+	for _, tc := range []struct {
+		status     int
+		body       string
+		want       protocol.Error
+		wantStatus int
+	}{
+		{
+			http.StatusInternalServerError,
+			`{"error": {"type": "function_error", "message": "out of quota", "code": "quota", "retryable": true}}`,
+			protocol.Error{Type: protocol.ErrorFunction, Message: "out of quota", Code: "quota", Retryable: true,
+				Source: protocol.SourceFunction},
+			http.StatusInternalServerError,
+		},
+		{
+			http.StatusBadRequest,
+			`{"error": {"type": "invalid_request", "message": "prompt is required"}}`,
+			protocol.Error{Type: protocol.ErrorInvalidRequest, Message: "prompt is required",
+				Source: protocol.SourceClient},
+			http.StatusBadRequest,
+		},
+		{
+			http.StatusBadRequest,
+			`{"error": {"type": "unsupported_version", "message": "only 2 is"}}`,
+			protocol.Error{Type: protocol.ErrorUnsupportedVersion, Message: "only 2 is",
+				Source: protocol.SourcePlatform},
+			http.StatusBadGateway,
+		},
+		{
+			http.StatusServiceUnavailable,
+			`{"error": {"type": "not_ready", "message": "loading", "code": "ignored"}}`,
+			protocol.Error{Type: protocol.ErrorNotReady, Message: "loading", Retryable: true,
+				Source: protocol.SourcePlatform},
+			http.StatusServiceUnavailable,
+		},
+		{
+			http.StatusInternalServerError,
+			"<html>Internal Server Error</html>\n",
+			protocol.Error{Type: protocol.ErrorInstanceFailed,
+				Message: "Instance responded with status 500: <html>Internal Server Error</html>", Retryable: true,
+				Source: protocol.SourcePlatform},
+			http.StatusInternalServerError,
+		},
+		{
+			http.StatusNotFound,
+			"not found",
+			protocol.Error{Type: protocol.ErrorInvalidRequest, Message: "Instance responded with status 404: not found",
+				Source: protocol.SourceClient},
+			http.StatusNotFound,
+		},
+		{
+			http.StatusConflict,
+			`{"error": {"type": "conflict", "message": "busy"}}`,
+			protocol.Error{Type: "conflict", Message: "busy", Source: protocol.SourceClient},
+			http.StatusConflict,
+		},
+	} {
+		got, status := interpretErrorResponse(tc.status, []byte(tc.body))
+		assert.Equal(t, tc.want, got, tc.body)
+		assert.Equal(t, tc.wantStatus, status, tc.body)
+	}
+}
+
+// Returns a handler responding with the error envelope of e, with the status of its type.
+func newErrorHandler(e protocol.Error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		writeJSON(w, e.Type.Status(), protocol.ErrorResponse{Error: e})
+	}
+}
+
+// TestDispatch_ErrorSources tests that errors are reported to clients in the error envelope, and counted and billed
+// by their sources
+func TestDispatch_ErrorSources(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	assert.NoError(t, d.GetBillingMgr().SetPlan(PricingPlan{Name: "default", PerRequest: 1}))
+	rc := addTestInst(t, d, "alpha", newErrorHandler(protocol.Error{Type: protocol.ErrorFunction,
+		Message: "division by zero", Code: "math"}))
+
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "function", w.Header().Get(errorSourceHeader))
+	assert.Equal(t, "function_error", w.Header().Get(errorTypeHeader))
+	var resp protocol.ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, protocol.Error{Type: protocol.ErrorFunction, Message: "division by zero", Code: "math",
+		Source: protocol.SourceFunction}, resp.Error)
+
+	// The instance crashes.
+	d.launcher.fnInstsMapMu.Lock()
+	rc.Url = "http://127.0.0.1:1"
+	d.launcher.fnInstsMapMu.Unlock()
+	w = httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, protocol.ErrorInstanceFailed, resp.Error.Type)
+	assert.Equal(t, protocol.SourcePlatform, resp.Error.Source)
+	assert.True(t, resp.Error.Retryable)
+
+	// Rejected before reaching an instance.
+	w = httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("stranger"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, protocol.ErrorForbidden, resp.Error.Type)
+	assert.Equal(t, protocol.SourceClient, resp.Error.Source)
+
+	assert.Equal(t, float64(1), d.metrics.invocationErrors.Value("alpha", "function", "function_error"))
+	assert.Equal(t, float64(1), d.metrics.invocationErrors.Value("alpha", "platform", "instance_failed"))
+	assert.Equal(t, float64(1), d.metrics.invocationErrors.Value("alpha", "client", "forbidden"))
+
+	// Only the function's errors are charged.
+	invoice := d.GetBillingMgr().Invoice("test", time.Time{}, time.Now().Add(time.Second))
+	assert.Len(t, invoice.Lines, 1)
+	assert.Equal(t, 2, invoice.Lines[0].Invocations)
+	assert.Equal(t, 1, invoice.Lines[0].FunctionErrors)
+	assert.Equal(t, 1, invoice.Lines[0].PlatformErrors)
+	assert.Equal(t, float64(1), invoice.Total)
+}
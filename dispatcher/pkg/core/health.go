@@ -0,0 +1,357 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// OutlierPolicy determines when instances of a function are ejected from routing, i.e., considered outliers.
+type OutlierPolicy struct {
+	// Ejects an instance after this many consecutive 5xx responses. 0 disables.
+	Consecutive5xx int `json:"consecutive_5xx"`
+
+	// Ejects an instance whose average latency exceeds LatencyFactor times the median of the function's instances.
+	// 0 disables.
+	LatencyFactor float64 `json:"latency_factor"`
+
+	// The responses an instance must have served before its latency is compared.
+	MinLatencySamples int `json:"min_latency_samples"`
+
+	// The n-th consecutive ejection of an instance lasts BaseEjectionTime * 2^(n-1), capped at MaxEjectionTime.
+	// The count of ejections resets once the instance stays in routing for MaxEjectionTime.
+	BaseEjectionTime Duration `json:"base_ejection_time"`
+	MaxEjectionTime  Duration `json:"max_ejection_time"`
+}
+
+func DefaultOutlierPolicy() OutlierPolicy {
+	return OutlierPolicy{
+		Consecutive5xx:    5,
+		LatencyFactor:     3,
+		MinLatencySamples: 10,
+		BaseEjectionTime:  Duration(30 * time.Second),
+		MaxEjectionTime:   Duration(5 * time.Minute),
+	}
+}
+
+func (p OutlierPolicy) Validate() error {
+	if p.Consecutive5xx < 0 || p.LatencyFactor < 0 || p.MinLatencySamples < 0 {
+		return fmt.Errorf("consecutive_5xx, latency_factor and min_latency_samples must be non-negative")
+	}
+	if p.LatencyFactor > 0 && p.LatencyFactor <= 1 {
+		return fmt.Errorf("latency_factor must be greater than 1")
+	}
+	if p.BaseEjectionTime <= 0 || p.MaxEjectionTime < p.BaseEjectionTime {
+		return fmt.Errorf("ejection times must satisfy 0 < base_ejection_time <= max_ejection_time")
+	}
+	return nil
+}
+
+// Returns how long the n-th consecutive ejection lasts, starting from 1.
+func (p OutlierPolicy) ejectionTime(n int) time.Duration {
+	d := time.Duration(p.BaseEjectionTime)
+	for i := 1; i < n && d < time.Duration(p.MaxEjectionTime); i++ {
+		d *= 2
+	}
+	return min(d, time.Duration(p.MaxEjectionTime))
+}
+
+// The reasons of ejecting instances.
+const (
+	ejectionReason5xx     = "5xx"
+	ejectionReasonLatency = "latency"
+)
+
+// BreakerState is the state of a function's circuit breaker, derived from the health of its instances.
+type BreakerState string
+
+const (
+	// Some instances are healthy, invocations are served as usual.
+	BreakerClosed BreakerState = "closed"
+	// All instances are ejected or on probation, invocations probe the instances on probation.
+	BreakerHalfOpen BreakerState = "half_open"
+	// All instances are ejected, invocations fail fast.
+	BreakerOpen BreakerState = "open"
+)
+
+// The passive health of one instance.
+type instHealth struct {
+	rc *RunningContainer
+
+	consecutive5xx int
+
+	// The exponentially weighted moving average of the latencies of successful responses.
+	latency time.Duration
+	samples int
+
+	// The instance is not routed to until ejectedUntil.
+	ejectedUntil time.Time
+	// The consecutive ejections, determining the length of the next one.
+	ejections int
+	// True after an ejection until the instance serves a successful response. Any failure on probation ejects the
+	// instance again.
+	probation bool
+}
+
+func (h *instHealth) ejected(now time.Time) bool {
+	return now.Before(h.ejectedUntil)
+}
+
+// InstHealth is a point-in-time view of the health of an instance.
+type InstHealth struct {
+	Instance       string    `json:"instance"`
+	Ejected        bool      `json:"ejected"`
+	EjectedUntil   time.Time `json:"ejected_until"`
+	Ejections      int       `json:"ejections"`
+	Probation      bool      `json:"probation"`
+	Consecutive5xx int       `json:"consecutive_5xx"`
+	Latency        Duration  `json:"latency"`
+}
+
+// FnHealth is a point-in-time view of the health of a function's instances.
+type FnHealth struct {
+	Breaker   BreakerState  `json:"breaker"`
+	Policy    OutlierPolicy `json:"policy"`
+	Instances []InstHealth  `json:"instances"`
+}
+
+// HealthMgr tracks the health of instances passively, from the responses they serve, and ejects the outliers from
+// routing. A function's circuit breaker opens when all of its instances are ejected.
+type HealthMgr struct {
+	mu sync.Mutex
+
+	// Protected by mu.
+	defaultPolicy OutlierPolicy
+	// Protected by mu.
+	policies map[string]OutlierPolicy
+
+	// Map from function to its instances' health.
+	// Protected by mu.
+	insts map[string]map[*RunningContainer]*instHealth
+}
+
+func NewHealthMgr(defaultPolicy OutlierPolicy) HealthMgr {
+	return HealthMgr{
+		defaultPolicy: defaultPolicy,
+		policies:      make(map[string]OutlierPolicy),
+		insts:         make(map[string]map[*RunningContainer]*instHealth),
+	}
+}
+
+// SetPolicy sets the outlier policy of function fn, overriding the default policy.
+func (m *HealthMgr) SetPolicy(fn string, p OutlierPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[fn] = p
+	return nil
+}
+
+// ResetPolicy removes the outlier policy of function fn, so the default policy applies.
+func (m *HealthMgr) ResetPolicy(fn string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.policies, fn)
+}
+
+// Must be called with mu held.
+func (m *HealthMgr) policyLocked(fn string) OutlierPolicy {
+	if p, ok := m.policies[fn]; ok {
+		return p
+	}
+	return m.defaultPolicy
+}
+
+// Returns the health of rc, creating it if not exist. Must be called with mu held.
+func (m *HealthMgr) healthLocked(rc *RunningContainer) *instHealth {
+	insts, ok := m.insts[rc.fn]
+	if !ok {
+		insts = make(map[*RunningContainer]*instHealth)
+		m.insts[rc.fn] = insts
+	}
+	h, ok := insts[rc]
+	if !ok {
+		h = &instHealth{rc: rc}
+		insts[rc] = h
+	}
+	return h
+}
+
+// InstLaunched implements InstLifecycleListener.
+func (m *HealthMgr) InstLaunched(rc *RunningContainer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.healthLocked(rc)
+}
+
+// InstStopped implements InstLifecycleListener.
+func (m *HealthMgr) InstStopped(rc *RunningContainer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.insts[rc.fn], rc)
+}
+
+// Records a response of rc with status, which took latency. Returns the reason if rc is ejected because of it, or
+// an empty string.
+func (m *HealthMgr) observe(rc *RunningContainer, status int, latency time.Duration) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	p := m.policyLocked(rc.fn)
+	h := m.healthLocked(rc)
+	if h.ejected(now) {
+		// Responses of invocations sent before ejecting.
+		return ""
+	}
+
+	if status >= 500 {
+		h.consecutive5xx++
+		if h.probation || (p.Consecutive5xx > 0 && h.consecutive5xx >= p.Consecutive5xx) {
+			m.ejectLocked(h, p, now)
+			return ejectionReason5xx
+		}
+		return ""
+	}
+
+	h.consecutive5xx = 0
+	h.probation = false
+	if h.samples == 0 {
+		h.latency = latency
+	} else {
+		h.latency = (4*h.latency + latency) / 5
+	}
+	h.samples++
+	if p.LatencyFactor > 0 && h.samples >= p.MinLatencySamples {
+		if median, ok := m.medianLatencyLocked(rc.fn, p); ok && float64(h.latency) > p.LatencyFactor*float64(median) {
+			m.ejectLocked(h, p, now)
+			return ejectionReasonLatency
+		}
+	}
+	return ""
+}
+
+// Returns the median latency of function fn's instances with enough samples, and false if there are fewer than two
+// of them to compare. Must be called with mu held.
+func (m *HealthMgr) medianLatencyLocked(fn string, p OutlierPolicy) (time.Duration, bool) {
+	var latencies []time.Duration
+	for _, h := range m.insts[fn] {
+		if h.samples >= p.MinLatencySamples {
+			latencies = append(latencies, h.latency)
+		}
+	}
+	if len(latencies) < 2 {
+		return 0, false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2], true
+}
+
+// Must be called with mu held.
+func (m *HealthMgr) ejectLocked(h *instHealth, p OutlierPolicy, now time.Time) {
+	if !h.ejectedUntil.IsZero() && now.Sub(h.ejectedUntil) > time.Duration(p.MaxEjectionTime) {
+		h.ejections = 0
+	}
+	h.ejections++
+	d := p.ejectionTime(h.ejections)
+	h.ejectedUntil = now.Add(d)
+	h.probation = true
+	h.consecutive5xx = 0
+	h.rc.logger().Warn("Ejected instance", "ejections", h.ejections, "duration", d)
+}
+
+// Returns true if rc is not ejected.
+func (m *HealthMgr) isRoutable(rc *RunningContainer) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.insts[rc.fn][rc]
+	return !ok || !h.ejected(time.Now())
+}
+
+// Must be called with mu held.
+func (m *HealthMgr) breakerLocked(fn string, now time.Time) (BreakerState, time.Duration) {
+	insts := m.insts[fn]
+	if len(insts) == 0 {
+		return BreakerClosed, 0
+	}
+	state := BreakerOpen
+	var retryAfter time.Duration
+	for _, h := range insts {
+		switch {
+		case !h.ejected(now) && !h.probation:
+			return BreakerClosed, 0
+		case !h.ejected(now):
+			state = BreakerHalfOpen
+		case retryAfter == 0 || h.ejectedUntil.Sub(now) < retryAfter:
+			retryAfter = h.ejectedUntil.Sub(now)
+		}
+	}
+	if state == BreakerHalfOpen {
+		return state, 0
+	}
+	return state, retryAfter
+}
+
+// Breaker returns the state of function fn's circuit breaker, and if open, how long until an instance is back on
+// probation.
+func (m *HealthMgr) Breaker(fn string) (BreakerState, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.breakerLocked(fn, time.Now())
+}
+
+// Snapshot returns the health of all functions' instances.
+func (m *HealthMgr) Snapshot() map[string]FnHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	res := make(map[string]FnHealth, len(m.insts))
+	for fn, insts := range m.insts {
+		state, _ := m.breakerLocked(fn, now)
+		fh := FnHealth{Breaker: state, Policy: m.policyLocked(fn), Instances: make([]InstHealth, 0, len(insts))}
+		for rc, h := range insts {
+			ih := InstHealth{
+				Instance:       rc.name,
+				Ejected:        h.ejected(now),
+				Ejections:      h.ejections,
+				Probation:      h.probation,
+				Consecutive5xx: h.consecutive5xx,
+				Latency:        Duration(h.latency),
+			}
+			if ih.Ejected {
+				ih.EjectedUntil = h.ejectedUntil
+			}
+			fh.Instances = append(fh.Instances, ih)
+		}
+		sort.Slice(fh.Instances, func(i, j int) bool { return fh.Instances[i].Instance < fh.Instances[j].Instance })
+		res[fn] = fh
+	}
+	return res
+}
+
+// Records the response of rc to invocation r with status, which took latency to respond, and whose error, if any, is
+// attributed to source, in the health of rc and the rollout of its function.
+func (d *Dispatcher) observeHealth(r *http.Request, rc *RunningContainer, status int, source protocol.ErrorSource,
+	latency time.Duration) {
+	if r.Context().Err() != nil {
+		// Failed because the client is gone.
+		return
+	}
+	healthStatus := status
+	if source == protocol.SourceFunction {
+		// Errors of the function's code are responded to by healthy instances, so they don't eject them. They still
+		// count toward the error rate of rollouts, as a version raising them regresses.
+		healthStatus = http.StatusOK
+	}
+	if reason := d.healthMgr.observe(rc, healthStatus, latency); reason != "" {
+		d.metrics.ejections.Inc(rc.fn, reason)
+	}
+	d.rolloutMgr.observe(rc.fn, rc.version, status, latency)
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// TestHealthMgr_Consecutive5xx tests that instances are ejected after consecutive 5xx responses, for exponentially
+// longer periods, and that a failure on probation ejects them again
+func TestHealthMgr_Consecutive5xx(t *testing.T) {
+	policy := DefaultOutlierPolicy()
+	policy.Consecutive5xx = 2
+	policy.BaseEjectionTime = Duration(50 * time.Millisecond)
+	policy.MaxEjectionTime = Duration(time.Second)
+	m := NewHealthMgr(policy)
+	rc := &RunningContainer{name: "alpha-0", fn: "alpha"}
+
+	assert.Empty(t, m.observe(rc, http.StatusInternalServerError, time.Millisecond))
+	assert.Empty(t, m.observe(rc, http.StatusOK, time.Millisecond), "successes reset the count")
+	assert.Empty(t, m.observe(rc, http.StatusBadGateway, time.Millisecond))
+	assert.Equal(t, ejectionReason5xx, m.observe(rc, http.StatusServiceUnavailable, time.Millisecond))
+	assert.False(t, m.isRoutable(rc))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, m.isRoutable(rc))
+	assert.True(t, m.Snapshot()["alpha"].Instances[0].Probation)
+	assert.Equal(t, ejectionReason5xx, m.observe(rc, http.StatusInternalServerError, time.Millisecond))
+	health := m.Snapshot()["alpha"].Instances[0]
+	assert.Equal(t, 2, health.Ejections)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(time.Until(health.EjectedUntil)),
+		float64(20*time.Millisecond))
+
+	time.Sleep(110 * time.Millisecond)
+	assert.Empty(t, m.observe(rc, http.StatusOK, time.Millisecond))
+	assert.False(t, m.Snapshot()["alpha"].Instances[0].Probation)
+}
+
+// TestHealthMgr_LatencyOutlier tests that instances much slower than the others are ejected
+func TestHealthMgr_LatencyOutlier(t *testing.T) {
+	policy := DefaultOutlierPolicy()
+	policy.MinLatencySamples = 3
+	m := NewHealthMgr(policy)
+	fast0 := &RunningContainer{name: "alpha-0", fn: "alpha"}
+	fast1 := &RunningContainer{name: "alpha-1", fn: "alpha"}
+	slow := &RunningContainer{name: "alpha-2", fn: "alpha"}
+	for i := 0; i < 3; i++ {
+		m.observe(fast0, http.StatusOK, 10*time.Millisecond)
+		m.observe(fast1, http.StatusOK, 12*time.Millisecond)
+	}
+	assert.Empty(t, m.observe(slow, http.StatusOK, 100*time.Millisecond))
+	assert.Empty(t, m.observe(slow, http.StatusOK, 100*time.Millisecond))
+	assert.Equal(t, ejectionReasonLatency, m.observe(slow, http.StatusOK, 100*time.Millisecond))
+	assert.False(t, m.isRoutable(slow))
+	assert.True(t, m.isRoutable(fast0))
+}
+
+// TestHealthMgr_Breaker tests that the circuit breaker opens when all instances are ejected
+func TestHealthMgr_Breaker(t *testing.T) {
+	policy := DefaultOutlierPolicy()
+	policy.Consecutive5xx = 2
+	policy.BaseEjectionTime = Duration(50 * time.Millisecond)
+	m := NewHealthMgr(policy)
+	state, _ := m.Breaker("alpha")
+	assert.Equal(t, BreakerClosed, state, "functions without instances")
+
+	rc0 := &RunningContainer{name: "alpha-0", fn: "alpha"}
+	rc1 := &RunningContainer{name: "alpha-1", fn: "alpha"}
+	m.InstLaunched(rc0)
+	m.InstLaunched(rc1)
+	for i := 0; i < 2; i++ {
+		m.observe(rc0, http.StatusInternalServerError, time.Millisecond)
+	}
+	state, _ = m.Breaker("alpha")
+	assert.Equal(t, BreakerClosed, state)
+
+	for i := 0; i < 2; i++ {
+		m.observe(rc1, http.StatusInternalServerError, time.Millisecond)
+	}
+	state, retryAfter := m.Breaker("alpha")
+	assert.Equal(t, BreakerOpen, state)
+	assert.Greater(t, retryAfter, time.Duration(0))
+	assert.LessOrEqual(t, retryAfter, 50*time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond)
+	state, _ = m.Breaker("alpha")
+	assert.Equal(t, BreakerHalfOpen, state)
+	m.observe(rc0, http.StatusOK, time.Millisecond)
+	state, _ = m.Breaker("alpha")
+	assert.Equal(t, BreakerClosed, state)
+
+	m.InstStopped(rc0)
+	m.InstStopped(rc1)
+	assert.Empty(t, m.Snapshot()["alpha"].Instances)
+}
+
+// TestDispatch_BreakerOpen tests that invocations fail fast when all instances of the function are ejected
+func TestDispatch_BreakerOpen(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultOutlierPolicy()
+	policy.Consecutive5xx = 2
+	policy.BaseEjectionTime = Duration(50 * time.Millisecond)
+	assert.NoError(t, d.GetHealthMgr().SetPolicy("alpha", policy))
+
+	rc := addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+	assert.False(t, d.GetHealthMgr().isRoutable(rc))
+	assert.Equal(t, float64(1), d.metrics.ejections.Value("alpha", ejectionReason5xx))
+
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, float64(1), d.metrics.breakerRejections.Value("alpha"))
+}
+
+// TestDispatch_FunctionErrorsNotEjected tests that errors of the function's code neither eject its instances nor open
+// the circuit breaker
+func TestDispatch_FunctionErrorsNotEjected(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultOutlierPolicy()
+	policy.Consecutive5xx = 2
+	assert.NoError(t, d.GetHealthMgr().SetPolicy("alpha", policy))
+
+	rc := addTestInst(t, d, "alpha", newErrorHandler(protocol.Error{Type: protocol.ErrorFunction, Message: "bug"}))
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, string(protocol.SourceFunction), w.Header().Get(errorSourceHeader))
+	}
+	assert.True(t, d.GetHealthMgr().isRoutable(rc))
+	assert.Equal(t, 0, d.GetHealthMgr().Snapshot()["alpha"].Instances[0].Consecutive5xx)
+	assert.Equal(t, float64(0), d.metrics.ejections.Value("alpha", ejectionReason5xx))
+	state, _ := d.GetHealthMgr().Breaker("alpha")
+	assert.Equal(t, BreakerClosed, state)
+}
+
+func TestOutlierPolicy_EjectionTime(t *testing.T) {
+	p := DefaultOutlierPolicy()
+	assert.Equal(t, 30*time.Second, p.ejectionTime(1))
+	assert.Equal(t, 60*time.Second, p.ejectionTime(2))
+	assert.Equal(t, 5*time.Minute, p.ejectionTime(10))
+}
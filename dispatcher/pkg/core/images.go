@@ -0,0 +1,325 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// ImageStatus is the availability of an image to instances.
+type ImageStatus string
+
+const (
+	// Present locally, instances can be run from it.
+	ImageAvailable ImageStatus = "available"
+
+	// Missing locally, and being pulled from the registry.
+	ImagePulling ImageStatus = "pulling"
+
+	// Missing locally, and either failed to be pulled, or there's no registry to pull it from.
+	ImageUnavailable ImageStatus = "unavailable"
+
+	// Could not be checked, e.g., as the docker daemon is unreachable. Invocations are still routed, and fail to
+	// launch instances if the image is missing.
+	ImageUnknown ImageStatus = "unknown"
+)
+
+// The results of pulling images, as reported to onPulled.
+const (
+	pullSucceeded = "succeeded"
+	pullFailed    = "failed"
+)
+
+// How long an unavailable image stays so before the next invocation of its versions checks it again, pulling it if
+// still missing, so that a failed pull, e.g., as the registry was down, does not disable the versions for good.
+const unavailableImageTTL = 30 * time.Second
+
+var errImageNotFound = errors.New("image not found locally")
+
+// Inspects and pulls images.
+type imageBackend interface {
+	// Returns the digest of image, errImageNotFound if it's not present locally.
+	inspect(image string) (string, error)
+
+	// Pulls image from registry, making it present locally under its name.
+	pull(registry, image string) error
+}
+
+// ImageState is the availability of an image.
+type ImageState struct {
+	Image  string      `json:"image"`
+	Status ImageStatus `json:"status"`
+	// The repo digest of the image, or its ID if it was built locally and never pushed. Empty unless available.
+	Digest string `json:"digest,omitempty"`
+	// Why the image is unavailable or unknown.
+	Error       string    `json:"error,omitempty"`
+	CheckedTime time.Time `json:"checked_time"`
+}
+
+// ImageMgr checks that the images of function versions are present locally, pulling missing ones from the registry in
+// the background, so that invocations are refused with a clear error instead of failing to launch instances.
+type ImageMgr struct {
+	// The registry missing images are pulled from, e.g., "localhost:5000". Missing images are unavailable if empty.
+	registry string
+
+	// imageBackend is used for testing.
+	backend imageBackend
+
+	mu sync.Mutex
+	// Map from the image to its state.
+	// Protected by mu.
+	images map[string]*ImageState
+
+	// Called with the result of each pull.
+	onPulled func(result string)
+}
+
+func NewImageMgr(registry string) *ImageMgr {
+	return &ImageMgr{
+		registry: registry,
+		backend:  dockerImages{},
+		images:   make(map[string]*ImageState),
+		onPulled: func(string) {},
+	}
+}
+
+// Check inspects image, and starts pulling it in the background if it's missing. Images being pulled are not checked
+// again.
+func (m *ImageMgr) Check(image string) ImageState {
+	if s, ok := m.State(image); ok && s.Status == ImagePulling {
+		return s
+	}
+	digest, err := m.backend.inspect(image)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.images[image]; ok && s.Status == ImagePulling {
+		// Checked and found missing concurrently.
+		return *s
+	}
+	s := &ImageState{Image: image, CheckedTime: time.Now()}
+	m.images[image] = s
+	switch {
+	case err == nil:
+		s.Status = ImageAvailable
+		s.Digest = digest
+	case !errors.Is(err, errImageNotFound):
+		s.Status = ImageUnknown
+		s.Error = err.Error()
+	case m.registry == "":
+		s.Status = ImageUnavailable
+		s.Error = fmt.Sprintf("image %s is not present locally, and no registry is configured to pull it from", image)
+	default:
+		s.Status = ImagePulling
+		go m.pull(image)
+	}
+	return *s
+}
+
+func (m *ImageMgr) pull(image string) {
+	logger := slog.With("image", image, "registry", m.registry)
+	logger.Info("Pulling image")
+	err := m.backend.pull(m.registry, image)
+	var digest string
+	if err == nil {
+		digest, err = m.backend.inspect(image)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &ImageState{Image: image, CheckedTime: time.Now()}
+	m.images[image] = s
+	if err != nil {
+		logger.Error("Failed to pull image", "error", err)
+		s.Status = ImageUnavailable
+		s.Error = fmt.Sprintf("Could not pull image %s from %s, error: %v", image, m.registry, err)
+		m.onPulled(pullFailed)
+		return
+	}
+	logger.Info("Pulled image", "digest", digest)
+	s.Status = ImageAvailable
+	s.Digest = digest
+	m.onPulled(pullSucceeded)
+}
+
+// State returns the state of image, and false if it was never checked.
+func (m *ImageMgr) State(image string) (ImageState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.images[image]
+	if !ok {
+		return ImageState{}, false
+	}
+	return *s, true
+}
+
+// Returns an error describing why instances can not be run from image, nil if they can, or it's unknown. Images
+// unavailable for unavailableImageTTL are checked again.
+func (m *ImageMgr) unavailable(image string) error {
+	s, ok := m.State(image)
+	if !ok {
+		return nil
+	}
+	if s.Status == ImageUnavailable && m.claimRecheck(image) {
+		s = m.Check(image)
+	}
+	switch s.Status {
+	case ImagePulling:
+		return fmt.Errorf("image %s is being pulled from %s", image, m.registry)
+	case ImageUnavailable:
+		return errors.New(s.Error)
+	}
+	return nil
+}
+
+// Returns true if image has been unavailable for unavailableImageTTL, refreshing its checked time, so that
+// concurrent invocations check it again only once.
+func (m *ImageMgr) claimRecheck(image string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.images[image]
+	if !ok || s.Status != ImageUnavailable || time.Since(s.CheckedTime) < unavailableImageTTL {
+		return false
+	}
+	s.CheckedTime = time.Now()
+	return true
+}
+
+// Inspects and pulls images with the docker daemon.
+type dockerImages struct{}
+
+func (dockerImages) inspect(image string) (string, error) {
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), image)
+	if client.IsErrNotFound(err) {
+		return "", errImageNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not inspect image %s, error: %v", image, err)
+	}
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0], nil
+	}
+	return inspect.ID, nil
+}
+
+func (dockerImages) pull(registry, name string) error {
+	ctx := context.Background()
+	ref := registry + "/" + name
+	out, err := dockerClient.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := readDockerStream(out, nil); err != nil {
+		return err
+	}
+	// Instances run the image by its name without the registry.
+	return dockerClient.ImageTag(ctx, ref, name)
+}
+
+// FunctionImage is the image of a function version, and its availability.
+type FunctionImage struct {
+	Version int `json:"version"`
+	ImageState
+}
+
+// CheckImages checks the images of all function versions, pulling missing ones from registry in the background, and
+// from then on, the images of published versions, refusing to publish versions whose images are unavailable.
+// Invocations of versions whose images are unavailable, or being pulled, are rejected with 503. Must be called before
+// serving invocations.
+func (d *Dispatcher) CheckImages(registry string) {
+	m := NewImageMgr(registry)
+	m.onPulled = func(result string) {
+		d.metrics.imagePulls.Inc(result)
+	}
+	d.imageMgr = m
+	d.checkAllImages()
+}
+
+// Checks the images of all function versions, returning them by function.
+func (d *Dispatcher) checkAllImages() map[string][]FunctionImage {
+	res := make(map[string][]FunctionImage)
+	for _, fn := range d.versionMgr.Functions() {
+		versions, _ := d.versionMgr.Versions(fn)
+		for _, v := range versions {
+			s := d.imageMgr.Check(v.Image)
+			if s.Status != ImageAvailable {
+				slog.Warn("Image is not available", logKeyFn, fn, logKeyVersion, v.Version, "image", v.Image,
+					"status", s.Status, "error", s.Error)
+			}
+			res[fn] = append(res[fn], FunctionImage{Version: v.Version, ImageState: s})
+		}
+	}
+	return res
+}
+
+// Returns the images of all function versions by function, without checking them again.
+func (d *Dispatcher) functionImages() map[string][]FunctionImage {
+	res := make(map[string][]FunctionImage)
+	for _, fn := range d.versionMgr.Functions() {
+		versions, _ := d.versionMgr.Versions(fn)
+		for _, v := range versions {
+			s, ok := d.imageMgr.State(v.Image)
+			if !ok {
+				s = ImageState{Image: v.Image, Status: ImageUnknown}
+			}
+			res[fn] = append(res[fn], FunctionImage{Version: v.Version, ImageState: s})
+		}
+	}
+	return res
+}
+
+// Publishes v as a new version of function fn, see VersionMgr.Publish. Its image is checked first if CheckImages was
+// called, and versions whose images are unavailable are refused.
+func (d *Dispatcher) publishVersion(fn string, v FunctionVersion) (FunctionVersion, error) {
+	if d.imageMgr != nil && v.Image != "" {
+		if s := d.imageMgr.Check(v.Image); s.Status == ImageUnavailable {
+			return FunctionVersion{}, errors.New(s.Error)
+		}
+	}
+	return d.versionMgr.Publish(fn, v)
+}
+
+// Returns an error describing why instances of version of function fn can not be launched, as its image is
+// unavailable, nil if they can, or image checks are disabled.
+func (d *Dispatcher) imageUnavailable(fn string, version int) error {
+	if d.imageMgr == nil {
+		return nil
+	}
+	v, ok := d.versionMgr.Version(fn, version)
+	if !ok {
+		return nil
+	}
+	return d.imageMgr.unavailable(v.Image)
+}
+
+// Reads the JSON messages streamed by the docker daemon about the progress of pulls and builds, calling onOutput with
+// the output of build steps if not nil. Returns the error of the first failed message.
+func readDockerStream(r io.Reader, onOutput func(string)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.Stream != "" && onOutput != nil {
+			onOutput(msg.Stream)
+		}
+	}
+}
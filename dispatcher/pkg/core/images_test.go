@@ -0,0 +1,173 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps images in memory, pulling the images in the registry.
+type testImageBackend struct {
+	mu sync.Mutex
+	// Map from the local images to their digests.
+	local map[string]string
+	// The images that can be pulled, the rest fail to.
+	registry map[string]bool
+	// Fails inspecting images if set, e.g., as if the docker daemon is unreachable.
+	err   error
+	pulls int
+}
+
+func (b *testImageBackend) inspect(image string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return "", b.err
+	}
+	digest, ok := b.local[image]
+	if !ok {
+		return "", errImageNotFound
+	}
+	return digest, nil
+}
+
+func (b *testImageBackend) pull(registry, image string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pulls++
+	if !b.registry[image] {
+		return errors.New("manifest unknown")
+	}
+	b.local[image] = registry + "/" + image + "@sha256:0"
+	return nil
+}
+
+// Returns a function waiting for image to be pulled by m.
+func pulled(m *ImageMgr, image string) func() bool {
+	return func() bool {
+		s, _ := m.State(image)
+		return s.Status != ImagePulling
+	}
+}
+
+// TestImageMgr_Check tests checking present images, and pulling missing ones
+func TestImageMgr_Check(t *testing.T) {
+	m := NewImageMgr("localhost:5000")
+	b := &testImageBackend{
+		local:    map[string]string{"runtime": "sha256:1"},
+		registry: map[string]bool{"runtime:v2": true},
+	}
+	m.backend = b
+	_, ok := m.State("runtime")
+	assert.False(t, ok)
+
+	s := m.Check("runtime")
+	assert.Equal(t, ImageAvailable, s.Status)
+	assert.Equal(t, "sha256:1", s.Digest)
+	assert.NoError(t, m.unavailable("runtime"))
+
+	s = m.Check("runtime:v2")
+	assert.Equal(t, ImagePulling, s.Status)
+	assert.Error(t, m.unavailable("runtime:v2"))
+	assert.Eventually(t, pulled(m, "runtime:v2"), time.Second, time.Millisecond)
+	s, _ = m.State("runtime:v2")
+	assert.Equal(t, ImageAvailable, s.Status)
+	assert.Equal(t, "localhost:5000/runtime:v2@sha256:0", s.Digest)
+	assert.NoError(t, m.unavailable("runtime:v2"))
+
+	m.Check("runtime:v3")
+	assert.Eventually(t, pulled(m, "runtime:v3"), time.Second, time.Millisecond)
+	s, _ = m.State("runtime:v3")
+	assert.Equal(t, ImageUnavailable, s.Status)
+	assert.Contains(t, s.Error, "manifest unknown")
+	assert.ErrorContains(t, m.unavailable("runtime:v3"), "Could not pull image runtime:v3")
+	assert.Equal(t, 2, b.pulls)
+
+	// Unavailable images are checked again once their state expires, pulling them if still missing.
+	b.mu.Lock()
+	b.registry["runtime:v3"] = true
+	b.mu.Unlock()
+	assert.Error(t, m.unavailable("runtime:v3"))
+	m.mu.Lock()
+	m.images["runtime:v3"].CheckedTime = time.Now().Add(-unavailableImageTTL)
+	m.mu.Unlock()
+	assert.ErrorContains(t, m.unavailable("runtime:v3"), "being pulled")
+	assert.Eventually(t, pulled(m, "runtime:v3"), time.Second, time.Millisecond)
+	assert.NoError(t, m.unavailable("runtime:v3"))
+	assert.Equal(t, 3, b.pulls)
+
+	// Images that could not be checked are still routed.
+	b.err = errors.New("docker daemon unreachable")
+	s = m.Check("runtime")
+	assert.Equal(t, ImageUnknown, s.Status)
+	assert.NoError(t, m.unavailable("runtime"))
+	assert.NoError(t, m.unavailable("never-checked"))
+
+	m = NewImageMgr("")
+	m.backend = &testImageBackend{local: map[string]string{}}
+	s = m.Check("runtime:v2")
+	assert.Equal(t, ImageUnavailable, s.Status)
+	assert.Contains(t, s.Error, "no registry")
+}
+
+// TestDispatch_ImageUnavailable tests that invocations of versions whose images are unavailable are rejected
+func TestDispatch_ImageUnavailable(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.imageMgr = NewImageMgr("")
+	d.imageMgr.backend = &testImageBackend{local: map[string]string{"runtime": "sha256:1"}}
+	d.imageMgr.Check("runtime")
+	_, err := d.versionMgr.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	d.imageMgr.Check("runtime:v2")
+
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha", Version: "2"}, w, newTestDispatchRequest("test"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Version 2 of function alpha is unavailable")
+	assert.Contains(t, w.Body.String(), "image runtime:v2 is not present locally")
+}
+
+// TestAdmin_Images tests reporting images, and refusing to publish versions whose images are unavailable
+func TestAdmin_Images(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	r := newTestAdminRouter(d)
+
+	w := doAdminRequest(r, http.MethodGet, "/admin/images", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	m := NewImageMgr("localhost:5000")
+	m.backend = &testImageBackend{local: map[string]string{"runtime": "sha256:1"}}
+	d.imageMgr = m
+	w = doAdminRequest(r, http.MethodPost, "/admin/images/check", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var images map[string][]FunctionImage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &images))
+	assert.Len(t, images, 3)
+	assert.Equal(t, ImageAvailable, images["alpha"][0].Status)
+	assert.Equal(t, "sha256:1", images["alpha"][0].Digest)
+
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/versions", "admin", `{"image": "runtime:v3"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Eventually(t, pulled(m, "runtime:v3"), time.Second, time.Millisecond)
+	w = doAdminRequest(r, http.MethodGet, "/admin/images", "admin", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &images))
+	assert.Equal(t, 2, images["alpha"][1].Version)
+	assert.Equal(t, ImageUnavailable, images["alpha"][1].Status)
+
+	// Without a registry, missing images are refused right away.
+	d.imageMgr = NewImageMgr("")
+	d.imageMgr.backend = &testImageBackend{local: map[string]string{"runtime": "sha256:1"}}
+	w = doAdminRequest(r, http.MethodPost, "/admin/functions/alpha/versions", "admin", `{"image": "runtime:v4"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	versions, _ := d.versionMgr.Versions("alpha")
+	assert.Len(t, versions, 2)
+}
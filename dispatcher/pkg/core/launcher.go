@@ -1,12 +1,16 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // A notification sent to launcher to instruct it to launch a new instance.
@@ -15,19 +19,38 @@ type launchNotification struct {
 	// The function that needs new RunningContainer.
 	fn string
 
+	// The version of fn that needs new RunningContainer.
+	version int
+
+	// The user whose invocation needs the new RunningContainer.
+	user string
+
+	// The span of the invocation, linked from the span of launching the RunningContainer.
+	spanCtx trace.SpanContext
+
 	// The channel used to receive the created RunningContainer.
 	rcChan chan *RunningContainer
 }
 
+// InstLifecycleListener receives the lifecycle events of RunningContainers launched by Launcher.
+// The methods are called with Launcher's lock held, so they must not call back into Launcher.
+type InstLifecycleListener interface {
+	// Called after rc is launched, and before it is used for serving invocations.
+	InstLaunched(rc *RunningContainer)
+
+	// Called after rc is stopped and removed.
+	InstStopped(rc *RunningContainer)
+}
+
 // Launcher stores containers for starting instances to serve function invocations.
 // TODO: Needs sync.Mutex to protect from concurrent access.
 type Launcher struct {
-	// Set during creation, and never change afterwards.
-	// Therefore mutex protection is not required.
-	//
-	// Map from the function to the Container template.
+	// Map from the function to the Container templates of its versions, version v at index v-1. Functions are
+	// registered during creation, and versions are only appended afterwards, so a version's template never changes.
 	// ContainerInterface is used for testing.
-	fnContainerMap map[string]ContainerInterface
+	// Protected by fnVersionsMu.
+	fnVersionsMu sync.RWMutex
+	fnVersions   map[string][]ContainerInterface
 
 	// The counter of running container created for function.
 	fnContainerNameCounter map[string]int
@@ -43,39 +66,141 @@ type Launcher struct {
 
 	// The interval for periodically check the load on each RunningContainer.
 	checkInterval time.Duration
+
+	// Set before MonitorForever starts, and never change afterwards.
+	listeners []InstLifecycleListener
+
+	// The utilization ratios last calculated by MonitorForever.
+	utilRatioMu sync.Mutex
+	utilRatio   map[string]float64
+
+	// Generic runtime containers specialized into instances on launch, refilled by MonitorForever. Nil if not used.
+	// Set before MonitorForever starts, and never change afterwards.
+	warmPool *WarmPool
+
+	snapshotsMu sync.Mutex
+	// Snapshots the first ready instance of each version, nil if disabled.
+	// Protected by snapshotsMu.
+	snapshotter snapshotter
+	// Map from the function version to its snapshot, which later instances of the version are launched from.
+	// Protected by snapshotsMu.
+	snapshots map[fnVersion]*instSnapshot
+
+	// Called with the function of each launched instance, and how it was launched, one of the launchFrom* constants.
+	onLaunched func(fn, from string)
+	// Called with the function of each snapshot taken or failed, and the result, one of the snapshot* results.
+	onSnapshot func(fn, result string)
 }
 
+// How instances are launched, as reported to onLaunched.
+const (
+	// Run from the template of the version.
+	launchFromTemplate = "template"
+	// Specialized from a generic container of the warm pool.
+	launchFromWarmPool = "warm_pool"
+	// Restored from the snapshot of the version.
+	launchFromSnapshot = "snapshot"
+)
+
 func NewLauncher(interval time.Duration) Launcher {
 	return Launcher{
-		fnContainerMap:         make(map[string]ContainerInterface),
+		fnVersions:             make(map[string][]ContainerInterface),
 		fnContainerNameCounter: make(map[string]int),
 		fnInstsMap:             make(map[string][]*RunningContainer),
 		launchNotifier:         make(chan launchNotification),
 		stopMonitorChan:        make(chan struct{}),
 		checkInterval:          interval,
+		snapshots:              make(map[fnVersion]*instSnapshot),
+		onLaunched:             func(string, string) {},
+		onSnapshot:             func(string, string) {},
 	}
 }
 
-func (l *Launcher) debugLog() {
+// Logs the running instances of each function. Must be called with fnInstsMapMu held.
+func (l *Launcher) debugLogLocked() {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
 	for fn, rcs := range l.fnInstsMap {
-		for _, rc := range rcs {
-			log.Println(fn, rc.name)
+		names := make([]string, len(rcs))
+		for i, rc := range rcs {
+			names[i] = rc.name
 		}
+		slog.Debug("Running instances", logKeyFn, fn, "instances", names)
 	}
 }
 
+// Registers function fn, with c as the template of version 1.
 func (d *Launcher) registerContainer(fn string, c ContainerInterface) {
-	d.fnContainerMap[fn] = c
+	d.fnVersionsMu.Lock()
+	defer d.fnVersionsMu.Unlock()
+	d.fnVersions[fn] = []ContainerInterface{c}
+}
+
+// Adds c as the template of a new version of function fn, and returns the version.
+func (d *Launcher) addVersion(fn string, c ContainerInterface) (int, error) {
+	d.fnVersionsMu.Lock()
+	defer d.fnVersionsMu.Unlock()
+	cs, ok := d.fnVersions[fn]
+	if !ok {
+		return 0, fmt.Errorf("Could not find serverless function %s", fn)
+	}
+	d.fnVersions[fn] = append(cs, c)
+	return len(cs) + 1, nil
+}
+
+// Returns the template of version of function fn.
+func (d *Launcher) template(fn string, version int) (ContainerInterface, bool) {
+	d.fnVersionsMu.RLock()
+	defer d.fnVersionsMu.RUnlock()
+	cs := d.fnVersions[fn]
+	if version < 1 || version > len(cs) {
+		return nil, false
+	}
+	return cs[version-1], true
 }
 
-// Launch a container instance for serving function fn.
+// Returns the latest version of function fn, 0 if fn is not registered.
+func (d *Launcher) latestVersion(fn string) int {
+	d.fnVersionsMu.RLock()
+	defer d.fnVersionsMu.RUnlock()
+	return len(d.fnVersions[fn])
+}
+
+// Must be called before MonitorForever starts.
+func (l *Launcher) addListener(listener InstLifecycleListener) {
+	l.listeners = append(l.listeners, listener)
+}
+
+// Launch a container instance for serving the latest version of function fn.
 func (d *Launcher) Launch(fn string) (*RunningContainer, error) {
+	return d.LaunchVersion(fn, d.latestVersion(fn))
+}
+
+// Launch a container instance for serving version of function fn.
+func (d *Launcher) LaunchVersion(fn string, version int) (*RunningContainer, error) {
+	return d.launch(fn, version, "", trace.SpanContext{})
+}
+
+// Launch a container instance for serving version of function fn, on behalf of user's invocation, whose span is
+// invocationSpan.
+func (d *Launcher) launch(fn string, version int, user string, invocationSpan trace.SpanContext) (
+	rc *RunningContainer, err error) {
+	requestedTime := time.Now()
+	opts := []trace.SpanStartOption{trace.WithAttributes(fnAttr(fn), versionAttr(version))}
+	if invocationSpan.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: invocationSpan}))
+	}
+	// Launching is shared by invocations, so it's traced as a new trace, instead of as part of the invocation's.
+	_, span := tracer().Start(context.Background(), "LaunchInstance", opts...)
+	defer func() { endSpan(span, err) }()
+
 	d.fnInstsMapMu.Lock()
 	defer d.fnInstsMapMu.Unlock()
 
-	c, ok := d.fnContainerMap[fn]
+	c, ok := d.template(fn, version)
 	if !ok {
-		return nil, fmt.Errorf("Could not find Container for serverless function %s", fn)
+		return nil, fmt.Errorf("Could not find Container for version %d of serverless function %s", version, fn)
 	}
 	counter, ok := d.fnContainerNameCounter[fn]
 	if !ok {
@@ -83,20 +208,66 @@ func (d *Launcher) Launch(fn string) (*RunningContainer, error) {
 	}
 	name := fn + "-" + strconv.Itoa(counter)
 	d.fnContainerNameCounter[fn] = counter + 1
-	rc, err := c.Run(name)
-	if err != nil {
-		return nil, fmt.Errorf("Could not run container for function: %s, error: %v", fn, err)
+	from := ""
+	if snapshot := d.snapshotTemplate(fn, version); snapshot != nil {
+		if rc, err = snapshot.Run(name); err == nil {
+			from = launchFromSnapshot
+		} else {
+			slog.Warn("Failed to restore snapshot, launching from the template", logKeyFn, fn, logKeyVersion, version,
+				"error", err)
+			d.restoreFailed(fn, version)
+		}
+	}
+	if from == "" && d.warmPool != nil {
+		if claim := d.warmPool.claim(c); claim != nil {
+			// Specializing waits for the runtime, which must not block launching and picking other instances.
+			d.fnInstsMapMu.Unlock()
+			rc, ok = d.warmPool.specialize(claim, name)
+			d.fnInstsMapMu.Lock()
+			if ok {
+				from = launchFromWarmPool
+				// The generic container was created and started ahead, which neither the cold start nor the trigger
+				// user pays for.
+				now := time.Now()
+				rc.launchTime, rc.createdTime, rc.startedTime = now, now, now
+			}
+		}
+	}
+	if from == "" {
+		if rc, err = c.Run(name); err != nil {
+			return nil, fmt.Errorf("Could not run container for function: %s, error: %v", fn, err)
+		}
+		from = launchFromTemplate
+	}
+	d.onLaunched(fn, from)
+	rc.fn = fn
+	rc.version = version
+	rc.launchedFrom = from
+	rc.launchRequestedTime = requestedTime
+	rc.triggerUser = user
+	rc.launchSpanCtx = span.SpanContext()
+	span.SetAttributes(instAttr(rc))
+	for _, listener := range d.listeners {
+		listener.InstLaunched(rc)
 	}
 	rcs, ok := d.fnInstsMap[fn]
 	if !ok {
 		rcs = make([]*RunningContainer, 0)
 	}
 	d.fnInstsMap[fn] = append(rcs, rc)
-	log.Println("After launching an instance")
-	d.debugLog()
+	rc.logger().Info("Launched instance", logKeyUser, user, "from", from)
+	d.debugLogLocked()
 	return rc, nil
 }
 
+// Returns true if function fn is registered.
+func (l *Launcher) HasFn(fn string) bool {
+	l.fnVersionsMu.RLock()
+	defer l.fnVersionsMu.RUnlock()
+	_, ok := l.fnVersions[fn]
+	return ok
+}
+
 func (l *Launcher) InstsCount(fn string) int {
 	l.fnInstsMapMu.Lock()
 	defer l.fnInstsMapMu.Unlock()
@@ -108,6 +279,44 @@ func (l *Launcher) InstsCount(fn string) int {
 	return len(rcs)
 }
 
+// The states of instances reported by InstStates.
+const (
+	instStateStarting = "starting"
+	instStateReady    = "ready"
+)
+
+// Returns the number of instances of each function by state.
+func (l *Launcher) InstStates() map[string]map[string]int {
+	l.fnInstsMapMu.Lock()
+	defer l.fnInstsMapMu.Unlock()
+
+	res := make(map[string]map[string]int)
+	for fn, rcs := range l.fnInstsMap {
+		states := map[string]int{instStateStarting: 0, instStateReady: 0}
+		for _, rc := range rcs {
+			if rc.IsReady() {
+				states[instStateReady]++
+			} else {
+				states[instStateStarting]++
+			}
+		}
+		res[fn] = states
+	}
+	return res
+}
+
+// Returns the utilization ratios last calculated by MonitorForever.
+func (l *Launcher) UtilRatios() map[string]float64 {
+	l.utilRatioMu.Lock()
+	defer l.utilRatioMu.Unlock()
+
+	res := make(map[string]float64, len(l.utilRatio))
+	for fn, r := range l.utilRatio {
+		res[fn] = r
+	}
+	return res
+}
+
 func (l *Launcher) hasUnrdyInsts(fn string) bool {
 	l.fnInstsMapMu.Lock()
 	defer l.fnInstsMapMu.Unlock()
@@ -138,65 +347,104 @@ func (l *Launcher) Shutdown(fn string) (*RunningContainer, error) {
 	idx := 0
 	for i, rc := range rcs {
 		if rc.launchTime.After(youngest.launchTime) {
-			log.Println("youngest", *youngest, "idx", idx, "i", i)
 			youngest = rc
 			idx = i
-			log.Println("youngest", *youngest, "idx", idx, "i", i)
 		}
 	}
 
-	log.Println("youngest", *youngest, "idx", idx)
 	// Remove the RunningContainer from the map
-	l.debugLog()
 	rcs[idx] = rcs[len(rcs)-1]
-	l.debugLog()
 	rcs = rcs[:len(rcs)-1]
-	l.debugLog()
 	l.fnInstsMap[fn] = rcs
-	l.debugLog()
-	log.Println("after Launcher.Shutdown:")
-	l.debugLog()
+	youngest.logger().Info("Shutting down the youngest instance")
+	l.debugLogLocked()
 
 	if err := youngest.Stop(); err != nil {
-		log.Println("Failed to stop running container:", youngest)
+		youngest.logger().Error("Failed to stop running container", "error", err)
 	}
 	if err := youngest.Remove(); err != nil {
-		log.Println("Failed to remove running container:", youngest)
+		youngest.logger().Error("Failed to remove running container", "error", err)
+	}
+	for _, listener := range l.listeners {
+		listener.InstStopped(youngest)
 	}
 	return youngest, nil
 }
 
+// Brings down instance rc, e.g., after it failed loading its function. Does nothing if rc was brought down already.
+func (l *Launcher) shutdownInst(rc *RunningContainer) {
+	l.fnInstsMapMu.Lock()
+	rcs := l.fnInstsMap[rc.fn]
+	idx := slices.Index(rcs, rc)
+	if idx < 0 {
+		l.fnInstsMapMu.Unlock()
+		return
+	}
+	rcs[idx] = rcs[len(rcs)-1]
+	l.fnInstsMap[rc.fn] = rcs[:len(rcs)-1]
+	rc.logger().Info("Shutting down instance")
+	l.debugLogLocked()
+	l.fnInstsMapMu.Unlock()
+
+	if err := rc.Stop(); err != nil {
+		rc.logger().Error("Failed to stop running container", "error", err)
+	}
+	if err := rc.Remove(); err != nil {
+		rc.logger().Error("Failed to remove running container", "error", err)
+	}
+	for _, listener := range l.listeners {
+		listener.InstStopped(rc)
+	}
+}
+
 // Returns the URL for serving the input function.
 // Picks a random container instances, and returns its URL.
 func (d *Launcher) PickInst(fn string) (*RunningContainer, error) {
+	return d.pickInst(fn, nil)
+}
+
+// Picks a random instance of function fn among those accepted by accept. A nil accept accepts all instances.
+// accept is called with the lock held, so it must not call back into Launcher.
+func (d *Launcher) pickInst(fn string, accept func(rc *RunningContainer) bool) (*RunningContainer, error) {
 	d.fnInstsMapMu.Lock()
 	defer d.fnInstsMapMu.Unlock()
 
-	rcs, ok := d.fnInstsMap[fn]
-	if !ok || len(rcs) == 0 {
+	var candidates []*RunningContainer
+	for _, rc := range d.fnInstsMap[fn] {
+		if accept == nil || accept(rc) {
+			candidates = append(candidates, rc)
+		}
+	}
+	if len(candidates) == 0 {
 		return nil, fmt.Errorf("No running container for function %s", fn)
 	}
-	rand.Seed(time.Now().UnixNano())
-	return rcs[rand.Intn(len(rcs))], nil
+	return candidates[rand.Intn(len(candidates))], nil
 }
 
-// Shutdown all container instances. Called when shutting down server.
+// Shutdown all container instances, and the warm pool. Called when shutting down server.
 func (d *Launcher) ShutdownAll() {
+	if d.warmPool != nil {
+		d.warmPool.shutdownAll()
+	}
 	d.fnInstsMapMu.Lock()
 	defer d.fnInstsMapMu.Unlock()
 
 	var wg sync.WaitGroup
 	for _, rcs := range d.fnInstsMap {
 		for _, rc := range rcs {
+			rc := rc
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				log.Println("stopping and removing", *rc, "in Launcher::Shutdown")
+				rc.logger().Info("Shutting down instance")
 				if err := rc.Stop(); err != nil {
-					log.Println("Failed to stop running container:", rc)
+					rc.logger().Error("Failed to stop running container", "error", err)
 				}
 				if err := rc.Remove(); err != nil {
-					log.Println("Failed to remove running container:", rc)
+					rc.logger().Error("Failed to remove running container", "error", err)
+				}
+				for _, listener := range d.listeners {
+					listener.InstStopped(rc)
 				}
 			}()
 		}
@@ -227,6 +475,26 @@ func (l *Launcher) calUtilRatio() map[string]float64 {
 	return res
 }
 
+// Returns the version of function fn whose ready instances have been busy the most, the latest version if none.
+func (l *Launcher) busiestVersion(fn string) int {
+	l.fnInstsMapMu.Lock()
+	defer l.fnInstsMapMu.Unlock()
+
+	busyTime := make(map[int]time.Duration)
+	for _, rc := range l.fnInstsMap[fn] {
+		if rc.IsReady() {
+			busyTime[rc.version] += rc.BusyTime()
+		}
+	}
+	version, maxBusyTime := l.latestVersion(fn), time.Duration(-1)
+	for v, t := range busyTime {
+		if t > maxBusyTime || (t == maxBusyTime && v > version) {
+			version, maxBusyTime = v, t
+		}
+	}
+	return version
+}
+
 const utilRatioUpperBound = 0.8
 const utilRatioLowerBound = 0.7
 
@@ -237,33 +505,41 @@ func (l *Launcher) MonitorForever() {
 	for {
 		select {
 		case n := <-l.launchNotifier:
-			log.Println("Received launch notification, function:", n.fn)
-			rc, err := l.Launch(n.fn)
+			slog.Debug("Received launch notification", logKeyFn, n.fn, logKeyUser, n.user)
+			rc, err := l.launch(n.fn, n.version, n.user, n.spanCtx)
 			if err != nil {
-				log.Println("Failed to launch container, function:", n.fn, "error:", err)
+				slog.Error("Failed to launch container", logKeyFn, n.fn, logKeyUser, n.user, "error", err)
 			}
 			n.rcChan <- rc
 		case _ = <-ticker.C:
+			if l.warmPool != nil {
+				l.warmPool.fill()
+			}
 			utilRatio := l.calUtilRatio()
-			log.Println("Checking for utilization ratio:", utilRatio)
+			slog.Debug("Checking for utilization ratio", "util_ratio", utilRatio)
+			l.utilRatioMu.Lock()
+			l.utilRatio = utilRatio
+			l.utilRatioMu.Unlock()
 			for fn, r := range utilRatio {
 				if l.hasUnrdyInsts(fn) {
 					// Only check stable instances.
 					continue
 				}
 				if r > utilRatioUpperBound {
-					rc, err := l.Launch(fn)
-					log.Println("Launched RunningContainer:", rc, "error:", err, "function:", fn)
+					if _, err := l.LaunchVersion(fn, l.busiestVersion(fn)); err != nil {
+						slog.Error("Failed to scale up", logKeyFn, fn, "util_ratio", r, "error", err)
+					}
 				}
 				if r < utilRatioLowerBound {
 					if l.InstsCount(fn) > 1 {
-						rc, err := l.Shutdown(fn)
-						log.Println("Shutdown RunningContainer:", rc, "error:", err, "function:", fn)
+						if _, err := l.Shutdown(fn); err != nil {
+							slog.Error("Failed to scale down", logKeyFn, fn, "util_ratio", r, "error", err)
+						}
 					}
 				}
 			}
 		case _ = <-l.stopMonitorChan:
-			log.Println("Received stopMonitorChan")
+			slog.Info("Stopped monitoring instances")
 			return
 		}
 	}
@@ -39,7 +39,7 @@ func TestLauncher_Launch(t *testing.T) {
 
 	// Create a mock container
 	mockContainer := new(MockContainer)
-	dispatcher.fnContainerMap["testFn"] = mockContainer
+	dispatcher.registerContainer("testFn", mockContainer)
 
 	// Create a mock running container
 	mockRunningContainer := RunningContainer{
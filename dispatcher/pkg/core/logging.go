@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// The header carrying the request ID. It is accepted from the caller, or generated if absent, then propagated to the
+// runtime and echoed in the response.
+const requestIDHeader = protocol.RequestIDHeader
+
+// The keys of log attributes shared by log lines.
+const (
+	logKeyFn          = "fn"
+	logKeyVersion     = "version"
+	logKeyInstance    = "instance"
+	logKeyContainerID = "container_id"
+	logKeyUser        = "user"
+	logKeyRequestID   = "request_id"
+)
+
+// InitLogging installs the default slog logger writing to w, at level, in format text or json.
+func InitLogging(w io.Writer, level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s, error: %v", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %s, must be text or json", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("Could not generate request ID, error: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+type loggerCtxKey struct{}
+
+// Returns a copy of ctx carrying logger, which is returned by loggerFrom.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, logger)
+}
+
+// Returns the logger carried by ctx, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type requestIDCtxKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, id)
+}
+
+// Returns the request ID carried by ctx, or an empty string.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	assert.NoError(t, InitLogging(&buf, "warn", "json"))
+	slog.Info("dropped")
+	slog.Warn("kept", logKeyFn, "alpha")
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "kept", line["msg"])
+	assert.Equal(t, "alpha", line[logKeyFn])
+
+	assert.Error(t, InitLogging(&buf, "verbose", "json"))
+	assert.Error(t, InitLogging(&buf, "info", "xml"))
+}
+
+func TestDispatch_RequestID(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.SetFnAPIConcurLimit("alpha", 0)
+
+	req := newTestDispatchRequest("test")
+	req.Header.Set(requestIDHeader, "my-request")
+	w := httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, req)
+	assert.Equal(t, "my-request", w.Header().Get(requestIDHeader))
+
+	w = httptest.NewRecorder()
+	d.Dispatch(CallContext{Fn: "alpha"}, w, newTestDispatchRequest("test"))
+	assert.Len(t, w.Header().Get(requestIDHeader), 32)
+}
+
+func TestProxyRequest_RequestID(t *testing.T) {
+	var requestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			requestID = r.Header.Get(requestIDHeader)
+		}
+	}))
+	defer server.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/alpha", nil)
+	req = req.WithContext(withRequestID(context.Background(), "my-request"))
+	assert.NoError(t, ProxyRequest(server.URL, httptest.NewRecorder(), req))
+	assert.Equal(t, "my-request", requestID)
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal implementation of Prometheus metrics and its text exposition format, so that exposing metrics needs neither
+// a client library nor any external service.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metricType string
+
+const (
+	metricTypeCounter   metricType = "counter"
+	metricTypeGauge     metricType = "gauge"
+	metricTypeHistogram metricType = "histogram"
+)
+
+// One time series of a metricVec, identified by its label values.
+type metricSeries struct {
+	labelValues []string
+
+	// The value of counters and gauges.
+	value float64
+
+	// The state of histograms. bucketCounts[i] counts the observations <= buckets[i], i.e., they are cumulative.
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// A metric family with a fixed set of label names.
+type metricVec struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+
+	// Upper bounds of histogram buckets, in increasing order. Only used by histograms.
+	buckets []float64
+
+	mu sync.Mutex
+	// Map from the joined label values to the series.
+	// Protected by mu.
+	series map[string]*metricSeries
+}
+
+func newMetricVec(name, help string, typ metricType, labelNames []string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+// Returns the series of labelValues, creating it if not exist.
+// Must be called with mu held.
+func (v *metricVec) seriesLocked(labelValues []string) *metricSeries {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if v.typ == metricTypeHistogram {
+			s.bucketCounts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) add(delta float64, labelValues []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.seriesLocked(labelValues).value += delta
+}
+
+// Removes all series, used by gauges computed at collection time.
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.series = make(map[string]*metricSeries)
+}
+
+// CounterVec is a Prometheus counter with labels.
+type CounterVec struct {
+	*metricVec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) CounterVec {
+	return CounterVec{newMetricVec(name, help, metricTypeCounter, labelNames)}
+}
+
+func (c CounterVec) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Value returns the current value of the series of labelValues, mostly for testing.
+func (c CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seriesLocked(labelValues).value
+}
+
+// GaugeVec is a Prometheus gauge with labels.
+type GaugeVec struct {
+	*metricVec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{newMetricVec(name, help, metricTypeGauge, labelNames)}
+}
+
+func (g GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seriesLocked(labelValues).value = value
+}
+
+func (g GaugeVec) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+// Value returns the current value of the series of labelValues, mostly for testing.
+func (g GaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.seriesLocked(labelValues).value
+}
+
+// HistogramVec is a Prometheus histogram with labels.
+type HistogramVec struct {
+	*metricVec
+}
+
+// The default histogram buckets in seconds, covering from fast invocations to slow cold starts.
+var defaultDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) HistogramVec {
+	v := newMetricVec(name, help, metricTypeHistogram, labelNames)
+	v.buckets = buckets
+	return HistogramVec{v}
+}
+
+func (h HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.seriesLocked(labelValues)
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Count returns the number of observations of the series of labelValues, mostly for testing.
+func (h HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seriesLocked(labelValues).count
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats labels as {name="value",...}, or an empty string if there are no labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes v in the text exposition format, with series ordered by label values.
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		if v.typ != metricTypeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues), formatMetricValue(s.value))
+			continue
+		}
+		bucketLabelNames := append(append([]string(nil), v.labelNames...), "le")
+		for i, upperBound := range v.buckets {
+			labels := formatLabels(bucketLabelNames, append(append([]string(nil), s.labelValues...),
+				formatMetricValue(upperBound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labels, s.bucketCounts[i])
+		}
+		labels := formatLabels(bucketLabelNames, append(append([]string(nil), s.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labels, s.count)
+		labels = formatLabels(v.labelNames, s.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, s.count)
+	}
+}
+
+// MetricsRegistry holds metrics, and serves them in the text exposition format.
+type MetricsRegistry struct {
+	mu sync.Mutex
+	// Protected by mu.
+	vecs []*metricVec
+	// Called before serving metrics, to update the metrics computed from the current state, e.g., instance counts.
+	// Protected by mu.
+	collectors []func()
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (r *MetricsRegistry) register(v *metricVec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.vecs = append(r.vecs, v)
+}
+
+func (r *MetricsRegistry) NewCounterVec(name, help string, labelNames ...string) CounterVec {
+	c := NewCounterVec(name, help, labelNames...)
+	r.register(c.metricVec)
+	return c
+}
+
+func (r *MetricsRegistry) NewGaugeVec(name, help string, labelNames ...string) GaugeVec {
+	g := NewGaugeVec(name, help, labelNames...)
+	r.register(g.metricVec)
+	return g
+}
+
+func (r *MetricsRegistry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) HistogramVec {
+	h := NewHistogramVec(name, help, buckets, labelNames...)
+	r.register(h.metricVec)
+	return h
+}
+
+// AddCollector registers fn to be called before serving metrics.
+func (r *MetricsRegistry) AddCollector(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, collect := range r.collectors {
+		collect()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, v := range r.vecs {
+		v.write(bw)
+	}
+	bw.Flush()
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(r *MetricsRegistry) string {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetricsRegistry_Counter(t *testing.T) {
+	r := NewMetricsRegistry()
+	c := r.NewCounterVec("test_total", "A test counter.", "fn", "status")
+
+	c.Inc("alpha", "200")
+	c.Inc("alpha", "200")
+	c.Inc("beta", "500")
+
+	assert.Equal(t, 2.0, c.Value("alpha", "200"))
+	assert.Equal(t, `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{fn="alpha",status="200"} 2
+test_total{fn="beta",status="500"} 1
+`, scrapeMetrics(r))
+}
+
+func TestMetricsRegistry_GaugeCollector(t *testing.T) {
+	r := NewMetricsRegistry()
+	g := r.NewGaugeVec("test_gauge", "A test gauge.", "fn")
+	value := 1.0
+	r.AddCollector(func() {
+		g.Reset()
+		g.Set(value, `quoted"fn`)
+	})
+
+	assert.Contains(t, scrapeMetrics(r), `test_gauge{fn="quoted\"fn"} 1`)
+	value = 0.5
+	assert.Contains(t, scrapeMetrics(r), `test_gauge{fn="quoted\"fn"} 0.5`)
+}
+
+func TestMetricsRegistry_Histogram(t *testing.T) {
+	r := NewMetricsRegistry()
+	h := r.NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "fn")
+
+	h.Observe(0.05, "alpha")
+	h.Observe(0.5, "alpha")
+	h.Observe(5, "alpha")
+
+	assert.Equal(t, uint64(3), h.Count("alpha"))
+	out := scrapeMetrics(r)
+	for _, line := range []string{
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{fn="alpha",le="0.1"} 1`,
+		`test_seconds_bucket{fn="alpha",le="1"} 2`,
+		`test_seconds_bucket{fn="alpha",le="+Inf"} 3`,
+		`test_seconds_sum{fn="alpha"} 5.55`,
+		`test_seconds_count{fn="alpha"} 3`,
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), "missing line %q in:\n%s", line, out)
+	}
+}
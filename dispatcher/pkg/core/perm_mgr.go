@@ -8,11 +8,15 @@ import (
 type PermMgr struct {
 	mu        sync.RWMutex
 	whiteList map[string]map[string]bool
+
+	// Users allowed to call the admin APIs.
+	admins map[string]bool
 }
 
 func NewPermMgr() PermMgr {
 	return PermMgr{
 		whiteList: make(map[string]map[string]bool),
+		admins:    make(map[string]bool),
 	}
 }
 
@@ -32,3 +36,17 @@ func (m *PermMgr) IsUserAllowed(user, api string) bool {
 
 	return m.whiteList[user][api]
 }
+
+func (m *PermMgr) AllowAdmin(user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.admins[user] = true
+}
+
+func (m *PermMgr) IsAdmin(user string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.admins[user]
+}
@@ -40,3 +40,20 @@ func TestIsUserAllowed(t *testing.T) {
 		t.Errorf("Expected user1 to not be allowed to access api2")
 	}
 }
+
+func TestIsAdmin(t *testing.T) {
+	uam := NewPermMgr()
+
+	if uam.IsAdmin("admin") {
+		t.Errorf("Expected admin to not be an admin initially")
+	}
+
+	uam.AllowAdmin("admin")
+
+	if !uam.IsAdmin("admin") {
+		t.Errorf("Expected admin to be an admin after granting permission")
+	}
+	if uam.IsAdmin("user1") {
+		t.Errorf("Expected user1 to not be an admin")
+	}
+}
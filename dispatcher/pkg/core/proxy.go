@@ -1,43 +1,223 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"serverless/dispatcher/pkg/protocol"
 )
 
-// Proxy the request to the input target URL.
-func ProxyRequest(target string, w http.ResponseWriter, r *http.Request) {
-	err := WaitForHTTPGetOK(target, 100*time.Millisecond, time.Second)
+const sseContentType = protocol.SSEMediaType
 
-	proxyURL, err := url.Parse(target)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("The input target URL '%s' is invalid", target), http.StatusBadRequest)
-		return
+// The timeout of proxied requests of functions without a per-function timeout.
+const defaultProxyTimeout = 60 * time.Second
+
+// ProxyError is returned by Proxy.Forward when it failed to get a response from the instance.
+type ProxyError struct {
+	// The status of the error response, 504 if timed out, 502 otherwise.
+	Status int
+	Err    error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy error %d: %v", e.Status, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the status of the error response for err, returned by the transport.
+func proxyErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// Returns the transport shared by all proxied requests, so that connections to instances are pooled.
+func newProxyTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		// Responses are passed through as is, compressed or not.
+		DisableCompression: true,
 	}
+}
 
-	proxyReq, err := http.NewRequest(r.Method, proxyURL.String(), r.Body)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating request, error: %v", err), http.StatusInternalServerError)
-		return
+// Proxy forwards invocations to instances.
+type Proxy struct {
+	transport http.RoundTripper
+
+	mu sync.RWMutex
+	// Protected by mu.
+	defaultTimeout time.Duration
+	// Protected by mu.
+	fnTimeouts map[string]time.Duration
+}
+
+func NewProxy() *Proxy {
+	return &Proxy{
+		transport:      newProxyTransport(),
+		defaultTimeout: defaultProxyTimeout,
+		fnTimeouts:     make(map[string]time.Duration),
+	}
+}
+
+// SetDefaultTimeout sets the timeout of proxied requests of functions without a per-function timeout.
+func (p *Proxy) SetDefaultTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.defaultTimeout = d
+}
+
+// SetFnTimeout sets the timeout of proxied requests of function fn, from sending the request to receiving the whole
+// response.
+func (p *Proxy) SetFnTimeout(fn string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fnTimeouts[fn] = d
+}
+
+// ResetFnTimeout removes the timeout of function fn, so that the default timeout applies.
+func (p *Proxy) ResetFnTimeout(fn string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.fnTimeouts, fn)
+}
+
+// Timeout returns the timeout in effect for function fn.
+func (p *Proxy) Timeout(fn string) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if d, ok := p.fnTimeouts[fn]; ok {
+		return d
+	}
+	return p.defaultTimeout
+}
+
+// A point-in-time view of the timeouts, formatted as durations like "30s".
+type ProxyTimeoutSnapshot struct {
+	DefaultTimeout string            `json:"default_timeout"`
+	Timeouts       map[string]string `json:"timeouts"`
+}
+
+func (p *Proxy) Snapshot() ProxyTimeoutSnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s := ProxyTimeoutSnapshot{DefaultTimeout: p.defaultTimeout.String(), Timeouts: make(map[string]string)}
+	for fn, d := range p.fnTimeouts {
+		s.Timeouts[fn] = d.String()
+	}
+	return s
+}
+
+// Forward proxies r of function fn to the instance at target, and writes the response to w.
+//
+// Hop-by-hop headers are stripped, X-Forwarded-* headers are set, and the internal User header is not forwarded. The
+// protocol version, the request ID and the deadline are set per the runtime protocol. Error responses are replaced
+// with the error envelope attributing the error to its source, see interpretErrorResponse.
+// Streamed responses are flushed to the client as they arrive. Returns a *ProxyError if failed to get a response
+// from target, after writing the error response.
+func (p *Proxy) Forward(fn, target string, w http.ResponseWriter, r *http.Request) error {
+	if err := p.forward(fn, target, w, r); err != nil {
+		writeProxyError(w, err)
+		return err
 	}
+	return nil
+}
 
-	proxyReq.Header = r.Header
+// Same as Forward, but leaves writing the error response to the caller.
+func (p *Proxy) forward(fn, target string, w http.ResponseWriter, r *http.Request) (proxyErr *ProxyError) {
+	ctx, span := tracer().Start(r.Context(), "Proxy", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if proxyErr != nil {
+			endSpan(span, proxyErr)
+		} else {
+			span.End()
+		}
+	}()
 
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	targetURL, err := url.Parse(target)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get response from proxy URL '%s', error: %v", target, err),
-			http.StatusInternalServerError)
-		return
+		return &ProxyError{Status: http.StatusInternalServerError, Err: err}
 	}
-	defer resp.Body.Close()
 
-	for key, value := range resp.Header {
-		w.Header().Set(key, value[0])
+	if timeout := p.Timeout(fn); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	deadline, hasDeadline := ctx.Deadline()
+
+	rp := &httputil.ReverseProxy{
+		Transport: p.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The instance serves invocations at exactly target, regardless of the path the client called.
+			pr.Out.URL = targetURL
+			pr.Out.Host = ""
+			pr.SetXForwarded()
+			pr.Out.Header.Del("User")
+			pr.Out.Header.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
+			if hasDeadline {
+				// The runtime gives up on invocations past their deadline, as no one is waiting for them anymore.
+				protocol.SetDeadline(pr.Out.Header, deadline)
+			}
+			if id := requestIDFrom(ctx); id != "" {
+				pr.Out.Header.Set(requestIDHeader, id)
+			}
+			// Propagates the trace into the runtime with the W3C traceparent header.
+			otel.GetTextMapPropagator().Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= http.StatusBadRequest {
+				return rewriteErrorResponse(resp)
+			}
+			return nil
+		},
+		ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, err error) {
+			status := proxyErrorStatus(err)
+			proxyErr = &ProxyError{Status: status, Err: err}
+			loggerFrom(ctx).Error("Failed to proxy request", "target", target, "status", status, "error", err)
+		},
+	}
+	rp.ServeHTTP(w, r.WithContext(ctx))
+	return proxyErr
+}
+
+// Writes the error response of err.
+func writeProxyError(w http.ResponseWriter, err *ProxyError) {
+	t := protocol.ErrorInstanceFailed
+	if err.Status == http.StatusGatewayTimeout {
+		t = protocol.ErrorDeadlineExceeded
+	}
+	writeErrorResponse(w, err.Status,
+		newInvokeError(t, fmt.Sprintf("Failed to get response from instance, error: %v", err.Err)))
+}
+
+var defaultProxy = NewProxy()
+
+// Proxy the request to the input target URL, with the default timeout.
+// Returns a *ProxyError if failed to get a response from target, after writing the error response.
+func ProxyRequest(target string, w http.ResponseWriter, r *http.Request) error {
+	return defaultProxy.Forward("", target, w, r)
 }
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// Returns a server proxying all requests to target.
+func newTestProxyServer(target string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ProxyRequest(target, w, r)
+	}))
+}
+
+func TestProxyRequest_StreamsSSE(t *testing.T) {
+	release := make(chan struct{})
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		w.Header().Set("Content-Type", sseContentType)
+		io.WriteString(w, "data: {\"chunk\": \"first\"}\n\n")
+		w.(http.Flusher).Flush()
+		// The first chunk must reach the client before the runtime finishes.
+		<-release
+		io.WriteString(w, "event: done\ndata: {}\n\n")
+	}))
+	defer runtime.Close()
+	proxy := newTestProxyServer(runtime.URL)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL, "application/json", strings.NewReader(`{"args": {}}`))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, sseContentType, resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: {\"chunk\": \"first\"}\n", line)
+
+	close(release)
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "\nevent: done\ndata: {}\n\n", string(rest))
+}
+
+func TestProxyRequest_StreamsRequestBody(t *testing.T) {
+	var transferEncoding []string
+	var body string
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		transferEncoding = r.TransferEncoding
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer runtime.Close()
+	proxy := newTestProxyServer(runtime.URL)
+	defer proxy.Close()
+
+	// A body of unknown length is sent chunked.
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, `{"args": `)
+		io.WriteString(pw, `{}}`)
+		pw.Close()
+	}()
+	resp, err := http.Post(proxy.URL, "application/json", pr)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"chunked"}, transferEncoding)
+	assert.Equal(t, `{"args": {}}`, body)
+}
+
+func TestProxyRequest_Headers(t *testing.T) {
+	var header http.Header
+	var path string
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		path = r.URL.Path
+		w.Header().Add("X-Result", "a")
+		w.Header().Add("X-Result", "b")
+	}))
+	defer runtime.Close()
+	proxy := newTestProxyServer(runtime.URL + "/invoke")
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/alpha", strings.NewReader(`{"args": {}}`))
+	req.Header.Set("User", "test")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Add("X-Multi", "a")
+	req.Header.Add("X-Multi", "b")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "/invoke", path)
+	assert.Empty(t, header.Get("User"))
+	assert.Empty(t, header.Get("X-Hop"), "headers listed in Connection are hop-by-hop")
+	assert.Equal(t, []string{"a", "b"}, header.Values("X-Multi"))
+	assert.Equal(t, "127.0.0.1", header.Get("X-Forwarded-For"))
+	assert.Equal(t, strings.TrimPrefix(proxy.URL, "http://"), header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, []string{"a", "b"}, resp.Header.Values("X-Result"))
+	assert.Equal(t, "1", header.Get(protocol.VersionHeader))
+	deadline, err := time.Parse(time.RFC3339Nano, header.Get(protocol.DeadlineHeader))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(defaultProxyTimeout), deadline, 5*time.Second)
+}
+
+func TestProxy_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer runtime.Close()
+	defer close(release)
+
+	p := NewProxy()
+	p.SetFnTimeout("alpha", 50*time.Millisecond)
+	assert.Equal(t, 50*time.Millisecond, p.Timeout("alpha"))
+	assert.Equal(t, defaultProxyTimeout, p.Timeout("beta"))
+
+	w := httptest.NewRecorder()
+	err := p.Forward("alpha", runtime.URL, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	var proxyErr *ProxyError
+	assert.ErrorAs(t, err, &proxyErr)
+	assert.Equal(t, http.StatusGatewayTimeout, proxyErr.Status)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	p.ResetFnTimeout("alpha")
+	assert.Equal(t, defaultProxyTimeout, p.Timeout("alpha"))
+}
+
+func TestProxy_BadGateway(t *testing.T) {
+	runtime := httptest.NewServer(http.NotFoundHandler())
+	// Nothing listens on the URL once the server is closed.
+	runtime.Close()
+
+	w := httptest.NewRecorder()
+	err := NewProxy().Forward("alpha", runtime.URL, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	var proxyErr *ProxyError
+	assert.ErrorAs(t, err, &proxyErr)
+	assert.Equal(t, http.StatusBadGateway, proxyErr.Status)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
@@ -0,0 +1,611 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// The header declaring that an invocation is safe to retry, even if its function is not idempotent.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// The failures to get a response that RetryPolicy.RetryableErrors can name.
+const (
+	// The instance could not be reached.
+	retryableErrorConnect = "connect"
+	// The instance did not respond within the invocation timeout.
+	retryableErrorTimeout = "timeout"
+)
+
+const (
+	// Invocations with larger request bodies are not retried, as their bodies are not kept for replaying.
+	maxRetryBodyBytes = 1 << 20
+
+	// The body of a retryable response is kept up to this size, for replaying it if no other attempt succeeds.
+	maxRetryableResponseBytes = 64 << 10
+
+	// The retry budget of a function never exceeds this many tokens, which bounds the burst of retries.
+	retryBudgetMaxTokens = 10
+
+	// The latencies of a function's latest invocations, from which the hedging delay is calculated.
+	latencyWindowSize = 128
+
+	// Hedging starts once a function has this many latency samples.
+	minHedgeSamples = 20
+)
+
+// RetryPolicy determines how failed invocations of a function are retried on other instances.
+type RetryPolicy struct {
+	// The maximal number of attempts of an invocation, including the first one and the hedged ones. 1 disables retries.
+	MaxAttempts int `json:"max_attempts"`
+
+	// The n-th retry waits for InitialBackoff * 2^(n-1), capped at MaxBackoff, and jittered by up to half of it.
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+
+	// The response statuses to retry.
+	RetryableStatuses []int `json:"retryable_statuses"`
+
+	// The failures to get a response to retry, "connect" and/or "timeout".
+	RetryableErrors []string `json:"retryable_errors"`
+
+	// True if all invocations of the function are safe to retry. Otherwise only invocations with the Idempotency-Key
+	// header are retried.
+	Idempotent bool `json:"idempotent"`
+
+	// If in (0, 1), an invocation not responded within this percentile of the function's latest latencies is sent to
+	// another instance as well, and the first response is used. 0 disables hedging.
+	HedgePercentile float64 `json:"hedge_percentile"`
+
+	// The retries and hedged requests allowed, as a ratio of invocations. Each invocation earns BudgetRatio tokens,
+	// and each retry or hedged request spends one. 0 disables the budget.
+	BudgetRatio float64 `json:"budget_ratio"`
+}
+
+// DefaultRetryPolicy returns a policy retrying idempotent invocations failed with 502 and 503, or failed to reach the
+// instance, up to 3 attempts.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    Duration(50 * time.Millisecond),
+		MaxBackoff:        Duration(time.Second),
+		RetryableStatuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+		RetryableErrors:   []string{retryableErrorConnect},
+		BudgetRatio:       0.2,
+	}
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be at least 1")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("backoffs must satisfy 0 <= initial_backoff <= max_backoff")
+	}
+	for _, e := range p.RetryableErrors {
+		if e != retryableErrorConnect && e != retryableErrorTimeout {
+			return fmt.Errorf("invalid retryable error %s, must be connect or timeout", e)
+		}
+	}
+	if p.HedgePercentile < 0 || p.HedgePercentile >= 1 {
+		return fmt.Errorf("hedge_percentile must be in [0, 1)")
+	}
+	if p.BudgetRatio < 0 {
+		return fmt.Errorf("budget_ratio must be non-negative")
+	}
+	return nil
+}
+
+// Returns true if invocation r may be sent to more than one instance.
+func (p RetryPolicy) allowsRetry(r *http.Request) bool {
+	return p.MaxAttempts > 1 && (p.Idempotent || r.Header.Get(idempotencyKeyHeader) != "")
+}
+
+func (p RetryPolicy) isRetryableStatus(status int) bool {
+	return slices.Contains(p.RetryableStatuses, status)
+}
+
+func (p RetryPolicy) isRetryableError(err *ProxyError) bool {
+	kind := retryableErrorConnect
+	if err.Status == http.StatusGatewayTimeout {
+		kind = retryableErrorTimeout
+	}
+	return slices.Contains(p.RetryableErrors, kind)
+}
+
+// Returns the time to wait before the n-th retry, starting from 1.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	return jitteredBackoff(time.Duration(p.InitialBackoff), time.Duration(p.MaxBackoff), n)
+}
+
+// Returns the time to wait before the n-th retry, starting from 1, which doubles from initial up to maxBackoff, and is
+// jittered randomly down to half of it.
+func jitteredBackoff(initial, maxBackoff time.Duration, n int) time.Duration {
+	d := initial
+	for i := 1; i < n && d < maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// The latencies of a function's latest invocations.
+type latencyWindow struct {
+	samples []time.Duration
+	// The index in samples to overwrite next, once it's full.
+	next int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	sorted := slices.Clone(w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// RetryMgr keeps the retry policies of functions, and the state shared by their invocations, i.e., retry budgets and
+// latencies.
+type RetryMgr struct {
+	mu sync.Mutex
+
+	// Functions without a policy are never retried.
+	// Protected by mu.
+	policies map[string]RetryPolicy
+
+	// Map from function to the tokens left in its retry budget.
+	// Protected by mu.
+	budgets map[string]float64
+
+	// Protected by mu.
+	latencies map[string]*latencyWindow
+}
+
+func NewRetryMgr() RetryMgr {
+	return RetryMgr{
+		policies:  make(map[string]RetryPolicy),
+		budgets:   make(map[string]float64),
+		latencies: make(map[string]*latencyWindow),
+	}
+}
+
+// SetPolicy sets the retry policy of function fn, and refills its retry budget.
+func (m *RetryMgr) SetPolicy(fn string, p RetryPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[fn] = p
+	m.budgets[fn] = retryBudgetMaxTokens
+	return nil
+}
+
+// ResetPolicy removes the retry policy of function fn, so that its invocations are never retried.
+func (m *RetryMgr) ResetPolicy(fn string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.policies, fn)
+	delete(m.budgets, fn)
+}
+
+func (m *RetryMgr) Policy(fn string) (RetryPolicy, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.policies[fn]
+	return p, ok
+}
+
+func (m *RetryMgr) Policies() map[string]RetryPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]RetryPolicy, len(m.policies))
+	for fn, p := range m.policies {
+		res[fn] = p
+	}
+	return res
+}
+
+// Adds the tokens earned by an invocation of function fn to its retry budget.
+func (m *RetryMgr) earn(fn string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.policies[fn]; ok {
+		m.budgets[fn] = min(m.budgets[fn]+p.BudgetRatio, retryBudgetMaxTokens)
+	}
+}
+
+// Spends one token of function fn's retry budget. Returns false if the budget is exhausted.
+func (m *RetryMgr) spend(fn string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.policies[fn]
+	if !ok {
+		return false
+	}
+	if p.BudgetRatio == 0 {
+		return true
+	}
+	if m.budgets[fn] < 1 {
+		return false
+	}
+	m.budgets[fn]--
+	return true
+}
+
+// Records the time function fn took to respond to an invocation.
+func (m *RetryMgr) observeLatency(fn string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.latencies[fn]
+	if !ok {
+		w = &latencyWindow{}
+		m.latencies[fn] = w
+	}
+	w.add(d)
+}
+
+// Returns the p-th percentile of function fn's latest latencies, and false if there are too few samples.
+func (m *RetryMgr) hedgeDelay(fn string, p float64) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.latencies[fn]
+	if !ok || len(w.samples) < minHedgeSamples {
+		return 0, false
+	}
+	return w.percentile(p), true
+}
+
+// Returned by an attempt whose response was aborted after being partially written.
+var errResponseAborted = errors.New("response aborted")
+
+// Arbitrates the attempts of one invocation: the first attempt getting a non-retryable response writes it to the
+// client, and the other attempts are canceled and their responses discarded.
+type attemptGroup struct {
+	w         http.ResponseWriter
+	retryable func(status int) bool
+
+	mu sync.Mutex
+	// The attempt whose response is written to w.
+	// Protected by mu.
+	winner *attemptWriter
+	// Protected by mu.
+	attempts []*attemptWriter
+}
+
+func newAttemptGroup(w http.ResponseWriter, retryable func(status int) bool) *attemptGroup {
+	return &attemptGroup{w: w, retryable: retryable}
+}
+
+func (g *attemptGroup) newWriter(cancel context.CancelFunc) *attemptWriter {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	aw := &attemptWriter{g: g, cancel: cancel, header: make(http.Header)}
+	g.attempts = append(g.attempts, aw)
+	return aw
+}
+
+// Makes aw the winner, and writes its response header to the client. Returns false if there is a winner already.
+func (g *attemptGroup) commit(aw *attemptWriter) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.winner != nil {
+		return false
+	}
+	g.winner = aw
+	for _, other := range g.attempts {
+		if other != aw {
+			other.cancel()
+		}
+	}
+	for k, v := range aw.header {
+		g.w.Header()[k] = v
+	}
+	g.w.WriteHeader(aw.status)
+	return true
+}
+
+func (g *attemptGroup) hasWinner() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.winner != nil
+}
+
+// Writes the outcome of the failed attempt a to the client, as no more attempts will be made. Returns the error to
+// report for the invocation.
+func (g *attemptGroup) fail(a *attempt) error {
+	if a.err == nil && a.w.status == 0 {
+		a.err = &ProxyError{Status: http.StatusBadGateway, Err: errResponseAborted}
+	}
+	if a.err == nil {
+		// Replays the retryable response.
+		if g.commit(a.w) {
+			g.w.Write(a.w.body.Bytes())
+		}
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.winner == nil {
+		writeProxyError(g.w, a.err)
+	}
+	return a.err
+}
+
+// The http.ResponseWriter of one attempt. It passes the response through to the client only if the attempt wins.
+// Used only by the goroutine of the attempt.
+type attemptWriter struct {
+	g      *attemptGroup
+	cancel context.CancelFunc
+	header http.Header
+
+	// The status of the response, 0 if not received yet.
+	status int
+	// The time when the response header was received.
+	respTime time.Time
+	// True if the response is written to the client.
+	committed bool
+	// The body of a retryable response, replayed to the client if no other attempt succeeds.
+	body bytes.Buffer
+}
+
+func (aw *attemptWriter) Header() http.Header {
+	if aw.committed {
+		// Trailers are set after writing the header.
+		return aw.g.w.Header()
+	}
+	return aw.header
+}
+
+func (aw *attemptWriter) WriteHeader(status int) {
+	// Informational responses are not passed through.
+	if status < http.StatusOK || aw.status != 0 {
+		return
+	}
+	aw.status = status
+	aw.respTime = time.Now()
+	if !aw.g.retryable(status) {
+		aw.committed = aw.g.commit(aw)
+	}
+}
+
+func (aw *attemptWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.committed {
+		return aw.g.w.Write(b)
+	}
+	if aw.g.retryable(aw.status) && aw.body.Len() < maxRetryableResponseBytes {
+		aw.body.Write(b[:min(len(b), maxRetryableResponseBytes-aw.body.Len())])
+	}
+	return len(b), nil
+}
+
+func (aw *attemptWriter) Flush() {
+	if aw.committed {
+		http.NewResponseController(aw.g.w).Flush()
+	}
+}
+
+// One attempt of an invocation.
+type attempt struct {
+	rc    *RunningContainer
+	w     *attemptWriter
+	start time.Time
+	err   *ProxyError
+	// True if the response was aborted after being partially written.
+	aborted bool
+}
+
+// Returns true if the failed attempt a can be retried under policy p.
+func (a *attempt) retryable(p RetryPolicy) bool {
+	if a.err != nil {
+		return p.isRetryableError(a.err)
+	}
+	// Only retryable responses are not committed when there is no winner.
+	return !a.aborted
+}
+
+// Reads the body of r for replaying it in retries. Returns false if the body is larger than maxRetryBodyBytes, in
+// which case r.Body is restored to read the whole body.
+func bufferRequestBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxRetryBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// Proxies r to rc, retrying on, and hedging to, other instances of ctx.Fn as allowed by the function's RetryPolicy.
+// Returns the instance whose response was written to w.
+func (d *Dispatcher) invoke(ctx CallContext, rc *RunningContainer, w http.ResponseWriter, r *http.Request) (
+	*RunningContainer, error) {
+	policy, ok := d.retryMgr.Policy(ctx.Fn)
+	if !ok || !policy.allowsRetry(r) {
+		return rc, d.forwardOnce(ctx, rc, w, r)
+	}
+
+	body, ok, err := bufferRequestBody(r)
+	if err != nil {
+		writeInvokeError(w, protocol.ErrorInvalidRequest, fmt.Sprintf("Could not read request body, error: %v", err))
+		return rc, err
+	}
+	if !ok {
+		loggerFrom(r.Context()).Warn("Request body too large to retry", "max_bytes", maxRetryBodyBytes)
+		return rc, d.forwardOnce(ctx, rc, w, r)
+	}
+	d.retryMgr.earn(ctx.Fn)
+
+	g := newAttemptGroup(w, policy.isRetryableStatus)
+	// Buffered, so that attempts finishing after the winner never block.
+	results := make(chan *attempt, policy.MaxAttempts)
+	var tried []*RunningContainer
+	run := func(rc *RunningContainer) {
+		tried = append(tried, rc)
+		attemptCtx, cancel := context.WithCancel(r.Context())
+		a := &attempt{rc: rc, w: g.newWriter(cancel), start: time.Now()}
+		req := r.Clone(attemptCtx)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.TransferEncoding = nil
+		go func() {
+			defer cancel()
+			a.err, a.aborted = d.forwardAttempt(ctx.Fn, rc, a.w, req)
+			rc.AddBusyTime(time.Since(a.start))
+			results <- a
+		}()
+	}
+
+	run(rc)
+	attempts, inflight := 1, 1
+	var hedgeChan <-chan time.Time
+	if policy.HedgePercentile > 0 {
+		if delay, ok := d.retryMgr.hedgeDelay(ctx.Fn, policy.HedgePercentile); ok {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			hedgeChan = timer.C
+		}
+	}
+	logger := loggerFrom(r.Context())
+	for {
+		select {
+		case a := <-results:
+			inflight--
+			respTime := a.w.respTime
+			if respTime.IsZero() {
+				// Failed without a response.
+				respTime = time.Now()
+			}
+			if a.w.committed || !g.hasWinner() {
+				// Attempts canceled for losing tell nothing about the health of their instances.
+				status := a.w.status
+				if a.err != nil {
+					status = a.err.Status
+				}
+				source := protocol.ErrorSource(a.w.Header().Get(errorSourceHeader))
+				d.observeHealth(r, a.rc, status, source, respTime.Sub(a.start))
+			}
+			if a.w.committed {
+				d.retryMgr.observeLatency(ctx.Fn, respTime.Sub(a.start))
+				if a.aborted {
+					return a.rc, errResponseAborted
+				}
+				return a.rc, nil
+			}
+			if inflight > 0 {
+				// Waits for the other attempts.
+				continue
+			}
+			if attempts >= policy.MaxAttempts || !a.retryable(policy) || r.Context().Err() != nil {
+				return a.rc, g.fail(a)
+			}
+			if !d.retryMgr.spend(ctx.Fn) {
+				logger.Warn("Retry budget exhausted")
+				d.metrics.retryBudgetExhausted.Inc(ctx.Fn)
+				return a.rc, g.fail(a)
+			}
+			select {
+			case <-time.After(policy.backoff(attempts)):
+			case <-r.Context().Done():
+				return a.rc, g.fail(a)
+			}
+			next, err := d.pickRetryInst(ctx.Fn, tried)
+			if err != nil {
+				// Retries on the same instance if there's no other.
+				next = a.rc
+			}
+			logger.Info("Retrying invocation", "attempt", attempts+1, "status", a.w.status, "next_instance", next.name)
+			d.metrics.retries.Inc(ctx.Fn, "retry")
+			run(next)
+			attempts++
+			inflight++
+		case <-hedgeChan:
+			hedgeChan = nil
+			if attempts >= policy.MaxAttempts {
+				continue
+			}
+			next, err := d.pickRetryInst(ctx.Fn, tried)
+			if err != nil {
+				continue
+			}
+			if !d.retryMgr.spend(ctx.Fn) {
+				d.metrics.retryBudgetExhausted.Inc(ctx.Fn)
+				continue
+			}
+			logger.Info("Hedging invocation", "attempt", attempts+1, "next_instance", next.name)
+			d.metrics.retries.Inc(ctx.Fn, "hedge")
+			run(next)
+			attempts++
+			inflight++
+		}
+	}
+}
+
+// Proxies r to rc without retrying.
+func (d *Dispatcher) forwardOnce(ctx CallContext, rc *RunningContainer, w http.ResponseWriter, r *http.Request) error {
+	sw := newStatusRecorder(w)
+	start := time.Now()
+	err := d.proxy.Forward(ctx.Fn, rc.Url, sw, r)
+	rc.AddBusyTime(time.Since(start))
+	respTime := sw.headerTime
+	if respTime.IsZero() {
+		respTime = time.Now()
+	}
+	d.observeHealth(r, rc, sw.status, protocol.ErrorSource(sw.Header().Get(errorSourceHeader)), respTime.Sub(start))
+	return err
+}
+
+// Picks a ready and routable instance of function fn to retry on, serving the same version as those tried, other than
+// them.
+func (d *Dispatcher) pickRetryInst(fn string, tried []*RunningContainer) (*RunningContainer, error) {
+	return d.launcher.pickInst(fn, func(rc *RunningContainer) bool {
+		return rc.version == tried[0].version && rc.IsReady() && !slices.Contains(tried, rc) &&
+			d.healthMgr.isRoutable(rc)
+	})
+}
+
+// Forwards one attempt to rc. Aborted responses are reported instead of panicking, as attempts are not run by the
+// goroutine serving the request.
+func (d *Dispatcher) forwardAttempt(fn string, rc *RunningContainer, aw *attemptWriter, r *http.Request) (
+	err *ProxyError, aborted bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+	return d.proxy.forward(fn, rc.Url, aw, r), false
+}
@@ -0,0 +1,285 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Adds a ready instance of version 1 of function fn to d, serving invocations with h.
+func addTestInst(t *testing.T, d *Dispatcher, fn string, h http.HandlerFunc) *RunningContainer {
+	return addTestVersionInst(t, d, fn, 1, h)
+}
+
+// Adds a ready instance of version of function fn to d, serving invocations with h.
+func addTestVersionInst(t *testing.T, d *Dispatcher, fn string, version int, h http.HandlerFunc) *RunningContainer {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	d.launcher.fnInstsMapMu.Lock()
+	defer d.launcher.fnInstsMapMu.Unlock()
+	rc := &RunningContainer{
+		name:    fmt.Sprintf("%s-test-%d", fn, len(d.launcher.fnInstsMap[fn])),
+		fn:      fn,
+		version: version,
+		Url:     server.URL,
+		isRdy:   true,
+		rdyTime: time.Now(),
+	}
+	d.launcher.fnInstsMap[fn] = append(d.launcher.fnInstsMap[fn], rc)
+	return rc
+}
+
+// Returns a handler responding with status and body, and counting the calls.
+func newCountingHandler(status int, body string, calls *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// TestInvoke_RetriesOnOtherInstance tests that a retryable failure is retried on another instance with the same body
+func TestInvoke_RetriesOnOtherInstance(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultRetryPolicy()
+	policy.Idempotent = true
+	policy.InitialBackoff = Duration(time.Millisecond)
+	policy.MaxBackoff = Duration(time.Millisecond)
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+
+	var failingCalls int32
+	failing := addTestInst(t, d, "alpha", newCountingHandler(http.StatusServiceUnavailable, "busy", &failingCalls))
+	var body string
+	healthy := addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("X-Instance", "healthy")
+		io.WriteString(w, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/alpha", strings.NewReader(`{"args": {}}`))
+	rc, err := d.invoke(CallContext{Fn: "alpha"}, failing, w, req)
+	assert.NoError(t, err)
+	assert.Same(t, healthy, rc)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+	assert.Equal(t, "healthy", w.Header().Get("X-Instance"))
+	assert.Equal(t, `{"args": {}}`, body)
+	assert.Equal(t, int32(1), failingCalls)
+	assert.Equal(t, float64(1), d.metrics.retries.Value("alpha", "retry"))
+}
+
+// TestInvoke_Idempotency tests that invocations of non-idempotent functions are only retried with Idempotency-Key
+func TestInvoke_Idempotency(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = Duration(time.Millisecond)
+	policy.MaxBackoff = Duration(time.Millisecond)
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+
+	var failingCalls, healthyCalls int32
+	failing := addTestInst(t, d, "alpha", newCountingHandler(http.StatusServiceUnavailable, "busy", &failingCalls))
+	addTestInst(t, d, "alpha", newCountingHandler(http.StatusOK, "ok", &healthyCalls))
+
+	w := httptest.NewRecorder()
+	d.invoke(CallContext{Fn: "alpha"}, failing, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int32(0), healthyCalls)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/alpha", nil)
+	req.Header.Set(idempotencyKeyHeader, "key")
+	d.invoke(CallContext{Fn: "alpha"}, failing, w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), healthyCalls)
+}
+
+// TestInvoke_RetriesExhausted tests that the last retryable response is passed to the client
+func TestInvoke_RetriesExhausted(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultRetryPolicy()
+	policy.Idempotent = true
+	policy.MaxAttempts = 2
+	policy.InitialBackoff = Duration(time.Millisecond)
+	policy.MaxBackoff = Duration(time.Millisecond)
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+
+	var calls int32
+	failing := addTestInst(t, d, "alpha", newCountingHandler(http.StatusBadGateway, "bad", &calls))
+	addTestInst(t, d, "alpha", newCountingHandler(http.StatusBadGateway, "bad", &calls))
+
+	w := httptest.NewRecorder()
+	_, err := d.invoke(CallContext{Fn: "alpha"}, failing, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "Instance responded with status 502: bad")
+	assert.Equal(t, int32(2), calls)
+}
+
+// TestInvoke_RetriesConnectError tests that failing to reach an instance is retried
+func TestInvoke_RetriesConnectError(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultRetryPolicy()
+	policy.Idempotent = true
+	policy.InitialBackoff = Duration(time.Millisecond)
+	policy.MaxBackoff = Duration(time.Millisecond)
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+
+	var calls int32
+	unreachable := addTestInst(t, d, "alpha", nil)
+	server := httptest.NewServer(nil)
+	server.Close()
+	unreachable.Url = server.URL
+	addTestInst(t, d, "alpha", newCountingHandler(http.StatusOK, "ok", &calls))
+
+	w := httptest.NewRecorder()
+	_, err := d.invoke(CallContext{Fn: "alpha"}, unreachable, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), calls)
+}
+
+// TestInvoke_LatencyOfConnectError tests that attempts failing to reach an instance are observed with the time they
+// took, though no response was received
+func TestInvoke_LatencyOfConnectError(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	defer d.rolloutMgr.Stop()
+	policy := DefaultRetryPolicy()
+	policy.Idempotent = true
+	policy.InitialBackoff = Duration(time.Millisecond)
+	policy.MaxBackoff = Duration(time.Millisecond)
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+	_, err := d.versionMgr.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	_, err = d.rolloutMgr.Start("alpha", spec)
+	assert.NoError(t, err)
+
+	var calls int32
+	unreachable := addTestInst(t, d, "alpha", nil)
+	server := httptest.NewServer(nil)
+	server.Close()
+	unreachable.Url = server.URL
+	addTestInst(t, d, "alpha", newCountingHandler(http.StatusOK, "ok", &calls))
+
+	w := httptest.NewRecorder()
+	_, err = d.invoke(CallContext{Fn: "alpha"}, unreachable, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	assert.NoError(t, err)
+	status, err := d.rolloutMgr.Get("alpha")
+	assert.NoError(t, err)
+	stats := status.Stats[1]
+	assert.Equal(t, 2, stats.Requests)
+	assert.GreaterOrEqual(t, stats.MeanLatency, Duration(0))
+	assert.Less(t, stats.MeanLatency, Duration(time.Second))
+}
+
+// TestInvoke_Hedge tests that a slow invocation is hedged to another instance, and the faster response is used
+func TestInvoke_Hedge(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	policy := DefaultRetryPolicy()
+	policy.Idempotent = true
+	policy.HedgePercentile = 0.9
+	assert.NoError(t, d.GetRetryMgr().SetPolicy("alpha", policy))
+	for i := 0; i < minHedgeSamples; i++ {
+		d.GetRetryMgr().observeLatency("alpha", 10*time.Millisecond)
+	}
+
+	slow := addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "slow")
+	})
+	var calls int32
+	fast := addTestInst(t, d, "alpha", newCountingHandler(http.StatusOK, "fast", &calls))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	rc, err := d.invoke(CallContext{Fn: "alpha"}, slow, w, httptest.NewRequest(http.MethodPost, "/alpha", nil))
+	assert.NoError(t, err)
+	assert.Same(t, fast, rc)
+	assert.Equal(t, "fast", w.Body.String())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, float64(1), d.metrics.retries.Value("alpha", "hedge"))
+}
+
+// TestRetryMgr_Budget tests that retries are limited by the budget earned by invocations
+func TestRetryMgr_Budget(t *testing.T) {
+	m := NewRetryMgr()
+	assert.False(t, m.spend("alpha"), "functions without policies are never retried")
+
+	policy := DefaultRetryPolicy()
+	policy.BudgetRatio = 0.5
+	assert.NoError(t, m.SetPolicy("alpha", policy))
+	for i := 0; i < retryBudgetMaxTokens; i++ {
+		assert.True(t, m.spend("alpha"))
+	}
+	assert.False(t, m.spend("alpha"))
+
+	m.earn("alpha")
+	assert.False(t, m.spend("alpha"))
+	m.earn("alpha")
+	assert.True(t, m.spend("alpha"))
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := DefaultRetryPolicy()
+	p.InitialBackoff = Duration(100 * time.Millisecond)
+	p.MaxBackoff = Duration(300 * time.Millisecond)
+	for n, max := range map[int]time.Duration{1: 100, 2: 200, 3: 300, 10: 300} {
+		max *= time.Millisecond
+		d := p.backoff(n)
+		assert.GreaterOrEqual(t, d, max/2, n)
+		assert.LessOrEqual(t, d, max, n)
+	}
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	assert.NoError(t, DefaultRetryPolicy().Validate())
+
+	p := DefaultRetryPolicy()
+	p.MaxAttempts = 0
+	assert.Error(t, p.Validate())
+
+	p = DefaultRetryPolicy()
+	p.RetryableErrors = []string{"reset"}
+	assert.Error(t, p.Validate())
+
+	p = DefaultRetryPolicy()
+	p.HedgePercentile = 1
+	assert.Error(t, p.Validate())
+}
+
+func TestBufferRequestBody_TooLarge(t *testing.T) {
+	large := strings.Repeat("x", maxRetryBodyBytes+10)
+	req := httptest.NewRequest(http.MethodPost, "/alpha", strings.NewReader(large))
+	_, ok, err := bufferRequestBody(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	b, _ := io.ReadAll(req.Body)
+	assert.Equal(t, large, string(b))
+
+	req = httptest.NewRequest(http.MethodPost, "/alpha", strings.NewReader("small"))
+	body, ok, err := bufferRequestBody(req)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "small", string(body))
+}
@@ -0,0 +1,486 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RolloutState is the state of a rollout.
+type RolloutState string
+
+const (
+	// Shifting traffic step by step.
+	RolloutRunning RolloutState = "running"
+	// All traffic of the alias is served by the new version.
+	RolloutCompleted RolloutState = "completed"
+	// The alias is restored to the weights before the rollout.
+	RolloutRolledBack RolloutState = "rolled_back"
+)
+
+// How often running rollouts are checked.
+const rolloutCheckInterval = time.Second
+
+var (
+	ErrRolloutNotFound   = errors.New("rollout not found")
+	ErrRolloutInProgress = errors.New("rollout in progress")
+)
+
+// RolloutSpec determines how a rollout shifts an alias from the old version to the new one.
+type RolloutSpec struct {
+	// The alias to shift, defaultAlias if empty.
+	Alias string `json:"alias"`
+
+	// The version the alias shifts from, i.e., the baseline, and the one it shifts to. The version weighted the most
+	// by the alias is shifted from if FromVersion is 0. Unless dry running, the alias must serve FromVersion.
+	FromVersion int `json:"from_version"`
+	ToVersion   int `json:"to_version"`
+
+	// The percentages of the alias' traffic sent to the new version in each step, increasing up to 100.
+	Steps []int `json:"steps"`
+
+	// How long each step lasts at least. A step also lasts until the new version has served MinRequests
+	// invocations since the rollout started, so that there is enough evidence to move on.
+	StepDuration Duration `json:"step_duration"`
+	MinRequests  int      `json:"min_requests"`
+
+	// Rolls back if the error rate, i.e., the ratio of 5xx responses, of the new version exceeds the baseline's by
+	// more than MaxErrorRateIncrease, e.g., 0.02 for 2 percentage points.
+	MaxErrorRateIncrease float64 `json:"max_error_rate_increase"`
+
+	// Rolls back if the mean latency of the new version exceeds MaxLatencyFactor times the baseline's. 0 disables.
+	MaxLatencyFactor float64 `json:"max_latency_factor"`
+
+	// Steps and rolls back without changing the alias, only recording what the rollout would have done, e.g., to
+	// rehearse the thresholds against traffic sent to the new version by another alias.
+	DryRun bool `json:"dry_run"`
+}
+
+func DefaultRolloutSpec() RolloutSpec {
+	return RolloutSpec{
+		Alias:                defaultAlias,
+		Steps:                []int{5, 25, 50, 100},
+		StepDuration:         Duration(5 * time.Minute),
+		MinRequests:          20,
+		MaxErrorRateIncrease: 0.02,
+		MaxLatencyFactor:     1.5,
+	}
+}
+
+func (s RolloutSpec) Validate() error {
+	if len(s.Steps) == 0 || s.Steps[len(s.Steps)-1] != 100 {
+		return fmt.Errorf("steps must end at 100")
+	}
+	for i, p := range s.Steps {
+		if p <= 0 || (i > 0 && p <= s.Steps[i-1]) {
+			return fmt.Errorf("steps must be positive and increasing")
+		}
+	}
+	if s.StepDuration <= 0 || s.MinRequests < 0 {
+		return fmt.Errorf("step_duration must be positive, and min_requests non-negative")
+	}
+	if s.MaxErrorRateIncrease < 0 || s.MaxErrorRateIncrease > 1 {
+		return fmt.Errorf("max_error_rate_increase must be in [0, 1]")
+	}
+	if s.MaxLatencyFactor != 0 && s.MaxLatencyFactor <= 1 {
+		return fmt.Errorf("max_latency_factor must be greater than 1")
+	}
+	return nil
+}
+
+// The responses of a version's instances observed by the proxy during a rollout.
+type versionStats struct {
+	requests int
+	// The 5xx responses, including the invocations failed to be proxied.
+	errors       int
+	totalLatency time.Duration
+}
+
+func (s *versionStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+func (s *versionStats) meanLatency() time.Duration {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.totalLatency / time.Duration(s.requests)
+}
+
+// VersionStats is a point-in-time view of the responses of a version's instances during a rollout.
+type VersionStats struct {
+	Requests int `json:"requests"`
+	// The ratio of 5xx responses, including the invocations failed to be proxied.
+	ErrorRate   float64  `json:"error_rate"`
+	MeanLatency Duration `json:"mean_latency"`
+}
+
+// RolloutEvent records a change of a rollout.
+type RolloutEvent struct {
+	Time time.Time `json:"time"`
+	// The percentage of traffic sent to the new version after the event.
+	Percent int    `json:"percent"`
+	Message string `json:"message"`
+}
+
+// Rollout is the state of shifting an alias of a function from one version to another.
+type Rollout struct {
+	Fn string `json:"fn"`
+	RolloutSpec
+
+	State RolloutState `json:"state"`
+	// The index of the current step.
+	Step            int       `json:"step"`
+	StartedTime     time.Time `json:"started_time"`
+	StepStartedTime time.Time `json:"step_started_time"`
+	// Zero while running.
+	FinishedTime time.Time `json:"finished_time"`
+	// Why the rollout was rolled back.
+	Reason string `json:"reason,omitempty"`
+
+	// The weights of the alias before the rollout, restored when rolling back.
+	OriginalWeights map[int]int `json:"original_weights"`
+
+	History []RolloutEvent `json:"history"`
+
+	// The stats of the versions since the rollout started.
+	stats map[int]*versionStats
+}
+
+// The percentage of traffic currently sent to the new version.
+func (r *Rollout) percent() int {
+	if r.State == RolloutRolledBack {
+		return 0
+	}
+	return r.Steps[r.Step]
+}
+
+// Returns the breached threshold, or "" if none is breached, or there's not enough evidence yet.
+func (r *Rollout) breach() string {
+	target, baseline := r.stats[r.ToVersion], r.stats[r.FromVersion]
+	if target.requests < r.MinRequests || target.requests == 0 {
+		return ""
+	}
+	// The baseline is only trusted with enough evidence too.
+	baselineKnown := baseline.requests >= r.MinRequests && baseline.requests > 0
+	baselineErrorRate := 0.0
+	if baselineKnown {
+		baselineErrorRate = baseline.errorRate()
+	}
+	if target.errorRate() > baselineErrorRate+r.MaxErrorRateIncrease {
+		return fmt.Sprintf("error rate %.4f of version %d exceeds %.4f of version %d by more than %.4f",
+			target.errorRate(), r.ToVersion, baselineErrorRate, r.FromVersion, r.MaxErrorRateIncrease)
+	}
+	if r.MaxLatencyFactor > 0 && baselineKnown &&
+		float64(target.meanLatency()) > r.MaxLatencyFactor*float64(baseline.meanLatency()) {
+		return fmt.Sprintf("mean latency %v of version %d exceeds %.2f times %v of version %d",
+			target.meanLatency(), r.ToVersion, r.MaxLatencyFactor, baseline.meanLatency(), r.FromVersion)
+	}
+	return ""
+}
+
+// Returns the weights of the alias at the current step. The new version is sent the step's percentage of the traffic,
+// and the other versions of the original weights share the rest in their original proportions.
+func (r *Rollout) weights() map[int]int {
+	if r.State == RolloutRolledBack {
+		return r.OriginalWeights
+	}
+	p := r.percent()
+	if p == 100 {
+		return map[int]int{r.ToVersion: 100}
+	}
+	others := 0
+	for v, weight := range r.OriginalWeights {
+		if v != r.ToVersion {
+			others += weight
+		}
+	}
+	weights := map[int]int{r.ToVersion: p * others}
+	for v, weight := range r.OriginalWeights {
+		if v != r.ToVersion {
+			weights[v] = (100 - p) * weight
+		}
+	}
+	return weights
+}
+
+// RolloutStatus is a point-in-time view of a rollout.
+type RolloutStatus struct {
+	Rollout
+	Percent int `json:"percent"`
+
+	// The stats of the versions since the rollout started, by version.
+	Stats map[int]VersionStats `json:"stats"`
+}
+
+// RolloutMgr shifts aliases to new versions step by step, rolling back when the new versions regress.
+type RolloutMgr struct {
+	versionMgr *VersionMgr
+
+	// Called with the function and the final state of each finished rollout.
+	onFinished func(fn string, state RolloutState)
+
+	// How often running rollouts are checked.
+	interval time.Duration
+
+	mu sync.Mutex
+	// Map from the function to its last rollout.
+	// Protected by mu.
+	rollouts map[string]*Rollout
+	// True if the goroutine checking running rollouts is running.
+	// Protected by mu.
+	checking bool
+	// Closed when stopping.
+	// Protected by mu.
+	stop chan struct{}
+}
+
+func NewRolloutMgr(versionMgr *VersionMgr) *RolloutMgr {
+	return &RolloutMgr{
+		versionMgr: versionMgr,
+		onFinished: func(string, RolloutState) {},
+		interval:   rolloutCheckInterval,
+		rollouts:   make(map[string]*Rollout),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start starts shifting an alias of function fn according to spec. Fails with ErrRolloutInProgress if fn already has
+// a running rollout.
+func (m *RolloutMgr) Start(fn string, spec RolloutSpec) (RolloutStatus, error) {
+	if spec.Alias == "" {
+		spec.Alias = defaultAlias
+	}
+	if err := spec.Validate(); err != nil {
+		return RolloutStatus{}, err
+	}
+	aliases, ok := m.versionMgr.Aliases(fn)
+	if !ok {
+		return RolloutStatus{}, fmt.Errorf("Function %s not found", fn)
+	}
+	alias, ok := aliases[spec.Alias]
+	if !ok {
+		return RolloutStatus{}, fmt.Errorf("alias %s of function %s not found", spec.Alias, fn)
+	}
+	if spec.FromVersion == 0 {
+		for v, weight := range alias.Weights {
+			if weight > alias.Weights[spec.FromVersion] ||
+				(weight == alias.Weights[spec.FromVersion] && v > spec.FromVersion) {
+				spec.FromVersion = v
+			}
+		}
+	}
+	versions, _ := m.versionMgr.Versions(fn)
+	if spec.ToVersion < 1 || spec.ToVersion > len(versions) || spec.FromVersion < 1 ||
+		spec.FromVersion > len(versions) {
+		return RolloutStatus{}, fmt.Errorf("versions %d and %d of function %s must exist", spec.FromVersion,
+			spec.ToVersion, fn)
+	}
+	if spec.FromVersion == spec.ToVersion {
+		return RolloutStatus{}, fmt.Errorf("from_version and to_version must differ")
+	}
+	// The baseline is only observed if the alias sends it traffic.
+	if !spec.DryRun && alias.Weights[spec.FromVersion] == 0 {
+		return RolloutStatus{}, fmt.Errorf("version %d is not served by alias %s", spec.FromVersion, spec.Alias)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.rollouts[fn]; ok && r.State == RolloutRunning {
+		return RolloutStatus{}, ErrRolloutInProgress
+	}
+	now := time.Now()
+	r := &Rollout{
+		Fn:              fn,
+		RolloutSpec:     spec,
+		State:           RolloutRunning,
+		StartedTime:     now,
+		StepStartedTime: now,
+		OriginalWeights: alias.Weights,
+		stats:           map[int]*versionStats{spec.FromVersion: {}, spec.ToVersion: {}},
+	}
+	if err := m.applyLocked(r, now, fmt.Sprintf("Started shifting from version %d to %d", r.FromVersion,
+		r.ToVersion)); err != nil {
+		return RolloutStatus{}, err
+	}
+	m.rollouts[fn] = r
+	if !m.checking {
+		m.checking = true
+		go m.check()
+	}
+	return m.statusLocked(r), nil
+}
+
+// Sets the alias to the weights of r's current step, and records the event. Must be called with mu held.
+func (m *RolloutMgr) applyLocked(r *Rollout, now time.Time, message string) error {
+	logger := slog.With(logKeyFn, r.Fn, "alias", r.Alias, "percent", r.percent(), "dry_run", r.DryRun)
+	if !r.DryRun {
+		if err := m.versionMgr.SetAlias(r.Fn, r.Alias, r.weights()); err != nil {
+			logger.Error("Failed to shift alias", "error", err)
+			return err
+		}
+	}
+	logger.Info(message)
+	r.History = append(r.History, RolloutEvent{Time: now, Percent: r.percent(), Message: message})
+	return nil
+}
+
+// Checks running rollouts periodically, until none is running, or stopping.
+func (m *RolloutMgr) check() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if !m.tick(now) {
+				return
+			}
+		case <-m.stop:
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.checking = false
+			return
+		}
+	}
+}
+
+// Steps or rolls back running rollouts as of now. Returns false, and marks the checking goroutine stopped, if no
+// rollout is running.
+func (m *RolloutMgr) tick(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	running := false
+	for _, r := range m.rollouts {
+		if r.State != RolloutRunning {
+			continue
+		}
+		m.checkLocked(r, now)
+		if r.State == RolloutRunning {
+			running = true
+		}
+	}
+	if !running {
+		m.checking = false
+	}
+	return running
+}
+
+// Must be called with mu held.
+func (m *RolloutMgr) checkLocked(r *Rollout, now time.Time) {
+	if reason := r.breach(); reason != "" {
+		m.rollbackLocked(r, now, reason)
+		return
+	}
+	if now.Sub(r.StepStartedTime) < time.Duration(r.StepDuration) || r.stats[r.ToVersion].requests < r.MinRequests {
+		return
+	}
+	if r.Step == len(r.Steps)-1 {
+		r.State = RolloutCompleted
+		r.FinishedTime = now
+		m.applyLocked(r, now, fmt.Sprintf("Completed shifting to version %d", r.ToVersion))
+		m.onFinished(r.Fn, r.State)
+		return
+	}
+	r.Step++
+	r.StepStartedTime = now
+	if err := m.applyLocked(r, now, fmt.Sprintf("Shifted %d%% of traffic to version %d", r.percent(),
+		r.ToVersion)); err != nil {
+		m.rollbackLocked(r, now, fmt.Sprintf("Could not shift alias, error: %v", err))
+	}
+}
+
+// Must be called with mu held.
+func (m *RolloutMgr) rollbackLocked(r *Rollout, now time.Time, reason string) {
+	r.State = RolloutRolledBack
+	r.FinishedTime = now
+	r.Reason = reason
+	m.applyLocked(r, now, "Rolled back: "+reason)
+	m.onFinished(r.Fn, r.State)
+}
+
+// Rollback rolls back the running rollout of function fn.
+func (m *RolloutMgr) Rollback(fn, reason string) (RolloutStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rollouts[fn]
+	if !ok || r.State != RolloutRunning {
+		return RolloutStatus{}, ErrRolloutNotFound
+	}
+	m.rollbackLocked(r, time.Now(), reason)
+	return m.statusLocked(r), nil
+}
+
+// Records the response of version of function fn with status, which took latency to respond.
+func (m *RolloutMgr) observe(fn string, version, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rollouts[fn]
+	if !ok || r.State != RolloutRunning {
+		return
+	}
+	s, ok := r.stats[version]
+	if !ok {
+		return
+	}
+	s.requests++
+	if status == 0 || status >= http.StatusInternalServerError {
+		s.errors++
+	}
+	s.totalLatency += latency
+}
+
+// Must be called with mu held.
+func (m *RolloutMgr) statusLocked(r *Rollout) RolloutStatus {
+	res := RolloutStatus{Rollout: *r, Percent: r.percent(), Stats: make(map[int]VersionStats)}
+	res.History = append([]RolloutEvent{}, r.History...)
+	res.stats = nil
+	for v, s := range r.stats {
+		res.Stats[v] = VersionStats{
+			Requests:    s.requests,
+			ErrorRate:   s.errorRate(),
+			MeanLatency: Duration(s.meanLatency()),
+		}
+	}
+	return res
+}
+
+// Get returns the last rollout of function fn.
+func (m *RolloutMgr) Get(fn string) (RolloutStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rollouts[fn]
+	if !ok {
+		return RolloutStatus{}, ErrRolloutNotFound
+	}
+	return m.statusLocked(r), nil
+}
+
+// List returns the last rollouts of all functions, ordered by function.
+func (m *RolloutMgr) List() []RolloutStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]RolloutStatus, 0, len(m.rollouts))
+	for _, r := range m.rollouts {
+		res = append(res, m.statusLocked(r))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Fn < res[j].Fn })
+	return res
+}
+
+// Stop stops checking running rollouts, leaving their aliases at their current steps.
+func (m *RolloutMgr) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+}
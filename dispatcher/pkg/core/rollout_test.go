@@ -0,0 +1,263 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// Simulates the rollout of function alpha for steps minutes, serving 1000 users every minute by the alias, with
+// respond returning the status and latency of each version. Returns the rollout afterwards.
+func simulateRollout(m *RolloutMgr, spec RolloutSpec, steps int,
+	respond func(version int) (int, time.Duration)) RolloutStatus {
+	status, _ := m.Get("alpha")
+	now := status.StartedTime
+	for i := 0; i < steps; i++ {
+		for u := 0; u < 1000; u++ {
+			v, _ := m.versionMgr.Resolve("alpha", spec.Alias, fmt.Sprintf("user-%d", u))
+			status, latency := respond(v)
+			m.observe("alpha", v, status, latency)
+		}
+		now = now.Add(time.Minute)
+		m.tick(now)
+	}
+	status, _ = m.Get("alpha")
+	return status
+}
+
+// TestRolloutMgr_Complete tests that a healthy rollout shifts the alias step by step, until it's completed
+func TestRolloutMgr_Complete(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	// Rollouts are only checked when the test calls tick, simulating the time.
+	m.interval = time.Hour
+	defer m.Stop()
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.StepDuration = Duration(time.Minute)
+	status, err := m.Start("alpha", spec)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, status.FromVersion)
+	assert.Equal(t, 5, status.Percent)
+	aliases, _ := m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{1: 95, 2: 5}, aliases[defaultAlias].Weights)
+
+	_, err = m.Start("alpha", spec)
+	assert.ErrorIs(t, err, ErrRolloutInProgress)
+
+	status = simulateRollout(m, spec, 10, func(int) (int, time.Duration) {
+		return http.StatusOK, 10 * time.Millisecond
+	})
+	assert.Equal(t, RolloutCompleted, status.State)
+	assert.Equal(t, 100, status.Percent)
+	assert.Len(t, status.History, len(spec.Steps)+1)
+	aliases, _ = m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{2: 100}, aliases[defaultAlias].Weights)
+}
+
+// TestRolloutMgr_RollbackOnErrors tests that a rollout is rolled back once the new version's error rate regresses
+func TestRolloutMgr_RollbackOnErrors(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.StepDuration = Duration(time.Minute)
+	spec.MinRequests = 5
+	_, err = m.Start("alpha", spec)
+	assert.NoError(t, err)
+
+	calls := 0
+	status := simulateRollout(m, spec, 10, func(v int) (int, time.Duration) {
+		calls++
+		if v == 2 && calls%5 == 0 {
+			return http.StatusInternalServerError, 10 * time.Millisecond
+		}
+		return http.StatusOK, 10 * time.Millisecond
+	})
+	assert.Equal(t, RolloutRolledBack, status.State)
+	assert.Contains(t, status.Reason, "error rate")
+	assert.Greater(t, status.Stats[2].ErrorRate, 0.1)
+	aliases, _ := m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{1: 1}, aliases[defaultAlias].Weights)
+}
+
+// TestDispatcher_RollbackOnFunctionErrors tests that a rollout is rolled back once the new version's code keeps
+// raising errors, though they don't eject its instances
+func TestDispatcher_RollbackOnFunctionErrors(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	defer d.rolloutMgr.Stop()
+	_, err := d.versionMgr.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.MinRequests = 5
+	status, err := d.rolloutMgr.Start("alpha", spec)
+	assert.NoError(t, err)
+
+	v1 := &RunningContainer{name: "alpha-0", fn: "alpha", version: 1}
+	v2 := &RunningContainer{name: "alpha-1", fn: "alpha", version: 2}
+	r := newTestDispatchRequest("test")
+	for i := 0; i < 5; i++ {
+		d.observeHealth(r, v1, http.StatusOK, "", time.Millisecond)
+		d.observeHealth(r, v2, http.StatusInternalServerError, protocol.SourceFunction, time.Millisecond)
+	}
+	assert.True(t, d.healthMgr.isRoutable(v2))
+	d.rolloutMgr.tick(status.StartedTime.Add(time.Duration(spec.StepDuration)))
+
+	status, _ = d.rolloutMgr.Get("alpha")
+	assert.Equal(t, RolloutRolledBack, status.State)
+	assert.Contains(t, status.Reason, "error rate")
+}
+
+// TestRolloutMgr_RollbackOnLatency tests that a rollout is rolled back once the new version's latency regresses
+func TestRolloutMgr_RollbackOnLatency(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.StepDuration = Duration(time.Minute)
+	spec.MinRequests = 5
+	_, err = m.Start("alpha", spec)
+	assert.NoError(t, err)
+
+	status := simulateRollout(m, spec, 10, func(v int) (int, time.Duration) {
+		return http.StatusOK, time.Duration(v*v) * 10 * time.Millisecond
+	})
+	assert.Equal(t, RolloutRolledBack, status.State)
+	assert.Contains(t, status.Reason, "latency")
+}
+
+// TestRolloutMgr_DryRun tests that a dry run records the steps and rollback without changing the alias
+func TestRolloutMgr_DryRun(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.StepDuration = Duration(time.Minute)
+	spec.DryRun = true
+	spec.MinRequests = 5
+	_, err = m.Start("alpha", spec)
+	assert.NoError(t, err)
+
+	// The alias is unchanged, so the new version is only invoked by its number.
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10; j++ {
+			m.observe("alpha", 1, http.StatusOK, time.Millisecond)
+			m.observe("alpha", 2, http.StatusOK, time.Millisecond)
+		}
+		now = now.Add(time.Minute)
+		m.tick(now)
+	}
+	status, _ := m.Get("alpha")
+	assert.Equal(t, RolloutRunning, status.State)
+	assert.Equal(t, 50, status.Percent)
+
+	m.observe("alpha", 2, http.StatusBadGateway, time.Millisecond)
+	m.tick(now.Add(time.Second))
+	status, _ = m.Get("alpha")
+	assert.Equal(t, RolloutRolledBack, status.State)
+	assert.Len(t, status.History, 4)
+	aliases, _ := m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{1: 1}, aliases[defaultAlias].Weights)
+}
+
+// TestRolloutMgr_OtherVersions tests that the versions of the alias other than the baseline keep their share of the
+// traffic left to the old versions
+func TestRolloutMgr_OtherVersions(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	for i := 0; i < 2; i++ {
+		_, err = vm.Publish("alpha", FunctionVersion{Image: "runtime:v3"})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, vm.SetAlias("alpha", defaultAlias, map[int]int{1: 3, 3: 1}))
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	spec.StepDuration = Duration(time.Minute)
+	spec.FromVersion = 4
+	_, err = m.Start("alpha", spec)
+	assert.Error(t, err)
+
+	spec.FromVersion = 0
+	status, err := m.Start("alpha", spec)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, status.FromVersion)
+	aliases, _ := m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{1: 285, 2: 20, 3: 95}, aliases[defaultAlias].Weights)
+
+	status = simulateRollout(m, spec, 4, func(int) (int, time.Duration) { return http.StatusOK, time.Millisecond })
+	assert.Equal(t, RolloutCompleted, status.State)
+	aliases, _ = m.versionMgr.Aliases("alpha")
+	assert.Equal(t, map[int]int{2: 100}, aliases[defaultAlias].Weights)
+}
+
+// TestRolloutMgr_Stop tests that stopping marks the goroutine checking rollouts stopped
+func TestRolloutMgr_Stop(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	spec := DefaultRolloutSpec()
+	spec.ToVersion = 2
+	_, err = m.Start("alpha", spec)
+	assert.NoError(t, err)
+	m.Stop()
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return !m.checking
+	}, time.Second, time.Millisecond)
+}
+
+// TestRolloutMgr_Validate tests that invalid rollouts are not started
+func TestRolloutMgr_Validate(t *testing.T) {
+	vm := newTestVersionMgr()
+	_, err := vm.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	m := NewRolloutMgr(vm)
+	m.interval = time.Hour
+	defer m.Stop()
+	for _, modify := range []func(s *RolloutSpec){
+		func(s *RolloutSpec) { s.ToVersion = 3 },
+		func(s *RolloutSpec) { s.ToVersion = 1 },
+		func(s *RolloutSpec) { s.Alias = "canary" },
+		func(s *RolloutSpec) { s.Steps = []int{50, 25, 100} },
+		func(s *RolloutSpec) { s.Steps = []int{50} },
+		func(s *RolloutSpec) { s.MaxLatencyFactor = 0.5 },
+	} {
+		spec := DefaultRolloutSpec()
+		spec.ToVersion = 2
+		modify(&spec)
+		_, err := m.Start("alpha", spec)
+		assert.Error(t, err)
+	}
+	_, err = m.Rollback("alpha", "test")
+	assert.ErrorIs(t, err, ErrRolloutNotFound)
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The timeout waiting for instances to become ready, for invocations served by RegisterInvokeRoutes.
+const defaultInstRdyTimeout = 12 * time.Second
+
+// The version name always resolving to the latest version of a function.
+const latestVersion = "latest"
+
+// ParseRouteAliases parses route aliases in the form of "<route>=<fn>,...", e.g., "alpha=alpha,b=beta".
+func ParseRouteAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return aliases, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		route, fn, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		route = strings.Trim(route, "/")
+		if !ok || route == "" || fn == "" || strings.Contains(route, "/") {
+			return nil, fmt.Errorf("invalid route alias %q, must be <route>=<fn>", pair)
+		}
+		aliases[route] = fn
+	}
+	return aliases, nil
+}
+
+// Registers the invocation routes onto r.
+//
+//	/functions/{name}/invoke               Invokes function name, through its default alias.
+//	/functions/{name}/versions/{v}/invoke  Invokes version v of function name, either a version number, "latest"
+//	                                       for the latest version, or an alias.
+//	/{route}                               Invokes the function aliases[route], for backward compatibility.
+//
+// Unknown functions and versions get 404.
+func (d *Dispatcher) RegisterInvokeRoutes(r *mux.Router, aliases map[string]string) {
+	r.HandleFunc("/functions/{name}/invoke", d.handleInvoke)
+	r.HandleFunc("/functions/{name}/versions/{v}/invoke", d.handleInvoke)
+	for route, fn := range aliases {
+		fn := fn
+		r.HandleFunc("/"+route, func(w http.ResponseWriter, r *http.Request) {
+			d.invokeFn(w, r, fn, "")
+		})
+	}
+}
+
+func (d *Dispatcher) handleInvoke(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	d.invokeFn(w, r, vars["name"], vars["v"])
+}
+
+func (d *Dispatcher) invokeFn(w http.ResponseWriter, r *http.Request, fn, version string) {
+	d.Dispatch(CallContext{Fn: fn, Version: version, InstRdyTimeout: defaultInstRdyTimeout}, w, r)
+}
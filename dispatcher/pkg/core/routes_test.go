@@ -0,0 +1,65 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseRouteAliases tests parsing valid and invalid route aliases
+func TestParseRouteAliases(t *testing.T) {
+	aliases, err := ParseRouteAliases("alpha=alpha, /b=beta")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"alpha": "alpha", "b": "beta"}, aliases)
+
+	aliases, err = ParseRouteAliases("")
+	assert.NoError(t, err)
+	assert.Empty(t, aliases)
+
+	for _, s := range []string{"alpha", "=alpha", "alpha=", "a/b=alpha"} {
+		_, err := ParseRouteAliases(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestInvokeRoutes tests that the generic, versioned and aliased routes invoke the function, and unknown functions
+// and versions get 404
+func TestInvokeRoutes(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	addTestInst(t, d, "alpha", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from alpha")
+	})
+	r := mux.NewRouter()
+	d.RegisterInvokeRoutes(r, map[string]string{"a": "alpha"})
+
+	invoke := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("User", "test")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/functions/alpha/invoke", "/functions/alpha/versions/latest/invoke", "/a"} {
+		w := invoke(path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "hello from alpha", w.Body.String(), path)
+	}
+
+	w := invoke("/functions/delta/invoke")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Function delta not found")
+
+	w = invoke("/functions/alpha/versions/3/invoke")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Version 3 of function alpha not found")
+
+	// Not aliased.
+	w = invoke("/alpha")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
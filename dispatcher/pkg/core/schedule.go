@@ -0,0 +1,374 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MissedRunPolicy determines what a schedule does with the runs missed while the dispatcher was down, or busy.
+type MissedRunPolicy string
+
+const (
+	// Skips the missed runs, only runs due within scheduleMisfireGrace are fired.
+	MissedRunSkip MissedRunPolicy = "skip"
+	// Fires once for all the missed runs.
+	MissedRunOnce MissedRunPolicy = "run_once"
+	// Fires every missed run, up to maxMissedRuns.
+	MissedRunAll MissedRunPolicy = "run_all"
+)
+
+const (
+	// How often schedules are checked for due runs.
+	scheduleTickInterval = time.Second
+
+	// How late a run can be fired under MissedRunSkip.
+	scheduleMisfireGrace = time.Minute
+
+	// The most missed runs fired at once under MissedRunAll.
+	maxMissedRuns = 100
+)
+
+// The results of due runs of schedules, reported in metrics.
+const (
+	scheduleFired          = "fired"
+	scheduleSkippedMissed  = "skipped_missed"
+	scheduleSkippedOverlap = "skipped_overlap"
+	scheduleFailed         = "failed"
+)
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule invokes a function asynchronously at the times given by a cron expression.
+type Schedule struct {
+	Fn string `json:"fn"`
+
+	// The cron expression, see CronExpr.
+	Cron string `json:"cron"`
+
+	// The location the cron expression is evaluated in, e.g., "America/New_York". UTC if empty.
+	Timezone string `json:"timezone,omitempty"`
+
+	// The user invocations run on behalf of, whose permissions, limits and billing apply.
+	User string `json:"user"`
+
+	// The JSON request body of invocations.
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// MissedRunSkip if empty.
+	MissedRuns MissedRunPolicy `json:"missed_runs,omitempty"`
+
+	// Fires even if the invocation of the previous run has not finished. Runs overlapping with the previous one are
+	// skipped by default. Missed runs fired together under MissedRunAll are only checked against the run before them,
+	// not against each other.
+	AllowOverlap bool `json:"allow_overlap,omitempty"`
+}
+
+// Returns the parsed cron expression and location of s, or an error if s is invalid.
+func (s Schedule) parse() (CronExpr, *time.Location, error) {
+	if s.Fn == "" || s.User == "" {
+		return CronExpr{}, nil, fmt.Errorf("fn and user must be provided")
+	}
+	expr, err := ParseCron(s.Cron)
+	if err != nil {
+		return CronExpr{}, nil, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return CronExpr{}, nil, fmt.Errorf("invalid timezone %q, error: %v", s.Timezone, err)
+	}
+	switch s.MissedRuns {
+	case "", MissedRunSkip, MissedRunOnce, MissedRunAll:
+	default:
+		return CronExpr{}, nil, fmt.Errorf("missed_runs must be one of skip, run_once and run_all")
+	}
+	if len(s.Payload) > 0 && !json.Valid(s.Payload) {
+		return CronExpr{}, nil, fmt.Errorf("payload must be valid JSON")
+	}
+	return expr, loc, nil
+}
+
+// ScheduleStatus is a point-in-time view of a schedule.
+type ScheduleStatus struct {
+	Name string `json:"name"`
+	Schedule
+
+	// Zero if the cron expression never matches.
+	NextFireTime time.Time `json:"next_fire_time"`
+	// Zero if never fired.
+	LastFireTime     time.Time `json:"last_fire_time"`
+	LastInvocationID string    `json:"last_invocation_id,omitempty"`
+}
+
+// The persisted state of a schedule.
+type scheduleState struct {
+	Schedule Schedule `json:"schedule"`
+
+	// When the schedule was last checked for due runs, initially when it was set.
+	CheckedTime      time.Time `json:"checked_time"`
+	LastFireTime     time.Time `json:"last_fire_time"`
+	LastInvocationID string    `json:"last_invocation_id,omitempty"`
+
+	expr CronExpr
+	loc  *time.Location
+}
+
+// ScheduleMgr fires the runs of schedules, queuing them as asynchronous invocations.
+type ScheduleMgr struct {
+	// The file persisting schedules, kept in memory only if empty.
+	file string
+
+	asyncMgr *AsyncMgr
+
+	// Called with the schedule and result of each due run.
+	onRun func(name, result string)
+
+	mu sync.Mutex
+	// Map from the name to the schedule.
+	// Protected by mu.
+	schedules map[string]*scheduleState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScheduleMgr creates a ScheduleMgr queuing invocations to asyncMgr, and loads the schedules persisted in file.
+func NewScheduleMgr(file string, asyncMgr *AsyncMgr) (*ScheduleMgr, error) {
+	m := &ScheduleMgr{
+		file:      file,
+		asyncMgr:  asyncMgr,
+		onRun:     func(string, string) {},
+		schedules: make(map[string]*scheduleState),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if file == "" {
+		return m, nil
+	}
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read schedules %s, error: %v", file, err)
+	}
+	if err := json.Unmarshal(b, &m.schedules); err != nil {
+		return nil, fmt.Errorf("Could not parse schedules %s, error: %v", file, err)
+	}
+	for name, st := range m.schedules {
+		if st.expr, st.loc, err = st.Schedule.parse(); err != nil {
+			return nil, fmt.Errorf("Invalid schedule %s, error: %v", name, err)
+		}
+	}
+	slog.Info("Loaded schedules", "file", file, "schedules", len(m.schedules))
+	return m, nil
+}
+
+// Start starts firing due runs.
+func (m *ScheduleMgr) Start() {
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(scheduleTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				m.tick(now)
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *ScheduleMgr) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// Writes all schedules to the file. Must be called with mu held.
+func (m *ScheduleMgr) persistLocked() {
+	if m.file == "" {
+		return
+	}
+	b, err := json.Marshal(m.schedules)
+	if err == nil {
+		err = writeFileAtomic(m.file, b)
+	}
+	if err != nil {
+		slog.Error("Failed to persist schedules", "file", m.file, "error", err)
+	}
+}
+
+// Set adds or replaces the schedule name. Runs are due from now on.
+func (m *ScheduleMgr) Set(name string, s Schedule) error {
+	expr, loc, err := s.parse()
+	if err != nil {
+		return err
+	}
+	if s.MissedRuns == "" {
+		s.MissedRuns = MissedRunSkip
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := &scheduleState{Schedule: s, CheckedTime: time.Now(), expr: expr, loc: loc}
+	if old, ok := m.schedules[name]; ok {
+		st.LastFireTime = old.LastFireTime
+		st.LastInvocationID = old.LastInvocationID
+	}
+	m.schedules[name] = st
+	m.persistLocked()
+	return nil
+}
+
+func (m *ScheduleMgr) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.schedules[name]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(m.schedules, name)
+	m.persistLocked()
+	return nil
+}
+
+// Must be called with mu held.
+func (m *ScheduleMgr) statusLocked(name string, st *scheduleState) ScheduleStatus {
+	return ScheduleStatus{
+		Name:             name,
+		Schedule:         st.Schedule,
+		NextFireTime:     st.expr.Next(st.CheckedTime.In(st.loc)),
+		LastFireTime:     st.LastFireTime,
+		LastInvocationID: st.LastInvocationID,
+	}
+}
+
+func (m *ScheduleMgr) Get(name string) (ScheduleStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.schedules[name]
+	if !ok {
+		return ScheduleStatus{}, ErrScheduleNotFound
+	}
+	return m.statusLocked(name, st), nil
+}
+
+// List returns all schedules, ordered by their next fire times.
+func (m *ScheduleMgr) List() []ScheduleStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]ScheduleStatus, 0, len(m.schedules))
+	for name, st := range m.schedules {
+		res = append(res, m.statusLocked(name, st))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		// Never-firing schedules go last.
+		if res[i].NextFireTime.IsZero() != res[j].NextFireTime.IsZero() {
+			return res[j].NextFireTime.IsZero()
+		}
+		if !res[i].NextFireTime.Equal(res[j].NextFireTime) {
+			return res[i].NextFireTime.Before(res[j].NextFireTime)
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Fires the runs of all schedules due by now.
+func (m *ScheduleMgr) tick(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for name, st := range m.schedules {
+		if m.checkLocked(name, st, now) {
+			changed = true
+		}
+	}
+	if changed {
+		m.persistLocked()
+	}
+}
+
+// Fires the runs of schedule name due by now, according to its missed run policy. Returns true if any run was due.
+// Must be called with mu held.
+func (m *ScheduleMgr) checkLocked(name string, st *scheduleState, now time.Time) bool {
+	var due []time.Time
+	for t := st.expr.Next(st.CheckedTime.In(st.loc)); !t.IsZero() && !t.After(now); t = st.expr.Next(t) {
+		due = append(due, t)
+		if len(due) > maxMissedRuns {
+			break
+		}
+	}
+	if len(due) == 0 {
+		return false
+	}
+	st.CheckedTime = now
+
+	fires := 1
+	switch st.Schedule.MissedRuns {
+	case MissedRunAll:
+		fires = min(len(due), maxMissedRuns)
+	case MissedRunOnce:
+	default:
+		if now.Sub(due[len(due)-1]) > scheduleMisfireGrace {
+			fires = 0
+		}
+	}
+	logger := slog.With("schedule", name, logKeyFn, st.Schedule.Fn)
+	for i := fires; i < len(due); i++ {
+		m.onRun(name, scheduleSkippedMissed)
+	}
+	if len(due) > fires {
+		logger.Warn("Skipped missed runs", "missed", len(due)-fires, "policy", st.Schedule.MissedRuns)
+	}
+
+	previous := st.LastInvocationID
+	for i := 0; i < fires; i++ {
+		if !st.Schedule.AllowOverlap && previous != "" {
+			if last, ok := m.asyncMgr.Get(previous); ok && !last.Status.finished() {
+				logger.Warn("Skipped run overlapping with the previous one", "previous", last.ID)
+				m.onRun(name, scheduleSkippedOverlap)
+				continue
+			}
+		}
+		inv, err := m.asyncMgr.Submit(AsyncRequest{
+			Fn:          st.Schedule.Fn,
+			User:        st.Schedule.User,
+			ContentType: "application/json",
+			Payload:     st.Schedule.Payload,
+		})
+		if err != nil {
+			logger.Error("Failed to queue scheduled invocation", "error", err)
+			m.onRun(name, scheduleFailed)
+			continue
+		}
+		logger.Info("Fired scheduled invocation", "id", inv.ID)
+		st.LastFireTime = now
+		st.LastInvocationID = inv.ID
+		m.onRun(name, scheduleFired)
+	}
+	return true
+}
+
+// StartScheduler starts firing schedules, persisted in file. Must be called after StartAsync.
+func (d *Dispatcher) StartScheduler(file string) error {
+	if d.asyncMgr == nil {
+		return fmt.Errorf("Asynchronous invocations must be started before schedules")
+	}
+	m, err := NewScheduleMgr(file, d.asyncMgr)
+	if err != nil {
+		return err
+	}
+	m.onRun = func(name, result string) {
+		d.metrics.scheduleRuns.Inc(name, result)
+	}
+	d.scheduleMgr = m
+	m.Start()
+	return nil
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sets schedule name of m, as if it were set at checked.
+func setTestSchedule(t *testing.T, m *ScheduleMgr, name string, s Schedule, checked time.Time) {
+	assert.NoError(t, m.Set(name, s))
+	m.schedules[name].CheckedTime = checked
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	m, err := NewScheduleMgr("", newTestAsyncMgr(t, "", nil))
+	assert.NoError(t, err)
+	valid := Schedule{Fn: "alpha", Cron: "@daily", User: "test", Payload: json.RawMessage(`{"args": {}}`)}
+	assert.NoError(t, m.Set("valid", valid))
+
+	for _, mutate := range []func(s *Schedule){
+		func(s *Schedule) { s.User = "" },
+		func(s *Schedule) { s.Cron = "* * *" },
+		func(s *Schedule) { s.Timezone = "Mars/Olympus" },
+		func(s *Schedule) { s.MissedRuns = "sometimes" },
+		func(s *Schedule) { s.Payload = json.RawMessage(`{`) },
+	} {
+		s := valid
+		mutate(&s)
+		assert.Error(t, m.Set("invalid", s))
+	}
+}
+
+// TestScheduleMgr_Fire tests that due runs queue invocations with the schedule's payload and principal
+func TestScheduleMgr_Fire(t *testing.T) {
+	// The AsyncMgr is not started, so that invocations stay queued.
+	asyncMgr := newTestAsyncMgr(t, "", nil)
+	m, err := NewScheduleMgr("", asyncMgr)
+	assert.NoError(t, err)
+	var results []string
+	m.onRun = func(name, result string) { results = append(results, result) }
+	start := time.Date(2024, 1, 31, 10, 0, 30, 0, time.UTC)
+	s := Schedule{Fn: "alpha", Cron: "*/5 * * * *", User: "test", Payload: json.RawMessage(`{"args": {"n": 1}}`)}
+	setTestSchedule(t, m, "every5", s, start)
+
+	m.tick(start.Add(4 * time.Minute))
+	assert.Empty(t, results)
+	status, _ := m.Get("every5")
+	assert.Equal(t, time.Date(2024, 1, 31, 10, 5, 0, 0, time.UTC), status.NextFireTime)
+
+	m.tick(start.Add(5 * time.Minute))
+	assert.Equal(t, []string{scheduleFired}, results)
+	status, _ = m.Get("every5")
+	assert.Equal(t, time.Date(2024, 1, 31, 10, 10, 0, 0, time.UTC), status.NextFireTime)
+	inv, ok := asyncMgr.Get(status.LastInvocationID)
+	assert.True(t, ok)
+	assert.Equal(t, "alpha", inv.Fn)
+	assert.Equal(t, "test", inv.User)
+	assert.Equal(t, `{"args": {"n": 1}}`, string(asyncMgr.records[inv.ID].Payload))
+	assert.Equal(t, "application/json", asyncMgr.records[inv.ID].ContentType)
+
+	// The invocation is still queued.
+	m.tick(start.Add(10 * time.Minute))
+	assert.Equal(t, []string{scheduleFired, scheduleSkippedOverlap}, results)
+}
+
+// TestScheduleMgr_MissedRuns tests the missed run policies
+func TestScheduleMgr_MissedRuns(t *testing.T) {
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	for policy, want := range map[MissedRunPolicy]map[string]int{
+		MissedRunSkip: {scheduleFired: 1, scheduleSkippedMissed: 9},
+		MissedRunOnce: {scheduleFired: 1, scheduleSkippedMissed: 9},
+		MissedRunAll:  {scheduleFired: 10},
+	} {
+		m, err := NewScheduleMgr("", newTestAsyncMgr(t, "", nil))
+		assert.NoError(t, err)
+		results := make(map[string]int)
+		m.onRun = func(name, result string) { results[result]++ }
+		s := Schedule{Fn: "alpha", Cron: "* * * * *", User: "test", MissedRuns: policy, AllowOverlap: true}
+		setTestSchedule(t, m, "minutely", s, start)
+		m.tick(start.Add(10*time.Minute + 5*time.Second))
+		assert.Equal(t, want, results, policy)
+	}
+
+	// Runs too late are skipped.
+	m, err := NewScheduleMgr("", newTestAsyncMgr(t, "", nil))
+	assert.NoError(t, err)
+	results := make(map[string]int)
+	m.onRun = func(name, result string) { results[result]++ }
+	setTestSchedule(t, m, "hourly", Schedule{Fn: "alpha", Cron: "@hourly", User: "test"}, start)
+	m.tick(start.Add(time.Hour + 5*time.Minute))
+	assert.Equal(t, map[string]int{scheduleSkippedMissed: 1}, results)
+}
+
+// TestScheduleMgr_MissedRunsOverlap tests that missed runs fired together don't skip each other for overlapping, but
+// are all skipped while the run before them is unfinished
+func TestScheduleMgr_MissedRunsOverlap(t *testing.T) {
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	// The AsyncMgr is not started, so that invocations stay queued.
+	asyncMgr := newTestAsyncMgr(t, "", nil)
+	m, err := NewScheduleMgr("", asyncMgr)
+	assert.NoError(t, err)
+	results := make(map[string]int)
+	m.onRun = func(name, result string) { results[result]++ }
+	s := Schedule{Fn: "alpha", Cron: "* * * * *", User: "test", MissedRuns: MissedRunAll}
+	setTestSchedule(t, m, "minutely", s, start)
+	m.tick(start.Add(10*time.Minute + 5*time.Second))
+	assert.Equal(t, map[string]int{scheduleFired: 10}, results)
+	assert.Len(t, asyncMgr.records, 10)
+
+	// The last run is still queued.
+	results = make(map[string]int)
+	m.tick(start.Add(13*time.Minute + 5*time.Second))
+	assert.Equal(t, map[string]int{scheduleSkippedOverlap: 3}, results)
+}
+
+// TestScheduleMgr_Persist tests that schedules and their last runs survive restarts
+func TestScheduleMgr_Persist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schedules.json")
+	m, err := NewScheduleMgr(file, newTestAsyncMgr(t, "", nil))
+	assert.NoError(t, err)
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	setTestSchedule(t, m, "daily", Schedule{Fn: "alpha", Cron: "0 9 * * *", Timezone: "UTC", User: "test"}, start)
+	setTestSchedule(t, m, "hourly", Schedule{Fn: "beta", Cron: "@hourly", User: "test"}, start)
+	m.tick(start.Add(time.Hour))
+	assert.NoError(t, m.Delete("daily"))
+	assert.ErrorIs(t, m.Delete("daily"), ErrScheduleNotFound)
+
+	m, err = NewScheduleMgr(file, newTestAsyncMgr(t, "", nil))
+	assert.NoError(t, err)
+	schedules := m.List()
+	assert.Len(t, schedules, 1)
+	assert.Equal(t, "hourly", schedules[0].Name)
+	assert.Equal(t, MissedRunSkip, schedules[0].MissedRuns)
+	assert.Equal(t, start.Add(time.Hour), schedules[0].LastFireTime.UTC())
+	assert.Equal(t, start.Add(2*time.Hour), schedules[0].NextFireTime.UTC())
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/checkpoint"
+	"github.com/docker/docker/api/types/container"
+)
+
+// SnapshotMode determines how the first ready instance of a function version is snapshotted, for later instances of
+// the version to be launched from the snapshot instead of running load() again.
+type SnapshotMode string
+
+const (
+	// Instances are always launched from the version's template.
+	SnapshotNone SnapshotMode = "none"
+
+	// Checkpoints the processes of the instance with CRIU, through docker checkpoint, which requires the docker
+	// daemon's experimental features. Restored instances resume with the function loaded.
+	SnapshotCheckpoint SnapshotMode = "checkpoint"
+
+	// Commits the filesystem of the instance to a derived image. Processes are not captured, so restored instances
+	// still run load(), and only start faster if load() caches what it downloads or compiles on disk.
+	SnapshotCommit SnapshotMode = "commit"
+)
+
+// The results of snapshots, as reported to onSnapshot.
+const (
+	snapshotTaken         = "taken"
+	snapshotFailed        = "failed"
+	snapshotRestoreFailed = "restore_failed"
+)
+
+func ParseSnapshotMode(s string) (SnapshotMode, error) {
+	switch m := SnapshotMode(s); m {
+	case SnapshotNone, SnapshotCheckpoint, SnapshotCommit:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid snapshot mode %s, must be none, checkpoint or commit", s)
+}
+
+// Snapshots ready instances.
+type snapshotter interface {
+	// Snapshots rc, which was launched from template c, and returns the template launching instances from the
+	// snapshot.
+	snapshot(rc *RunningContainer, c ContainerInterface) (ContainerInterface, error)
+}
+
+// Returns the snapshotter of mode, nil for SnapshotNone. Checkpoints are stored under checkpointDir, which is required
+// with SnapshotCheckpoint and created if missing. Restores have to name the directory the checkpoint was created in,
+// so the docker daemon's default directory, which is per container, would never be found by other containers.
+func newSnapshotter(mode SnapshotMode, checkpointDir string) (snapshotter, error) {
+	switch mode {
+	case SnapshotCheckpoint:
+		if checkpointDir == "" {
+			return nil, fmt.Errorf("checkpoint snapshots require a checkpoint directory")
+		}
+		// The docker daemon resolves the directory, so it must not be relative to the dispatcher's working directory.
+		dir, err := filepath.Abs(checkpointDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("Could not create checkpoint directory %s, error: %v", dir, err)
+		}
+		return checkpointSnapshotter{dir: dir}, nil
+	case SnapshotCommit:
+		return commitSnapshotter{}, nil
+	}
+	return nil, nil
+}
+
+type checkpointSnapshotter struct {
+	dir string
+}
+
+func (s checkpointSnapshotter) snapshot(rc *RunningContainer, c ContainerInterface) (ContainerInterface, error) {
+	tc, ok := c.(Container)
+	if !ok {
+		return nil, fmt.Errorf("only docker containers can be checkpointed")
+	}
+	id := fmt.Sprintf("%s-v%d-%d", rc.fn, rc.version, time.Now().UnixNano())
+	err := dockerClient.CheckpointCreate(context.Background(), rc.containerID, checkpoint.CreateOptions{
+		CheckpointID:  id,
+		CheckpointDir: s.dir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not checkpoint container %s, error: %v", rc.containerID, err)
+	}
+	return checkpointContainer{Container: tc, checkpointID: id, checkpointDir: s.dir}, nil
+}
+
+// Runs the Container restored from a checkpoint of another container running it.
+type checkpointContainer struct {
+	Container
+	checkpointID  string
+	checkpointDir string
+}
+
+func (c checkpointContainer) Run(name string) (*RunningContainer, error) {
+	rc, err := c.run(name, container.StartOptions{CheckpointID: c.checkpointID, CheckpointDir: c.checkpointDir})
+	if err != nil {
+		return nil, err
+	}
+	rc.restored = true
+	return rc, nil
+}
+
+type commitSnapshotter struct{}
+
+func (commitSnapshotter) snapshot(rc *RunningContainer, c ContainerInterface) (ContainerInterface, error) {
+	tc, ok := c.(Container)
+	if !ok {
+		return nil, fmt.Errorf("only docker containers can be committed")
+	}
+	// Image names must be lowercase.
+	ref := fmt.Sprintf("serverless-snapshot/%s:v%d", strings.ToLower(rc.fn), rc.version)
+	_, err := dockerClient.ContainerCommit(context.Background(), rc.containerID, container.CommitOptions{
+		Reference: ref,
+		Comment:   fmt.Sprintf("Snapshot of version %d of function %s", rc.version, rc.fn),
+		Pause:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not commit container %s, error: %v", rc.containerID, err)
+	}
+	return Container{image: ref, cmd: tc.cmd, memoryMB: tc.memoryMB}, nil
+}
+
+// Identifies a version of a function.
+type fnVersion struct {
+	fn      string
+	version int
+}
+
+// The snapshot of a function version.
+type instSnapshot struct {
+	// The template restoring the snapshot, nil while it's being taken.
+	template ContainerInterface
+	// Whether taking or restoring the snapshot failed, in which case the version is launched from its template from
+	// then on.
+	failed bool
+}
+
+// Sets the snapshotter of ready instances, nil to disable snapshots. Snapshots taken before are dropped.
+func (l *Launcher) setSnapshotter(s snapshotter) {
+	l.snapshotsMu.Lock()
+	defer l.snapshotsMu.Unlock()
+	l.snapshotter = s
+	l.snapshots = make(map[fnVersion]*instSnapshot)
+}
+
+// Called once rc becomes ready, i.e., its function is loaded. Snapshots rc in the background, if its version has not
+// been snapshotted yet.
+func (l *Launcher) instReady(rc *RunningContainer) {
+	l.snapshotsMu.Lock()
+	defer l.snapshotsMu.Unlock()
+	key := fnVersion{rc.fn, rc.version}
+	if l.snapshotter == nil || l.snapshots[key] != nil {
+		return
+	}
+	c, ok := l.template(rc.fn, rc.version)
+	if !ok {
+		return
+	}
+	s := &instSnapshot{}
+	l.snapshots[key] = s
+	go l.takeSnapshot(l.snapshotter, s, rc, c)
+}
+
+func (l *Launcher) takeSnapshot(snapshotter snapshotter, s *instSnapshot, rc *RunningContainer, c ContainerInterface) {
+	start := time.Now()
+	template, err := snapshotter.snapshot(rc, c)
+
+	l.snapshotsMu.Lock()
+	defer l.snapshotsMu.Unlock()
+	if err != nil {
+		rc.logger().Error("Failed to snapshot instance", "error", err)
+		s.failed = true
+		l.onSnapshot(rc.fn, snapshotFailed)
+		return
+	}
+	rc.logger().Info("Snapshotted instance", "duration", time.Since(start))
+	s.template = template
+	l.onSnapshot(rc.fn, snapshotTaken)
+}
+
+// Returns the template restoring the snapshot of version of function fn, nil if there's none.
+func (l *Launcher) snapshotTemplate(fn string, version int) ContainerInterface {
+	l.snapshotsMu.Lock()
+	defer l.snapshotsMu.Unlock()
+	if s := l.snapshots[fnVersion{fn, version}]; s != nil && !s.failed {
+		return s.template
+	}
+	return nil
+}
+
+// Stops launching version of function fn from its snapshot, which failed to be restored.
+func (l *Launcher) restoreFailed(fn string, version int) {
+	l.snapshotsMu.Lock()
+	defer l.snapshotsMu.Unlock()
+	if s := l.snapshots[fnVersion{fn, version}]; s != nil {
+		s.failed = true
+	}
+	l.onSnapshot(fn, snapshotRestoreFailed)
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Snapshots instances into template, or fails with err.
+type testSnapshotter struct {
+	template ContainerInterface
+	err      error
+
+	mu          sync.Mutex
+	snapshotted []string
+}
+
+func (s *testSnapshotter) snapshot(rc *RunningContainer, c ContainerInterface) (ContainerInterface, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshotted = append(s.snapshotted, rc.name)
+	return s.template, s.err
+}
+
+// Runs instances named by Run, or fails with err.
+type testNamedContainer struct {
+	err error
+
+	mu   sync.Mutex
+	runs int
+}
+
+func (c *testNamedContainer) Run(name string) (*RunningContainer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &RunningContainer{name: name}, nil
+}
+
+// TestParseSnapshotMode tests parsing snapshot modes
+func TestParseSnapshotMode(t *testing.T) {
+	for _, m := range []SnapshotMode{SnapshotNone, SnapshotCheckpoint, SnapshotCommit} {
+		mode, err := ParseSnapshotMode(string(m))
+		assert.NoError(t, err)
+		assert.Equal(t, m, mode)
+	}
+	_, err := ParseSnapshotMode("criu")
+	assert.Error(t, err)
+}
+
+// TestLauncher_LaunchSnapshot tests that the first ready instance of a version is snapshotted once, and later
+// instances are restored from the snapshot
+func TestLauncher_LaunchSnapshot(t *testing.T) {
+	restored := &testNamedContainer{}
+	s := &testSnapshotter{template: restored}
+	l := NewLauncher(time.Second)
+	l.registerContainer("alpha", &testNamedContainer{})
+	l.setSnapshotter(s)
+	var launched []string
+	l.onLaunched = func(fn, from string) { launched = append(launched, from) }
+
+	rc, err := l.Launch("alpha")
+	assert.NoError(t, err)
+	l.instReady(rc)
+	assert.Eventually(t, func() bool { return l.snapshotTemplate("alpha", 1) != nil }, time.Second, time.Millisecond)
+
+	rc, err = l.Launch("alpha")
+	assert.NoError(t, err)
+	assert.Equal(t, "alpha-1", rc.name)
+	l.instReady(rc)
+	assert.Equal(t, []string{launchFromTemplate, launchFromSnapshot}, launched)
+	assert.Equal(t, []string{"alpha-0"}, s.snapshotted)
+	assert.Equal(t, 1, restored.runs)
+}
+
+// TestLauncher_LaunchSnapshotFallback tests that versions are launched from their templates after snapshotting fails
+func TestLauncher_LaunchSnapshotFallback(t *testing.T) {
+	s := &testSnapshotter{err: errors.New("checkpoint failed")}
+	l := NewLauncher(time.Second)
+	l.registerContainer("alpha", &testNamedContainer{})
+	l.setSnapshotter(s)
+	var launched []string
+	l.onLaunched = func(fn, from string) { launched = append(launched, from) }
+	rc, err := l.Launch("alpha")
+	assert.NoError(t, err)
+	l.instReady(rc)
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.snapshotted) == 1
+	}, time.Second, time.Millisecond)
+	_, err = l.Launch("alpha")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{launchFromTemplate, launchFromTemplate}, launched)
+}
+
+// TestLauncher_LaunchRestoreFallback tests that versions are launched from their templates after restoring fails
+func TestLauncher_LaunchRestoreFallback(t *testing.T) {
+	restored := &testNamedContainer{err: errors.New("restore failed")}
+	l := NewLauncher(time.Second)
+	l.registerContainer("alpha", &testNamedContainer{})
+	l.setSnapshotter(&testSnapshotter{template: restored})
+	var launched []string
+	l.onLaunched = func(fn, from string) { launched = append(launched, from) }
+	rc, err := l.Launch("alpha")
+	assert.NoError(t, err)
+	l.instReady(rc)
+	assert.Eventually(t, func() bool { return l.snapshotTemplate("alpha", 1) != nil }, time.Second, time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err = l.Launch("alpha")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{launchFromTemplate, launchFromTemplate, launchFromTemplate}, launched)
+	assert.Equal(t, 1, restored.runs)
+	assert.Nil(t, l.snapshotTemplate("alpha", 1))
+}
+
+// TestNewSnapshotter tests that checkpoint snapshots require a checkpoint directory, which is made absolute and created
+func TestNewSnapshotter(t *testing.T) {
+	_, err := newSnapshotter(SnapshotCheckpoint, "")
+	assert.Error(t, err)
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	rel, err := filepath.Rel(wd, filepath.Join(t.TempDir(), "checkpoints"))
+	assert.NoError(t, err)
+	s, err := newSnapshotter(SnapshotCheckpoint, rel)
+	assert.NoError(t, err)
+	dir := s.(checkpointSnapshotter).dir
+	assert.True(t, filepath.IsAbs(dir))
+	assert.DirExists(t, dir)
+
+	s, err = newSnapshotter(SnapshotCommit, "")
+	assert.NoError(t, err)
+	assert.Equal(t, commitSnapshotter{}, s)
+	s, err = newSnapshotter(SnapshotNone, "")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+// TestCheckpointRestore tests that a second container is restored from the checkpoint of a ready instance
+func TestCheckpointRestore(t *testing.T) {
+	info, err := dockerClient.Info(context.Background())
+	if err != nil || !info.ExperimentalBuild {
+		t.Skip("Checkpoints require a docker daemon with experimental features enabled")
+	}
+	// Go to $ToT/runtime for instructions of building this image.
+	c := NewContainer("runtime:latest",
+		[]string{"python", "runtime.py", "--file=runtime_alpha.py", "--class_name=RuntimeAlpha"})
+	rc, err := c.Run("test-checkpoint-0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rc.Remove()
+	defer rc.Stop()
+	assert.NoError(t, rc.WaitForReady(10*time.Second))
+	rc.fn, rc.version = "alpha", 1
+
+	s, err := newSnapshotter(SnapshotCheckpoint, t.TempDir())
+	assert.NoError(t, err)
+	template, err := s.snapshot(rc, c)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	restored, err := template.Run("test-checkpoint-1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restored.Remove()
+	defer restored.Stop()
+	assert.True(t, restored.restored)
+	assert.NotEqual(t, rc.containerID, restored.containerID)
+	assert.NoError(t, restored.WaitForReady(10*time.Second))
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "serverless/dispatcher"
+
+// Returns the tracer of the dispatcher. Spans are dropped unless InitTracing is called.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TracingConfig configures where spans are exported to. Only one of the exporters is used, OTLPEndpoint takes
+// precedence over File.
+type TracingConfig struct {
+	// The OTLP/HTTP endpoint to export spans to, e.g., localhost:4318.
+	OTLPEndpoint string
+
+	// Sends spans to OTLPEndpoint over plain HTTP instead of HTTPS.
+	OTLPInsecure bool
+
+	// The file to write spans to, one JSON object per line, for tests and local debugging.
+	File string
+}
+
+// InitTracing installs the global tracer provider exporting spans as configured by cfg, and the W3C trace context
+// propagator. Returns the function that flushes and stops exporting spans, which should be called before exiting.
+func InitTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	var opt sdktrace.TracerProviderOption
+	switch {
+	case cfg.OTLPEndpoint != "":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create OTLP exporter, error: %v", err)
+		}
+		opt = sdktrace.WithBatcher(exporter)
+	case cfg.File != "":
+		exporter, err := NewFileSpanExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		// Export synchronously, so that spans are in the file as soon as they end.
+		opt = sdktrace.WithSyncer(exporter)
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+
+	tp := sdktrace.NewTracerProvider(opt, sdktrace.WithResource(resource.NewSchemaless(
+		semconv.ServiceName("serverless-dispatcher"))))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// ExportedSpan is the JSON object written by FileSpanExporter for each span.
+type ExportedSpan struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	StartTime    time.Time         `json:"start_time"`
+	EndTime      time.Time         `json:"end_time"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Links        []ExportedLink    `json:"links,omitempty"`
+	Status       string            `json:"status"`
+}
+
+type ExportedLink struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+// FileSpanExporter writes spans to a file, one ExportedSpan per line.
+type FileSpanExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileSpanExporter(path string) (*FileSpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open span file %s, error: %v", path, err)
+	}
+	return &FileSpanExporter{f: f}, nil
+}
+
+func toExportedSpan(s sdktrace.ReadOnlySpan) ExportedSpan {
+	e := ExportedSpan{
+		Name:      s.Name(),
+		TraceID:   s.SpanContext().TraceID().String(),
+		SpanID:    s.SpanContext().SpanID().String(),
+		StartTime: s.StartTime(),
+		EndTime:   s.EndTime(),
+		Status:    s.Status().Code.String(),
+	}
+	if s.Parent().IsValid() {
+		e.ParentSpanID = s.Parent().SpanID().String()
+	}
+	if attrs := s.Attributes(); len(attrs) > 0 {
+		e.Attributes = make(map[string]string, len(attrs))
+		for _, kv := range attrs {
+			e.Attributes[string(kv.Key)] = kv.Value.Emit()
+		}
+	}
+	for _, l := range s.Links() {
+		e.Links = append(e.Links, ExportedLink{
+			TraceID: l.SpanContext.TraceID().String(),
+			SpanID:  l.SpanContext.SpanID().String(),
+		})
+	}
+	return e
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *FileSpanExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.f)
+	for _, s := range spans {
+		if err := enc.Encode(toExportedSpan(s)); err != nil {
+			return fmt.Errorf("Could not write span %s, error: %v", s.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *FileSpanExporter) Shutdown(_ context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// Ends span, recording err as its status if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Attributes shared by spans.
+func fnAttr(fn string) attribute.KeyValue {
+	return attribute.String("serverless.fn", fn)
+}
+
+func versionAttr(version int) attribute.KeyValue {
+	return attribute.Int("serverless.version", version)
+}
+
+func userAttr(user string) attribute.KeyValue {
+	return attribute.String("serverless.user", user)
+}
+
+func instAttr(rc *RunningContainer) attribute.KeyValue {
+	return attribute.String("serverless.instance", rc.name)
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Installs tracing exporting to a temporary file, and returns the function reading the spans ended so far by name.
+func setupTestTracing(t *testing.T) func() map[string]ExportedSpan {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	shutdown, err := InitTracing(TracingConfig{File: path})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	return func() map[string]ExportedSpan {
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		spans := make(map[string]ExportedSpan)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var s ExportedSpan
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+			spans[s.Name] = s
+		}
+		return spans
+	}
+}
+
+func TestTracing_DispatchPhases(t *testing.T) {
+	readSpans := setupTestTracing(t)
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.SetFnAPIConcurLimit("alpha", 0)
+
+	req := newTestDispatchRequest("test")
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	d.Dispatch(CallContext{Fn: "alpha"}, httptest.NewRecorder(), req)
+
+	spans := readSpans()
+	root := spans["Dispatch"]
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", root.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", root.ParentSpanID)
+	assert.Equal(t, "alpha", root.Attributes["serverless.fn"])
+	assert.Equal(t, "503", root.Attributes["http.response.status_code"])
+	assert.Equal(t, "Error", root.Status)
+	for _, name := range []string{"CheckPermission", "AcquireLimit"} {
+		assert.Equal(t, root.SpanID, spans[name].ParentSpanID, name)
+	}
+	assert.Equal(t, "Error", spans["AcquireLimit"].Status)
+}
+
+func TestTracing_ProxyPropagation(t *testing.T) {
+	readSpans := setupTestTracing(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			traceparent = r.Header.Get("traceparent")
+		}
+	}))
+	defer server.Close()
+
+	ctx, span := tracer().Start(context.Background(), "Test")
+	req := httptest.NewRequest(http.MethodPost, "/alpha", nil).WithContext(ctx)
+	assert.NoError(t, ProxyRequest(server.URL, httptest.NewRecorder(), req))
+	span.End()
+
+	spans := readSpans()
+	proxy := spans["Proxy"]
+	assert.Equal(t, span.SpanContext().SpanID().String(), proxy.ParentSpanID)
+	assert.Equal(t, "00-"+proxy.TraceID+"-"+proxy.SpanID+"-01", traceparent)
+	assert.Empty(t, req.Header.Get("traceparent"), "the incoming request must not be modified")
+}
+
+func TestTracing_LaunchLink(t *testing.T) {
+	readSpans := setupTestTracing(t)
+	l := NewLauncher(time.Second)
+	mockContainer := new(MockContainer)
+	mockContainer.On("Run", mock.Anything).Return(&RunningContainer{}, nil)
+	l.registerContainer("testFn", mockContainer)
+
+	_, span := tracer().Start(context.Background(), "Invocation")
+	rc, err := l.launch("testFn", 1, "test", span.SpanContext())
+	span.End()
+
+	assert.NoError(t, err)
+	assert.True(t, rc.launchSpanCtx.IsValid())
+	launch := readSpans()["LaunchInstance"]
+	assert.Equal(t, rc.launchSpanCtx.SpanID().String(), launch.SpanID)
+	assert.NotEqual(t, span.SpanContext().TraceID().String(), launch.TraceID)
+	assert.Equal(t, []ExportedLink{{
+		TraceID: span.SpanContext().TraceID().String(),
+		SpanID:  span.SpanContext().SpanID().String(),
+	}}, launch.Links)
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UsageBucket is the time granularity of usage reports.
+type UsageBucket string
+
+const (
+	UsageBucketHour UsageBucket = "hour"
+	UsageBucketDay  UsageBucket = "day"
+)
+
+// Returns the start of the bucket containing t, in UTC.
+func (b UsageBucket) start(t time.Time) time.Time {
+	t = t.UTC()
+	if b == UsageBucketHour {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func parseUsageBucket(s string) (UsageBucket, error) {
+	switch UsageBucket(s) {
+	case "":
+		return UsageBucketDay, nil
+	case UsageBucketHour, UsageBucketDay:
+		return UsageBucket(s), nil
+	}
+	return "", fmt.Errorf("invalid bucket %s, must be hour or day", s)
+}
+
+// UsageRecord sums up a user's invocations of one function within one time bucket.
+type UsageRecord struct {
+	BucketStart   time.Time `json:"bucket_start"`
+	User          string    `json:"user"`
+	Fn            string    `json:"fn"`
+	Invocations   int       `json:"invocations"`
+	ColdStarts    int       `json:"cold_starts"`
+	ExecSeconds   float64   `json:"exec_seconds"`
+	QueuedSeconds float64   `json:"queued_seconds"`
+	GBSeconds     float64   `json:"gb_seconds"`
+	Charges       float64   `json:"charges"`
+}
+
+// AggregateUsage sums up entries by time bucket, user and function.
+// The records are ordered by bucket, then user, then function.
+func AggregateUsage(entries []LedgerEntry, bucket UsageBucket) []UsageRecord {
+	type recordKey struct {
+		bucketStart time.Time
+		user, fn    string
+	}
+	records := make(map[recordKey]*UsageRecord)
+	for _, e := range entries {
+		key := recordKey{bucket.start(e.ReceivedTime), e.User, e.Fn}
+		rec, ok := records[key]
+		if !ok {
+			rec = &UsageRecord{BucketStart: key.bucketStart, User: e.User, Fn: e.Fn}
+			records[key] = rec
+		}
+		rec.Invocations++
+		if e.ColdStart {
+			rec.ColdStarts++
+		}
+		rec.ExecSeconds += e.ExecTime.Seconds()
+		rec.QueuedSeconds += e.QueuedTime.Seconds()
+		rec.GBSeconds += e.GBSeconds()
+		rec.Charges += e.Charges.Total
+	}
+
+	res := make([]UsageRecord, 0, len(records))
+	for _, rec := range records {
+		res = append(res, *rec)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].BucketStart.Equal(res[j].BucketStart) {
+			return res[i].BucketStart.Before(res[j].BucketStart)
+		}
+		if res[i].User != res[j].User {
+			return res[i].User < res[j].User
+		}
+		return res[i].Fn < res[j].Fn
+	})
+	return res
+}
+
+var usageCSVHeader = []string{
+	"bucket_start", "user", "fn", "invocations", "cold_starts", "exec_seconds", "queued_seconds", "gb_seconds", "charges",
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Writes records as CSV, with usageCSVHeader as the first row.
+func writeUsageCSV(w http.ResponseWriter, records []UsageRecord) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(usageCSVHeader)
+	for _, rec := range records {
+		cw.Write([]string{
+			rec.BucketStart.Format(time.RFC3339),
+			rec.User,
+			rec.Fn,
+			strconv.Itoa(rec.Invocations),
+			strconv.Itoa(rec.ColdStarts),
+			formatFloat(rec.ExecSeconds),
+			formatFloat(rec.QueuedSeconds),
+			formatFloat(rec.GBSeconds),
+			formatFloat(rec.Charges),
+		})
+	}
+	cw.Flush()
+}
+
+// Registers the usage reporting APIs onto r. The User header is required; admins can query everyone's usage, other
+// users only their own.
+//
+//	GET /usage                  Returns the usage of all users, or only the caller's if not an admin.
+//	GET /usage/users/{user}     Returns the usage of user.
+//	GET /usage/functions/{fn}   Returns the usage of function fn by all users, or only the caller's if not an admin.
+//
+// All of them accept these query parameters:
+//
+//	from, to  The period in RFC 3339, default to the beginning of the ledger and now.
+//	bucket    The time granularity, hour or day (the default).
+//	format    The response format, json (the default) or csv.
+//
+// Besides, the time instances spent starting up and idling is attributed to users by the OverheadPolicy, and reported
+// separately from the execution time:
+//
+//	GET /usage/lifecycle        Returns a map from user to UserUsage, only containing the caller if not an admin.
+//	                            Overhead absorbed by the platform is reported as PlatformUser.
+func (d *Dispatcher) RegisterUsageRoutes(r *mux.Router) {
+	r.HandleFunc("/usage", d.handleGetUsage).Methods(http.MethodGet)
+	r.HandleFunc("/usage/lifecycle", d.handleGetLifecycleUsage).Methods(http.MethodGet)
+	r.HandleFunc("/usage/users/{user}", d.handleGetUsage).Methods(http.MethodGet)
+	r.HandleFunc("/usage/functions/{fn}", d.handleGetUsage).Methods(http.MethodGet)
+}
+
+func (d *Dispatcher) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	caller := r.Header.Get("User")
+	if caller == "" {
+		http.Error(w, "User header not provided", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	user, hasUser := vars["user"]
+	fn, hasFn := vars["fn"]
+	if !d.permMgr.IsAdmin(caller) {
+		if hasUser && user != caller {
+			http.Error(w, fmt.Sprintf("User %s is not allowed to query usage of user %s", caller, user),
+				http.StatusForbidden)
+			return
+		}
+		user, hasUser = caller, true
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bucket, err := parseUsageBucket(r.URL.Query().Get("bucket"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("invalid format %s, must be json or csv", format), http.StatusBadRequest)
+		return
+	}
+
+	entries := d.billingMgr.Entries(from, to, func(e LedgerEntry) bool {
+		return (!hasUser || e.User == user) && (!hasFn || e.Fn == fn)
+	})
+	records := AggregateUsage(entries, bucket)
+	if format == "csv" {
+		writeUsageCSV(w, records)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (d *Dispatcher) handleGetLifecycleUsage(w http.ResponseWriter, r *http.Request) {
+	caller := r.Header.Get("User")
+	if caller == "" {
+		http.Error(w, "User header not provided", http.StatusBadRequest)
+		return
+	}
+
+	if d.permMgr.IsAdmin(caller) {
+		writeJSON(w, http.StatusOK, d.apiUsageTracker.GetAllUsage())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]UserUsage{caller: d.apiUsageTracker.GetUsage(caller)})
+}
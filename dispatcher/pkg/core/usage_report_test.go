@@ -0,0 +1,127 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+var testUsageStart = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// The invocations of user1 and user2 reported on.
+var testUsageEntries = []LedgerEntry{
+	{User: "user1", Fn: "alpha", ReceivedTime: testUsageStart.Add(10 * time.Minute), ExecTime: time.Second,
+		MemoryMB: 1024, ColdStart: true},
+	{User: "user1", Fn: "alpha", ReceivedTime: testUsageStart.Add(20 * time.Minute), ExecTime: time.Second,
+		MemoryMB: 1024},
+	{User: "user1", Fn: "alpha", ReceivedTime: testUsageStart.Add(90 * time.Minute), ExecTime: time.Second,
+		MemoryMB: 1024},
+	{User: "user2", Fn: "alpha", ReceivedTime: testUsageStart.Add(10 * time.Minute), ExecTime: time.Second,
+		MemoryMB: 1024},
+	{User: "user2", Fn: "beta", ReceivedTime: testUsageStart.Add(10 * time.Minute), ExecTime: time.Second,
+		MemoryMB: 1024},
+}
+
+func getUsage(t *testing.T, r http.Handler, path, user string) []UsageRecord {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("User", user)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var records []UsageRecord
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	return records
+}
+
+func TestAggregateUsage(t *testing.T) {
+	records := AggregateUsage(testUsageEntries, UsageBucketHour)
+	assert.Len(t, records, 4)
+	assert.Equal(t, UsageRecord{BucketStart: testUsageStart, User: "user1", Fn: "alpha", Invocations: 2,
+		ColdStarts: 1, ExecSeconds: 2, GBSeconds: 2}, records[0])
+	assert.Equal(t, testUsageStart.Add(time.Hour), records[3].BucketStart)
+
+	records = AggregateUsage(testUsageEntries, UsageBucketDay)
+	assert.Len(t, records, 3)
+	assert.Equal(t, 3, records[0].Invocations)
+}
+
+func TestUsageAPI_Permission(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	for _, e := range testUsageEntries {
+		d.GetBillingMgr().Record(e)
+	}
+	r := mux.NewRouter()
+	d.RegisterUsageRoutes(r)
+
+	// Non-admins only see their own usage.
+	records := getUsage(t, r, "/usage", "user1")
+	assert.Len(t, records, 1)
+	assert.Equal(t, "user1", records[0].User)
+
+	records = getUsage(t, r, "/usage/functions/alpha", "user2")
+	assert.Len(t, records, 1)
+	assert.Equal(t, "user2", records[0].User)
+
+	req := httptest.NewRequest(http.MethodGet, "/usage/users/user2", nil)
+	req.Header.Set("User", "user1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Admins see everyone's usage.
+	records = getUsage(t, r, "/usage", "admin")
+	assert.Len(t, records, 3)
+	records = getUsage(t, r, "/usage/functions/alpha?bucket=hour", "admin")
+	assert.Len(t, records, 3)
+	records = getUsage(t, r, "/usage/users/user2", "admin")
+	assert.Len(t, records, 2)
+}
+
+func TestUsageAPI_CSV(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	d.AllowAdmin("admin")
+	for _, e := range testUsageEntries {
+		d.GetBillingMgr().Record(e)
+	}
+	r := mux.NewRouter()
+	d.RegisterUsageRoutes(r)
+
+	req := httptest.NewRequest(http.MethodGet, "/usage/users/user1?format=csv&bucket=hour", nil)
+	req.Header.Set("User", "user1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, usageCSVHeader, rows[0])
+	assert.Equal(t, []string{"2024-06-01T00:00:00Z", "user1", "alpha", "2", "1", "2", "0", "2"}, rows[1][:8])
+}
+
+func TestUsageAPI_InvalidParams(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	r := mux.NewRouter()
+	d.RegisterUsageRoutes(r)
+
+	for _, path := range []string{"/usage?bucket=week", "/usage?format=xml", "/usage?from=now"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User", "user1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
@@ -1,14 +1,30 @@
 package core
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 )
 
 // Send HTTP GET request to the input url, every checkInterval, until timeout.
 // Returns OK if get OK status within timeout.
 func WaitForHTTPGetOK(url string, checkInterval, timeout time.Duration) error {
+	_, err := waitForHTTPGetOKBody(url, checkInterval, timeout)
+	return err
+}
+
+// Returned by waitForHTTPGetOKBody if the server responds with 500, which waiting longer does not fix.
+var errServerFailed = errors.New("server failed")
+
+// Same as WaitForHTTPGetOK, and returns the body of the OK response. Stops waiting with errServerFailed if url
+// responds with 500, unlike the 503 of servers not ready yet.
+func waitForHTTPGetOKBody(url string, checkInterval, timeout time.Duration) ([]byte, error) {
 	now := time.Now()
 	deadline := now.Add(timeout)
 	for time.Now().Before(deadline) {
@@ -17,13 +33,70 @@ func WaitForHTTPGetOK(url string, checkInterval, timeout time.Duration) error {
 		}
 		resp, err := client.Get(url)
 		if err == nil && resp.StatusCode == http.StatusOK {
+			body, err := io.ReadAll(resp.Body)
 			resp.Body.Close()
-			return nil
-		}
-		if err == nil {
+			if err == nil {
+				return body, nil
+			}
+		} else if err == nil && resp.StatusCode == http.StatusInternalServerError {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("request to %s %w: %s", url, errServerFailed, body)
+		} else if err == nil {
 			resp.Body.Close()
 		}
 		time.Sleep(checkInterval)
 	}
-	return fmt.Errorf("request to %s did not succeed within the timeout period", url)
+	return nil, fmt.Errorf("request to %s did not succeed within the timeout period", url)
+}
+
+// Writes v as the JSON response body with the input status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write JSON response", "error", err)
+	}
+}
+
+// Duration is a time.Duration in JSON as a string like "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Writes b to the file at path atomically, i.e., readers see either the old or the new content even if crashed
+// midway.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
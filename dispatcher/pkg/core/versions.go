@@ -0,0 +1,284 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The alias serving invocations that do not name a version. Every function has it, initially pointing at version 1.
+const defaultAlias = "default"
+
+// The header of responses, naming the version of the function that served the invocation.
+const versionHeader = "X-Function-Version"
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+	ErrAliasNotFound   = errors.New("alias not found")
+)
+
+// Alias names start with a letter, so that they are never confused with version numbers.
+var aliasNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// FunctionVersion is an immutable version of a function, i.e., the container its instances run.
+type FunctionVersion struct {
+	Version int      `json:"version"`
+	Image   string   `json:"image"`
+	Cmd     []string `json:"cmd"`
+
+	// The memory limit of instances in MB. Instances are not limited, and billed at defaultMemoryMB, if 0.
+	MemoryMB    int64     `json:"memory_mb,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedTime time.Time `json:"created_time"`
+}
+
+func (v FunctionVersion) container() Container {
+	return Container{
+		image:    v.Image,
+		cmd:      v.Cmd,
+		memoryMB: v.MemoryMB,
+	}
+}
+
+// Alias routes invocations to a weighted set of versions of a function.
+type Alias struct {
+	// Map from the version to its weight. Weights are relative to their sum, e.g., {"1": 95, "2": 5} sends 5% of the
+	// invocations to version 2.
+	Weights map[int]int `json:"weights"`
+
+	UpdatedTime time.Time `json:"updated_time"`
+}
+
+// Returns the version serving user's invocations. Users are assigned to versions by the hash of key and their names,
+// so they stick to the same version as long as the weights do not change. When a version's weight grows at the
+// expense of lower versions, e.g., while shifting traffic to a new version, only users moving to it switch versions.
+func (a Alias) pick(key, user string) int {
+	versions := make([]int, 0, len(a.Weights))
+	total := 0
+	for v, weight := range a.Weights {
+		versions = append(versions, v)
+		total += weight
+	}
+	sort.Ints(versions)
+
+	// Hashed with SHA-256 rather than FNV, whose high bits are poorly mixed for names differing in the last letters.
+	sum := sha256.Sum256([]byte(key + "/" + user))
+	// In [0, total).
+	point := float64(binary.BigEndian.Uint32(sum[:4])) / (1 << 32) * float64(total)
+	cumulative := 0
+	for _, v := range versions {
+		cumulative += a.Weights[v]
+		if point < float64(cumulative) {
+			return v
+		}
+	}
+	return versions[len(versions)-1]
+}
+
+// VersionMgr keeps the versions and aliases of functions, and resolves invocations to versions.
+type VersionMgr struct {
+	// Launches the instances of versions, keeping their Container templates.
+	launcher *Launcher
+
+	mu sync.Mutex
+	// Map from the function to its versions, version v at index v-1.
+	// Protected by mu.
+	versions map[string][]FunctionVersion
+	// Map from the function to its aliases by name.
+	// Protected by mu.
+	aliases map[string]map[string]Alias
+}
+
+func NewVersionMgr(launcher *Launcher) VersionMgr {
+	return VersionMgr{
+		launcher: launcher,
+		versions: make(map[string][]FunctionVersion),
+		aliases:  make(map[string]map[string]Alias),
+	}
+}
+
+// Registers function fn with c as version 1, pointed at by the default alias.
+func (m *VersionMgr) register(fn string, c Container, description string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createLocked(fn, FunctionVersion{Image: c.image, Cmd: c.cmd, MemoryMB: c.memoryMB, Description: description})
+}
+
+// Create registers function fn with v as version 1, pointed at by the default alias, and returns the version. Fails
+// if fn is already registered.
+func (m *VersionMgr) Create(fn string, v FunctionVersion) (FunctionVersion, error) {
+	if v.Image == "" || len(v.Cmd) == 0 {
+		return FunctionVersion{}, fmt.Errorf("image and cmd must be provided")
+	}
+	if v.MemoryMB < 0 {
+		return FunctionVersion{}, fmt.Errorf("memory_mb must be non-negative")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.versions[fn]; ok {
+		return FunctionVersion{}, fmt.Errorf("Function %s already exists", fn)
+	}
+	return m.createLocked(fn, v), nil
+}
+
+// Must be called with mu held.
+func (m *VersionMgr) createLocked(fn string, v FunctionVersion) FunctionVersion {
+	now := time.Now()
+	v.Version = 1
+	v.CreatedTime = now
+	m.launcher.registerContainer(fn, v.container())
+	m.versions[fn] = []FunctionVersion{v}
+	m.aliases[fn] = map[string]Alias{defaultAlias: {Weights: map[int]int{1: 1}, UpdatedTime: now}}
+	return v
+}
+
+// Publish adds v as a new version of function fn, and returns it with its version number. The image and command
+// default to those of the latest version. Aliases are not changed, so the new version serves no invocations until an
+// alias points at it, or it's invoked by its number.
+func (m *VersionMgr) Publish(fn string, v FunctionVersion) (FunctionVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions, ok := m.versions[fn]
+	if !ok {
+		return FunctionVersion{}, fmt.Errorf("Function %s not found", fn)
+	}
+	if v.MemoryMB < 0 {
+		return FunctionVersion{}, fmt.Errorf("memory_mb must be non-negative")
+	}
+	latest := versions[len(versions)-1]
+	if v.Image == "" {
+		v.Image = latest.Image
+	}
+	if len(v.Cmd) == 0 {
+		v.Cmd = latest.Cmd
+	}
+	var err error
+	if v.Version, err = m.launcher.addVersion(fn, v.container()); err != nil {
+		return FunctionVersion{}, err
+	}
+	v.CreatedTime = time.Now()
+	m.versions[fn] = append(versions, v)
+	return v, nil
+}
+
+// Versions returns the versions of function fn, the oldest first.
+func (m *VersionMgr) Versions(fn string) ([]FunctionVersion, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions, ok := m.versions[fn]
+	return append([]FunctionVersion{}, versions...), ok
+}
+
+// Version returns version v of function fn, and false if it does not exist.
+func (m *VersionMgr) Version(fn string, v int) (FunctionVersion, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := m.versions[fn]
+	if v < 1 || v > len(versions) {
+		return FunctionVersion{}, false
+	}
+	return versions[v-1], true
+}
+
+// Functions returns the registered functions, sorted.
+func (m *VersionMgr) Functions() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fns := make([]string, 0, len(m.versions))
+	for fn := range m.versions {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	return fns
+}
+
+// Aliases returns the aliases of function fn by name.
+func (m *VersionMgr) Aliases(fn string) (map[string]Alias, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	aliases, ok := m.aliases[fn]
+	if !ok {
+		return nil, false
+	}
+	res := make(map[string]Alias, len(aliases))
+	for name, a := range aliases {
+		res[name] = a
+	}
+	return res, true
+}
+
+// SetAlias adds or replaces alias name of function fn, routing to versions by weights.
+func (m *VersionMgr) SetAlias(fn, name string, weights map[int]int) error {
+	if !aliasNameRegexp.MatchString(name) || name == latestVersion {
+		return fmt.Errorf("invalid alias name %q, must start with a letter, followed by letters, digits, - or _", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions, ok := m.versions[fn]
+	if !ok {
+		return fmt.Errorf("Function %s not found", fn)
+	}
+	total := 0
+	for v, weight := range weights {
+		if v < 1 || v > len(versions) {
+			return fmt.Errorf("version %d of function %s not found", v, fn)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weights must be non-negative")
+		}
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("weights must sum up to a positive number")
+	}
+	a := Alias{Weights: make(map[int]int), UpdatedTime: time.Now()}
+	for v, weight := range weights {
+		if weight > 0 {
+			a.Weights[v] = weight
+		}
+	}
+	m.aliases[fn][name] = a
+	return nil
+}
+
+// DeleteAlias removes alias name of function fn. The default alias can not be removed.
+func (m *VersionMgr) DeleteAlias(fn, name string) error {
+	if name == defaultAlias {
+		return fmt.Errorf("the %s alias can not be removed", defaultAlias)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.aliases[fn][name]; !ok {
+		return ErrAliasNotFound
+	}
+	delete(m.aliases[fn], name)
+	return nil
+}
+
+// Resolve returns the version of function fn serving user's invocation of version, which is a version number,
+// "latest", or an alias. Invocations not naming a version are served by the default alias.
+func (m *VersionMgr) Resolve(fn, version, user string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := m.versions[fn]
+	if version == "" {
+		version = defaultAlias
+	}
+	if version == latestVersion && len(versions) > 0 {
+		return len(versions), nil
+	}
+	if a, ok := m.aliases[fn][version]; ok {
+		return a.pick(fn+"/"+version, user), nil
+	}
+	if v, err := strconv.Atoi(version); err == nil && v >= 1 && v <= len(versions) {
+		return v, nil
+	}
+	return 0, ErrVersionNotFound
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestVersionMgr() *VersionMgr {
+	l := NewLauncher(time.Second)
+	m := NewVersionMgr(&l)
+	m.register("alpha", NewContainer("runtime", []string{"python", "runtime.py"}), "")
+	return &m
+}
+
+// TestVersionMgr_Publish tests that published versions get increasing numbers and inherit the latest version's image
+// and command
+func TestVersionMgr_Publish(t *testing.T) {
+	m := newTestVersionMgr()
+
+	v, err := m.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Version)
+	assert.Equal(t, []string{"python", "runtime.py"}, v.Cmd)
+	c, ok := m.launcher.template("alpha", 2)
+	assert.True(t, ok)
+	assert.Equal(t, "runtime:v2", c.(Container).image)
+
+	v, err = m.Publish("alpha", FunctionVersion{Cmd: []string{"python", "runtime_v3.py"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, v.Version)
+	assert.Equal(t, "runtime:v2", v.Image)
+
+	_, err = m.Publish("delta", FunctionVersion{})
+	assert.Error(t, err)
+
+	versions, ok := m.Versions("alpha")
+	assert.True(t, ok)
+	assert.Len(t, versions, 3)
+}
+
+// TestVersionMgr_Resolve tests resolving version numbers, latest and aliases
+func TestVersionMgr_Resolve(t *testing.T) {
+	m := newTestVersionMgr()
+	_, err := m.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+
+	for version, expected := range map[string]int{"": 1, "default": 1, "latest": 2, "1": 1, "2": 2} {
+		v, err := m.Resolve("alpha", version, "test")
+		assert.NoError(t, err, version)
+		assert.Equal(t, expected, v, version)
+	}
+	for _, version := range []string{"0", "3", "canary"} {
+		_, err := m.Resolve("alpha", version, "test")
+		assert.ErrorIs(t, err, ErrVersionNotFound, version)
+	}
+
+	assert.NoError(t, m.SetAlias("alpha", "canary", map[int]int{2: 1}))
+	v, err := m.Resolve("alpha", "canary", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+
+	assert.Error(t, m.SetAlias("alpha", "canary", map[int]int{3: 1}))
+	assert.Error(t, m.SetAlias("alpha", "canary", map[int]int{1: 0}))
+	assert.Error(t, m.SetAlias("alpha", "latest", map[int]int{1: 1}))
+	assert.Error(t, m.SetAlias("alpha", "2", map[int]int{1: 1}))
+
+	assert.Error(t, m.DeleteAlias("alpha", defaultAlias))
+	assert.NoError(t, m.DeleteAlias("alpha", "canary"))
+	assert.ErrorIs(t, m.DeleteAlias("alpha", "canary"), ErrAliasNotFound)
+}
+
+// TestVersionMgr_TrafficSplit tests that aliases split users by weight, and users stick to their versions as traffic
+// shifts to the new version
+func TestVersionMgr_TrafficSplit(t *testing.T) {
+	m := newTestVersionMgr()
+	_, err := m.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+
+	resolveAll := func() map[string]int {
+		res := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			v, err := m.Resolve("alpha", "", user)
+			assert.NoError(t, err)
+			res[user] = v
+		}
+		return res
+	}
+	count := func(assigned map[string]int, version int) int {
+		n := 0
+		for _, v := range assigned {
+			if v == version {
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.NoError(t, m.SetAlias("alpha", defaultAlias, map[int]int{1: 95, 2: 5}))
+	canary := resolveAll()
+	assert.InDelta(t, 500, count(canary, 2), 100)
+	assert.Equal(t, canary, resolveAll())
+
+	assert.NoError(t, m.SetAlias("alpha", defaultAlias, map[int]int{1: 50, 2: 50}))
+	half := resolveAll()
+	assert.InDelta(t, 5000, count(half, 2), 300)
+	for user, v := range canary {
+		if v == 2 {
+			assert.Equal(t, 2, half[user], user)
+		}
+	}
+}
+
+// TestInvokeRoutes_Versions tests that invocations are served by instances of the resolved version
+func TestInvokeRoutes_Versions(t *testing.T) {
+	d := NewDispatcher("runtime")
+	defer d.StopLaunchMonitor()
+	_, err := d.versionMgr.Publish("alpha", FunctionVersion{Image: "runtime:v2"})
+	assert.NoError(t, err)
+	for _, v := range []int{1, 2} {
+		v := v
+		addTestVersionInst(t, d, "alpha", v, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "v%d", v)
+		})
+	}
+	assert.NoError(t, d.versionMgr.SetAlias("alpha", "canary", map[int]int{2: 1}))
+	r := mux.NewRouter()
+	d.RegisterInvokeRoutes(r, nil)
+
+	for path, expected := range map[string]string{
+		"/functions/alpha/invoke":                  "1",
+		"/functions/alpha/versions/2/invoke":       "2",
+		"/functions/alpha/versions/latest/invoke":  "2",
+		"/functions/alpha/versions/canary/invoke":  "2",
+		"/functions/alpha/versions/1/invoke":       "1",
+		"/functions/alpha/versions/default/invoke": "1",
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("User", "test")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Body)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "v"+expected, string(body), path)
+		assert.Equal(t, expected, w.Header().Get(versionHeader), path)
+	}
+}
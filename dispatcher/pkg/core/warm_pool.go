@@ -0,0 +1,242 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The timeout waiting for a generic container to be up.
+	warmPoolStartTimeout = 30 * time.Second
+
+	// The timeout of asking a generic container to specialize, which returns before loading.
+	specializeTimeout = 5 * time.Second
+)
+
+// The command running the runtime without a function, i.e., generic until specialized.
+var genericRuntimeCmd = []string{"python", "runtime.py"}
+
+// Returns the --file and --class_name arguments of a runtime command, and false if cmd is not one.
+func parseRuntimeCmd(cmd []string) (file, className string, ok bool) {
+	if len(cmd) < 2 || cmd[0] != genericRuntimeCmd[0] || cmd[1] != genericRuntimeCmd[1] {
+		return "", "", false
+	}
+	for i := 2; i < len(cmd); i++ {
+		name, value, hasValue := strings.Cut(cmd[i], "=")
+		if !hasValue {
+			if i+1 >= len(cmd) {
+				return "", "", false
+			}
+			i++
+			value = cmd[i]
+		}
+		switch name {
+		case "--file":
+			file = value
+		case "--class_name":
+			className = value
+		default:
+			// Other arguments can not be passed to a started runtime.
+			return "", "", false
+		}
+	}
+	return file, className, file != "" && className != ""
+}
+
+// WarmPool keeps generic runtime containers started ahead of invocations, to be specialized into instances of any
+// function running the runtime image, so that cold starts only pay for the function's load().
+type WarmPool struct {
+	// The image of the generic containers. Only versions running it with a runtime command are specialized from
+	// the pool.
+	image string
+
+	// The template of the generic containers.
+	// ContainerInterface is used for testing.
+	template ContainerInterface
+
+	mu sync.Mutex
+	// The target count of idle containers, 0 disables the pool.
+	// Protected by mu.
+	size int
+	// The containers ready to be specialized.
+	// Protected by mu.
+	idle []*RunningContainer
+	// The count of containers being started.
+	// Protected by mu.
+	starting int
+	// The counter of containers created, naming them.
+	// Protected by mu.
+	counter int
+}
+
+// NewWarmPool creates an empty WarmPool of the runtime image. Containers are started once it's resized.
+func NewWarmPool(image string) *WarmPool {
+	return &WarmPool{
+		image:    image,
+		template: NewContainer(image, genericRuntimeCmd),
+	}
+}
+
+// Resize sets the count of idle containers kept, stopping the extra ones.
+func (p *WarmPool) Resize(size int) {
+	p.mu.Lock()
+	var extra []*RunningContainer
+	p.size = size
+	if len(p.idle) > size {
+		extra = p.idle[size:]
+		p.idle = append([]*RunningContainer{}, p.idle[:size]...)
+	}
+	p.mu.Unlock()
+	for _, rc := range extra {
+		discardInst(rc)
+	}
+}
+
+// Returns the count of idle containers, and the target count.
+func (p *WarmPool) Size() (idle, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle), p.size
+}
+
+// Starts containers in the background, up to the target count.
+func (p *WarmPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle)+p.starting < p.size {
+		p.starting++
+		name := "warm-" + strconv.Itoa(p.counter)
+		p.counter++
+		go p.start(name)
+	}
+}
+
+func (p *WarmPool) start(name string) {
+	logger := slog.With(logKeyInstance, name)
+	rc, err := p.template.Run(name)
+	if err == nil {
+		if err = WaitForHTTPGetOK(rc.aliveUrl, 100*time.Millisecond, warmPoolStartTimeout); err != nil {
+			discardInst(rc)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starting--
+	if err != nil {
+		logger.Error("Failed to start warm container", "error", err)
+		return
+	}
+	if len(p.idle) >= p.size {
+		// Shrunk while starting.
+		go discardInst(rc)
+		return
+	}
+	logger.Debug("Started warm container")
+	p.idle = append(p.idle, rc)
+}
+
+// Returns an idle container, or nil if none.
+func (p *WarmPool) take() *RunningContainer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	rc := p.idle[0]
+	p.idle = p.idle[1:]
+	return rc
+}
+
+// An idle container taken to be specialized into an instance of a template.
+type warmClaim struct {
+	rc        *RunningContainer
+	file      string
+	className string
+}
+
+// Takes an idle container to be specialized into an instance run from template c. Returns nil if c does not run the
+// runtime image without a memory limit, or there's no idle container.
+func (p *WarmPool) claim(c ContainerInterface) *warmClaim {
+	tc, ok := c.(Container)
+	if !ok || tc.image != p.image || tc.memoryMB != 0 {
+		return nil
+	}
+	file, className, ok := parseRuntimeCmd(tc.cmd)
+	if !ok {
+		return nil
+	}
+	rc := p.take()
+	if rc == nil {
+		return nil
+	}
+	return &warmClaim{rc: rc, file: file, className: className}
+}
+
+// Specializes the container of claim into an instance named name. Returns false if specializing fails, in which case
+// the container is discarded. It calls the runtime, so it must be called without holding the launcher's locks.
+func (p *WarmPool) specialize(claim *warmClaim, name string) (*RunningContainer, bool) {
+	rc := claim.rc
+	if err := requestSpecialize(rc.specializeUrl, claim.file, claim.className); err != nil {
+		rc.logger().Error("Failed to specialize warm container", "error", err)
+		go discardInst(rc)
+		return nil, false
+	}
+	rc.name = name
+	return rc, true
+}
+
+// Asks the generic runtime at url to load class className of file.
+func requestSpecialize(url, file, className string) error {
+	body, err := json.Marshal(map[string]string{"file": file, "class_name": className})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: specializeTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("specialize responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Stops all idle containers. Containers still starting are stopped once started, as the pool is resized to 0.
+func (p *WarmPool) shutdownAll() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.size = 0
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, rc := range idle {
+		rc := rc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discardInst(rc)
+		}()
+	}
+	wg.Wait()
+}
+
+// Stops and removes rc, which never served invocations.
+func discardInst(rc *RunningContainer) {
+	if err := rc.Stop(); err != nil {
+		rc.logger().Error("Failed to stop running container", "error", err)
+	}
+	if err := rc.Remove(); err != nil {
+		rc.logger().Error("Failed to remove running container", "error", err)
+	}
+}
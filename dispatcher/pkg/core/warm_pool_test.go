@@ -0,0 +1,150 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs generic runtimes served by a test server, recording the functions they are specialized into.
+type testGenericContainer struct {
+	t      *testing.T
+	status int
+
+	mu          sync.Mutex
+	specialized []string
+}
+
+func (c *testGenericContainer) Run(name string) (*RunningContainer, error) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alive":
+		case "/specialize":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			c.mu.Lock()
+			c.specialized = append(c.specialized, req["file"]+":"+req["class_name"])
+			c.mu.Unlock()
+			w.WriteHeader(c.status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	c.t.Cleanup(server.Close)
+	return &RunningContainer{
+		name:          name,
+		Url:           server.URL + "/invoke",
+		readyUrl:      server.URL + "/ready",
+		aliveUrl:      server.URL + "/alive",
+		specializeUrl: server.URL + "/specialize",
+		launchTime:    time.Now(),
+	}, nil
+}
+
+// TestParseRuntimeCmd tests extracting the function from runtime commands
+func TestParseRuntimeCmd(t *testing.T) {
+	file, className, ok := parseRuntimeCmd([]string{"python", "runtime.py", "--file=a.py", "--class_name=A"})
+	assert.True(t, ok)
+	assert.Equal(t, "a.py", file)
+	assert.Equal(t, "A", className)
+
+	file, className, ok = parseRuntimeCmd([]string{"python", "runtime.py", "--file", "a.py", "--class_name", "A"})
+	assert.True(t, ok)
+	assert.Equal(t, "a.py", file)
+	assert.Equal(t, "A", className)
+
+	for _, cmd := range [][]string{
+		{"python", "runtime.py", "--file=a.py"},
+		{"python", "runtime.py", "--file=a.py", "--class_name=A", "--port=6000"},
+		{"python", "other.py", "--file=a.py", "--class_name=A"},
+		{"python", "runtime.py", "--file"},
+	} {
+		_, _, ok := parseRuntimeCmd(cmd)
+		assert.False(t, ok, cmd)
+	}
+}
+
+// TestLauncher_LaunchWarm tests that launching specializes an idle container of the warm pool
+func TestLauncher_LaunchWarm(t *testing.T) {
+	c := &testGenericContainer{t: t, status: http.StatusAccepted}
+	warm, _ := c.Run("warm-0")
+	l := NewLauncher(time.Second)
+	l.warmPool = &WarmPool{image: "runtime", template: c, size: 1, idle: []*RunningContainer{warm}}
+	l.registerContainer("alpha", NewContainer("runtime",
+		[]string{"python", "runtime.py", "--file=runtime_alpha.py", "--class_name=RuntimeAlpha"}))
+	var launched []string
+	l.onLaunched = func(fn, from string) { launched = append(launched, from) }
+
+	rc, err := l.Launch("alpha")
+	assert.NoError(t, err)
+	assert.Equal(t, "alpha-0", rc.name)
+	assert.Equal(t, "alpha", rc.fn)
+	assert.Equal(t, []string{"runtime_alpha.py:RuntimeAlpha"}, c.specialized)
+	assert.Equal(t, []string{launchFromWarmPool}, launched)
+	idle, _ := l.warmPool.Size()
+	assert.Equal(t, 0, idle)
+}
+
+// TestLauncher_LaunchWarmStartupTime tests that the startup time of specialized instances excludes the time their
+// generic containers were idle in the pool
+func TestLauncher_LaunchWarmStartupTime(t *testing.T) {
+	c := &testGenericContainer{t: t, status: http.StatusAccepted}
+	warm, _ := c.Run("warm-0")
+	l := NewLauncher(time.Second)
+	l.warmPool = &WarmPool{image: "runtime", template: c, size: 1, idle: []*RunningContainer{warm}}
+	l.registerContainer("alpha", NewContainer("runtime",
+		[]string{"python", "runtime.py", "--file=runtime_alpha.py", "--class_name=RuntimeAlpha"}))
+	tracker := NewAPIUsageTracker()
+	l.addListener(&tracker)
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	rc, err := l.Launch("alpha")
+	assert.NoError(t, err)
+	assert.False(t, rc.launchTime.Before(start))
+	usages := tracker.GetInstanceUsages()
+	assert.Len(t, usages, 1)
+	assert.Less(t, usages[0].StartupTime(time.Now()), 200*time.Millisecond)
+}
+
+// TestWarmPool_Specialize tests that only templates running the runtime image are specialized, and failed
+// specializations are not used
+func TestWarmPool_Specialize(t *testing.T) {
+	p := NewWarmPool("runtime")
+	p.template = &testGenericContainer{t: t, status: http.StatusAccepted}
+	p.Resize(2)
+	p.fill()
+	assert.Eventually(t, func() bool {
+		idle, _ := p.Size()
+		return idle == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cmd := []string{"python", "runtime.py", "--file=runtime_beta.py", "--class_name=RuntimeBeta"}
+
+	assert.Nil(t, p.claim(NewContainer("other", cmd)))
+	assert.Nil(t, p.claim(Container{image: "runtime", cmd: cmd, memoryMB: 2048}))
+	assert.Nil(t, p.claim(new(MockContainer)))
+	idle, _ := p.Size()
+	assert.Equal(t, 2, idle)
+
+	claim := p.claim(NewContainer("runtime", cmd))
+	assert.NotNil(t, claim)
+	rc, ok := p.specialize(claim, "beta-0")
+	assert.True(t, ok)
+	assert.Equal(t, "beta-0", rc.name)
+
+	p.Resize(0)
+	assert.Nil(t, p.claim(NewContainer("runtime", cmd)))
+
+	c := &testGenericContainer{t: t, status: http.StatusConflict}
+	warm, _ := c.Run("warm-0")
+	p = &WarmPool{image: "runtime", template: c, size: 1, idle: []*RunningContainer{warm}}
+	_, ok = p.specialize(p.claim(NewContainer("runtime", cmd)), "beta-0")
+	assert.False(t, ok)
+	idle, _ = p.Size()
+	assert.Equal(t, 0, idle)
+}
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The header of async invocation requests, providing the URL to POST the result to.
+	callbackURLHeader = "X-Callback-URL"
+
+	// The headers of callbacks. The signature is "sha256=" followed by the hex-encoded HMAC-SHA256 of
+	// "<timestamp>.<body>", keyed by the callback secret. See SignWebhook.
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+
+	// The timeout of each attempt of delivering a callback.
+	webhookAttemptTimeout = 10 * time.Second
+
+	// The most dead letters kept, the oldest ones are dropped beyond it.
+	maxWebhookDeadLetters = 1000
+)
+
+// The results of delivering callbacks, reported in metrics.
+const (
+	webhookDelivered  = "delivered"
+	webhookRetried    = "retried"
+	webhookDeadLetter = "dead_letter"
+)
+
+// WebhookConfig configures the callbacks of async invocations.
+type WebhookConfig struct {
+	// The URLs that callback URLs must be under, i.e., with the same scheme and host, and a path, once cleaned, equal
+	// to the allowed one or under it. Callbacks are not accepted if empty.
+	Allowlist []string
+
+	// The key signing callbacks. Callbacks are not signed if empty.
+	Secret string
+
+	// A callback is delivered at most MaxAttempts times, waiting exponentially longer between attempts, from
+	// InitialBackoff up to MaxBackoff.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+// WebhookPayload is the body of callbacks, in JSON.
+type WebhookPayload struct {
+	Invocation AsyncInvocation `json:"invocation"`
+
+	// The content type and body of the function's response. The body is encoded in base64.
+	ResultContentType string `json:"result_content_type,omitempty"`
+	Result            []byte `json:"result,omitempty"`
+}
+
+// WebhookDeadLetter records a callback that could not be delivered.
+type WebhookDeadLetter struct {
+	InvocationID string    `json:"invocation_id"`
+	Fn           string    `json:"fn"`
+	URL          string    `json:"url"`
+	Attempts     int       `json:"attempts"`
+	FailedTime   time.Time `json:"failed_time"`
+
+	// The status of the last response, 0 if the callback URL could not be reached.
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error"`
+}
+
+// SignWebhook returns the signature of a callback with body, sent at timestamp in Unix seconds.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookMgr delivers the results of async invocations to their callback URLs.
+type WebhookMgr struct {
+	cfg       WebhookConfig
+	allowlist []*url.URL
+	client    *http.Client
+
+	// Called with the function and result of each delivery attempt.
+	onResult func(fn, result string)
+
+	// Canceled when stopping, interrupting deliveries.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	deliveries sync.WaitGroup
+
+	mu sync.Mutex
+	// The oldest first.
+	// Protected by mu.
+	deadLetters []WebhookDeadLetter
+}
+
+func NewWebhookMgr(cfg WebhookConfig) (*WebhookMgr, error) {
+	if cfg.MaxAttempts < 1 {
+		return nil, fmt.Errorf("max attempts of callbacks must be positive")
+	}
+	m := &WebhookMgr{
+		cfg:      cfg,
+		onResult: func(string, string) {},
+	}
+	m.client = &http.Client{
+		Timeout: webhookAttemptTimeout,
+		// Redirects could lead callbacks anywhere, bypassing the allowlist.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, allowed := range cfg.Allowlist {
+		u, err := url.Parse(allowed)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid callback allowlist entry %q, must be an absolute http(s) URL", allowed)
+		}
+		m.allowlist = append(m.allowlist, u)
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m, nil
+}
+
+// ValidateURL returns an error if callbacks can not be sent to rawURL.
+func (m *WebhookMgr) ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("Invalid callback URL, error: %v", err)
+	}
+	if u.User != nil {
+		return fmt.Errorf("Callback URL must not contain credentials")
+	}
+	for _, allowed := range m.allowlist {
+		if u.Scheme == allowed.Scheme && strings.EqualFold(u.Host, allowed.Host) && isUnderPath(u.Path, allowed.Path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Callback URL %s is not allowed", rawURL)
+}
+
+// Returns true if p is dir or under it, once both are cleaned, e.g., "/hooks/a" is under "/hooks/", but neither
+// "/hooks-evil" nor "/hooks/../admin" is.
+func isUnderPath(p, dir string) bool {
+	dir = strings.TrimSuffix(path.Clean("/"+dir), "/")
+	p = path.Clean("/" + p)
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// Deliver POSTs payload to callbackURL in the background, retrying until delivered or MaxAttempts is reached, after
+// which the callback is recorded as a dead letter.
+func (m *WebhookMgr) Deliver(callbackURL string, payload WebhookPayload) {
+	m.deliveries.Add(1)
+	go func() {
+		defer m.deliveries.Done()
+		m.deliver(callbackURL, payload)
+	}()
+}
+
+func (m *WebhookMgr) deliver(callbackURL string, payload WebhookPayload) {
+	inv := payload.Invocation
+	logger := slog.With(logKeyRequestID, inv.ID, logKeyFn, inv.Fn, "url", callbackURL)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("Failed to encode callback", "error", err)
+		return
+	}
+
+	var status int
+	attempts := 0
+loop:
+	for attempts < m.cfg.MaxAttempts {
+		if attempts > 0 {
+			m.onResult(inv.Fn, webhookRetried)
+			select {
+			case <-time.After(jitteredBackoff(m.cfg.InitialBackoff, m.cfg.MaxBackoff, attempts)):
+			case <-m.ctx.Done():
+				err = fmt.Errorf("dispatcher stopped, last error: %v", err)
+				break loop
+			}
+		}
+		attempts++
+		status, err = m.post(callbackURL, body)
+		if err == nil {
+			logger.Info("Delivered callback", "attempts", attempts)
+			m.onResult(inv.Fn, webhookDelivered)
+			return
+		}
+		logger.Warn("Failed to deliver callback", "attempt", attempts, "status", status, "error", err)
+		if status >= 300 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+			// Rejected or redirected by the receiver, retrying won't help.
+			break loop
+		}
+	}
+
+	logger.Error("Gave up delivering callback", "attempts", attempts, "error", err)
+	m.onResult(inv.Fn, webhookDeadLetter)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters = append(m.deadLetters, WebhookDeadLetter{
+		InvocationID: inv.ID,
+		Fn:           inv.Fn,
+		URL:          callbackURL,
+		Attempts:     attempts,
+		FailedTime:   time.Now(),
+		LastStatus:   status,
+		LastError:    err.Error(),
+	})
+	if len(m.deadLetters) > maxWebhookDeadLetters {
+		m.deadLetters = m.deadLetters[len(m.deadLetters)-maxWebhookDeadLetters:]
+	}
+}
+
+// Sends one attempt of a callback. Returns the response status if any, and an error unless it's 2xx.
+func (m *WebhookMgr) post(callbackURL string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.cfg.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(webhookSignatureHeader, SignWebhook(m.cfg.Secret, timestamp, body))
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return resp.StatusCode, fmt.Errorf("callback redirected with status %d, redirects are not followed",
+			resp.StatusCode)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// DeadLetters returns the callbacks that could not be delivered, the oldest first.
+func (m *WebhookMgr) DeadLetters() []WebhookDeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]WebhookDeadLetter{}, m.deadLetters...)
+}
+
+// PurgeDeadLetters removes all dead letters, and returns how many were removed.
+func (m *WebhookMgr) PurgeDeadLetters() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.deadLetters)
+	m.deadLetters = nil
+	return n
+}
+
+// Stop interrupts the pending deliveries, recording them as dead letters, and waits for them to return.
+func (m *WebhookMgr) Stop() {
+	m.cancel()
+	m.deliveries.Wait()
+}
@@ -0,0 +1,206 @@
+// Package protocol defines the contract between the dispatcher and the runtimes serving functions, i.e., the HTTP
+// endpoints, headers, and the JSON envelopes of requests and responses. See runtime/PROTOCOL.md for the
+// specification.
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The version of the protocol. Runtimes reject invocations of other versions.
+const Version = 1
+
+// Headers of invocations.
+const (
+	// The version of the protocol the dispatcher speaks. Invocations without it are served as the current version.
+	VersionHeader = "X-Runtime-Protocol-Version"
+
+	// The ID of the invocation, echoed in the response, and used to correlate logs.
+	RequestIDHeader = "X-Request-ID"
+
+	// The time by which the invocation must be responded to, in RFC 3339 with fractional seconds. Absent if the
+	// invocation has no deadline.
+	DeadlineHeader = "X-Invocation-Deadline"
+)
+
+// Endpoints of runtimes, relative to their base URLs.
+const (
+	// POST, serves an invocation.
+	InvokePath = "/invoke"
+
+	// GET, 200 once the function is loaded, and invocations can be served, 503 before.
+	ReadyPath = "/ready"
+
+	// GET, 200 once the runtime is up, even if the function is not loaded yet.
+	AlivePath = "/alive"
+
+	// POST, loads a function into a generic runtime. Optional.
+	SpecializePath = "/specialize"
+)
+
+// Media types of streamed responses, selected by the Accept header of invocations.
+const (
+	// Server-Sent Events, each chunk an event with data Chunk, followed by a final "done" event.
+	SSEMediaType = "text/event-stream"
+
+	// Newline-delimited JSON, each chunk a line of Chunk.
+	NDJSONMediaType = "application/x-ndjson"
+)
+
+// InvokeRequest is the body of invocations.
+type InvokeRequest struct {
+	Args json.RawMessage `json:"args"`
+}
+
+// InvokeResponse is the body of successful invocations, not streamed.
+type InvokeResponse struct {
+	Response any `json:"response"`
+}
+
+// Chunk is a chunk of a streamed response.
+type Chunk struct {
+	Chunk any `json:"chunk"`
+}
+
+// ErrorType classifies errors, determining the status of their responses.
+type ErrorType string
+
+const (
+	// The invocation is malformed, e.g., its body is not an InvokeRequest, or its args are invalid. 400.
+	ErrorInvalidRequest ErrorType = "invalid_request"
+
+	// The invocation is of an unsupported version of the protocol. 400.
+	ErrorUnsupportedVersion ErrorType = "unsupported_version"
+
+	// The function failed serving the invocation. 500.
+	ErrorFunction ErrorType = "function_error"
+
+	// The function is not loaded yet, or failed loading. 503.
+	ErrorNotReady ErrorType = "not_ready"
+
+	// The deadline of the invocation passed before it was served. 504.
+	ErrorDeadlineExceeded ErrorType = "deadline_exceeded"
+)
+
+// Errors of the dispatcher, in responses to clients only.
+const (
+	// The function or version does not exist. 404.
+	ErrorNotFound ErrorType = "not_found"
+
+	// The client is not allowed to call the function. 403.
+	ErrorForbidden ErrorType = "forbidden"
+
+	// The client made too many concurrent calls to the function. 429.
+	ErrorRateLimited ErrorType = "rate_limited"
+
+	// The function can't serve invocations for now, e.g., there is no capacity, or its instances are failing. 503.
+	ErrorUnavailable ErrorType = "unavailable"
+
+	// The instance crashed, could not be reached, or responded with an error outside of the protocol. 502.
+	ErrorInstanceFailed ErrorType = "instance_failed"
+)
+
+// ErrorSource is who an error is attributed to, which determines who is billed for the invocation.
+type ErrorSource string
+
+const (
+	// The client, e.g., calling with invalid args, or without being allowed to.
+	SourceClient ErrorSource = "client"
+
+	// The function's code, e.g., raising an exception.
+	SourceFunction ErrorSource = "function"
+
+	// The platform, e.g., timing out, crashing instances or running out of capacity.
+	SourcePlatform ErrorSource = "platform"
+)
+
+// Status returns the status of the error responses of t.
+func (t ErrorType) Status() int {
+	switch t {
+	case ErrorInvalidRequest, ErrorUnsupportedVersion:
+		return http.StatusBadRequest
+	case ErrorNotFound:
+		return http.StatusNotFound
+	case ErrorForbidden:
+		return http.StatusForbidden
+	case ErrorRateLimited:
+		return http.StatusTooManyRequests
+	case ErrorNotReady, ErrorUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrorDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrorInstanceFailed:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// Source returns who errors of type t are attributed to.
+func (t ErrorType) Source() ErrorSource {
+	switch t {
+	case ErrorInvalidRequest, ErrorNotFound, ErrorForbidden, ErrorRateLimited:
+		return SourceClient
+	case ErrorFunction:
+		return SourceFunction
+	}
+	return SourcePlatform
+}
+
+// Error is the error of a failed invocation.
+type Error struct {
+	Type    ErrorType `json:"type"`
+	Message string    `json:"message"`
+
+	// An error code defined by the function, e.g., "quota_exceeded", for clients to tell its errors apart. Optional.
+	Code string `json:"code,omitempty"`
+
+	// Whether calling again with the same args may succeed, e.g., if a dependency of the function is down.
+	Retryable bool `json:"retryable"`
+
+	// Set by the dispatcher in responses to clients. Runtimes leave it empty.
+	Source ErrorSource `json:"source,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return string(e.Type) + ": " + e.Message
+}
+
+// ErrorResponse is the body of failed invocations, with the status of the error's type.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// ReadyResponse is the body of the ready endpoint once the function is loaded.
+type ReadyResponse struct {
+	ProtocolVersion int `json:"protocol_version"`
+
+	// How long importing the function, and running its load, took.
+	ImportSeconds float64 `json:"import_seconds"`
+	LoadSeconds   float64 `json:"load_seconds"`
+}
+
+// SetDeadline sets the deadline header of h.
+func SetDeadline(h http.Header, deadline time.Time) {
+	h.Set(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+}
+
+// ParseHeaders returns the protocol version and the deadline of an invocation, with ok false if the deadline header is
+// not set. Invocations without the version header are of the current version.
+func ParseHeaders(h http.Header) (version int, deadline time.Time, ok bool, err error) {
+	version = Version
+	if s := h.Get(VersionHeader); s != "" {
+		if version, err = strconv.Atoi(s); err != nil {
+			return 0, time.Time{}, false, &Error{Type: ErrorUnsupportedVersion, Message: "invalid version " + s}
+		}
+	}
+	if s := h.Get(DeadlineHeader); s != "" {
+		if deadline, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return 0, time.Time{}, false, &Error{Type: ErrorInvalidRequest, Message: "invalid deadline " + s}
+		}
+		ok = true
+	}
+	return version, deadline, ok, nil
+}
@@ -0,0 +1,334 @@
+// Package sdk serves Go functions over the runtime protocol, so that they can be run by the dispatcher the same as
+// Python functions. A function is served by its image's entrypoint:
+//
+//	func main() {
+//		if err := sdk.Serve(":5000", &Echo{}); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// Function is a function served by the runtime.
+type Function interface {
+	// Load is called once before serving invocations, e.g., to load models. Invocations are rejected as not ready
+	// until it returns, and forever if it fails.
+	Load(ctx context.Context) error
+
+	// Invoke serves an invocation with args, the raw JSON of the invocation's args, and returns the response, which is
+	// marshaled into JSON. ctx is done once the invocation's deadline passes, and carries its request ID.
+	Invoke(ctx context.Context, args json.RawMessage) (any, error)
+}
+
+// StreamingFunction is a Function streaming its response to clients accepting a streamed media type. Invoke serves the
+// other clients.
+type StreamingFunction interface {
+	Function
+
+	// InvokeStream serves an invocation with args, sending each chunk of the response with send, which fails once
+	// the client is gone.
+	InvokeStream(ctx context.Context, args json.RawMessage, send func(chunk any) error) error
+}
+
+// Errorf returns an error failing invocations with type t, instead of function_error, e.g., invalid_request for
+// invalid args.
+func Errorf(t protocol.ErrorType, format string, args ...any) error {
+	return &protocol.Error{Type: t, Message: fmt.Sprintf(format, args...)}
+}
+
+// NewError returns an error failing invocations as function errors with code, e.g., "quota_exceeded", for clients to
+// tell the function's errors apart, and whether calling again with the same args may succeed.
+func NewError(code, message string, retryable bool) error {
+	return &protocol.Error{Type: protocol.ErrorFunction, Message: message, Code: code, Retryable: retryable}
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the request ID of the invocation served with ctx, empty if the dispatcher did not set one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Runtime serves a Function over the runtime protocol.
+type Runtime struct {
+	fn Function
+
+	mu sync.Mutex
+	// Set once fn is loaded. Protected by mu.
+	ready *protocol.ReadyResponse
+	// Set if loading fn failed. Protected by mu.
+	loadErr error
+}
+
+func New(fn Function) *Runtime {
+	return &Runtime{fn: fn}
+}
+
+// Load loads the function, after which invocations are served.
+func (rt *Runtime) Load(ctx context.Context) error {
+	start := time.Now()
+	err := rt.fn.Load(ctx)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if err != nil {
+		rt.loadErr = err
+		slog.Error("Failed to load function", "error", err)
+		return err
+	}
+	// Go functions are compiled in, so there is nothing to import.
+	rt.ready = &protocol.ReadyResponse{ProtocolVersion: protocol.Version, LoadSeconds: time.Since(start).Seconds()}
+	slog.Info("Loaded function", "duration", time.Since(start))
+	return nil
+}
+
+// Returns an error of type not_ready if the function is not loaded.
+func (rt *Runtime) notReady() *protocol.Error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.loadErr != nil {
+		return &protocol.Error{Type: protocol.ErrorNotReady, Message: "failed loading: " + rt.loadErr.Error()}
+	}
+	if rt.ready == nil {
+		return &protocol.Error{Type: protocol.ErrorNotReady, Message: "loading"}
+	}
+	return nil
+}
+
+// Handler returns the handler of the runtime's endpoints.
+func (rt *Runtime) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.InvokePath, rt.handleInvoke)
+	mux.HandleFunc(protocol.ReadyPath, rt.handleReady)
+	mux.HandleFunc(protocol.AlivePath, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	})
+	return mux
+}
+
+// Serve loads fn in the background, and serves it at addr.
+func Serve(addr string, fn Function) error {
+	rt := New(fn)
+	go rt.Load(context.Background())
+	slog.Info("Serving function", "addr", addr)
+	return http.ListenAndServe(addr, rt.Handler())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Returns err as a *protocol.Error, of type function_error unless err is one.
+func protocolError(err error) *protocol.Error {
+	var protoErr *protocol.Error
+	if !errors.As(err, &protoErr) {
+		protoErr = &protocol.Error{Type: protocol.ErrorFunction, Message: err.Error()}
+	}
+	return protoErr
+}
+
+// Writes the error response of err.
+func writeError(w http.ResponseWriter, err error) {
+	protoErr := protocolError(err)
+	writeJSON(w, protoErr.Type.Status(), protocol.ErrorResponse{Error: *protoErr})
+}
+
+func (rt *Runtime) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := rt.notReady(); err != nil {
+		writeError(w, err)
+		return
+	}
+	rt.mu.Lock()
+	ready := *rt.ready
+	rt.mu.Unlock()
+	writeJSON(w, http.StatusOK, ready)
+}
+
+func (rt *Runtime) handleInvoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID := r.Header.Get(protocol.RequestIDHeader)
+	if requestID != "" {
+		w.Header().Set(protocol.RequestIDHeader, requestID)
+	}
+	if err := rt.notReady(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	version, deadline, hasDeadline, err := protocol.ParseHeaders(r.Header)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if version != protocol.Version {
+		writeError(w, Errorf(protocol.ErrorUnsupportedVersion, "version %d is not supported, only %d is",
+			version, protocol.Version))
+		return
+	}
+	ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+	if hasDeadline {
+		if !time.Now().Before(deadline) {
+			writeError(w, Errorf(protocol.ErrorDeadlineExceeded, "deadline %s passed before invoking",
+				deadline.Format(time.RFC3339Nano)))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var req protocol.InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, Errorf(protocol.ErrorInvalidRequest, "invalid request body: %v", err))
+		return
+	}
+	if len(req.Args) == 0 || string(req.Args) == "null" {
+		req.Args = json.RawMessage("{}")
+	}
+
+	logger := slog.With("request_id", requestID)
+	logger.Info("Invoking")
+	if sf, ok := rt.fn.(StreamingFunction); ok {
+		if mediaType := streamedMediaType(r.Header.Get("Accept")); mediaType != "" {
+			rt.stream(ctx, w, sf, req.Args, mediaType)
+			return
+		}
+	}
+
+	resp, err := rt.invoke(ctx, req.Args)
+	if err != nil {
+		logger.Warn("Invocation failed", "error", err)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, protocol.InvokeResponse{Response: resp})
+}
+
+// Calls the function in the background, so that invocations are responded to by their deadlines even if the function
+// ignores ctx. Panics are returned as errors.
+func (rt *Runtime) invoke(ctx context.Context, args json.RawMessage) (any, error) {
+	type result struct {
+		resp any
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		resp, err := rt.fn.Invoke(ctx, args)
+		done <- result{resp, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, Errorf(protocol.ErrorDeadlineExceeded, "%v", res.err)
+		}
+		return res.resp, res.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, Errorf(protocol.ErrorDeadlineExceeded, "deadline passed while invoking")
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the first streamed media type listed in accept, empty if none is.
+func streamedMediaType(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if mediaType == protocol.SSEMediaType || mediaType == protocol.NDJSONMediaType {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// Streams the response of sf as mediaType. Errors after the first chunk can't change the status anymore, so they are
+// sent as a final error event or line.
+func (rt *Runtime) stream(ctx context.Context, w http.ResponseWriter, sf StreamingFunction, args json.RawMessage,
+	mediaType string) {
+	flusher, _ := w.(http.Flusher)
+	started := false
+	write := func(event string, v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !started {
+			w.Header().Set("Content-Type", mediaType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if mediaType == protocol.SSEMediaType {
+			if event != "" {
+				fmt.Fprintf(w, "event: %s\n", event)
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", b)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return sf.InvokeStream(ctx, args, func(chunk any) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return write("", protocol.Chunk{Chunk: chunk})
+		})
+	}()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = Errorf(protocol.ErrorDeadlineExceeded, "%v", err)
+	}
+	if err != nil {
+		slog.Warn("Streamed invocation failed", "request_id", RequestID(ctx), "error", err)
+		if !started {
+			writeError(w, err)
+			return
+		}
+		write("error", protocol.ErrorResponse{Error: *protocolError(err)})
+		return
+	}
+	if mediaType == protocol.SSEMediaType {
+		write("done", struct{}{})
+	} else if !started {
+		// No chunks.
+		w.Header().Set("Content-Type", mediaType)
+	}
+}
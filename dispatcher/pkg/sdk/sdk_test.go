@@ -0,0 +1,199 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"serverless/dispatcher/pkg/protocol"
+)
+
+// Responds with the args, failing per the "fail" arg, and streams the "chunks" arg.
+type testFunction struct {
+	loadErr error
+}
+
+type testArgs struct {
+	Fail   string   `json:"fail"`
+	Sleep  string   `json:"sleep"`
+	Chunks []string `json:"chunks"`
+}
+
+func (f *testFunction) Load(ctx context.Context) error {
+	return f.loadErr
+}
+
+func (f *testFunction) Invoke(ctx context.Context, args json.RawMessage) (any, error) {
+	var a testArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return nil, Errorf(protocol.ErrorInvalidRequest, "invalid args: %v", err)
+	}
+	switch a.Fail {
+	case "error":
+		return nil, errors.New("failed")
+	case "panic":
+		panic("panicked")
+	case "quota":
+		return nil, NewError("quota_exceeded", "out of quota", true)
+	}
+	if a.Sleep != "" {
+		d, _ := time.ParseDuration(a.Sleep)
+		// Ignores ctx.
+		time.Sleep(d)
+	}
+	return map[string]any{"args": args, "request_id": RequestID(ctx)}, nil
+}
+
+func (f *testFunction) InvokeStream(ctx context.Context, args json.RawMessage, send func(any) error) error {
+	var a testArgs
+	json.Unmarshal(args, &a)
+	for _, chunk := range a.Chunks {
+		if err := send(chunk); err != nil {
+			return err
+		}
+	}
+	if a.Fail == "error" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func newTestRuntime(t *testing.T, fn Function) *Runtime {
+	rt := New(fn)
+	assert.NoError(t, rt.Load(context.Background()))
+	return rt
+}
+
+func doInvoke(h http.Handler, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, protocol.InvokePath, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// Returns the error type of the error response of w.
+func errorType(t *testing.T, w *httptest.ResponseRecorder) protocol.ErrorType {
+	var resp protocol.ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return resp.Error.Type
+}
+
+// TestRuntime_Invoke tests serving invocations with the response envelope, and echoing the request ID
+func TestRuntime_Invoke(t *testing.T) {
+	h := newTestRuntime(t, &testFunction{}).Handler()
+
+	w := doInvoke(h, `{"args": {"x": 1}}`, map[string]string{protocol.RequestIDHeader: "my-request"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "my-request", w.Header().Get(protocol.RequestIDHeader))
+	assert.JSONEq(t, `{"response": {"args": {"x": 1}, "request_id": "my-request"}}`, w.Body.String())
+
+	// Args default to {}.
+	w = doInvoke(h, `{}`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"response": {"args": {}, "request_id": ""}}`, w.Body.String())
+}
+
+// TestRuntime_Errors tests the error responses of invalid invocations and failed functions
+func TestRuntime_Errors(t *testing.T) {
+	h := newTestRuntime(t, &testFunction{}).Handler()
+	passed := time.Now().Add(-time.Second).Format(time.RFC3339Nano)
+
+	for _, tc := range []struct {
+		body   string
+		header map[string]string
+		want   protocol.ErrorType
+	}{
+		{`not json`, nil, protocol.ErrorInvalidRequest},
+		{`{"args": []}`, nil, protocol.ErrorInvalidRequest},
+		{`{"args": {}}`, map[string]string{protocol.VersionHeader: "2"}, protocol.ErrorUnsupportedVersion},
+		{`{"args": {}}`, map[string]string{protocol.DeadlineHeader: "tomorrow"}, protocol.ErrorInvalidRequest},
+		{`{"args": {}}`, map[string]string{protocol.DeadlineHeader: passed}, protocol.ErrorDeadlineExceeded},
+		{`{"args": {"fail": "error"}}`, nil, protocol.ErrorFunction},
+		{`{"args": {"fail": "panic"}}`, nil, protocol.ErrorFunction},
+	} {
+		w := doInvoke(h, tc.body, tc.header)
+		assert.Equal(t, tc.want.Status(), w.Code, tc.body)
+		assert.Equal(t, tc.want, errorType(t, w), tc.body)
+	}
+
+	// Responded to by the deadline, even though the function ignores it.
+	start := time.Now()
+	w := doInvoke(h, `{"args": {"sleep": "1s"}}`,
+		map[string]string{protocol.DeadlineHeader: time.Now().Add(50 * time.Millisecond).Format(time.RFC3339Nano)})
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, protocol.ErrorDeadlineExceeded, errorType(t, w))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	w = doInvoke(h, `{"args": {"fail": "quota"}}`, nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error": {"type": "function_error", "message": "out of quota", "code": "quota_exceeded",
+		"retryable": true}}`, w.Body.String())
+}
+
+// TestRuntime_Ready tests that invocations are rejected until the function is loaded
+func TestRuntime_Ready(t *testing.T) {
+	rt := New(&testFunction{})
+	h := rt.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, protocol.AlivePath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, protocol.ReadyPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, protocol.ErrorNotReady, errorType(t, w))
+	w = doInvoke(h, `{"args": {}}`, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	assert.NoError(t, rt.Load(context.Background()))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, protocol.ReadyPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ready protocol.ReadyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ready))
+	assert.Equal(t, protocol.Version, ready.ProtocolVersion)
+
+	failed := New(&testFunction{loadErr: errors.New("no model")})
+	assert.Error(t, failed.Load(context.Background()))
+	w = doInvoke(failed.Handler(), `{"args": {}}`, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "no model")
+}
+
+// TestRuntime_Stream tests streaming chunks as SSE and NDJSON, with errors after the first chunk sent as a final
+// error
+func TestRuntime_Stream(t *testing.T) {
+	h := newTestRuntime(t, &testFunction{}).Handler()
+
+	w := doInvoke(h, `{"args": {"chunks": ["a", "b"]}}`, map[string]string{"Accept": protocol.SSEMediaType})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, protocol.SSEMediaType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "data: {\"chunk\":\"a\"}\n\ndata: {\"chunk\":\"b\"}\n\nevent: done\ndata: {}\n\n", w.Body.String())
+
+	w = doInvoke(h, `{"args": {"chunks": ["a"], "fail": "error"}}`,
+		map[string]string{"Accept": protocol.NDJSONMediaType})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, protocol.NDJSONMediaType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"chunk\":\"a\"}\n"+
+		"{\"error\":{\"type\":\"function_error\",\"message\":\"failed\",\"retryable\":false}}\n", w.Body.String())
+
+	// Failing before the first chunk is an error response.
+	w = doInvoke(h, `{"args": {"fail": "error"}}`, map[string]string{"Accept": protocol.NDJSONMediaType})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// Clients not accepting streams are served by Invoke.
+	w = doInvoke(h, `{"args": {"chunks": ["a"]}}`, map[string]string{"Accept": "application/json"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
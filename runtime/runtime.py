@@ -1,10 +1,30 @@
 import datetime
 import importlib.util
 import argparse
-from flask import Flask, request, jsonify
+import inspect
+import json
+import logging
+import threading
+import time
+from flask import Flask, Response, request, jsonify, make_response, stream_with_context
 
 app = Flask(__name__)
 
+# The version of the runtime protocol implemented, see PROTOCOL.md.
+PROTOCOL_VERSION = 1
+# The header carrying the version of the protocol the dispatcher speaks.
+VERSION_HEADER = 'X-Runtime-Protocol-Version'
+# The header carrying the request ID assigned by the dispatcher, used to correlate logs.
+REQUEST_ID_HEADER = 'X-Request-ID'
+# The header carrying the time by which the invocation must be responded to, in RFC 3339.
+DEADLINE_HEADER = 'X-Invocation-Deadline'
+
+# Media types of streamed responses, selected by the Accept header of the request.
+# Server-Sent Events: each chunk is an event with data {"chunk": ...}, followed by a final "done" event.
+SSE_MIMETYPE = 'text/event-stream'
+# Newline-delimited JSON: each chunk is a line of {"chunk": ...}.
+NDJSON_MIMETYPE = 'application/x-ndjson'
+
 def load_class_from_file(file_path, class_name):
     spec = importlib.util.spec_from_file_location(class_name, file_path)
     module = importlib.util.module_from_spec(spec)
@@ -16,41 +36,214 @@ class ServerlessRuntime:
     def __init__(self, class_path, class_name):
         self.class_path = class_path
         self.class_name = class_name
+        start = time.monotonic()
         self.runtime_class = load_class_from_file(class_path, class_name)()
+        loaded = time.monotonic()
         # Ensure load function is called before serving requests.
         # This is required in the assignment spec.
         self.runtime_class.load()
+        # Reported through /ready, for the dispatcher to break cold starts down.
+        self.import_seconds = loaded - start
+        self.load_seconds = time.monotonic() - loaded
 
     def handle_request(self, args):
         return self.runtime_class.generate(args)
 
 runtime_instance = None
 
+# Started without --file and --class_name, the runtime is generic, i.e., kept warm by the dispatcher until specialized
+# into a function through /specialize.
+specialize_lock = threading.Lock()
+specializing = False
+# Why specializing failed, reported through /ready for the dispatcher to remove the container.
+specialize_error = None
+
+# The statuses of the error types of the protocol.
+ERROR_STATUSES = {
+    'invalid_request': 400,
+    'unsupported_version': 400,
+    'function_error': 500,
+    'not_ready': 503,
+    'deadline_exceeded': 504,
+}
+
+def error_response(error_type, message):
+    return jsonify({"error": {"type": error_type, "message": message, "retryable": False}}), ERROR_STATUSES[error_type]
+
+# Returns the error envelope of exception e raised by the function. Functions tell their errors apart for clients by
+# setting the code attribute of exceptions, e.g., 'quota_exceeded', and the retryable attribute to True if calling again
+# with the same args may succeed.
+def function_error(e):
+    error = {
+        "type": "function_error",
+        "message": f'{type(e).__name__}: {e}',
+        "retryable": bool(getattr(e, 'retryable', False)),
+    }
+    code = getattr(e, 'code', None)
+    if code is not None:
+        error["code"] = str(code)
+    return {"error": error}
+
+# Returns the deadline of the request, None if it has none, and raises ValueError if it's invalid.
+def parse_deadline():
+    value = request.headers.get(DEADLINE_HEADER)
+    if not value:
+        return None
+    # fromisoformat() of Python 3.9 accepts neither the Z suffix, nor fractional seconds of other than 3 or 6 digits.
+    value = value.replace('Z', '+00:00')
+    date, sep, rest = value.partition('.')
+    if sep:
+        digits = len(rest) - len(rest.lstrip('0123456789'))
+        value = date + sep + rest[:digits][:6].ljust(6, '0') + rest[digits:]
+    return datetime.datetime.fromisoformat(value)
+
 @app.route('/invoke', methods=['POST'])
 def invoke():
-    data = request.json
-    args = data.get('args', {})
-    response = runtime_instance.handle_request(args)
+    request_id = request.headers.get(REQUEST_ID_HEADER, '')
+    resp = make_response(serve_invocation(request_id))
+    if request_id:
+        resp.headers[REQUEST_ID_HEADER] = request_id
+    return resp
+
+def serve_invocation(request_id):
+    if runtime_instance is None:
+        return error_response('not_ready', 'Not specialized')
+    version = request.headers.get(VERSION_HEADER, str(PROTOCOL_VERSION))
+    if version != str(PROTOCOL_VERSION):
+        return error_response('unsupported_version',
+                              f'version {version} is not supported, only {PROTOCOL_VERSION} is')
+    try:
+        deadline = parse_deadline()
+    except ValueError:
+        return error_response('invalid_request', f'invalid deadline {request.headers.get(DEADLINE_HEADER)}')
+    # The function can't be interrupted, so only invocations whose deadlines already passed are rejected.
+    if deadline is not None and deadline <= datetime.datetime.now(datetime.timezone.utc):
+        return error_response('deadline_exceeded', 'deadline passed before invoking')
+    data = request.get_json(force=True, silent=True)
+    if not isinstance(data, dict):
+        return error_response('invalid_request', 'request body must be a JSON object')
+    args = data.get('args')
+    if args is None:
+        args = {}
+
+    app.logger.info('Invoking request_id=%s', request_id)
+    try:
+        response = runtime_instance.handle_request(args)
+    except Exception as e:
+        app.logger.exception('Invocation failed request_id=%s', request_id)
+        return jsonify(function_error(e)), ERROR_STATUSES['function_error']
+    if inspect.isgenerator(response):
+        return stream_response(response)
     return jsonify({"response": response})
 
-# To indicate this server is ready for serving requests.
+# An error raised by the function after streaming started.
+class StreamError:
+    def __init__(self, e):
+        self.envelope = function_error(e)
+
+# Yields the chunks, followed by a StreamError if the function raises.
+def chunks_or_error(chunks):
+    try:
+        yield from chunks
+    except Exception as e:
+        app.logger.exception('Streamed invocation failed')
+        yield StreamError(e)
+
+# Functions whose generate() is a generator stream their output if the client accepts a streamed media type, and
+# otherwise respond with all chunks joined, the same as non-streaming functions. Errors raised after streaming started
+# can't change the status anymore, so they are sent as a final error event or line.
+def stream_response(chunks):
+    mimetype = request.accept_mimetypes.best_match([SSE_MIMETYPE, NDJSON_MIMETYPE, 'application/json'])
+    if mimetype == SSE_MIMETYPE:
+        def events():
+            for chunk in chunks_or_error(chunks):
+                if isinstance(chunk, StreamError):
+                    yield f"event: error\ndata: {json.dumps(chunk.envelope)}\n\n"
+                    return
+                yield f"data: {json.dumps({'chunk': chunk})}\n\n"
+            yield "event: done\ndata: {}\n\n"
+        return Response(stream_with_context(events()), mimetype=SSE_MIMETYPE)
+    if mimetype == NDJSON_MIMETYPE:
+        def lines():
+            for chunk in chunks_or_error(chunks):
+                if isinstance(chunk, StreamError):
+                    yield json.dumps(chunk.envelope) + '\n'
+                    return
+                yield json.dumps({'chunk': chunk}) + '\n'
+        return Response(stream_with_context(lines()), mimetype=NDJSON_MIMETYPE)
+    try:
+        joined = "".join(str(chunk) for chunk in chunks)
+    except Exception as e:
+        app.logger.exception('Invocation failed')
+        return jsonify(function_error(e)), ERROR_STATUSES['function_error']
+    return jsonify({"response": joined})
+
+# To indicate this server is ready for serving requests, with how long importing the function's module and running its
+# load() took.
 @app.route('/ready', methods=['GET'])
 def ready():
+    if specialize_error is not None:
+        return error_response('function_error', specialize_error)
+    if runtime_instance is None:
+        return error_response('not_ready', 'Not specialized')
+    return jsonify({
+        "protocol_version": PROTOCOL_VERSION,
+        "import_seconds": runtime_instance.import_seconds,
+        "load_seconds": runtime_instance.load_seconds,
+    })
+
+# To indicate this server is up, even if it's generic.
+@app.route('/alive', methods=['GET'])
+def alive():
     return 'OK', 200
 
+# Specializes a generic runtime into the function given by {"file": ..., "class_name": ...}. Loading happens in the
+# background, /ready succeeds once it's done.
+@app.route('/specialize', methods=['POST'])
+def specialize():
+    global specializing
+    data = request.json
+    file_path, class_name = data.get('file'), data.get('class_name')
+    if not file_path or not class_name:
+        return 'file and class_name must be provided', 400
+    with specialize_lock:
+        if specializing or runtime_instance is not None or specialize_error is not None:
+            return 'Already specialized', 409
+        specializing = True
+    threading.Thread(target=load_runtime, args=(file_path, class_name), daemon=True).start()
+    return '', 202
+
+def load_runtime(file_path, class_name):
+    global runtime_instance, specializing, specialize_error
+    start = datetime.datetime.now()
+    try:
+        runtime_instance = ServerlessRuntime(file_path, class_name)
+    except Exception as e:
+        app.logger.exception('Failed to specialize into %s of %s', class_name, file_path)
+        with specialize_lock:
+            specializing = False
+            specialize_error = f'Failed loading {class_name} of {file_path}: {type(e).__name__}: {e}'
+        return
+    app.logger.info('Specialized into %s of %s in %s', class_name, file_path, datetime.datetime.now() - start)
+
 if __name__ == '__main__':
     parser = argparse.ArgumentParser(description='Serverless Runtime')
-    parser.add_argument('--file', required=True, help='Path to the Python file')
-    parser.add_argument('--class_name', required=True, help='Name of the class to load')
+    parser.add_argument('--file', help='Path to the Python file; generic until specialized if not provided')
+    parser.add_argument('--class_name', help='Name of the class to load')
     parser.add_argument('--port', default=5000, help='Path to the Python file')
 
     args = parser.parse_args()
 
+    logging.basicConfig(level=logging.INFO)
+
     runtime_file_path = args.file
     runtime_class_name = args.class_name
+    if bool(runtime_file_path) != bool(runtime_class_name):
+        parser.error('--file and --class_name must be provided together')
 
     # Initializing a runtime instance with the provided file path and class name
-    runtime_instance = ServerlessRuntime(runtime_file_path, runtime_class_name)
+    if runtime_file_path:
+        runtime_instance = ServerlessRuntime(runtime_file_path, runtime_class_name)
 
     # Use host='0.0.0.0' to bind to all local IP address.
     # This seems necessary when running inside docker container.
@@ -0,0 +1,14 @@
+import time
+
+class RuntimeGamma:
+    def load(self):
+        # This function needs to be called every time the container starts.
+        time.sleep(1)
+
+    def generate(self, args):
+        # This is just a mock function to simulate an LLM streaming its answer token by token.
+        prompt = args["prompt"]
+        answer = f"Given your question: {prompt}. I think the best answer is to go for a walk."
+        for token in answer.split(" "):
+            time.sleep(0.1)
+            yield token + " "